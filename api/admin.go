@@ -0,0 +1,125 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chromium/hstspreload"
+	"github.com/chromium/hstspreload.org/database"
+)
+
+// WithAdminToken returns a copy of `api` that accepts `token` as a bearer
+// token for the admin endpoints. Without a token, the admin endpoints are
+// disabled.
+func (api API) WithAdminToken(token string) API {
+	api.adminToken = token
+	return api
+}
+
+// isAdmin reports whether `r` carries the admin token, i.e. whether it was
+// made by a preload list maintainer.
+func (api API) isAdmin(r *http.Request) bool {
+	if api.adminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(api.adminToken)) == 1
+}
+
+// requireAdmin writes an error and returns false if `r` isn't an admin
+// request.
+func (api API) requireAdmin(w http.ResponseWriter, r *http.Request) (cont bool) {
+	if api.adminToken == "" {
+		httpError(w, "Admin endpoints are not enabled.", errorAdminDisabled, http.StatusForbidden)
+		return false
+	}
+	if !api.isAdmin(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		httpError(w, "Admin token required.", errorAdminTokenRequired, http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// SubmissionRecord is a DomainState together with the metadata recorded
+// when it was submitted.
+type SubmissionRecord struct {
+	Name           string                 `json:"name"`
+	Status         database.PreloadStatus `json:"status"`
+	SubmissionDate time.Time              `json:"submissionDate"`
+	Submission     database.Submission    `json:"submission"`
+}
+
+func submissionRecord(state database.DomainState) SubmissionRecord {
+	submission := state.Submission
+	// Always list issues as arrays, like the other endpoints do.
+	if submission.Issues.Errors == nil {
+		submission.Issues.Errors = []hstspreload.Issue{}
+	}
+	if submission.Issues.Warnings == nil {
+		submission.Issues.Warnings = []hstspreload.Issue{}
+	}
+	return SubmissionRecord{
+		Name:           state.Name,
+		Status:         state.Status,
+		SubmissionDate: state.SubmissionDate,
+		Submission:     submission,
+	}
+}
+
+// AdminSubmission takes a single domain and returns its status together
+// with the metadata recorded when it was last submitted. It requires the
+// admin token.
+//
+// Example: GET /admin/submission?domain=garron.net
+func (api API) AdminSubmission(w http.ResponseWriter, r *http.Request) {
+	if cont := api.requireAdmin(w, r); !cont {
+		return
+	}
+
+	domain, ok := getASCIIDomain(http.MethodGet, w, r)
+	if !ok {
+		return
+	}
+
+	state, err := api.database.StateForDomain(r.Context(), domain)
+	if err != nil {
+		msg := fmt.Sprintf("Internal error: could not retrieve status. (%s)\n", err)
+		httpError(w, msg, errorDatabase, http.StatusInternalServerError)
+		return
+	}
+	state.Name = domain
+	writeJSONOrBust(w, submissionRecord(state))
+}
+
+// AdminPending returns the domains with status "pending", together with
+// the metadata recorded when they were submitted. It requires the admin
+// token.
+//
+// Example: GET /admin/pending
+func (api API) AdminPending(w http.ResponseWriter, r *http.Request) {
+	if cont := api.requireAdmin(w, r); !cont {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		httpError(w, "Wrong method. Requires GET.", errorMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	states, err := api.database.StatesWithStatus(r.Context(), database.StatusPending)
+	if err != nil {
+		msg := fmt.Sprintf("Internal error: could not retrieve list for status \"%s\". (%s)\n", database.StatusPending, err)
+		httpError(w, msg, errorDatabase, http.StatusInternalServerError)
+		return
+	}
+
+	records := []SubmissionRecord{}
+	for _, state := range states {
+		records = append(records, submissionRecord(state))
+	}
+	writeJSONOrBust(w, records)
+}
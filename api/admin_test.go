@@ -0,0 +1,242 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chromium/hstspreload"
+	"github.com/chromium/hstspreload.org/database"
+)
+
+const testAdminToken = "admin-token"
+
+func TestAdminAuth(t *testing.T) {
+	api, _, _, _ := mockAPI(0 * time.Second)
+
+	tests := []struct {
+		description   string
+		adminToken    string
+		authorization string
+		wantCode      int
+	}{
+		{"disabled", "", "Bearer ", http.StatusForbidden},
+		{"missing token", testAdminToken, "", http.StatusUnauthorized},
+		{"wrong token", testAdminToken, "Bearer wrong", http.StatusUnauthorized},
+		{"wrong scheme", testAdminToken, "Basic " + testAdminToken, http.StatusUnauthorized},
+		{"valid token", testAdminToken, "Bearer " + testAdminToken, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		r, err := http.NewRequest("GET", "?domain=a.test", nil)
+		if err != nil {
+			t.Fatalf("[%s] NewRequest failed: %s", tt.description, err)
+		}
+		if tt.authorization != "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+
+		for name, handler := range map[string]http.HandlerFunc{
+			"AdminSubmission": api.WithAdminToken(tt.adminToken).AdminSubmission,
+			"AdminPending":    api.WithAdminToken(tt.adminToken).AdminPending,
+		} {
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("[%s] %s: wrong status code %d, want %d", tt.description, name, w.Code, tt.wantCode)
+			}
+		}
+	}
+}
+
+func TestSubmissionMetadata(t *testing.T) {
+	api, _, h, _ := mockAPI(0 * time.Second)
+	proxies, err := ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	api = api.WithAdminToken(testAdminToken).WithFingerprintKey([]byte("key")).WithTrustedProxies(proxies)
+
+	warning := hstspreload.Issue{Code: "domain.is_subdomain", Summary: "Subdomain", Message: "This is a subdomain."}
+	h.preloadableResponses = map[string]hstspreload.Issues{
+		"web.test":   {Warnings: []hstspreload.Issue{warning}},
+		"api.test":   emptyIssues,
+		"admin.test": emptyIssues,
+	}
+	h.preloadableHeaders = map[string]string{
+		"web.test": "max-age=63072000; includeSubDomains; preload",
+	}
+
+	submit := func(domain string, header http.Header) {
+		r, err := http.NewRequest("POST", "https://hstspreload.org/api/v2/submit?domain="+domain, nil)
+		if err != nil {
+			t.Fatalf("NewRequest failed: %s", err)
+		}
+		r.Header = header
+		r.RemoteAddr = "10.0.0.2:1234"
+		w := httptest.NewRecorder()
+		api.Submit(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Submit %s: wrong status code %d", domain, w.Code)
+		}
+	}
+	submit("web.test", http.Header{
+		"Origin":          {"https://hstspreload.org"},
+		"User-Agent":      {"browser"},
+		"X-Forwarded-For": {"203.0.113.7, 10.0.0.1"},
+	})
+	submit("api.test", http.Header{
+		"User-Agent":      {"browser"},
+		"X-Forwarded-For": {"203.0.113.99"},
+	})
+	submit("admin.test", http.Header{
+		"Authorization": {"Bearer " + testAdminToken},
+		"User-Agent":    {"curl"},
+	})
+
+	r, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %s", err)
+	}
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	api.AdminPending(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("AdminPending: wrong status code %d", w.Code)
+	}
+	var records []SubmissionRecord
+	if err := json.Unmarshal(w.Body.Bytes(), &records); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("AdminPending: wrong number of records: %#v", records)
+	}
+	byName := map[string]SubmissionRecord{}
+	for _, record := range records {
+		if record.Status != database.StatusPending || record.SubmissionDate.IsZero() {
+			t.Errorf("Wrong record: %#v", record)
+		}
+		byName[record.Name] = record
+	}
+
+	webSub, apiSub, adminSub := byName["web.test"].Submission, byName["api.test"].Submission, byName["admin.test"].Submission
+	if webSub.Channel != database.ChannelWeb || apiSub.Channel != database.ChannelAPI || adminSub.Channel != database.ChannelAdmin {
+		t.Errorf("Wrong channels: %q, %q, %q", webSub.Channel, apiSub.Channel, adminSub.Channel)
+	}
+	if len(webSub.Issues.Warnings) != 1 || webSub.Issues.Warnings[0] != warning {
+		t.Errorf("Wrong issues: %#v", webSub.Issues)
+	}
+	if webSub.Header != h.preloadableHeaders["web.test"] || apiSub.Header != "" {
+		t.Errorf("Wrong headers: %q, %q", webSub.Header, apiSub.Header)
+	}
+	// Clients in the same /24 with the same user agent can't be told
+	// apart. The admin request came from the proxy itself.
+	if webSub.ClientFingerprint == "" || webSub.ClientFingerprint != apiSub.ClientFingerprint {
+		t.Errorf("Fingerprints of the same client should match: %q, %q", webSub.ClientFingerprint, apiSub.ClientFingerprint)
+	}
+	if adminSub.ClientFingerprint == "" || adminSub.ClientFingerprint == webSub.ClientFingerprint {
+		t.Errorf("Fingerprints of different clients should not match: %q, %q", adminSub.ClientFingerprint, webSub.ClientFingerprint)
+	}
+
+	r, err = http.NewRequest("GET", "?domain=web.test", nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %s", err)
+	}
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w = httptest.NewRecorder()
+	api.AdminSubmission(w, r)
+	var record SubmissionRecord
+	if err := json.Unmarshal(w.Body.Bytes(), &record); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if record.Name != "web.test" || !record.Submission.Equal(webSub) {
+		t.Errorf("AdminSubmission: wrong record %#v", record)
+	}
+
+	// The metadata is not part of the public status.
+	r, err = http.NewRequest("GET", "?domain=web.test", nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %s", err)
+	}
+	w = httptest.NewRecorder()
+	api.Status(w, r)
+	var status map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, ok := status["submission"]; ok {
+		t.Errorf("Status should not include the submission: %s", w.Body.String())
+	}
+}
+
+func TestClientNetwork(t *testing.T) {
+	api, _, _, _ := mockAPI(0 * time.Second)
+	proxies, err := ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	api = api.WithTrustedProxies(proxies)
+
+	tests := []struct {
+		remoteAddr    string
+		forwardedFor  string
+		wantedNetwork string
+	}{
+		{"198.51.100.17:1234", "", "198.51.100.0/24"},
+		{"198.51.100.17:1234", "203.0.113.7, 10.0.0.1", "198.51.100.0/24"},
+		{"10.0.0.2:1234", "203.0.113.7, 10.0.0.1", "203.0.113.0/24"},
+		{"[2001:db8:1:2::3]:1234", "", "2001:db8:1::/48"},
+		{"[::ffff:198.51.100.17]:1234", "", "198.51.100.0/24"},
+		{"198.51.100.17", "", "198.51.100.0/24"},
+		{"", "garbage", ""},
+	}
+
+	for _, tt := range tests {
+		r := &http.Request{RemoteAddr: tt.remoteAddr, Header: http.Header{}}
+		if tt.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		if network := api.clientNetwork(r); network != tt.wantedNetwork {
+			t.Errorf("clientNetwork(%q, %q) = %q, want %q", tt.remoteAddr, tt.forwardedFor, network, tt.wantedNetwork)
+		}
+	}
+}
+
+func TestTrustedClientAddr(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Errorf("An invalid network was accepted")
+	}
+
+	tests := []struct {
+		description  string
+		remoteAddr   string
+		forwardedFor []string
+		wantAddr     string
+	}{
+		{"no proxy", "198.51.100.17:1234", nil, "198.51.100.17"},
+		{"untrusted proxy", "198.51.100.17:1234", []string{"203.0.113.7"}, "198.51.100.17"},
+		{"trusted proxy", "10.1.2.3:1234", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"spoofed address", "10.1.2.3:1234", []string{"1.2.3.4, 203.0.113.7"}, "203.0.113.7"},
+		{"chain of proxies", "10.1.2.3:1234", []string{"203.0.113.7, 192.0.2.1", "10.0.0.1"}, "203.0.113.7"},
+		{"only proxies", "10.1.2.3:1234", []string{"10.0.0.1"}, "10.0.0.1"},
+		{"invalid forwarded address", "10.1.2.3:1234", []string{"garbage"}, "10.1.2.3"},
+		{"mapped address", "[::ffff:10.1.2.3]:1234", []string{"203.0.113.7"}, "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		r := &http.Request{RemoteAddr: tt.remoteAddr, Header: http.Header{"X-Forwarded-For": tt.forwardedFor}}
+		addr, ok := trustedClientAddr(r, proxies)
+		if !ok || addr.String() != tt.wantAddr {
+			t.Errorf("[%s] Wrong client address: %s", tt.description, addr)
+		}
+	}
+
+	if _, ok := trustedClientAddr(&http.Request{Header: http.Header{}}, proxies); ok {
+		t.Errorf("A request without a remote address should have no client address")
+	}
+}
@@ -1,10 +1,12 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/netip"
 	"strings"
 	"time"
 
@@ -17,7 +19,30 @@ type API struct {
 	hstspreload hstspreloadWrapper
 	preloadlist preloadlistWrapper
 	cache       *cache
+	jobs        *jobStore
 	logger      *log.Logger
+	// adminToken is the bearer token for the admin endpoints. They are
+	// disabled if it is empty.
+	adminToken string
+	// trustedProxies are the networks of the proxies in front of the
+	// server, whose X-Forwarded-For addresses are used to find the client.
+	trustedProxies []netip.Prefix
+	// fingerprintKey is the HMAC key for client fingerprints.
+	fingerprintKey []byte
+	// ownership checks that removal requests come from the owner of the
+	// domain. Removals are not checked if it is nil.
+	ownership *ownershipChecker
+	// webhookClient posts webhook events.
+	webhookClient *http.Client
+	// autocompleteLimiter limits how often each client can call
+	// Autocomplete.
+	autocompleteLimiter *rateLimiter
+	// statusBatchLimiter limits how often each client can call
+	// StatusBatch.
+	statusBatchLimiter *rateLimiter
+	// scanLimiter limits the handlers wrapped with RateLimit. Nothing is
+	// limited if it is nil.
+	scanLimiter *scanLimiter
 }
 
 const (
@@ -28,11 +53,19 @@ const (
 // unexported fields.
 func New(db database.Database, logger *log.Logger) API {
 	return API{
-		database:    db,
-		hstspreload: actualHstspreload{},
-		preloadlist: actualPreloadlist{},
-		cache:       cacheWithDuration(defaultCacheDuration),
-		logger:      logger,
+		database:            db,
+		hstspreload:         newScanCache(actualHstspreload{}, scanCacheDuration),
+		preloadlist:         actualPreloadlist{},
+		cache:               cacheWithDuration(defaultCacheDuration),
+		jobs:                newJobStore(defaultJobRetention),
+		logger:              logger,
+		trustedProxies:      DefaultTrustedProxies(),
+		fingerprintKey:      newRandomKey(),
+		ownership:           newOwnershipChecker(newRandomKey()),
+		webhookClient:       newPublicClient(webhookTimeout),
+		autocompleteLimiter: newRateLimiter(autocompleteRate, autocompleteBurst),
+		statusBatchLimiter:  newRateLimiter(statusBatchRate, statusBatchBurst),
+		scanLimiter:         newScanLimiter(DefaultRateLimits()),
 	}
 }
 
@@ -43,7 +76,7 @@ func writeJSONOrBust(w http.ResponseWriter, v interface{}) {
 	b, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		msg := fmt.Sprintf("Internal error: could not format JSON. (%s)\n", err)
-		http.Error(w, msg, http.StatusInternalServerError)
+		httpError(w, msg, errorEncoding, http.StatusInternalServerError)
 		return
 	}
 
@@ -51,9 +84,9 @@ func writeJSONOrBust(w http.ResponseWriter, v interface{}) {
 }
 
 // CheckConnection tests if we can connect the database.
-func (api API) CheckConnection() error {
+func (api API) CheckConnection(ctx context.Context) error {
 	// Make sure we can connect to the datastore by forcing a fetch.
-	_, err := api.database.StateForDomain("garron.net")
+	_, err := api.database.StateForDomain(ctx, "garron.net")
 	if err != nil {
 		if strings.Contains(err.Error(), "missing project/dataset id") {
 			api.logger.Print("Try running: make serve")
@@ -2,6 +2,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -52,6 +53,10 @@ var issuesRemoveProtected = hstspreload.Issues{
 	},
 }
 
+// setupCtx is used to seed the mock database with domains in any status.
+// Like an admin tool, it bypasses the transition checks.
+var setupCtx = database.WithActor(context.Background(), database.ActorAdmin, "test setup")
+
 func mockAPI(cacheDuration time.Duration) (api API, mc *database.MockController, h *mockHstspreload, c *mockPreloadlist) {
 	db, mc := database.NewMock()
 	h = &mockHstspreload{}
@@ -61,6 +66,7 @@ func mockAPI(cacheDuration time.Duration) (api API, mc *database.MockController,
 		hstspreload: h,
 		preloadlist: c,
 		cache:       cacheWithDuration(cacheDuration),
+		jobs:        newJobStore(defaultJobRetention),
 		logger:      log.Default(),
 	}
 	return api, mc, h, c
@@ -69,12 +75,18 @@ func mockAPI(cacheDuration time.Duration) (api API, mc *database.MockController,
 func TestCheckConnection(t *testing.T) {
 	api, mc, _, _ := mockAPI(0 * time.Second)
 
-	if err := api.CheckConnection(); err != nil {
+	if err := api.CheckConnection(context.Background()); err != nil {
 		t.Errorf("%s", err)
 	}
 
-	mc.FailCalls = true
-	if err := api.CheckConnection(); err == nil {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := api.CheckConnection(ctx); err == nil {
+		t.Error("connection should fail with a cancelled context")
+	}
+
+	mc.SetFailCalls(true)
+	if err := api.CheckConnection(context.Background()); err == nil {
 		t.Error("connection should fail")
 	}
 }
@@ -153,7 +165,7 @@ func TestAPI(t *testing.T) {
 
 	// tests for correct behavior for domains that are StatusPendingAutomatedRemoval in the database
 	pendingAutomatedRemovalDomain := database.DomainState{Name: "pending-automated-removal.test", Status: database.StatusPendingAutomatedRemoval, IncludeSubDomains: true, Policy: preloadlist.Test}
-	api.database.PutState(pendingAutomatedRemovalDomain)
+	api.database.PutState(setupCtx, pendingAutomatedRemovalDomain)
 
 	apiTestSequence := []apiTestCase{
 		// wrong HTTP method
@@ -347,7 +359,7 @@ func TestAPI(t *testing.T) {
 		h.removableResponses = tt.mockData.removableResponses
 		c.list = tt.mockData.preloadlist
 
-		mc.FailCalls = (tt.failState & failDatabase) != 0
+		mc.SetFailCalls((tt.failState & failDatabase) != 0)
 		c.failCalls = (tt.failState & failChromiumpreload) != 0
 
 		w := httptest.NewRecorder()
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/chromium/hstspreload.org/database"
+)
+
+const (
+	// maxSuggestions is the most domains Autocomplete suggests.
+	maxSuggestions = 10
+
+	// Browsers request suggestions as the user types, so clients get a
+	// burst large enough to type a long domain name.
+	autocompleteRate  = 5
+	autocompleteBurst = 30
+)
+
+// suggestedStatuses are the statuses of the domains that Autocomplete
+// suggests: the ones the site can act on. Rejected and removed domains are
+// left out.
+var suggestedStatuses = map[database.PreloadStatus]bool{
+	database.StatusPending:                 true,
+	database.StatusPreloaded:               true,
+	database.StatusPendingRemoval:          true,
+	database.StatusPendingAutomatedRemoval: true,
+}
+
+// Autocomplete takes the beginning of a domain name and suggests known
+// domains that start with it and have one of the suggestedStatuses, as used by the OpenSearch description in
+// search.xml. The response is in the OpenSearch suggestions format: the
+// query, the suggested domains, and the status of each domain.
+//
+// Example: GET /autocomplete?domain=garron
+func (api API) Autocomplete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Wrong method. Requires GET.", errorMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cont := api.rateLimit(w, r, api.autocompleteLimiter); !cont {
+		return
+	}
+
+	query := r.URL.Query().Get("domain")
+	names := []string{}
+	statuses := []string{}
+
+	// Input that can't be part of a domain name has no suggestions, and an
+	// empty prefix would match every domain.
+	prefix, err := normalizeDomain(strings.TrimSpace(query))
+	if err == nil && prefix != "" {
+		states, err := api.domainsWithPrefixCached(r.Context(), prefix, maxSuggestions)
+		if err != nil {
+			msg := fmt.Sprintf("Internal error: could not retrieve suggestions. (%s)\n", err)
+			httpError(w, msg, errorDatabase, http.StatusInternalServerError)
+			return
+		}
+		for _, state := range states {
+			names = append(names, state.Name)
+			statuses = append(statuses, string(state.Status))
+		}
+	}
+
+	b, err := json.Marshal([]interface{}{query, names, statuses})
+	if err != nil {
+		msg := fmt.Sprintf("Internal error: could not format JSON. (%s)\n", err)
+		httpError(w, msg, errorEncoding, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-suggestions+json; charset=utf-8")
+	fmt.Fprintf(w, "%s\n", b)
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chromium/hstspreload.org/database"
+)
+
+func TestAutocomplete(t *testing.T) {
+	api, mc, _, _ := mockAPI(time.Minute)
+	states := []database.DomainState{
+		{Name: "example.com", Status: database.StatusPreloaded},
+		{Name: "example.net", Status: database.StatusPending},
+		{Name: "examples.org", Status: database.StatusRemoved},
+		{Name: "example.org", Status: database.StatusRejected},
+		{Name: "example.test", Status: database.StatusPendingRemoval},
+		{Name: "other.com", Status: database.StatusPreloaded},
+	}
+	for i := 0; i < maxSuggestions+2; i++ {
+		states = append(states, database.DomainState{Name: fmt.Sprintf("many%02d.test", i), Status: database.StatusPending})
+	}
+	if err := api.database.PutStates(setupCtx, states, func(format string, args ...interface{}) {}); err != nil {
+		t.Fatalf("cannot put states: %s", err)
+	}
+
+	autocomplete := func(query string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("GET", "?domain="+query, nil)
+		if err != nil {
+			t.Fatalf("NewRequest failed: %s", err)
+		}
+		w := httptest.NewRecorder()
+		api.Autocomplete(w, r)
+		return w
+	}
+
+	tests := []struct {
+		query        string
+		wantNames    []string
+		wantStatuses []string
+	}{
+		{"Example", []string{"example.com", "example.net", "example.test"}, []string{"preloaded", "pending", "pending-removal"}},
+		{"examples", []string{}, []string{}},
+		{"example.n", []string{"example.net"}, []string{"pending"}},
+		{"nomatch", []string{}, []string{}},
+		{"", []string{}, []string{}},
+	}
+	for _, tt := range tests {
+		w := autocomplete(tt.query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("[%q] Wrong status code: %d", tt.query, w.Code)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/x-suggestions+json; charset=utf-8" {
+			t.Errorf("[%q] Wrong content type: %q", tt.query, contentType)
+		}
+		var got []interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("[%q] %s", tt.query, err)
+		}
+		want := []interface{}{tt.query, toInterfaces(tt.wantNames), toInterfaces(tt.wantStatuses)}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("[%q] Wrong suggestions: %#v", tt.query, got)
+		}
+	}
+
+	var got []interface{}
+	if err := json.Unmarshal(autocomplete("many").Body.Bytes(), &got); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if names := got[1].([]interface{}); len(names) != maxSuggestions || names[0] != "many00.test" {
+		t.Errorf("Wrong suggestions for a prefix with many matches: %#v", names)
+	}
+
+	// Suggestions are cached.
+	calls := mc.CallCount("IterateDomainStates")
+	autocomplete("Example")
+	if n := mc.CallCount("IterateDomainStates"); n != calls {
+		t.Errorf("Cached suggestions were fetched again")
+	}
+
+	mc.SetFailCalls(true)
+	if w := autocomplete("new"); w.Code != http.StatusInternalServerError {
+		t.Errorf("Wrong status code for a database failure: %d", w.Code)
+	}
+	mc.SetFailCalls(false)
+
+	api.autocompleteLimiter = newRateLimiter(1, 2)
+	autocomplete("example")
+	autocomplete("example")
+	w := autocomplete("example")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Wrong status code when rate limited: %d", w.Code)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "1" {
+		t.Errorf("Wrong Retry-After: %q", retryAfter)
+	}
+}
+
+func toInterfaces(strs []string) []interface{} {
+	l := []interface{}{}
+	for _, s := range strs {
+		l = append(l, s)
+	}
+	return l
+}
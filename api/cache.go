@@ -1,10 +1,15 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"iter"
 	"sync"
 	"time"
 
+	"cloud.google.com/go/datastore"
 	"github.com/chromium/hstspreload.org/database"
+	"golang.org/x/sync/singleflight"
 )
 
 type domainList struct {
@@ -18,9 +23,14 @@ type stateEntry struct {
 }
 
 type cache struct {
+	// statusGroup makes concurrent misses of domainsByStatus read the
+	// states from the database once.
+	statusGroup singleflight.Group
+
 	lock            sync.Mutex
 	domainsByStatus map[database.PreloadStatus]domainList
 	stateForDomain  map[string]stateEntry
+	domainsByPrefix map[string]domainList
 	cacheDuration   time.Duration
 }
 
@@ -28,52 +38,245 @@ func cacheWithDuration(duration time.Duration) *cache {
 	return &cache{
 		domainsByStatus: make(map[database.PreloadStatus]domainList),
 		stateForDomain:  make(map[string]stateEntry),
+		domainsByPrefix: make(map[string]domainList),
 		cacheDuration:   duration,
 	}
 }
 
-func (api API) statesWithStatusCached(status database.PreloadStatus) ([]database.DomainState, error) {
+// cacheFillTimeout bounds a read of all the states with a status. The
+// read fills the cache for every caller, so it doesn't stop when the
+// caller that started it goes away.
+const cacheFillTimeout = 1 * time.Minute
+
+// statesWithStatusCached iterates over the states of domains with the
+// given status. If the cached states are fresh, they are used. Otherwise,
+// the states are read from the database and cached. Concurrent calls share
+// a single read: the caller that starts it gets the states as they are
+// read, and the others get them from the filled cache.
+func (api API) statesWithStatusCached(ctx context.Context, status database.PreloadStatus) iter.Seq2[database.DomainState, error] {
+	return func(yield func(database.DomainState, error) bool) {
+		api.cache.lock.Lock()
+		entry, ok := api.cache.domainsByStatus[status]
+		api.cache.lock.Unlock()
+
+		if !ok || time.Since(entry.cacheTime) >= api.cache.cacheDuration {
+			filled := false
+			streaming := true
+			v, err, _ := api.cache.statusGroup.Do(string(status), func() (interface{}, error) {
+				filled = true
+				c, cancel := context.WithTimeout(context.WithoutCancel(ctx), cacheFillTimeout)
+				defer cancel()
+
+				var domains []database.DomainState
+				for domain, err := range api.database.IterateStatesWithStatus(c, status) {
+					if err != nil {
+						return nil, err
+					}
+					domains = append(domains, domain)
+					if streaming {
+						streaming = yield(domain, nil)
+					}
+				}
+
+				api.cache.lock.Lock()
+				defer api.cache.lock.Unlock()
+				api.cache.domainsByStatus[status] = domainList{
+					domains:   domains,
+					cacheTime: time.Now(),
+				}
+				return domains, nil
+			})
+			if err != nil {
+				if streaming {
+					yield(database.DomainState{}, err)
+				}
+				return
+			}
+			if filled {
+				return
+			}
+			entry.domains = v.([]database.DomainState)
+		}
+
+		for _, domain := range entry.domains {
+			if !yield(domain, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (api API) stateForDomainCached(ctx context.Context, domain string) (state database.DomainState, err error) {
 	api.cache.lock.Lock()
 	defer api.cache.lock.Unlock()
 
-	if entry, ok := api.cache.domainsByStatus[status]; ok {
+	if entry, ok := api.cache.stateForDomain[domain]; ok {
 		if time.Since(entry.cacheTime) < api.cache.cacheDuration {
-			return entry.domains, nil
+			return entry.state, nil
 		}
 	}
 
-	domains, err := api.database.StatesWithStatus(status)
+	state, err = api.database.StateForDomain(ctx, domain)
 	if err != nil {
-		return domains, err
+		return state, err
 	}
 
-	api.cache.domainsByStatus[status] = domainList{
-		domains:   domains,
+	api.cache.putState(domain, stateEntry{
+		state:     state,
 		cacheTime: time.Now(),
-	}
+	})
 
-	return domains, nil
+	return state, nil
+}
+
+// maxCachedStates is the number of domains whose states are cached before
+// the cache starts over, so that lookups of arbitrary domains can't grow it
+// without bound.
+const maxCachedStates = 100000
+
+// putState caches the state of `domain`. The caller must hold the lock.
+func (c *cache) putState(domain string, entry stateEntry) {
+	if _, ok := c.stateForDomain[domain]; !ok && len(c.stateForDomain) >= maxCachedStates {
+		c.stateForDomain = make(map[string]stateEntry)
+	}
+	c.stateForDomain[domain] = entry
 }
 
-func (api API) stateForDomainCached(domain string) (state database.DomainState, err error) {
+// lookupBatchSize is the most domains statesForDomainsCached passes to a
+// single StatesForDomains call. It is no larger than the database batch
+// size, so that the indices of a datastore.MultiError line up with the
+// domains of the call.
+const lookupBatchSize = 400
+
+// statesForDomainsCached returns the states of the given domains, using
+// fresh cached states where possible and fetching the rest in batches.
+// Domains that are not in the database have StatusUnknown. Like
+// StateForDomain, the Name fields of the states are not set.
+func (api API) statesForDomainsCached(ctx context.Context, domains []string) (map[string]database.DomainState, error) {
+	states := make(map[string]database.DomainState, len(domains))
+	var misses []string
+
 	api.cache.lock.Lock()
-	defer api.cache.lock.Unlock()
+	for _, domain := range domains {
+		if _, ok := states[domain]; ok {
+			continue
+		}
+		if entry, ok := api.cache.stateForDomain[domain]; ok && time.Since(entry.cacheTime) < api.cache.cacheDuration {
+			states[domain] = entry.state
+			continue
+		}
+		// Mark the domain as seen, so that it is only fetched once.
+		states[domain] = database.DomainState{Status: database.StatusUnknown}
+		misses = append(misses, domain)
+	}
+	api.cache.lock.Unlock()
 
-	if entry, ok := api.cache.stateForDomain[domain]; ok {
-		if time.Since(entry.cacheTime) < api.cache.cacheDuration {
-			return entry.state, nil
+	for i := 0; i < len(misses); i += lookupBatchSize {
+		batch := misses[i:min(i+lookupBatchSize, len(misses))]
+		found, err := api.fetchStates(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, state := range found {
+			states[state.Name] = state
 		}
 	}
 
-	state, err = api.database.StateForDomain(domain)
-	if err != nil {
-		return state, err
+	api.cache.lock.Lock()
+	now := time.Now()
+	for _, domain := range misses {
+		state := states[domain]
+		state.Name = ""
+		states[domain] = state
+		api.cache.putState(domain, stateEntry{
+			state:     state,
+			cacheTime: now,
+		})
 	}
+	api.cache.lock.Unlock()
 
-	api.cache.stateForDomain[domain] = stateEntry{
-		state:     state,
+	return states, nil
+}
+
+// fetchStates returns the states of the domains in `batch` that are in
+// the database. StatesForDomains fails if any domain is missing, so the
+// missing ones are dropped and the rest are fetched again.
+func (api API) fetchStates(ctx context.Context, batch []string) ([]database.DomainState, error) {
+	for len(batch) > 0 {
+		states, err := api.database.StatesForDomains(ctx, batch)
+		var multiErr datastore.MultiError
+		if !errors.As(err, &multiErr) || len(multiErr) != len(batch) {
+			return states, err
+		}
+
+		var present []string
+		for j, domainErr := range multiErr {
+			switch domainErr {
+			case nil:
+				present = append(present, batch[j])
+			case datastore.ErrNoSuchEntity:
+			default:
+				return nil, domainErr
+			}
+		}
+		batch = present
+	}
+	return nil, nil
+}
+
+// maxCachedPrefixes is the number of prefixes domainsWithPrefixCached
+// caches before it starts over, so that arbitrary input can't grow the
+// cache without bound.
+const maxCachedPrefixes = 10000
+
+// domainsWithPrefixCached returns the states of up to `limit` domains
+// whose names start with `prefix` and whose status is in
+// suggestedStatuses, in name order.
+func (api API) domainsWithPrefixCached(ctx context.Context, prefix string, limit int) ([]database.DomainState, error) {
+	api.cache.lock.Lock()
+	entry, ok := api.cache.domainsByPrefix[prefix]
+	api.cache.lock.Unlock()
+
+	if ok && time.Since(entry.cacheTime) < api.cache.cacheDuration {
+		return entry.domains, nil
+	}
+
+	domains := []database.DomainState{}
+	for state, err := range api.database.IterateDomainStates(ctx, prefix, prefixEnd(prefix)) {
+		if err != nil {
+			return nil, err
+		}
+		if !suggestedStatuses[state.Status] {
+			continue
+		}
+		domains = append(domains, state)
+		if len(domains) == limit {
+			break
+		}
+	}
+
+	api.cache.lock.Lock()
+	if len(api.cache.domainsByPrefix) >= maxCachedPrefixes {
+		api.cache.domainsByPrefix = make(map[string]domainList)
+	}
+	api.cache.domainsByPrefix[prefix] = domainList{
+		domains:   domains,
 		cacheTime: time.Now(),
 	}
+	api.cache.lock.Unlock()
 
-	return state, nil
+	return domains, nil
+}
+
+// prefixEnd returns the smallest string that is greater than every string
+// starting with `prefix`, or "" if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
 }
@@ -1,12 +1,34 @@
 package api
 
 import (
+	"context"
+	"fmt"
+	"iter"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/chromium/hstspreload.org/database"
 )
 
+// withoutName returns `state` as StateForDomain returns it: like
+// Datastore, the database doesn't fill in the name.
+func withoutName(state database.DomainState) database.DomainState {
+	state.Name = ""
+	return state
+}
+
+func collectStates(seq iter.Seq2[database.DomainState, error]) (states []database.DomainState, err error) {
+	for state, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
 func TestCacheZeroDuration(t *testing.T) {
 	api, mc, _, _ := mockAPI(0 * time.Second)
 
@@ -15,32 +37,32 @@ func TestCacheZeroDuration(t *testing.T) {
 	domainC := database.DomainState{Name: "c.test", Status: database.StatusPendingRemoval}
 	newDomainA := database.DomainState{Name: "a.test", Status: database.StatusPending, IncludeSubDomains: false}
 
-	api.database.PutState(domainA)
+	api.database.PutState(context.Background(), domainA)
 
-	domains, err := api.statesWithStatusCached(database.StatusPending)
+	domains, err := collectStates(api.statesWithStatusCached(context.Background(), database.StatusPending))
 	if err != nil {
 		t.Fatalf("Error getting domains: %v", err)
 	}
 	if len(domains) != 1 {
 		t.Fatalf("First pending retrieval had wrong number of domains: %d", len(domains))
 	}
-	if domains[0] != domainA {
+	if !domains[0].Equal(domainA) {
 		t.Fatalf("First pending retrieval had wrong domain: %v", domains[0])
 	}
 
-	state, err := api.stateForDomainCached("a.test")
+	state, err := api.stateForDomainCached(context.Background(), "a.test")
 	if err != nil {
 		t.Fatalf("Error getting state for domain a.test: %v", err)
 	}
-	if state != domainA {
+	if !state.Equal(withoutName(domainA)) {
 		t.Fatalf("State of a.test is incorrect: %v", state)
 	}
 
-	api.database.PutState(domainB)
-	api.database.PutState(domainC)
-	api.database.PutState(newDomainA)
+	api.database.PutState(context.Background(), domainB)
+	api.database.PutState(setupCtx, domainC)
+	api.database.PutState(context.Background(), newDomainA)
 
-	domains, err = api.statesWithStatusCached(database.StatusPending)
+	domains, err = collectStates(api.statesWithStatusCached(context.Background(), database.StatusPending))
 	if err != nil {
 		t.Fatalf("Error getting domains: %v", err)
 	}
@@ -48,45 +70,45 @@ func TestCacheZeroDuration(t *testing.T) {
 		t.Fatalf("Second pending retrieval had wrong number of domains: %d", len(domains))
 	}
 
-	domains, err = api.statesWithStatusCached(database.StatusPendingRemoval)
+	domains, err = collectStates(api.statesWithStatusCached(context.Background(), database.StatusPendingRemoval))
 	if err != nil {
 		t.Fatalf("Error getting domains: %v", err)
 	}
 	if len(domains) != 1 {
 		t.Fatalf("First pending removal retrieval had wrong number of domains: %d", len(domains))
 	}
-	if domains[0] != domainC {
+	if !domains[0].Equal(domainC) {
 		t.Fatalf("First pending removal retrieval had wrong domain: %v", domains[0])
 	}
 
-	state, err = api.stateForDomainCached("a.test")
+	state, err = api.stateForDomainCached(context.Background(), "a.test")
 	if err != nil {
 		t.Fatalf("Error getting state for domain a.test: %v", err)
 	}
-	if state != newDomainA {
+	if !state.Equal(withoutName(newDomainA)) {
 		t.Fatalf("State of a.test is incorrect: %v", state)
 	}
-	state, err = api.stateForDomainCached("b.test")
+	state, err = api.stateForDomainCached(context.Background(), "b.test")
 	if err != nil {
 		t.Fatalf("Error getting state for domain b.test: %v", err)
 	}
-	if state != domainB {
+	if !state.Equal(withoutName(domainB)) {
 		t.Fatalf("State of b.test is incorrect: %v", state)
 	}
-	state, err = api.stateForDomainCached("c.test")
+	state, err = api.stateForDomainCached(context.Background(), "c.test")
 	if err != nil {
 		t.Fatalf("Error getting state for domain c.test: %v", err)
 	}
-	if state != domainC {
+	if !state.Equal(withoutName(domainC)) {
 		t.Fatalf("State of c.test is incorrect: %v", state)
 	}
 
-	mc.FailCalls = true
-	_, err = api.statesWithStatusCached(database.StatusPending)
+	mc.SetFailCalls(true)
+	_, err = collectStates(api.statesWithStatusCached(context.Background(), database.StatusPending))
 	if err == nil {
 		t.Fatalf("Expected uncached call StatesWithStatus to fail")
 	}
-	_, err = api.stateForDomainCached("")
+	_, err = api.stateForDomainCached(context.Background(), "")
 	if err == nil {
 		t.Fatalf("Expected uncached call StateForDomain to fail")
 	}
@@ -101,20 +123,20 @@ func TestCacheShortDuration(t *testing.T) {
 	domainC := database.DomainState{Name: "c.test", Status: database.StatusPendingRemoval}
 	newDomainA := database.DomainState{Name: "a.test", Status: database.StatusPending, IncludeSubDomains: true}
 
-	api.database.PutState(domainA)
+	api.database.PutState(context.Background(), domainA)
 
-	domains, err := api.statesWithStatusCached(database.StatusPending)
+	domains, err := collectStates(api.statesWithStatusCached(context.Background(), database.StatusPending))
 	if err != nil {
 		t.Fatalf("Error getting domains: %v", err)
 	}
 	if len(domains) != 1 {
 		t.Fatalf("First pending retrieval had wrong number of domains: %d", len(domains))
 	}
-	if domains[0] != domainA {
+	if !domains[0].Equal(domainA) {
 		t.Fatalf("First pending retrieval had wrong domain: %v", domains[0])
 	}
 
-	domains, err = api.statesWithStatusCached(database.StatusPendingRemoval)
+	domains, err = collectStates(api.statesWithStatusCached(context.Background(), database.StatusPendingRemoval))
 	if err != nil {
 		t.Fatalf("Error getting domains: %v", err)
 	}
@@ -122,19 +144,19 @@ func TestCacheShortDuration(t *testing.T) {
 		t.Fatalf("First pending removal retrieval had wrong number of domains: %d", len(domains))
 	}
 
-	state, err := api.stateForDomainCached("a.test")
+	state, err := api.stateForDomainCached(context.Background(), "a.test")
 	if err != nil {
 		t.Fatalf("Error getting state for domain a.test: %v", err)
 	}
-	if state != domainA {
+	if !state.Equal(withoutName(domainA)) {
 		t.Fatalf("State of a.test is incorrect: %v", state)
 	}
 
-	api.database.PutState(domainB)
-	api.database.PutState(domainC)
-	api.database.PutState(newDomainA)
+	api.database.PutState(context.Background(), domainB)
+	api.database.PutState(setupCtx, domainC)
+	api.database.PutState(context.Background(), newDomainA)
 
-	domains, err = api.statesWithStatusCached(database.StatusPending)
+	domains, err = collectStates(api.statesWithStatusCached(context.Background(), database.StatusPending))
 	if err != nil {
 		t.Fatalf("Error getting domains: %v", err)
 	}
@@ -142,7 +164,7 @@ func TestCacheShortDuration(t *testing.T) {
 		t.Fatalf("Cached pending retrieval had wrong number of domains: %d", len(domains))
 	}
 
-	domains, err = api.statesWithStatusCached(database.StatusPendingRemoval)
+	domains, err = collectStates(api.statesWithStatusCached(context.Background(), database.StatusPendingRemoval))
 	if err != nil {
 		t.Fatalf("Error getting domains: %v", err)
 	}
@@ -150,31 +172,31 @@ func TestCacheShortDuration(t *testing.T) {
 		t.Fatalf("Cached pending removal retrieval had wrong number of domains: %d", len(domains))
 	}
 
-	state, err = api.stateForDomainCached("a.test")
+	state, err = api.stateForDomainCached(context.Background(), "a.test")
 	if err != nil {
 		t.Fatalf("Error getting state for domain a.test: %v", err)
 	}
-	if state != domainA {
+	if !state.Equal(withoutName(domainA)) {
 		t.Fatalf("Cached state retrieval of a.test is incorrect: %v", state)
 	}
-	state, err = api.stateForDomainCached("b.test")
+	state, err = api.stateForDomainCached(context.Background(), "b.test")
 	if err != nil {
 		t.Fatalf("Error getting state for domain b.test: %v", err)
 	}
-	if state != domainB {
+	if !state.Equal(withoutName(domainB)) {
 		t.Fatalf("Cached state retrieval of b.test is incorrect: %v", state)
 	}
-	state, err = api.stateForDomainCached("c.test")
+	state, err = api.stateForDomainCached(context.Background(), "c.test")
 	if err != nil {
 		t.Fatalf("Error getting state for domain c.test: %v", err)
 	}
-	if state != domainC {
+	if !state.Equal(withoutName(domainC)) {
 		t.Fatalf("Cached state retrival of c.test is incorrect: %v", state)
 	}
 
-	mc.FailCalls = true
+	mc.SetFailCalls(true)
 
-	domains, err = api.statesWithStatusCached(database.StatusPending)
+	domains, err = collectStates(api.statesWithStatusCached(context.Background(), database.StatusPending))
 	if err != nil {
 		t.Fatalf("Error getting domains: %v", err)
 	}
@@ -182,7 +204,7 @@ func TestCacheShortDuration(t *testing.T) {
 		t.Fatalf("Failing database pending retrieval had wrong number of domains: %d", len(domains))
 	}
 
-	domains, err = api.statesWithStatusCached(database.StatusPendingRemoval)
+	domains, err = collectStates(api.statesWithStatusCached(context.Background(), database.StatusPendingRemoval))
 	if err != nil {
 		t.Fatalf("Error getting domains: %v", err)
 	}
@@ -190,32 +212,32 @@ func TestCacheShortDuration(t *testing.T) {
 		t.Fatalf("Failing database pending removal retrieval had wrong number of domains: %d", len(domains))
 	}
 
-	state, err = api.stateForDomainCached("a.test")
+	state, err = api.stateForDomainCached(context.Background(), "a.test")
 	if err != nil {
 		t.Fatalf("Error getting state for domain a.test: %v", err)
 	}
-	if state != domainA {
+	if !state.Equal(withoutName(domainA)) {
 		t.Fatalf("Failing state retrieval of a.test is incorrect: %v", state)
 	}
-	state, err = api.stateForDomainCached("b.test")
+	state, err = api.stateForDomainCached(context.Background(), "b.test")
 	if err != nil {
 		t.Fatalf("Error getting state for domain b.test: %v", err)
 	}
-	if state != domainB {
+	if !state.Equal(withoutName(domainB)) {
 		t.Fatalf("Failing state retrival of b.test is incorrect: %v", state)
 	}
-	state, err = api.stateForDomainCached("c.test")
+	state, err = api.stateForDomainCached(context.Background(), "c.test")
 	if err != nil {
 		t.Fatalf("Error getting state for domain c.test: %v", err)
 	}
-	if state != domainC {
+	if !state.Equal(withoutName(domainC)) {
 		t.Fatalf("Failing state retrival of c.test is incorrect: %v", state)
 	}
 
 	time.Sleep(duration)
-	mc.FailCalls = false
+	mc.SetFailCalls(false)
 
-	domains, err = api.statesWithStatusCached(database.StatusPending)
+	domains, err = collectStates(api.statesWithStatusCached(context.Background(), database.StatusPending))
 	if err != nil {
 		t.Fatalf("Error getting domains: %v", err)
 	}
@@ -223,36 +245,156 @@ func TestCacheShortDuration(t *testing.T) {
 		t.Fatalf("Last pending retrieval had wrong number of domains: %d", len(domains))
 	}
 
-	domains, err = api.statesWithStatusCached(database.StatusPendingRemoval)
+	domains, err = collectStates(api.statesWithStatusCached(context.Background(), database.StatusPendingRemoval))
 	if err != nil {
 		t.Fatalf("Error getting domains: %v", err)
 	}
 	if len(domains) != 1 {
 		t.Fatalf("Last removal retrieval had wrong number of domains: %d", len(domains))
 	}
-	if domains[0] != domainC {
+	if !domains[0].Equal(domainC) {
 		t.Fatalf("Last removal retrieval had wrong domain: %v", domains[0])
 	}
 
-	state, err = api.stateForDomainCached("a.test")
+	state, err = api.stateForDomainCached(context.Background(), "a.test")
 	if err != nil {
 		t.Fatalf("Error getting state for domain a.test: %v", err)
 	}
-	if state != newDomainA {
+	if !state.Equal(withoutName(newDomainA)) {
 		t.Fatalf("Last state retrieval of a.test is incorrect: %v", state)
 	}
-	state, err = api.stateForDomainCached("b.test")
+	state, err = api.stateForDomainCached(context.Background(), "b.test")
 	if err != nil {
 		t.Fatalf("Error getting state for domain b.test: %v", err)
 	}
-	if state != domainB {
+	if !state.Equal(withoutName(domainB)) {
 		t.Fatalf("Last state retrival of b.test is incorrect: %v", state)
 	}
-	state, err = api.stateForDomainCached("c.test")
+	state, err = api.stateForDomainCached(context.Background(), "c.test")
 	if err != nil {
 		t.Fatalf("Error getting state for domain c.test: %v", err)
 	}
-	if state != domainC {
+	if !state.Equal(withoutName(domainC)) {
 		t.Fatalf("Last state retrival of c.test is incorrect: %v", state)
 	}
 }
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"example", "examplf"},
+		{"a.b", "a.c"},
+		{"a\xff", "b"},
+		{"\xff\xff", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := prefixEnd(tt.prefix); got != tt.want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestCacheBoundsStates(t *testing.T) {
+	c := cacheWithDuration(time.Minute)
+	for i := 0; i < maxCachedStates; i++ {
+		c.putState(fmt.Sprintf("%d.test", i), stateEntry{})
+	}
+	c.putState("0.test", stateEntry{cacheTime: time.Now()})
+	if len(c.stateForDomain) != maxCachedStates {
+		t.Errorf("Updating a cached state should keep the others: %d states", len(c.stateForDomain))
+	}
+	c.putState("new.test", stateEntry{})
+	if _, ok := c.stateForDomain["new.test"]; !ok || len(c.stateForDomain) != 1 {
+		t.Errorf("A full cache should start over: %d states", len(c.stateForDomain))
+	}
+}
+
+// blockingStatusDatabase counts the reads of states by status, and makes
+// them wait for `block` to be closed.
+type blockingStatusDatabase struct {
+	database.Mock
+	block chan struct{}
+	reads *atomic.Int32
+}
+
+func (db blockingStatusDatabase) IterateStatesWithStatus(ctx context.Context, status database.PreloadStatus) iter.Seq2[database.DomainState, error] {
+	db.reads.Add(1)
+	<-db.block
+	return db.Mock.IterateStatesWithStatus(ctx, status)
+}
+
+func TestCacheCoalescesStatusReads(t *testing.T) {
+	api, _, _, _ := mockAPI(time.Minute)
+	if err := api.database.PutState(setupCtx, database.DomainState{Name: "a.test", Status: database.StatusPending}); err != nil {
+		t.Fatalf("cannot put state: %s", err)
+	}
+	db := blockingStatusDatabase{Mock: api.database.(database.Mock), block: make(chan struct{}), reads: &atomic.Int32{}}
+	api.database = db
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			states, err := collectStates(api.statesWithStatusCached(context.Background(), database.StatusPending))
+			if err != nil || len(states) != 1 {
+				t.Errorf("Wrong states: %v %v", states, err)
+			}
+		}()
+	}
+	for db.reads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Give the other goroutines time to wait for the running read.
+	time.Sleep(10 * time.Millisecond)
+	close(db.block)
+	wg.Wait()
+
+	if reads := db.reads.Load(); reads != 1 {
+		t.Errorf("Concurrent reads were not coalesced: %d reads", reads)
+	}
+}
+
+func TestCacheFillOutlivesCaller(t *testing.T) {
+	api, _, _, _ := mockAPI(time.Minute)
+	if err := api.database.PutState(setupCtx, database.DomainState{Name: "a.test", Status: database.StatusPending}); err != nil {
+		t.Fatalf("cannot put state: %s", err)
+	}
+	db := blockingStatusDatabase{Mock: api.database.(database.Mock), block: make(chan struct{}), reads: &atomic.Int32{}}
+	api.database = db
+
+	// The first caller starts the read, and goes away while it runs.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan struct{})
+	go func() {
+		defer close(first)
+		collectStates(api.statesWithStatusCached(ctx, database.StatusPending))
+	}()
+	for db.reads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	second := make(chan []database.DomainState)
+	go func() {
+		states, err := collectStates(api.statesWithStatusCached(context.Background(), database.StatusPending))
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		second <- states
+	}()
+	// Give the second caller time to wait for the running read.
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	close(db.block)
+	<-first
+
+	if states := <-second; len(states) != 1 || states[0].Name != "a.test" {
+		t.Errorf("Wrong states: %v", states)
+	}
+	if reads := db.reads.Load(); reads != 1 {
+		t.Errorf("Concurrent reads were not coalesced: %d reads", reads)
+	}
+}
@@ -11,10 +11,10 @@ import (
 // DebugAllStates allows preloading a domain without any checks.
 // This should only be exposed for test servers.
 func (api API) DebugAllStates(w http.ResponseWriter, r *http.Request) {
-	states, err := api.database.AllDomainStates()
+	states, err := api.database.AllDomainStates(r.Context())
 	if err != nil {
 		msg := fmt.Sprintf("Internal error: could not get domain states. (%s)\n", err)
-		http.Error(w, msg, http.StatusInternalServerError)
+		httpError(w, msg, errorDatabase, http.StatusInternalServerError)
 		return
 	}
 
@@ -31,7 +31,8 @@ func (api API) DebugSetPreloaded(w http.ResponseWriter, r *http.Request) {
 
 	issues := hstspreload.Issues{}
 
-	putErr := api.database.PutState(database.DomainState{
+	ctx := database.WithActor(r.Context(), database.ActorAdmin, "Set as preloaded through the debug API.")
+	putErr := api.database.PutState(ctx, database.DomainState{
 		Name:              domain,
 		Status:            database.StatusPreloaded,
 		IncludeSubDomains: true,
@@ -62,7 +63,8 @@ func (api API) DebugSetRejected(w http.ResponseWriter, r *http.Request) {
 
 	issues := hstspreload.Issues{}
 
-	putErr := api.database.PutState(database.DomainState{
+	ctx := database.WithActor(r.Context(), database.ActorAdmin, "Set as rejected through the debug API.")
+	putErr := api.database.PutState(ctx, database.DomainState{
 		Name:              domain,
 		Status:            database.StatusRejected,
 		IncludeSubDomains: false,
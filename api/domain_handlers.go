@@ -1,8 +1,12 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -32,26 +36,61 @@ func normalizeDomain(unicode string) (string, error) {
 
 func getASCIIDomain(wantMethod string, w http.ResponseWriter, r *http.Request) (ascii string, ok bool) {
 	if r.Method != wantMethod {
-		http.Error(w, fmt.Sprintf("Wrong method. Requires %s.", wantMethod), http.StatusMethodNotAllowed)
+		httpError(w, fmt.Sprintf("Wrong method. Requires %s.", wantMethod), errorMethodNotAllowed, http.StatusMethodNotAllowed)
 		return "", false
 	}
 
 	unicode := r.URL.Query().Get("domain")
 	if unicode == "" {
-		http.Error(w, "Domain not specified.", http.StatusBadRequest)
+		httpError(w, "Domain not specified.", errorDomainMissing, http.StatusBadRequest)
 		return "", false
 	}
 
 	normalized, err := normalizeDomain(unicode)
 	if err != nil {
 		msg := fmt.Sprintf("Internal error: could not convert domain to ASCII. (%s)\n", err)
-		http.Error(w, msg, http.StatusInternalServerError)
+		httpError(w, msg, errorDomainInvalid, http.StatusInternalServerError)
 		return "", false
 	}
 
 	return normalized, true
 }
 
+// getASCIIDomainList reads a JSON array of at most `max` domains from the
+// body of `r`, and normalizes them like getASCIIDomain.
+func getASCIIDomainList(w http.ResponseWriter, r *http.Request, max int) (ascii []string, ok bool) {
+	// Domain names are at most 253 characters long, so this leaves plenty
+	// of room for quoting and whitespace.
+	body := http.MaxBytesReader(w, r.Body, int64(max)*300)
+	var unicodeDomains []string
+	if err := json.NewDecoder(body).Decode(&unicodeDomains); err != nil {
+		msg := fmt.Sprintf("Invalid request body. Requires a JSON array of at most %d domains. (%s)\n", max, err)
+		httpError(w, msg, errorBodyInvalid, http.StatusBadRequest)
+		return nil, false
+	}
+	if len(unicodeDomains) > max {
+		msg := fmt.Sprintf("Too many domains. At most %d are allowed per request.\n", max)
+		httpError(w, msg, errorTooManyDomains, http.StatusBadRequest)
+		return nil, false
+	}
+
+	ascii = make([]string, len(unicodeDomains))
+	for i, unicode := range unicodeDomains {
+		if unicode == "" {
+			httpError(w, "Domain not specified.", errorDomainMissing, http.StatusBadRequest)
+			return nil, false
+		}
+		normalized, err := normalizeDomain(unicode)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid domain %q. (%s)\n", unicode, err)
+			httpError(w, msg, errorDomainInvalid, http.StatusBadRequest)
+			return nil, false
+		}
+		ascii[i] = normalized
+	}
+	return ascii, true
+}
+
 // Preloadable takes a single domain and returns if it is preloadable.
 //
 // Example: GET /preloadable?domain=garron.net
@@ -78,10 +117,10 @@ func (api API) Removable(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	bulkState, err := api.statusForDomain(domain)
+	bulkState, err := api.statusForDomain(r.Context(), domain)
 	if err != nil {
 		msg := fmt.Sprintf("Internal error: could not retrieve status. (%s)\n", err)
-		http.Error(w, msg, http.StatusInternalServerError)
+		httpError(w, msg, errorDatabase, http.StatusInternalServerError)
 		return
 	}
 
@@ -139,26 +178,104 @@ func (api API) Status(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	bulkState, err := api.statusForDomain(domain)
+	bulkState, err := api.statusForDomain(r.Context(), domain)
 	if err != nil {
 		msg := fmt.Sprintf("Internal error: could not retrieve status. (%s)\n", err)
-		http.Error(w, msg, http.StatusInternalServerError)
+		httpError(w, msg, errorDatabase, http.StatusInternalServerError)
 		return
 	}
 	writeJSONOrBust(w, bulkState)
 }
 
-func (api API) statusForDomain(domain string) (*DomainStateWithBulk, error) {
-	preloadedDomain := domain
-	state, err := api.stateForDomainCached(domain)
+const (
+	// maxStatusBatchSize is the most domains StatusBatch accepts in a
+	// single request.
+	maxStatusBatchSize = 1000
+	// maxStatusBatchLookups is the most distinct domains and ancestors
+	// StatusBatch looks up for a single request, since each domain can
+	// have over a hundred labels.
+	maxStatusBatchLookups = 5000
+
+	// Each StatusBatch request can look up thousands of domains, so
+	// clients get fewer of them than of the other lookups.
+	statusBatchRate  = 1
+	statusBatchBurst = 10
+)
+
+// StatusBatch takes a JSON array of domains and returns the preload status
+// of each, in the same order. It is equivalent to calling Status for each
+// domain, but looks up all domains and their ancestors together.
+//
+// Example: POST /status/batch with body ["garron.net", "example.com"]
+func (api API) StatusBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Wrong method. Requires POST.", errorMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cont := api.rateLimit(w, r, api.statusBatchLimiter); !cont {
+		return
+	}
+
+	domains, ok := getASCIIDomainList(w, r, maxStatusBatchSize)
+	if !ok {
+		return
+	}
+
+	var lookups []string
+	seen := make(map[string]bool)
+	for _, domain := range domains {
+		for lookup, ok := domain, true; ok && !seen[lookup]; lookup, ok = parentDomain(lookup) {
+			seen[lookup] = true
+			lookups = append(lookups, lookup)
+		}
+		if len(lookups) > maxStatusBatchLookups {
+			msg := fmt.Sprintf("Too many domains. The domains and their parent domains must have at most %d distinct names.\n", maxStatusBatchLookups)
+			httpError(w, msg, errorTooManyDomains, http.StatusBadRequest)
+			return
+		}
+	}
+
+	states, err := api.statesForDomainsCached(r.Context(), lookups)
+	if err != nil {
+		msg := fmt.Sprintf("Internal error: could not retrieve status. (%s)\n", err)
+		httpError(w, msg, errorDatabase, http.StatusInternalServerError)
+		return
+	}
+	lookup := func(domain string) (database.DomainState, bool) {
+		state, ok := states[domain]
+		return state, ok
+	}
+
+	bulkStates := make([]*DomainStateWithBulk, len(domains))
+	for i, domain := range domains {
+		bulkStates[i] = bulkStatus(domain, states[domain], lookup)
+	}
+	writeJSONOrBust(w, bulkStates)
+}
+
+func (api API) statusForDomain(ctx context.Context, domain string) (*DomainStateWithBulk, error) {
+	state, err := api.stateForDomainCached(ctx, domain)
 	if err != nil {
 		return nil, err
 	}
 
+	return bulkStatus(domain, state, func(ancestorDomain string) (database.DomainState, bool) {
+		ancestorState, err := api.stateForDomainCached(ctx, ancestorDomain)
+		return ancestorState, err == nil
+	}), nil
+}
+
+// bulkStatus returns the status of `domain`, given its stored `state`. If
+// the domain isn't known, it is preloaded if one of its ancestors is
+// preloaded with includeSubDomains. `lookup` returns the state of an
+// ancestor, and returns false if it can't be found.
+func bulkStatus(domain string, state database.DomainState, lookup func(string) (database.DomainState, bool)) *DomainStateWithBulk {
+	preloadedDomain := domain
 	if state.Status == database.StatusUnknown {
 		// walk up the domain name chain.
 		for ancestorDomain, ok := parentDomain(domain); ok; ancestorDomain, ok = parentDomain(ancestorDomain) {
-			if ancestorState, err := api.stateForDomainCached(ancestorDomain); err == nil {
+			if ancestorState, ok := lookup(ancestorDomain); ok {
 				// if an ancestor domain is preloaded and includes subdomains, set current domain status
 				// to preloaded as well.
 				if ancestorState.Status == database.StatusPreloaded && ancestorState.IncludeSubDomains {
@@ -178,7 +295,7 @@ func (api API) statusForDomain(domain string) (*DomainStateWithBulk, error) {
 	if state.Status == database.StatusPreloaded {
 		bulkState.PreloadedDomain = preloadedDomain
 	}
-	return bulkState, nil
+	return bulkState
 }
 
 // parentDomain finds the parent (immediate ancestor) domain of the input domain.
@@ -190,29 +307,156 @@ func parentDomain(domain string) (string, bool) {
 	return domain[dot+1:], true
 }
 
+// History takes a single domain and returns the changes to its preload
+// status, oldest first.
+//
+// Example: GET /history?domain=garron.net
+func (api API) History(w http.ResponseWriter, r *http.Request) {
+	if cont := api.allowCORS(w, r); !cont {
+		return
+	}
+
+	domain, ok := getASCIIDomain(http.MethodGet, w, r)
+	if !ok {
+		return
+	}
+
+	transitions, err := api.database.TransitionsForDomain(r.Context(), domain)
+	if err != nil {
+		msg := fmt.Sprintf("Internal error: could not retrieve history. (%s)\n", err)
+		httpError(w, msg, errorDatabase, http.StatusInternalServerError)
+		return
+	}
+	if transitions == nil {
+		transitions = []database.Transition{}
+	}
+	writeJSONOrBust(w, transitions)
+}
+
+// Submit and Remove only write a new state if the domain's state hasn't
+// changed since they read it. If it has (e.g. because of a concurrent
+// request or the update cron), they fail with one of these issues.
+var (
+	preloadStateChangedIssue = hstspreload.Issue{
+		Code:    "server.preload.state_changed",
+		Summary: "Domain status changed",
+		Message: "The status of the domain changed while your submission was being processed. Please check the current status and try again.",
+	}
+	removeStateChangedIssue = hstspreload.Issue{
+		Code:    "server.remove.state_changed",
+		Summary: "Domain status changed",
+		Message: "The status of the domain changed while your removal request was being processed. Please check the current status and try again.",
+	}
+)
+
+// submittablePolicies are the policies that domains can be submitted under.
+// The other policies are only used for entries that are added to the list
+// by hand.
+var submittablePolicies = map[preloadlist.PolicyType]bool{
+	preloadlist.Bulk1Year:   true,
+	preloadlist.Bulk18Weeks: true,
+}
+
+// includeSubDomainsRequiredIssue is returned for submissions that don't
+// include subdomains. Bulk entries always include subdomains; entries
+// without them have to be requested on the Chromium bug tracker.
+var includeSubDomainsRequiredIssue = hstspreload.Issue{
+	Code:    "server.preload.include_subdomains_required",
+	Summary: "Subdomains must be included",
+	Message: "Domains can only be submitted with includeSubDomains. Please file a bug at https://crbug.com/new if you need an entry without it.",
+}
+
+// getSubmissionOptions reads the optional `policy` and `include_subdomains`
+// URL parameters of a submission. The policy defaults to bulk-1-year, and
+// subdomains are included by default.
+func getSubmissionOptions(w http.ResponseWriter, r *http.Request) (policy preloadlist.PolicyType, includeSubDomains bool, ok bool) {
+	policy = preloadlist.PolicyType(r.URL.Query().Get("policy"))
+	if policy == preloadlist.UnspecifiedPolicyType {
+		policy = preloadlist.Bulk1Year
+	}
+	if !submittablePolicies[policy] {
+		msg := fmt.Sprintf("Invalid policy %q. Requires %q or %q.", policy, preloadlist.Bulk1Year, preloadlist.Bulk18Weeks)
+		httpError(w, msg, errorPolicyInvalid, http.StatusBadRequest)
+		return "", false, false
+	}
+
+	includeSubDomains = true
+	if param := r.URL.Query().Get("include_subdomains"); param != "" {
+		var err error
+		if includeSubDomains, err = strconv.ParseBool(param); err != nil {
+			msg := fmt.Sprintf("Invalid include_subdomains %q. Requires true or false.", param)
+			httpError(w, msg, errorParameterInvalid, http.StatusBadRequest)
+			return "", false, false
+		}
+	}
+
+	return policy, includeSubDomains, true
+}
+
+// addPutStateIssue returns `issues` with an error added if `putErr`, the
+// result of PutStateIfUnchanged, is not nil: `changed` if the state changed
+// since it was read, an internal error if the transition is not allowed,
+// or `failed` otherwise. `action` is "preload" or "remove".
+func addPutStateIssue(issues hstspreload.Issues, putErr error, action string, changed hstspreload.Issue, failed hstspreload.Issue) hstspreload.Issues {
+	var invalid *database.InvalidTransitionError
+	issue := failed
+	switch {
+	case putErr == nil:
+		return issues
+	case putErr == database.ErrStateChanged:
+		issue = changed
+	case errors.As(putErr, &invalid):
+		issue = hstspreload.Issue{
+			Code:    hstspreload.IssueCode("internal.server." + action + ".invalid_transition"),
+			Summary: "Internal error",
+			Message: fmt.Sprintf("Cannot %s; the domain cannot move from %s to %s.", action, invalid.From, invalid.To),
+		}
+	}
+	return hstspreload.Issues{
+		Errors:   append(issues.Errors, issue),
+		Warnings: issues.Warnings,
+	}
+}
+
 // Submit takes a single domain and attempts to submit it to the
 // pending queue for the HSTS preload list.
 //
 // Although the method is POST, we currently use a URL parameter so that
 // it's easy to use in the same way as the other domain endpoints.
 //
+// The domain is checked against the requirements of the `policy` parameter
+// (bulk-1-year or bulk-18-weeks; bulk-1-year by default), and the policy is
+// stored with the pending entry. Bulk entries always include subdomains, so
+// `include_subdomains=false` is reported as an error.
+//
 // Example: POST /submit?domain=garron.net
+// Example: POST /submit?domain=garron.net&policy=bulk-18-weeks
 func (api API) Submit(w http.ResponseWriter, r *http.Request) {
 	domain, ok := getASCIIDomain(http.MethodPost, w, r)
 	if !ok {
 		return
 	}
+	policy, includeSubDomains, ok := getSubmissionOptions(w, r)
+	if !ok {
+		return
+	}
 
-	_, issues := api.hstspreload.PreloadableDomain(domain)
+	header, issues := api.hstspreload.EligibleDomain(domain, policy)
+	if !includeSubDomains {
+		issues = hstspreload.Issues{
+			Errors:   append(issues.Errors, includeSubDomainsRequiredIssue),
+			Warnings: issues.Warnings,
+		}
+	}
 	if len(issues.Errors) > 0 {
 		writeJSONOrBust(w, issues)
 		return
 	}
 
-	state, stateErr := api.database.StateForDomain(domain)
+	state, stateErr := api.database.StateForDomain(r.Context(), domain)
 	if stateErr != nil {
 		msg := fmt.Sprintf("Internal error: could not get current domain status. (%s)\n", stateErr)
-		http.Error(w, msg, http.StatusInternalServerError)
+		httpError(w, msg, errorDatabase, http.StatusInternalServerError)
 		return
 	}
 
@@ -222,23 +466,20 @@ func (api API) Submit(w http.ResponseWriter, r *http.Request) {
 	case database.StatusRejected:
 		fallthrough
 	case database.StatusRemoved:
-		putErr := api.database.PutState(database.DomainState{
+		ctx := database.WithActor(r.Context(), database.ActorUser, "Submitted for preloading.")
+		putErr := api.database.PutStateIfUnchanged(ctx, state, database.DomainState{
 			Name:              domain,
 			Status:            database.StatusPending,
-			IncludeSubDomains: true,
+			IncludeSubDomains: includeSubDomains,
+			Policy:            policy,
 			SubmissionDate:    time.Now(),
+			Submission:        api.newSubmission(r, header, issues),
+		})
+		issues = addPutStateIssue(issues, putErr, "preload", preloadStateChangedIssue, hstspreload.Issue{
+			Code:    "internal.server.preload.save_failed",
+			Summary: "Internal error",
+			Message: "Unable to save to the pending list.",
 		})
-		if putErr != nil {
-			issue := hstspreload.Issue{
-				Code:    "internal.server.preload.save_failed",
-				Summary: "Internal error",
-				Message: "Unable to save to the pending list.",
-			}
-			issues = hstspreload.Issues{
-				Errors:   append(issues.Errors, issue),
-				Warnings: issues.Warnings,
-			}
-		}
 	case database.StatusPending:
 		formattedDate := state.SubmissionDate.Format("Monday, _2 January 2006")
 		issue := hstspreload.Issue{
@@ -263,23 +504,20 @@ func (api API) Submit(w http.ResponseWriter, r *http.Request) {
 	case database.StatusPendingAutomatedRemoval:
 		fallthrough
 	case database.StatusPendingRemoval:
-		putErr := api.database.PutState(database.DomainState{
+		ctx := database.WithActor(r.Context(), database.ActorUser, "Resubmitted while pending removal.")
+		putErr := api.database.PutStateIfUnchanged(ctx, state, database.DomainState{
 			Name:              domain,
 			Status:            database.StatusPreloaded,
-			IncludeSubDomains: true,
+			IncludeSubDomains: includeSubDomains,
+			Policy:            policy,
 			SubmissionDate:    state.SubmissionDate,
+			Submission:        state.Submission,
+		})
+		issues = addPutStateIssue(issues, putErr, "preload", preloadStateChangedIssue, hstspreload.Issue{
+			Code:    "internal.server.preload.save_failed",
+			Summary: "Internal error",
+			Message: "Unable to save to the preloaded list.",
 		})
-		if putErr != nil {
-			issue := hstspreload.Issue{
-				Code:    "internal.server.preload.save_failed",
-				Summary: "Internal error",
-				Message: "Unable to save to the preloaded list.",
-			}
-			issues = hstspreload.Issues{
-				Errors:   append(issues.Errors, issue),
-				Warnings: issues.Warnings,
-			}
-		}
 	default:
 		issue := hstspreload.Issue{
 			Code:    "internal.server.preload.unknown_status",
@@ -287,7 +525,7 @@ func (api API) Submit(w http.ResponseWriter, r *http.Request) {
 			Message: "Cannot preload; could not find domain status.",
 		}
 		issues = hstspreload.Issues{
-			Errors:   append(issues.Warnings, issue),
+			Errors:   append(issues.Errors, issue),
 			Warnings: issues.Warnings,
 		}
 	}
@@ -298,6 +536,10 @@ func (api API) Submit(w http.ResponseWriter, r *http.Request) {
 // Remove takes a single domain and attempts to submit it to the
 // removal queue for the HSTS preload list.
 //
+// The requester must first show that they control the domain, by
+// publishing the token from RemovalChallenge. If they haven't, the
+// response has an error with the token and instructions.
+//
 // Although the method is POST, we currently use a URL parameter so that
 // it's easy to use in the same way as the other domain endpoints.
 //
@@ -314,10 +556,10 @@ func (api API) Remove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	state, stateErr := api.database.StateForDomain(domain)
+	state, stateErr := api.database.StateForDomain(r.Context(), domain)
 	if stateErr != nil {
 		msg := fmt.Sprintf("Internal error: could not get current domain status. (%s)\n", stateErr)
-		http.Error(w, msg, http.StatusInternalServerError)
+		httpError(w, msg, errorDatabase, http.StatusInternalServerError)
 		return
 	}
 
@@ -370,23 +612,29 @@ func (api API) Remove(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
-		putErr := api.database.PutState(database.DomainState{
+		if api.ownership != nil {
+			if err := api.ownership.verify(r.Context(), domain, time.Now()); err != nil {
+				token, _ := api.ownership.token(domain, time.Now())
+				issues = hstspreload.Issues{
+					Errors:   append(issues.Errors, ownershipUnverifiedIssue(domain, token, err)),
+					Warnings: issues.Warnings,
+				}
+				break
+			}
+		}
+
+		ctx := database.WithActor(r.Context(), database.ActorUser, "Submitted for removal.")
+		putErr := api.database.PutStateIfUnchanged(ctx, state, database.DomainState{
 			Name:              domain,
 			Status:            database.StatusPendingRemoval,
 			IncludeSubDomains: false,
 			SubmissionDate:    time.Now(),
 		})
-		if putErr != nil {
-			issue := hstspreload.Issue{
-				Code:    "internal.server.remove.removal_failed",
-				Summary: "Internal error",
-				Message: "Unable to remove from the preload list.",
-			}
-			issues = hstspreload.Issues{
-				Errors:   append(issues.Errors, issue),
-				Warnings: issues.Warnings,
-			}
-		}
+		issues = addPutStateIssue(issues, putErr, "remove", removeStateChangedIssue, hstspreload.Issue{
+			Code:    "internal.server.remove.removal_failed",
+			Summary: "Internal error",
+			Message: "Unable to remove from the preload list.",
+		})
 	default:
 		issue := hstspreload.Issue{
 			Code:    "internal.server.remove.unknown_status",
@@ -394,7 +642,7 @@ func (api API) Remove(w http.ResponseWriter, r *http.Request) {
 			Message: "Cannot remove; could not find domain status.",
 		}
 		issues = hstspreload.Issues{
-			Errors:   append(issues.Warnings, issue),
+			Errors:   append(issues.Errors, issue),
 			Warnings: issues.Warnings,
 		}
 	}
@@ -415,7 +663,7 @@ type DomainStateWithIssues struct {
 func (api API) RemoveIneligibleDomains(w http.ResponseWriter, r *http.Request) {
 	// ensures endpoint requests can only come from App Engine
 	if r.Header.Get("X-Appengine-Cron") != "true" {
-		w.WriteHeader(http.StatusForbidden)
+		httpError(w, "Only App Engine cron requests are allowed.", errorCronOnly, http.StatusForbidden)
 		return
 	}
 
@@ -438,32 +686,31 @@ func (api API) RemoveIneligibleDomains(w http.ResponseWriter, r *http.Request) {
 	}
 	// Get domains
 	api.logger.Printf("using start %q, end %q", start, end)
-	domains, err := api.database.DomainStatesInRange(start, end)
-	if err != nil {
-		msg := fmt.Sprintf("Internal error: could not retrieve domains. (%s)\n", err)
-		http.Error(w, msg, http.StatusInternalServerError)
-		return
-	}
-	api.logger.Printf("Filtering %d domains...", len(domains))
-
-	// Filter Domains
-	for _, d := range domains {
+	// Filter Domains as they are fetched, so that only the ones we scan
+	// are kept in memory.
+	numDomains := 0
+	for d, err := range api.database.IterateDomainStates(r.Context(), start, end) {
+		if err != nil {
+			msg := fmt.Sprintf("Internal error: could not retrieve domains. (%s)\n", err)
+			httpError(w, msg, errorDatabase, http.StatusInternalServerError)
+			return
+		}
+		numDomains++
 		if d.Policy == preloadlist.Bulk18Weeks || d.Policy == preloadlist.Bulk1Year {
 			policyStates[d.Name] = d
 		}
 	}
+	api.logger.Printf("Filtered %d domains...", numDomains)
 	api.logger.Print("Getting ineligible domain states...")
 
-	// call GetIneligibleDomainStates and store them in a map by domain name
+	// Store the IneligibleDomainStates in a map by domain name
 	states := make(map[string]database.IneligibleDomainState)
-	state, err := api.database.GetAllIneligibleDomainStates()
-	if err != nil {
-		msg := fmt.Sprintf("Internal error: could not get domains. (%s)\n", err)
-		http.Error(w, msg, http.StatusInternalServerError)
-		return
-	}
-
-	for _, s := range state {
+	for s, err := range api.database.IterateIneligibleDomainStates(r.Context()) {
+		if err != nil {
+			msg := fmt.Sprintf("Internal error: could not get domains. (%s)\n", err)
+			httpError(w, msg, errorDatabase, http.StatusInternalServerError)
+			return
+		}
 		// ignore IneligibleDomainStates for domain names not in the [start, end)
 		// range we're processing.
 		if (start != "" && s.Name < start) || (end != "" && s.Name >= end) {
@@ -478,6 +725,7 @@ func (api API) RemoveIneligibleDomains(w http.ResponseWriter, r *http.Request) {
 	}
 
 	api.logger.Printf("Starting to scan %d domains\n", len(policyStates))
+	scanner := uncached(api.hstspreload)
 	statesAndIssues := make(chan DomainStateWithIssues)
 	domainStates := make(chan database.DomainState)
 	var wg sync.WaitGroup
@@ -488,7 +736,7 @@ func (api API) RemoveIneligibleDomains(w http.ResponseWriter, r *http.Request) {
 		// closed.
 		go func() {
 			for d := range domainStates {
-				_, issues := api.hstspreload.EligibleDomain(d.Name, d.Policy)
+				_, issues := scanner.EligibleDomain(d.Name, d.Policy)
 				statesAndIssues <- DomainStateWithIssues{d, issues}
 				wg.Done()
 			}
@@ -539,23 +787,23 @@ func (api API) RemoveIneligibleDomains(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Delete eligible domains from the database
-	err = api.database.DeleteIneligibleDomainStates(deleteEligibleDomains)
+	err := api.database.DeleteIneligibleDomainStates(r.Context(), deleteEligibleDomains)
 
 	if err != nil {
 		msg := fmt.Sprintf("Internal error: could not delete domains. (%s)\n", err)
-		http.Error(w, msg, http.StatusInternalServerError)
+		httpError(w, msg, errorDatabase, http.StatusInternalServerError)
 		return
 	}
 
 	api.logger.Printf("About to set %d domains as potentially ineligible\n", len(ineligibleDomains))
 
 	// Add ineligible domains to the database
-	err = api.database.SetIneligibleDomainStates(ineligibleDomains, func(format string, args ...interface{}) {
+	err = api.database.SetIneligibleDomainStates(r.Context(), ineligibleDomains, func(format string, args ...interface{}) {
 		api.logger.Printf(format, args...)
 	})
 	if err != nil {
 		msg := fmt.Sprintf("Internal error: could not set domains. (%s)\n", err)
-		http.Error(w, msg, http.StatusInternalServerError)
+		httpError(w, msg, errorDatabase, http.StatusInternalServerError)
 		return
 	}
 
@@ -575,18 +823,17 @@ func (api API) RemoveIneligibleDomains(w http.ResponseWriter, r *http.Request) {
 
 	// Get list of names of all domains that need their status changed
 	var pendingRemoval []string
-	allStates, err := api.database.GetAllIneligibleDomainStates()
-	if err != nil {
-		msg := fmt.Sprintf("Internal error: could not get all ineligible domains. (%s)\n", err)
-		http.Error(w, msg, http.StatusInternalServerError)
-		return
-	}
-	for _, id := range allStates {
+	for id, err := range api.database.IterateIneligibleDomainStates(r.Context()) {
+		if err != nil {
+			msg := fmt.Sprintf("Internal error: could not get all ineligible domains. (%s)\n", err)
+			httpError(w, msg, errorDatabase, http.StatusInternalServerError)
+			return
+		}
 		if shouldRemove(id) {
 			pendingRemoval = append(pendingRemoval, id.Name)
 		}
 	}
 
 	// Change status of the domain
-	database.SetPendingAutomatedRemoval(api.database, pendingRemoval, func(fomat string, args ...interface{}) {})
+	database.SetPendingAutomatedRemoval(r.Context(), api.database, pendingRemoval, func(fomat string, args ...interface{}) {})
 }
@@ -2,6 +2,9 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -85,7 +88,7 @@ func TestAddIneligibleDomain(t *testing.T) {
 	mockPreloadlist.list = TestPreloadlist
 
 	// tests that Scan field is appended to if domain is already present in the database
-	err := api.database.SetIneligibleDomainStates([]database.IneligibleDomainState{
+	err := api.database.SetIneligibleDomainStates(context.Background(), []database.IneligibleDomainState{
 		{
 			Name:   "preloaded-bulk-1-year-errors.test",
 			Scans:  []database.Scan{{Issues: issuesWithErrors}},
@@ -119,7 +122,7 @@ func TestAddIneligibleDomain(t *testing.T) {
 		t.Errorf("HTTP Response Invalid: Status code is not 200")
 	}
 
-	states, err := api.database.GetAllIneligibleDomainStates()
+	states, err := api.database.GetAllIneligibleDomainStates(context.Background())
 	if err != nil {
 		t.Fatalf("Couldn't get the states of all domains in the database.")
 	}
@@ -155,7 +158,7 @@ func TestDeleteIneligibleDomain(t *testing.T) {
 		},
 	}
 
-	err := api.database.SetIneligibleDomainStates(ineligibleDomains, func(format string, args ...interface{}) {})
+	err := api.database.SetIneligibleDomainStates(context.Background(), ineligibleDomains, func(format string, args ...interface{}) {})
 	if err != nil {
 		t.Errorf("Could not Set IneligibleDomains")
 	}
@@ -195,7 +198,7 @@ func TestDeleteIneligibleDomain(t *testing.T) {
 	api.Update(w, r)
 	api.RemoveIneligibleDomains(w, r)
 
-	states, err := api.database.GetAllIneligibleDomainStates()
+	states, err := api.database.GetAllIneligibleDomainStates(context.Background())
 	if err != nil {
 		t.Errorf("Could not get all IneligibleDomains")
 	}
@@ -246,7 +249,7 @@ func TestStatusChange(t *testing.T) {
 		},
 	}
 
-	err := api.database.SetIneligibleDomainStates(testIneligibleDomainList, func(format string, args ...interface{}) {})
+	err := api.database.SetIneligibleDomainStates(context.Background(), testIneligibleDomainList, func(format string, args ...interface{}) {})
 	if err != nil {
 		t.Fatalf("Couldn't set the states of ineligible domains in the database.")
 	}
@@ -263,7 +266,7 @@ func TestStatusChange(t *testing.T) {
 	api.Update(w, r)
 	api.RemoveIneligibleDomains(w, r)
 
-	state, err := api.database.AllDomainStates()
+	state, err := api.database.AllDomainStates(context.Background())
 	if err != nil {
 		t.Errorf("Couldn't get the state of preloaded-errors-ineligible from the database.")
 	}
@@ -312,7 +315,7 @@ func TestDeletionAndStatusChange(t *testing.T) {
 		},
 	}
 
-	err := api.database.SetIneligibleDomainStates(testIneligibleDomainList, func(format string, args ...interface{}) {})
+	err := api.database.SetIneligibleDomainStates(context.Background(), testIneligibleDomainList, func(format string, args ...interface{}) {})
 	if err != nil {
 		t.Fatalf("Couldn't set the states of ineligible domains in the database.")
 	}
@@ -329,7 +332,7 @@ func TestDeletionAndStatusChange(t *testing.T) {
 	api.Update(w, r)
 	api.RemoveIneligibleDomains(w, r)
 
-	states, err := api.database.GetAllIneligibleDomainStates()
+	states, err := api.database.GetAllIneligibleDomainStates(context.Background())
 	if err != nil {
 		t.Errorf("Couldn't get all ineligible states from the database.")
 	}
@@ -347,7 +350,7 @@ func TestDeletionAndStatusChange(t *testing.T) {
 
 	api.RemoveIneligibleDomains(w, r)
 
-	errState, err := api.database.StateForDomain("preloaded-errors-ineligible")
+	errState, err := api.database.StateForDomain(context.Background(), "preloaded-errors-ineligible")
 	if err != nil {
 		t.Errorf("Couldn't get the state of preloaded-errors-ineligible from the database.")
 	}
@@ -355,7 +358,7 @@ func TestDeletionAndStatusChange(t *testing.T) {
 		t.Errorf("Status has not been changed")
 	}
 
-	state, err := api.database.StateForDomain("preloaded-no-errors")
+	state, err := api.database.StateForDomain(context.Background(), "preloaded-no-errors")
 	if err != nil {
 		t.Errorf("Couldn't get the state of preloaded-no-errors from the database.")
 	}
@@ -469,7 +472,7 @@ func TestRemoveIneligibleDomainsSharding(t *testing.T) {
 		// Look at the IneligibleDomainStates created or updated by
 		// RemoveIneligibleDomains and check that the number of scans for
 		// each domain matches the expected count.
-		states, err := api.database.GetAllIneligibleDomainStates()
+		states, err := api.database.GetAllIneligibleDomainStates(context.Background())
 		if err != nil {
 			t.Fatalf("Couldn't get the states of all domains in the database.")
 		}
@@ -490,3 +493,364 @@ func TestRemoveIneligibleDomainsSharding(t *testing.T) {
 		}
 	}
 }
+
+func TestHistory(t *testing.T) {
+	api, _, mockHstspreload, mockPreloadlist := mockAPI(0 * time.Second)
+	mockHstspreload.preloadableResponses = map[string]hstspreload.Issues{"history.test": emptyIssues}
+	mockHstspreload.removableResponses = map[string]hstspreload.Issues{"history.test": emptyIssues}
+	mockPreloadlist.list = preloadlist.PreloadList{Entries: []preloadlist.Entry{
+		{Name: "history.test", Mode: preloadlist.ForceHTTPS, IncludeSubDomains: true, Policy: preloadlist.Bulk1Year},
+	}}
+
+	calls := []struct {
+		handler http.HandlerFunc
+		method  string
+	}{
+		{api.Submit, "POST"},
+		{api.Update, "GET"},
+		{api.Remove, "POST"},
+	}
+	for _, call := range calls {
+		r, err := http.NewRequest(call.method, "?domain=history.test", nil)
+		if err != nil {
+			t.Fatalf("NewRequest Failed: %s", err)
+		}
+		call.handler(httptest.NewRecorder(), toAppEngineHttpRequest(r))
+	}
+
+	r, err := http.NewRequest("GET", "?domain=history.test", nil)
+	if err != nil {
+		t.Fatalf("NewRequest Failed: %s", err)
+	}
+	w := httptest.NewRecorder()
+	api.History(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Wrong status code: %d", w.Code)
+	}
+
+	var transitions []database.Transition
+	if err := json.Unmarshal(w.Body.Bytes(), &transitions); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	wanted := []struct {
+		old, new database.PreloadStatus
+		actor    database.Actor
+	}{
+		{database.StatusUnknown, database.StatusPending, database.ActorUser},
+		{database.StatusPending, database.StatusPreloaded, database.ActorUpdate},
+		{database.StatusPreloaded, database.StatusPendingRemoval, database.ActorUser},
+	}
+	if len(transitions) != len(wanted) {
+		t.Fatalf("Wrong number of transitions: %#v", transitions)
+	}
+	for i, tr := range transitions {
+		if tr.Name != "history.test" || tr.OldStatus != wanted[i].old || tr.NewStatus != wanted[i].new || tr.Actor != wanted[i].actor {
+			t.Errorf("Transition %d does not match wanted: %#v", i, tr)
+		}
+	}
+}
+
+func TestSubmitPolicy(t *testing.T) {
+	api, _, h, _ := mockAPI(0 * time.Second)
+	h.preloadableResponses = map[string]hstspreload.Issues{
+		"default.test":   emptyIssues,
+		"subdomain.test": emptyIssues,
+	}
+	h.eligibleResponses = map[string]hstspreload.Issues{
+		"weeks.test":   emptyIssues,
+		"removal.test": emptyIssues,
+	}
+	if err := api.database.PutStates(setupCtx, []database.DomainState{
+		{Name: "removal.test", Status: database.StatusPendingRemoval, Policy: preloadlist.Bulk1Year, IncludeSubDomains: true},
+	}, func(format string, args ...interface{}) {}); err != nil {
+		t.Fatalf("cannot put states: %s", err)
+	}
+
+	submit := func(query string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("POST", "?"+query, nil)
+		if err != nil {
+			t.Fatalf("NewRequest failed: %s", err)
+		}
+		w := httptest.NewRecorder()
+		api.Submit(w, r)
+		return w
+	}
+
+	tests := []struct {
+		description string
+		query       string
+		wantCode    int
+		wantErrors  int
+		wantState   database.DomainState
+	}{
+		{"default policy", "domain=default.test", 200, 0,
+			database.DomainState{Name: "default.test", Status: database.StatusPending, Policy: preloadlist.Bulk1Year, IncludeSubDomains: true}},
+		{"bulk-18-weeks", "domain=weeks.test&policy=bulk-18-weeks&include_subdomains=true", 200, 0,
+			database.DomainState{Name: "weeks.test", Status: database.StatusPending, Policy: preloadlist.Bulk18Weeks, IncludeSubDomains: true}},
+		{"without subdomains", "domain=subdomain.test&include_subdomains=false", 200, 1,
+			database.DomainState{Name: "subdomain.test", Status: database.StatusUnknown}},
+		{"resubmitted while pending removal", "domain=removal.test&policy=bulk-18-weeks", 200, 0,
+			database.DomainState{Name: "removal.test", Status: database.StatusPreloaded, Policy: preloadlist.Bulk18Weeks, IncludeSubDomains: true}},
+		{"custom policy", "domain=custom.test&policy=custom", 400, 0,
+			database.DomainState{Name: "custom.test", Status: database.StatusUnknown}},
+		{"invalid include_subdomains", "domain=invalid.test&include_subdomains=maybe", 400, 0,
+			database.DomainState{Name: "invalid.test", Status: database.StatusUnknown}},
+	}
+	for _, tt := range tests {
+		w := submit(tt.query)
+		if w.Code != tt.wantCode {
+			t.Errorf("[%s] Wrong status code: %d", tt.description, w.Code)
+		}
+		if w.Code == http.StatusOK {
+			var issues hstspreload.Issues
+			if err := json.Unmarshal(w.Body.Bytes(), &issues); err != nil {
+				t.Fatalf("[%s] %s", tt.description, err)
+			}
+			if len(issues.Errors) != tt.wantErrors {
+				t.Errorf("[%s] Wrong errors: %#v", tt.description, issues.Errors)
+			}
+		}
+
+		state, err := api.database.StateForDomain(context.Background(), tt.wantState.Name)
+		if err != nil {
+			t.Fatalf("[%s] %s", tt.description, err)
+		}
+		if state.Status != tt.wantState.Status || state.Policy != tt.wantState.Policy || state.IncludeSubDomains != tt.wantState.IncludeSubDomains {
+			t.Errorf("[%s] Wrong state: %#v", tt.description, state)
+		}
+	}
+
+	r, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %s", err)
+	}
+	w := httptest.NewRecorder()
+	api.Pending(w, r)
+	want := `[
+    { "name": "default.test", "policy": "bulk-1-year", "mode": "force-https", "include_subdomains": true },
+    { "name": "weeks.test", "policy": "bulk-18-weeks", "mode": "force-https", "include_subdomains": true }
+]
+`
+	if w.Body.String() != want {
+		t.Errorf("Wrong pending list: %q", w.Body.String())
+	}
+}
+
+func TestStatusBatch(t *testing.T) {
+	api, mc, _, _ := mockAPI(time.Minute)
+	if err := api.database.PutStates(setupCtx, []database.DomainState{
+		{Name: "example.test", Status: database.StatusPreloaded, IncludeSubDomains: true, Policy: preloadlist.Bulk1Year},
+		{Name: "pending.test", Status: database.StatusPending},
+	}, func(format string, args ...interface{}) {}); err != nil {
+		t.Fatalf("cannot put states: %s", err)
+	}
+
+	statusBatch := func(body string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("POST", "", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("NewRequest failed: %s", err)
+		}
+		w := httptest.NewRecorder()
+		JSONErrors(http.HandlerFunc(api.StatusBatch)).ServeHTTP(w, r)
+		return w
+	}
+
+	body := `["a.sub.EXAMPLE.test", "pending.test", "unknown.test", "example.test", "a.sub.example.test"]`
+	w := statusBatch(body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Wrong status code: %d (%s)", w.Code, w.Body.String())
+	}
+	var got []DomainStateWithBulk
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("%s", err)
+	}
+	wanted := []struct {
+		name            string
+		status          database.PreloadStatus
+		bulk            bool
+		preloadedDomain string
+	}{
+		{"a.sub.example.test", database.StatusPreloaded, false, "example.test"},
+		{"pending.test", database.StatusPending, false, ""},
+		{"unknown.test", database.StatusUnknown, false, ""},
+		{"example.test", database.StatusPreloaded, true, "example.test"},
+		{"a.sub.example.test", database.StatusPreloaded, false, "example.test"},
+	}
+	if len(got) != len(wanted) {
+		t.Fatalf("Wrong number of states: %#v", got)
+	}
+	for i, want := range wanted {
+		if got[i].Name != want.name || got[i].Status != want.status || got[i].Bulk != want.bulk || got[i].PreloadedDomain != want.preloadedDomain {
+			t.Errorf("State %d does not match wanted: %#v %#v", i, got[i].DomainState, got[i])
+		}
+	}
+
+	// Each domain and ancestor is looked up once, in a single batch,
+	// followed by another for the ones that exist.
+	if n := mc.CallCount("StatesForDomains"); n != 2 {
+		t.Errorf("Wrong number of StatesForDomains calls: %d", n)
+	}
+	if n := mc.CallCount("StateForDomain"); n != 0 {
+		t.Errorf("StatusBatch should not look up domains one by one, but made %d calls", n)
+	}
+
+	// The states are cached.
+	if w := statusBatch(body); w.Code != http.StatusOK {
+		t.Errorf("Wrong status code: %d", w.Code)
+	}
+	if n := mc.CallCount("StatesForDomains"); n != 2 {
+		t.Errorf("Cached states were fetched again: %d StatesForDomains calls", n)
+	}
+
+	tooMany, err := json.Marshal(make([]string, maxStatusBatchSize+1))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	var deep []string
+	for i := 0; i < maxStatusBatchSize; i++ {
+		deep = append(deep, fmt.Sprintf("a.b.c.d.e.%d.test", i))
+	}
+	tooManyLookups, err := json.Marshal(deep)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, body := range []string{`"example.test"`, `["example.test", ""]`, string(tooMany), string(tooManyLookups)} {
+		if w := statusBatch(body); w.Code != http.StatusBadRequest {
+			t.Errorf("Wrong status code for %.40q: %d", body, w.Code)
+		}
+	}
+	if w := statusBatch(string(tooManyLookups)); errorCode(w) != errorTooManyDomains {
+		t.Errorf("Wrong error for too many ancestors: %q", w.Body.String())
+	}
+
+	api.statusBatchLimiter = RateLimit{Requests: 1, Period: time.Hour}.newLimiter()
+	if w := statusBatch(body); w.Code != http.StatusOK {
+		t.Errorf("Wrong status code for the first limited request: %d", w.Code)
+	}
+	if w := statusBatch(body); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Wrong response over the limit: %d %q", w.Code, w.Body.String())
+	}
+	api.statusBatchLimiter = nil
+
+	mc.SetFailCalls(true)
+	if w := statusBatch(`["new.test"]`); w.Code != http.StatusInternalServerError {
+		t.Errorf("Wrong status code for a database failure: %d", w.Code)
+	}
+
+	r, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %s", err)
+	}
+	w = httptest.NewRecorder()
+	api.StatusBatch(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Wrong status code for GET: %d", w.Code)
+	}
+}
+
+// staleReadDatabase returns an outdated state from StateForDomain, as if
+// the domain had changed right after it was read.
+type staleReadDatabase struct {
+	database.Mock
+	stale database.DomainState
+}
+
+func (db staleReadDatabase) StateForDomain(ctx context.Context, domain string) (database.DomainState, error) {
+	return db.stale, nil
+}
+
+func TestStateChangedWhileProcessing(t *testing.T) {
+	tests := []struct {
+		description string
+		stored      database.DomainState
+		stale       database.DomainState
+		handler     func(API) http.HandlerFunc
+		wantCode    hstspreload.IssueCode
+	}{
+		{
+			"submit",
+			database.DomainState{Name: "conflict.test", Status: database.StatusPending},
+			database.DomainState{Status: database.StatusUnknown},
+			func(api API) http.HandlerFunc { return api.Submit },
+			"server.preload.state_changed",
+		},
+		{
+			"resubmit",
+			database.DomainState{Name: "conflict.test", Status: database.StatusRemoved},
+			database.DomainState{Status: database.StatusPendingRemoval},
+			func(api API) http.HandlerFunc { return api.Submit },
+			"server.preload.state_changed",
+		},
+		{
+			"remove",
+			database.DomainState{Name: "conflict.test", Status: database.StatusPendingRemoval},
+			database.DomainState{Status: database.StatusPending},
+			func(api API) http.HandlerFunc { return api.Remove },
+			"server.remove.state_changed",
+		},
+	}
+
+	for _, tt := range tests {
+		api, _, mockHstspreload, _ := mockAPI(0 * time.Second)
+		mockHstspreload.preloadableResponses = map[string]hstspreload.Issues{"conflict.test": emptyIssues}
+		mockHstspreload.removableResponses = map[string]hstspreload.Issues{"conflict.test": emptyIssues}
+		db := api.database.(database.Mock)
+		if err := db.PutState(setupCtx, tt.stored); err != nil {
+			t.Fatalf("[%s] cannot put state: %s", tt.description, err)
+		}
+		api.database = staleReadDatabase{db, tt.stale}
+
+		r, err := http.NewRequest("POST", "?domain=conflict.test", nil)
+		if err != nil {
+			t.Fatalf("[%s] NewRequest Failed: %s", tt.description, err)
+		}
+		w := httptest.NewRecorder()
+		tt.handler(api)(w, r)
+
+		var issues hstspreload.Issues
+		if err := json.Unmarshal(w.Body.Bytes(), &issues); err != nil {
+			t.Fatalf("[%s] %s", tt.description, err)
+		}
+		if len(issues.Errors) != 1 || issues.Errors[0].Code != tt.wantCode {
+			t.Errorf("[%s] Wanted a %s error, got: %#v", tt.description, tt.wantCode, issues)
+		}
+
+		state, err := db.StateForDomain(context.Background(), "conflict.test")
+		if err != nil {
+			t.Fatalf("[%s] %s", tt.description, err)
+		}
+		if state.Status != tt.stored.Status {
+			t.Errorf("[%s] The stored state was overwritten: %#v", tt.description, state)
+		}
+	}
+}
+
+func TestUnknownStatus(t *testing.T) {
+	api, _, h, _ := mockAPI(0 * time.Second)
+	warning := hstspreload.Issue{Code: "test.warning", Summary: "Warning", Message: "A warning."}
+	h.eligibleResponses = map[string]hstspreload.Issues{"odd.test": {Warnings: []hstspreload.Issue{warning}}}
+	h.removableResponses = map[string]hstspreload.Issues{"odd.test": {Warnings: []hstspreload.Issue{warning}}}
+	if err := api.database.PutStates(setupCtx, []database.DomainState{
+		{Name: "odd.test", Status: "odd"},
+	}, func(format string, args ...interface{}) {}); err != nil {
+		t.Fatalf("cannot put states: %s", err)
+	}
+
+	for _, handler := range []http.HandlerFunc{api.Submit, api.Remove} {
+		r, err := http.NewRequest("POST", "?domain=odd.test", nil)
+		if err != nil {
+			t.Fatalf("NewRequest failed: %s", err)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		var issues hstspreload.Issues
+		if err := json.Unmarshal(w.Body.Bytes(), &issues); err != nil {
+			t.Fatalf("%s (%q)", err, w.Body.String())
+		}
+		// The warning is not repeated as an error.
+		if len(issues.Errors) != 1 || len(issues.Warnings) != 1 || issues.Errors[0].Summary != "Internal error" {
+			t.Errorf("Wrong issues for an unknown status: %#v", issues)
+		}
+	}
+}
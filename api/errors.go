@@ -0,0 +1,174 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const (
+	// requestIDHeader carries the ID that JSONErrors assigns to a request.
+	requestIDHeader = "X-Request-Id"
+	// traceHeader is set by the App Engine frontend. Its trace ID is used as
+	// the request ID, so that it matches the logs.
+	traceHeader = "X-Cloud-Trace-Context"
+)
+
+// Machine-readable codes for error responses. Errors without a specific
+// code get one based on their HTTP status, from statusErrorCodes.
+const (
+	errorDomainMissing       = "domain_missing"
+	errorDomainInvalid       = "domain_invalid"
+	errorPolicyInvalid       = "policy_invalid"
+	errorOwnershipUnverified = "ownership_unverified"
+	errorOwnershipDisabled   = "ownership_verification_disabled"
+	errorParameterInvalid    = "parameter_invalid"
+	errorIDMissing           = "id_missing"
+	errorBodyInvalid         = "body_invalid"
+	errorTooManyDomains      = "too_many_domains"
+	errorDatabase            = "database_error"
+	errorPreloadList         = "preload_list_error"
+	errorEncoding            = "encoding_error"
+	errorMethodNotAllowed    = "method_not_allowed"
+	errorRateLimited         = "rate_limited"
+	errorAdminDisabled       = "admin_disabled"
+	errorAdminTokenRequired  = "admin_token_required"
+	errorCronOnly            = "cron_only"
+	errorJobNotFound         = "job_not_found"
+	errorTooManyJobs         = "too_many_jobs"
+	errorSubscriptionUnknown = "subscription_not_found"
+	errorSecretRequired      = "secret_required"
+)
+
+var statusErrorCodes = map[int]string{
+	http.StatusBadRequest:          "bad_request",
+	http.StatusUnauthorized:        "unauthorized",
+	http.StatusForbidden:           "forbidden",
+	http.StatusNotFound:            "not_found",
+	http.StatusMethodNotAllowed:    "method_not_allowed",
+	http.StatusTooManyRequests:     "rate_limited",
+	http.StatusInternalServerError: "internal_error",
+	http.StatusServiceUnavailable:  "unavailable",
+}
+
+// httpError is like http.Error, but also records a machine-readable
+// `code` for the error if the response goes through JSONErrors. Other
+// responses are plain text, like before the codes existed.
+func httpError(w http.ResponseWriter, msg string, code string, status int) {
+	if ew, ok := w.(*errorResponseWriter); ok {
+		ew.code = code
+	}
+	http.Error(w, msg, status)
+}
+
+// ErrorResponse is the body of every error response from a handler wrapped
+// with JSONErrors.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes an error.
+type ErrorDetail struct {
+	// Code is a machine-readable code, e.g. "domain_missing".
+	Code string `json:"code"`
+	// Message is a human-readable explanation.
+	Message string `json:"message"`
+	// RequestID identifies the request in the server logs.
+	RequestID string `json:"requestId"`
+}
+
+// JSONErrors wraps `handler` so that every response has an X-Request-Id
+// header, and every response with a non-2xx status has an ErrorResponse as
+// its body instead of plain text. Successful responses are unchanged.
+func JSONErrors(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := newRequestID(r)
+		w.Header().Set(requestIDHeader, requestID)
+
+		ew := &errorResponseWriter{ResponseWriter: w}
+		handler.ServeHTTP(ew, r)
+		if ew.status != 0 {
+			ew.writeError(requestID)
+		}
+	})
+}
+
+// newRequestID returns the App Engine trace ID of `r` if there is one, and
+// a random ID otherwise.
+func newRequestID(r *http.Request) string {
+	if trace, _, _ := strings.Cut(r.Header.Get(traceHeader), "/"); trace != "" {
+		return trace
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// errorResponseWriter passes successful responses through, and buffers
+// error responses so that they can be rewritten.
+type errorResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	// status is set if the response is an error.
+	status int
+	// code is the code recorded by httpError, if any.
+	code string
+	body bytes.Buffer
+}
+
+func (ew *errorResponseWriter) WriteHeader(status int) {
+	if ew.wroteHeader {
+		return
+	}
+	ew.wroteHeader = true
+	if status >= 200 && status < 300 {
+		ew.ResponseWriter.WriteHeader(status)
+		return
+	}
+	ew.status = status
+}
+
+func (ew *errorResponseWriter) Write(b []byte) (int, error) {
+	if !ew.wroteHeader {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.status != 0 {
+		return ew.body.Write(b)
+	}
+	return ew.ResponseWriter.Write(b)
+}
+
+func (ew *errorResponseWriter) Flush() {
+	if f, ok := ew.ResponseWriter.(http.Flusher); ok && ew.status == 0 {
+		f.Flush()
+	}
+}
+
+func (ew *errorResponseWriter) writeError(requestID string) {
+	header := ew.ResponseWriter.Header()
+	code := ew.code
+	if code == "" {
+		code = statusErrorCodes[ew.status]
+	}
+	if code == "" {
+		code = "error"
+	}
+	message := strings.TrimSpace(ew.body.String())
+	if message == "" {
+		message = http.StatusText(ew.status)
+	}
+
+	// Marshalling can't fail, since every field is a string.
+	b, _ := json.Marshal(ErrorResponse{ErrorDetail{
+		Code:      code,
+		Message:   message,
+		RequestID: requestID,
+	}})
+
+	header.Set("Content-Type", "application/json; charset=utf-8")
+	ew.ResponseWriter.WriteHeader(ew.status)
+	ew.ResponseWriter.Write(append(b, '\n'))
+}
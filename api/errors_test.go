@@ -0,0 +1,98 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestJSONErrors(t *testing.T) {
+	api, mc, _, _ := mockAPI(0 * time.Second)
+
+	tests := []struct {
+		description string
+		handler     http.HandlerFunc
+		method      string
+		url         string
+		failCalls   bool
+		wantStatus  int
+		wantCode    string
+		wantMessage string
+	}{
+		{"missing domain", api.Status, "GET", "", false, http.StatusBadRequest, "domain_missing", "Domain not specified."},
+		{"wrong method", api.Status, "POST", "?domain=a.test", false, http.StatusMethodNotAllowed, "method_not_allowed", "Wrong method. Requires GET."},
+		{"database failure", api.Status, "GET", "?domain=a.test", true, http.StatusInternalServerError, "database_error", "Internal error: could not retrieve status. (forced failure)"},
+		{"list failure", api.Pending, "GET", "", true, http.StatusInternalServerError, "database_error", "Internal error: could not retrieve list for status \"pending\". (forced failure)"},
+		{"empty body", api.RemoveIneligibleDomains, "GET", "", false, http.StatusForbidden, "cron_only", "Only App Engine cron requests are allowed."},
+	}
+
+	for _, tt := range tests {
+		mc.SetFailCalls(tt.failCalls)
+		r, err := http.NewRequest(tt.method, tt.url, nil)
+		if err != nil {
+			t.Fatalf("[%s] NewRequest failed: %s", tt.description, err)
+		}
+		w := httptest.NewRecorder()
+		JSONErrors(tt.handler).ServeHTTP(w, r)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("[%s] Wrong status code: %d", tt.description, w.Code)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/json; charset=utf-8" {
+			t.Errorf("[%s] Wrong content type: %q", tt.description, contentType)
+		}
+		if code := w.Header().Get("X-Error-Code"); code != "" {
+			t.Errorf("[%s] The error code should not be sent as a header: %q", tt.description, code)
+		}
+		var resp ErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("[%s] %s (%q)", tt.description, err, w.Body.String())
+		}
+		if resp.Error.Code != tt.wantCode || resp.Error.Message != tt.wantMessage {
+			t.Errorf("[%s] Wrong error: %#v", tt.description, resp.Error)
+		}
+		if resp.Error.RequestID == "" || resp.Error.RequestID != w.Header().Get(requestIDHeader) {
+			t.Errorf("[%s] Wrong request ID: %q (header %q)", tt.description, resp.Error.RequestID, w.Header().Get(requestIDHeader))
+		}
+	}
+	mc.SetFailCalls(false)
+
+	// Successful responses are unchanged.
+	r, err := http.NewRequest("GET", "?domain=a.test", nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %s", err)
+	}
+	r.Header.Set(traceHeader, "0123456789abcdef/1;o=1")
+	plain := httptest.NewRecorder()
+	api.Status(plain, r)
+	wrapped := httptest.NewRecorder()
+	JSONErrors(http.HandlerFunc(api.Status)).ServeHTTP(wrapped, r)
+	if wrapped.Code != plain.Code || wrapped.Body.String() != plain.Body.String() ||
+		wrapped.Header().Get("Content-Type") != plain.Header().Get("Content-Type") {
+		t.Errorf("Successful response was changed: %d %q", wrapped.Code, wrapped.Body.String())
+	}
+	if requestID := wrapped.Header().Get(requestIDHeader); requestID != "0123456789abcdef" {
+		t.Errorf("The trace ID should be used as the request ID: %q", requestID)
+	}
+
+	// v2 errors are plain text, without the code.
+	r, err = http.NewRequest("GET", "", nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %s", err)
+	}
+	w := httptest.NewRecorder()
+	api.Status(w, r)
+	if w.Code != http.StatusBadRequest || w.Body.String() != "Domain not specified.\n" || len(w.Header().Values("X-Error-Code")) != 0 {
+		t.Errorf("Wrong plain text error: %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+}
+
+// errorCode returns the code of the JSON error response in `w`, or "" if
+// it is not an error response.
+func errorCode(w *httptest.ResponseRecorder) string {
+	var resp ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.Error.Code
+}
@@ -0,0 +1,284 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/chromium/hstspreload"
+	"github.com/chromium/hstspreload.org/database"
+)
+
+const (
+	// maxJobDomains is the most domains a single preloadable job can check.
+	maxJobDomains = 1000
+	// jobWorkers is the number of domains a job checks at the same time.
+	jobWorkers = 20
+	// maxRunningJobs is the most jobs that each instance runs at the same
+	// time.
+	maxRunningJobs = 10
+	// jobSaveInterval is how often the progress of a running job is saved.
+	jobSaveInterval = 1 * time.Second
+	// defaultJobRetention is how long the results of a job are kept after
+	// it has finished.
+	defaultJobRetention = 1 * time.Hour
+)
+
+// Values for PreloadableJob.Status
+const (
+	jobRunning = "running"
+	jobDone    = "done"
+)
+
+// PreloadableJob is the progress of a bulk preloadability check, and the
+// results for the domains that have been checked so far.
+type PreloadableJob struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// Total is the number of domains in the job, and Completed is the
+	// number that have been checked.
+	Total     int       `json:"total"`
+	Completed int       `json:"completed"`
+	Created   time.Time `json:"created"`
+	// Expires is when the results will be deleted. It is only set once the
+	// job is done.
+	Expires *time.Time          `json:"expires,omitempty"`
+	Results []PreloadableResult `json:"results"`
+}
+
+// PreloadableResult is the result of checking a single domain, i.e. what
+// Preloadable returns for it.
+type PreloadableResult struct {
+	Domain string             `json:"domain"`
+	Issues hstspreload.Issues `json:"issues"`
+}
+
+// jobStore tracks the preloadable jobs run by this instance. The jobs
+// themselves are kept in the database, so that any instance can serve
+// their progress, and are deleted `retention` after they finish.
+type jobStore struct {
+	lock sync.Mutex
+	// running is the number of jobs this instance is running.
+	running   int
+	retention time.Duration
+}
+
+func newJobStore(retention time.Duration) *jobStore {
+	return &jobStore{retention: retention}
+}
+
+// jobStatus returns the public view of `job`.
+func jobStatus(job database.Job) PreloadableJob {
+	status := PreloadableJob{
+		ID:        job.ID,
+		Status:    jobRunning,
+		Total:     len(job.Domains),
+		Completed: len(job.Results),
+		Created:   job.Created,
+		Results:   []PreloadableResult{},
+	}
+	if !job.Finished.IsZero() {
+		status.Status = jobDone
+		expires := job.Expires
+		status.Expires = &expires
+	}
+	for _, r := range job.Results {
+		status.Results = append(status.Results, PreloadableResult{Domain: r.Domain, Issues: r.Issues})
+	}
+	return status
+}
+
+// jobResults returns the results for the domains of a job that have been
+// checked, where issues[i] is nil until domains[i] has been checked.
+func jobResults(domains []string, issues []*hstspreload.Issues) []database.JobResult {
+	var results []database.JobResult
+	for i, domainIssues := range issues {
+		if domainIssues != nil {
+			results = append(results, database.JobResult{Domain: domains[i], Issues: *domainIssues})
+		}
+	}
+	return results
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// saveJob stores the progress of `job`. A failure is only logged, since
+// the next save will include the results that weren't stored.
+func (api API) saveJob(job database.Job) {
+	if err := api.database.PutJob(context.Background(), job); err != nil {
+		api.logger.Printf("Could not save preloadable job %s: %v", job.ID, err)
+	}
+}
+
+// runPreloadableJob checks the domains of `job` with a bounded number of
+// workers. The results are saved every jobSaveInterval, and once the job
+// has finished.
+func (api API) runPreloadableJob(job database.Job) {
+	defer func() {
+		api.jobs.lock.Lock()
+		api.jobs.running--
+		api.jobs.lock.Unlock()
+	}()
+
+	type result struct {
+		index  int
+		issues hstspreload.Issues
+	}
+	indices := make(chan int)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for range min(jobWorkers, len(job.Domains)) {
+		wg.Add(1)
+		// Each worker checks the domains at the indices it receives, and
+		// stops when the channel is closed.
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				_, issues := api.hstspreload.PreloadableDomain(job.Domains[i])
+				results <- result{i, issues}
+			}
+		}()
+	}
+	go func() {
+		for i := range job.Domains {
+			indices <- i
+		}
+		close(indices)
+		wg.Wait()
+		close(results)
+	}()
+
+	issues := make([]*hstspreload.Issues, len(job.Domains))
+	saved := time.Now()
+	for r := range results {
+		issues[r.index] = &r.issues
+		if time.Since(saved) >= jobSaveInterval {
+			job.Results = jobResults(job.Domains, issues)
+			api.saveJob(job)
+			saved = time.Now()
+		}
+	}
+
+	job.Results = jobResults(job.Domains, issues)
+	job.Finished = time.Now()
+	job.Expires = job.Finished.Add(api.jobs.retention)
+	api.saveJob(job)
+	api.logger.Printf("Preloadable job %s checked %d domains", job.ID, len(job.Domains))
+}
+
+// SubmitPreloadableJob takes a JSON array of domains and starts checking
+// whether they are preloadable in the background. It returns the new job,
+// whose progress and results can be fetched from PreloadableJobStatus.
+//
+// Example: POST /preloadable/jobs with body ["garron.net", "example.com"]
+func (api API) SubmitPreloadableJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Wrong method. Requires POST.", errorMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	domains, ok := getASCIIDomainList(w, r, maxJobDomains)
+	if !ok {
+		return
+	}
+
+	// Each domain is only checked once.
+	seen := make(map[string]bool, len(domains))
+	var unique []string
+	for _, domain := range domains {
+		if !seen[domain] {
+			seen[domain] = true
+			unique = append(unique, domain)
+		}
+	}
+	// Every domain counts against its own rate limit, like a Preloadable
+	// request would.
+	if cont := api.limitDomains(w, unique); !cont {
+		return
+	}
+
+	if err := api.database.DeleteExpiredJobs(r.Context(), time.Now()); err != nil {
+		api.logger.Printf("Could not delete expired preloadable jobs: %v", err)
+	}
+
+	api.jobs.lock.Lock()
+	if api.jobs.running >= maxRunningJobs {
+		api.jobs.lock.Unlock()
+		w.Header().Set("Retry-After", "60")
+		httpError(w, "Too many jobs are running. Please try again later.", errorTooManyJobs, http.StatusServiceUnavailable)
+		return
+	}
+	api.jobs.running++
+	api.jobs.lock.Unlock()
+
+	// Until it finishes, a job expires `retention` after it was created,
+	// so that it is deleted even if its instance stops before that.
+	created := time.Now()
+	job := database.Job{
+		ID:      newJobID(),
+		Domains: unique,
+		Created: created,
+		Expires: created.Add(api.jobs.retention),
+	}
+	if err := api.database.PutJob(r.Context(), job); err != nil {
+		api.jobs.lock.Lock()
+		api.jobs.running--
+		api.jobs.lock.Unlock()
+		msg := fmt.Sprintf("Internal error: could not store the job. (%s)\n", err)
+		httpError(w, msg, errorDatabase, http.StatusInternalServerError)
+		return
+	}
+
+	go api.runPreloadableJob(job)
+
+	// The job is served under the same API version as the request.
+	w.Header().Set("Location", path.Join(path.Dir(r.URL.Path), "job")+"?id="+job.ID)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	writeJSONOrBust(w, jobStatus(job))
+}
+
+// PreloadableJobStatus takes a job ID and returns the progress of the job,
+// with the results for the domains that have been checked so far. Results
+// are only available until the job expires.
+//
+// Example: GET /preloadable/job?id=0123456789abcdef0123456789abcdef
+func (api API) PreloadableJobStatus(w http.ResponseWriter, r *http.Request) {
+	if cont := api.allowCORS(w, r); !cont {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		httpError(w, "Wrong method. Requires GET.", errorMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		httpError(w, "Job ID not specified.", errorIDMissing, http.StatusBadRequest)
+		return
+	}
+
+	job, err := api.database.Job(r.Context(), id)
+	if errors.Is(err, database.ErrNoSuchJob) || (err == nil && !time.Now().Before(job.Expires)) {
+		msg := fmt.Sprintf("Unknown job %q. It may have expired.\n", id)
+		httpError(w, msg, errorJobNotFound, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Internal error: could not retrieve the job. (%s)\n", err)
+		httpError(w, msg, errorDatabase, http.StatusInternalServerError)
+		return
+	}
+	writeJSONOrBust(w, jobStatus(job))
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chromium/hstspreload"
+)
+
+func TestPreloadableJob(t *testing.T) {
+	api, _, h, _ := mockAPI(0 * time.Second)
+	notPreloadable := hstspreload.Issues{Errors: []hstspreload.Issue{{Code: "header.preloadable.no_header", Summary: "No HSTS header"}}}
+	h.preloadableResponses = map[string]hstspreload.Issues{
+		"a.test": notPreloadable,
+		"b.test": emptyIssues,
+	}
+
+	getJob := func(id string) (*httptest.ResponseRecorder, PreloadableJob) {
+		r, err := http.NewRequest("GET", "?id="+id, nil)
+		if err != nil {
+			t.Fatalf("NewRequest failed: %s", err)
+		}
+		w := httptest.NewRecorder()
+		api.PreloadableJobStatus(w, r)
+		var job PreloadableJob
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+				t.Fatalf("%s", err)
+			}
+		}
+		return w, job
+	}
+
+	r, err := http.NewRequest("POST", "/api/v3/preloadable/jobs", bytes.NewBufferString(`["a.test", "B.test", "a.test"]`))
+	if err != nil {
+		t.Fatalf("NewRequest failed: %s", err)
+	}
+	w := httptest.NewRecorder()
+	api.SubmitPreloadableJob(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Wrong status code: %d (%s)", w.Code, w.Body.String())
+	}
+	var created PreloadableJob
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if created.ID == "" || created.Total != 2 {
+		t.Errorf("Wrong job: %#v", created)
+	}
+	if location := w.Header().Get("Location"); location != "/api/v3/preloadable/job?id="+created.ID {
+		t.Errorf("Wrong location: %q", location)
+	}
+
+	// The job is polled like a client would, until it is done.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, job := getJob(created.ID); job.Status == jobDone {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Job did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w, job := getJob(created.ID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Wrong status code: %d", w.Code)
+	}
+	if job.Status != jobDone || job.Completed != 2 || job.Expires == nil {
+		t.Errorf("Wrong job: %#v", job)
+	}
+	if len(job.Results) != 2 ||
+		job.Results[0].Domain != "a.test" || !job.Results[0].Issues.Match(notPreloadable) ||
+		job.Results[1].Domain != "b.test" || !job.Results[1].Issues.Match(emptyIssues) {
+		t.Errorf("Wrong results: %#v", job.Results)
+	}
+
+	// Results are no longer served once the job has expired.
+	stored, err := api.database.Job(context.Background(), created.ID)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	stored.Expires = time.Now()
+	if err := api.database.PutJob(context.Background(), stored); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if w, _ := getJob(created.ID); w.Code != http.StatusNotFound {
+		t.Errorf("Wrong status code for an expired job: %d", w.Code)
+	}
+	if w, _ := getJob(""); w.Code != http.StatusBadRequest {
+		t.Errorf("Wrong status code for a missing ID: %d", w.Code)
+	}
+}
+
+func TestPreloadableJobLimits(t *testing.T) {
+	api, _, _, _ := mockAPI(0 * time.Second)
+
+	submit := func(body string) int {
+		r, err := http.NewRequest("POST", "", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("NewRequest failed: %s", err)
+		}
+		w := httptest.NewRecorder()
+		api.SubmitPreloadableJob(w, r)
+		return w.Code
+	}
+
+	tooMany, err := json.Marshal(make([]string, maxJobDomains+1))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if code := submit(string(tooMany)); code != http.StatusBadRequest {
+		t.Errorf("Wrong status code for too many domains: %d", code)
+	}
+
+	// Each domain counts against its rate limit, and a job that is over
+	// the limit for any domain doesn't count against the others.
+	api = api.WithRateLimits(RateLimits{PerDomain: RateLimit{Requests: 2, Period: time.Minute}})
+	for _, tt := range []struct {
+		body     string
+		wantCode int
+	}{
+		{`["a.test", "b.test"]`, http.StatusAccepted},
+		{`["a.test", "a.test"]`, http.StatusAccepted},
+		{`["b.test", "a.test"]`, http.StatusTooManyRequests},
+		{`["b.test"]`, http.StatusAccepted},
+	} {
+		if code := submit(tt.body); code != tt.wantCode {
+			t.Errorf("Wrong status code for %s: %d", tt.body, code)
+		}
+	}
+	api.scanLimiter = nil
+
+	// Jobs that haven't finished count against the limit. The jobs above
+	// may still be running, and stop counting when they finish.
+	api.jobs.lock.Lock()
+	api.jobs.running += maxRunningJobs
+	api.jobs.lock.Unlock()
+	if code := submit(`["a.test"]`); code != http.StatusServiceUnavailable {
+		t.Errorf("Wrong status code with too many running jobs: %d", code)
+	}
+}
@@ -0,0 +1,30 @@
+package api
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec is the OpenAPI 3 description of the API. Paths are relative
+// to the API version prefix, so the same document describes /api/v2 and
+// /api/v3.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// OpenAPI returns the OpenAPI description of the API.
+//
+// Example: GET /api/openapi.json
+func (api API) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	if cont := api.allowCORS(w, r); !cont {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		httpError(w, "Wrong method. Requires GET.", errorMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(openAPISpec)
+}
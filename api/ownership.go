@@ -0,0 +1,209 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chromium/hstspreload"
+)
+
+const (
+	// verificationPath is where a domain can publish its challenge token
+	// over HTTPS, one token per line.
+	verificationPath = "/.well-known/hstspreload-verification.txt"
+	// verificationRecordPrefix is prepended to a domain to get the name of
+	// the DNS TXT record where it can publish its challenge token.
+	verificationRecordPrefix = "_hstspreload-verification."
+	// verificationTokenPrefix makes tokens recognizable wherever they
+	// are published.
+	verificationTokenPrefix = "hstspreload-verification="
+
+	// A token is accepted during the period it was issued in and the next
+	// one, so that owners have at least one full period to publish it.
+	verificationPeriod = 7 * 24 * time.Hour
+
+	verificationTimeout     = 10 * time.Second
+	maxVerificationBodySize = 4096
+)
+
+// txtResolver looks up DNS TXT records. It is implemented by *net.Resolver.
+type txtResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// ownershipChecker issues challenge tokens and checks whether a domain
+// publishes them, as proof that the requester controls the domain.
+//
+// Tokens are derived from the domain and the current period with an HMAC,
+// so they don't need to be stored. They can only be checked by a checker
+// with the same key.
+type ownershipChecker struct {
+	key      []byte
+	resolver txtResolver
+	client   *http.Client
+}
+
+// newOwnershipChecker returns a checker that looks up tokens with the
+// system resolver, and fetches them with a client that only connects to
+// public addresses and doesn't follow redirects.
+func newOwnershipChecker(key []byte) *ownershipChecker {
+	return &ownershipChecker{
+		key:      key,
+		resolver: net.DefaultResolver,
+		client:   newPublicClient(verificationTimeout),
+	}
+}
+
+// WithVerificationKey returns a copy of `api` that uses `key` for the
+// ownership challenge tokens of removal requests. Tokens are only accepted
+// by servers with the same key.
+func (api API) WithVerificationKey(key []byte) API {
+	api.ownership = newOwnershipChecker(key)
+	return api
+}
+
+func verificationPeriodOf(t time.Time) int64 {
+	return t.Unix() / int64(verificationPeriod/time.Second)
+}
+
+func (c *ownershipChecker) tokenForPeriod(domain string, period int64) string {
+	mac := hmac.New(sha256.New, c.key)
+	fmt.Fprintf(mac, "%s\x00%d", domain, period)
+	return verificationTokenPrefix + hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// token returns the challenge token for `domain` at time `t`, and the time
+// until which it is accepted.
+func (c *ownershipChecker) token(domain string, t time.Time) (token string, expires time.Time) {
+	period := verificationPeriodOf(t)
+	expires = time.Unix((period+2)*int64(verificationPeriod/time.Second), 0)
+	return c.tokenForPeriod(domain, period), expires
+}
+
+// verify checks that `domain` publishes a token that is accepted at time
+// `t`, either in its DNS TXT record or at its well-known HTTPS path. The
+// error explains why the domain could not be verified.
+func (c *ownershipChecker) verify(ctx context.Context, domain string, t time.Time) error {
+	period := verificationPeriodOf(t)
+	accepted := map[string]bool{
+		c.tokenForPeriod(domain, period):   true,
+		c.tokenForPeriod(domain, period-1): true,
+	}
+
+	var problems []string
+	records, err := c.resolver.LookupTXT(ctx, verificationRecordPrefix+domain)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("could not look up the DNS TXT record: %s", err))
+	}
+	for _, record := range records {
+		if accepted[strings.TrimSpace(record)] {
+			return nil
+		}
+	}
+
+	lines, err := c.wellKnownLines(ctx, domain)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("could not fetch https://%s%s: %s", domain, verificationPath, err))
+	}
+	for _, line := range lines {
+		if accepted[line] {
+			return nil
+		}
+	}
+
+	if len(problems) == 0 {
+		return errors.New("no current token was found")
+	}
+	return fmt.Errorf("no current token was found; %s", strings.Join(problems, "; "))
+}
+
+// wellKnownLines returns the trimmed lines of the file at the
+// verification path of `domain`.
+func (c *ownershipChecker) wellKnownLines(ctx context.Context, domain string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+domain+verificationPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxVerificationBodySize))
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSpace(scanner.Text()))
+	}
+	return lines, scanner.Err()
+}
+
+// ownershipUnverifiedIssue explains how to verify `domain` with `token`,
+// and why the last attempt failed.
+func ownershipUnverifiedIssue(domain string, token string, err error) hstspreload.Issue {
+	return hstspreload.Issue{
+		Code:    "server.remove.ownership_unverified",
+		Summary: "Domain ownership not verified",
+		Message: fmt.Sprintf(
+			"To show that you control %s, publish the token `%s` in a DNS TXT record for %s, "+
+				"or on its own line at https://%s%s, and then try again. (%s)",
+			domain, token, verificationRecordPrefix+domain, domain, verificationPath, err),
+	}
+}
+
+// RemovalChallenge describes how to prove ownership of a domain before
+// requesting its removal.
+type RemovalChallenge struct {
+	Domain string `json:"domain"`
+	// Token must be published in one of the two places below.
+	Token string `json:"token"`
+	// DNSName is the name of the TXT record that can hold the token.
+	DNSName string `json:"dnsName"`
+	// URL is the HTTPS URL of a file that can hold the token on its own
+	// line.
+	URL string `json:"url"`
+	// Expires is when the token stops being accepted.
+	Expires time.Time `json:"expires"`
+}
+
+// RemovalChallenge returns the challenge token that a domain must publish
+// before its removal can be requested.
+//
+// Example: GET /removal-challenge?domain=garron.net
+func (api API) RemovalChallenge(w http.ResponseWriter, r *http.Request) {
+	if cont := api.allowCORS(w, r); !cont {
+		return
+	}
+
+	domain, ok := getASCIIDomain(http.MethodGet, w, r)
+	if !ok {
+		return
+	}
+
+	if api.ownership == nil {
+		httpError(w, "Ownership verification is disabled.", errorOwnershipDisabled, http.StatusNotFound)
+		return
+	}
+
+	token, expires := api.ownership.token(domain, time.Now())
+	writeJSONOrBust(w, RemovalChallenge{
+		Domain:  domain,
+		Token:   token,
+		DNSName: verificationRecordPrefix + domain,
+		URL:     "https://" + domain + verificationPath,
+		Expires: expires,
+	})
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chromium/hstspreload"
+	"github.com/chromium/hstspreload.org/database"
+	"github.com/chromium/hstspreload/chromium/preloadlist"
+)
+
+// fakeResolver serves TXT records from a map.
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := f[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+// newFakeOwnershipChecker returns a checker that resolves TXT records with
+// `resolver`, and sends every HTTPS request to a local server that serves
+// `files` by host. The local server's certificate is only valid for
+// example.com.
+func newFakeOwnershipChecker(t *testing.T, resolver fakeResolver, files map[string]string) *ownershipChecker {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := files[r.Host]
+		if !ok || r.URL.Path != verificationPath {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+
+	client := server.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+	}
+	client.Transport = transport
+
+	return &ownershipChecker{
+		key:      []byte("verification key"),
+		resolver: resolver,
+		client:   client,
+	}
+}
+
+func TestOwnershipCheckerRefusesNonPublicAddresses(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	// The well-known file of a domain that resolves to the server's own
+	// network is not fetched.
+	domain := strings.Replace(strings.TrimPrefix(server.URL, "https://"), "127.0.0.1", "localhost", 1)
+	_, err := newOwnershipChecker([]byte("key")).wellKnownLines(context.Background(), domain)
+	if err == nil || !strings.Contains(err.Error(), "non-public address") {
+		t.Errorf("Wrong error: %v", err)
+	}
+}
+
+func TestOwnershipCheckerVerify(t *testing.T) {
+	now := time.Now()
+	checker := newFakeOwnershipChecker(t, nil, nil)
+	current, expires := checker.token("example.com", now)
+	previous, _ := checker.token("example.com", now.Add(-verificationPeriod))
+	stale, _ := checker.token("example.com", now.Add(-2*verificationPeriod))
+	other, _ := checker.token("example.net", now)
+
+	if !expires.After(now.Add(verificationPeriod)) || expires.After(now.Add(2*verificationPeriod)) {
+		t.Errorf("Wrong expiry: %s", expires)
+	}
+	if current == previous || current == other {
+		t.Errorf("Tokens should depend on the period and the domain")
+	}
+
+	tests := []struct {
+		description string
+		resolver    fakeResolver
+		files       map[string]string
+		wantOK      bool
+	}{
+		{"nothing published", nil, nil, false},
+		{"DNS", fakeResolver{"_hstspreload-verification.example.com": {"unrelated", " " + current + " "}}, nil, true},
+		{"HTTPS", nil, map[string]string{"example.com": "# tokens\n" + current + "\n"}, true},
+		{"previous period", fakeResolver{"_hstspreload-verification.example.com": {previous}}, nil, true},
+		{"stale token", fakeResolver{"_hstspreload-verification.example.com": {stale}}, map[string]string{"example.com": stale}, false},
+		{"other domain's token", nil, map[string]string{"example.com": other}, false},
+	}
+	for _, tt := range tests {
+		checker := newFakeOwnershipChecker(t, tt.resolver, tt.files)
+		err := checker.verify(context.Background(), "example.com", now)
+		if (err == nil) != tt.wantOK {
+			t.Errorf("[%s] Wrong verification result: %v", tt.description, err)
+		}
+	}
+
+	// Tokens are only accepted by a checker with the same key.
+	checker = newFakeOwnershipChecker(t, fakeResolver{"_hstspreload-verification.example.com": {current}}, nil)
+	checker.key = []byte("another key")
+	if err := checker.verify(context.Background(), "example.com", now); err == nil {
+		t.Errorf("A token made with another key was accepted")
+	}
+}
+
+func TestRemoveRequiresOwnership(t *testing.T) {
+	api, _, h, _ := mockAPI(0 * time.Second)
+	resolver := fakeResolver{}
+	api.ownership = newFakeOwnershipChecker(t, resolver, nil)
+	h.removableResponses = map[string]hstspreload.Issues{"owned.test": emptyIssues}
+	if err := api.database.PutState(setupCtx, database.DomainState{Name: "owned.test", Status: database.StatusPreloaded, IncludeSubDomains: true, Policy: preloadlist.Bulk1Year}); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	r, err := http.NewRequest("GET", "?domain=owned.test", nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %s", err)
+	}
+	w := httptest.NewRecorder()
+	api.RemovalChallenge(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Wrong status code: %d", w.Code)
+	}
+	var challenge RemovalChallenge
+	if err := json.Unmarshal(w.Body.Bytes(), &challenge); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if challenge.Domain != "owned.test" || challenge.DNSName != "_hstspreload-verification.owned.test" ||
+		challenge.URL != "https://owned.test/.well-known/hstspreload-verification.txt" ||
+		!strings.HasPrefix(challenge.Token, verificationTokenPrefix) {
+		t.Errorf("Wrong challenge: %#v", challenge)
+	}
+
+	remove := func() hstspreload.Issues {
+		r, err := http.NewRequest("POST", "?domain=owned.test", nil)
+		if err != nil {
+			t.Fatalf("NewRequest failed: %s", err)
+		}
+		w := httptest.NewRecorder()
+		api.Remove(w, r)
+		var issues hstspreload.Issues
+		if err := json.Unmarshal(w.Body.Bytes(), &issues); err != nil {
+			t.Fatalf("%s", err)
+		}
+		return issues
+	}
+	status := func() database.PreloadStatus {
+		state, err := api.database.StateForDomain(context.Background(), "owned.test")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		return state.Status
+	}
+
+	issues := remove()
+	if len(issues.Errors) != 1 || issues.Errors[0].Code != "server.remove.ownership_unverified" ||
+		!strings.Contains(issues.Errors[0].Message, challenge.Token) {
+		t.Errorf("Wrong issues before verification: %#v", issues)
+	}
+	if s := status(); s != database.StatusPreloaded {
+		t.Errorf("The domain was removed without verification: %s", s)
+	}
+
+	resolver[challenge.DNSName] = []string{challenge.Token}
+	if issues := remove(); len(issues.Errors) != 0 {
+		t.Errorf("Wrong issues after verification: %#v", issues)
+	}
+	if s := status(); s != database.StatusPendingRemoval {
+		t.Errorf("Wrong status after verification: %s", s)
+	}
+
+	api.ownership = nil
+	w = httptest.NewRecorder()
+	api.RemovalChallenge(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Wrong status code when verification is disabled: %d", w.Code)
+	}
+}
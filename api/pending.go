@@ -5,55 +5,87 @@ import (
 	"net/http"
 
 	"github.com/chromium/hstspreload.org/database"
+	"github.com/chromium/hstspreload/chromium/preloadlist"
 )
 
-func (api API) listDomainsWithStatus(w http.ResponseWriter, r *http.Request, status database.PreloadStatus, entryFormat string) {
+// listDomainsWithStatus writes a JSON array with an entry for each domain
+// with the given status. `formatEntry` returns the JSON for an entry.
+func (api API) listDomainsWithStatus(w http.ResponseWriter, r *http.Request, status database.PreloadStatus, formatEntry func(database.DomainState) string) {
 	if r.Method != "GET" {
-		http.Error(w, "Wrong method. Requires GET.", http.StatusMethodNotAllowed)
+		httpError(w, "Wrong method. Requires GET.", errorMethodNotAllowed, http.StatusMethodNotAllowed)
 		return
 	}
 
-	domainStates, err := api.statesWithStatusCached(status)
-	if err != nil {
-		msg := fmt.Sprintf("Internal error: could not retrieve list for status \"%s\". (%s)\n", status, err)
-		http.Error(w, msg, http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	// Entries are written as they are read, so the comma after an entry
+	// is only written once we know whether it is the last one.
+	written := false
+	var prev database.DomainState
+	for ds, err := range api.statesWithStatusCached(r.Context(), status) {
+		if err != nil {
+			if !written {
+				msg := fmt.Sprintf("Internal error: could not retrieve list for status \"%s\". (%s)\n", status, err)
+				httpError(w, msg, errorDatabase, http.StatusInternalServerError)
+				return
+			}
+			// The response has already started, so the best we can do is
+			// to leave it incomplete.
+			api.logger.Printf("Could not finish list for status %q: %s", status, err)
+			return
+		}
 
-	fmt.Fprintf(w, "[\n")
-	for i, ds := range domainStates {
-		comma := ","
-		if i+1 == len(domainStates) {
-			comma = ""
+		if !written {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			fmt.Fprintf(w, "[\n")
+			written = true
+		} else {
+			fmt.Fprintf(w, "    %s,\n", formatEntry(prev))
 		}
+		prev = ds
+	}
 
-		fmt.Fprintf(w, entryFormat, ds.Name, comma)
+	if !written {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, "[\n")
+	} else {
+		fmt.Fprintf(w, "    %s\n", formatEntry(prev))
 	}
 	fmt.Fprintf(w, "]\n")
 }
 
-// Pending returns a list of domains with status "pending".
+// pendingEntry formats a pending domain like an entry of the preload list.
+// Domains submitted before the policy was stored were all submitted under
+// bulk-1-year.
+func pendingEntry(ds database.DomainState) string {
+	policy := ds.Policy
+	if policy == preloadlist.UnspecifiedPolicyType {
+		policy = preloadlist.Bulk1Year
+	}
+	return fmt.Sprintf(`{ "name": "%s", "policy": "%s", "mode": "force-https", "include_subdomains": %t }`, ds.Name, policy, ds.IncludeSubDomains)
+}
+
+// nameEntry formats a domain as just its name.
+func nameEntry(ds database.DomainState) string {
+	return fmt.Sprintf(`"%s"`, ds.Name)
+}
+
+// Pending returns a list of domains with status "pending", with the policy
+// that each domain was submitted under.
 //
 // Example: GET /pending
 func (api API) Pending(w http.ResponseWriter, r *http.Request) {
-	api.listDomainsWithStatus(w, r, database.StatusPending, `    { "name": "%s", "policy": "bulk-1-year", "mode": "force-https", "include_subdomains": true }%s
-`)
+	api.listDomainsWithStatus(w, r, database.StatusPending, pendingEntry)
 }
 
 // PendingRemoval returns a list of domains with status "pending-removal".
 //
 // Example: GET /pending-removal
 func (api API) PendingRemoval(w http.ResponseWriter, r *http.Request) {
-	api.listDomainsWithStatus(w, r, database.StatusPendingRemoval, `    "%s"%s
-`)
+	api.listDomainsWithStatus(w, r, database.StatusPendingRemoval, nameEntry)
 }
 
 // PendingAutomatedRemoval returns a lsit of domain with status "pending-automated-removal"
 //
 // Example: Get /pending-automated-removal
 func (api API) PendingAutomatedRemoval(w http.ResponseWriter, r *http.Request) {
-	api.listDomainsWithStatus(w, r, database.StatusPendingAutomatedRemoval, `    "%s"%s
-`)
+	api.listDomainsWithStatus(w, r, database.StatusPendingAutomatedRemoval, nameEntry)
 }
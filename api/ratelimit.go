@@ -0,0 +1,341 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// maxLimiterKeys is the number of keys a rateLimiter tracks before it
+	// forgets the ones that have been idle long enough to have a full
+	// bucket. If none of them have, it starts over.
+	maxLimiterKeys = 10000
+	// limiterSweepInterval is the least time between two sweeps for idle
+	// keys, so that a full rateLimiter doesn't sweep on every request.
+	limiterSweepInterval = 1 * time.Minute
+)
+
+// rateLimiter limits how often each key (e.g. a client network) can make
+// requests, using a token bucket per key. A nil rateLimiter doesn't limit
+// anything.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	lock      sync.Mutex
+	limiters  map[string]*limiterEntry
+	lastSweep time.Time
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newRateLimiter returns a rateLimiter that allows `limit` requests per
+// second for each key, with bursts of up to `burst` requests.
+func newRateLimiter(limit rate.Limit, burst int) *rateLimiter {
+	return &rateLimiter{
+		limit:    limit,
+		burst:    burst,
+		limiters: make(map[string]*limiterEntry),
+	}
+}
+
+// allow reports whether a request for `key` may be made now. If not, it
+// also returns how long the client should wait before trying again.
+func (l *rateLimiter) allow(key string) (ok bool, retryAfter time.Duration) {
+	now := time.Now()
+	reservation := l.reserve(key, now)
+	if delay := reservationDelay(reservation, now); delay > 0 {
+		cancelReservation(reservation, now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// reserve takes a token for `key` at `now`. The reservation must be
+// cancelled if the request is not made. It returns nil if `l` is nil.
+func (l *rateLimiter) reserve(key string, now time.Time) *rate.Reservation {
+	if l == nil {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entry, ok := l.limiters[key]
+	if !ok {
+		if len(l.limiters) >= maxLimiterKeys && now.Sub(l.lastSweep) >= limiterSweepInterval {
+			l.removeIdle(now)
+			l.lastSweep = now
+		}
+		if len(l.limiters) >= maxLimiterKeys {
+			l.limiters = make(map[string]*limiterEntry)
+		}
+		entry = &limiterEntry{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = entry
+	}
+	entry.lastSeen = now
+	return entry.limiter.ReserveN(now, 1)
+}
+
+// reservationDelay returns how long the request of `r` must wait, which is
+// zero for a nil reservation.
+func reservationDelay(r *rate.Reservation, now time.Time) time.Duration {
+	if r == nil {
+		return 0
+	}
+	return r.DelayFrom(now)
+}
+
+// cancelReservation gives back the token of `r`, if there is one.
+func cancelReservation(r *rate.Reservation, now time.Time) {
+	if r != nil {
+		r.CancelAt(now)
+	}
+}
+
+// removeIdle forgets the keys whose buckets have refilled, since they
+// behave like new ones. The caller must hold the lock.
+func (l *rateLimiter) removeIdle(now time.Time) {
+	refill := time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second))
+	for key, entry := range l.limiters {
+		if now.Sub(entry.lastSeen) >= refill {
+			delete(l.limiters, key)
+		}
+	}
+}
+
+// rateLimit writes an error and returns false if `r` exceeds the limit of
+// `limiter` for the client's network.
+func (api API) rateLimit(w http.ResponseWriter, r *http.Request, limiter *rateLimiter) (cont bool) {
+	ok, retryAfter := limiter.allow(api.clientNetwork(r))
+	if ok {
+		return true
+	}
+	tooManyRequests(w, "Too many requests.", retryAfter)
+	return false
+}
+
+// tooManyRequests writes a 429 response that asks the client to wait for
+// `retryAfter`.
+func tooManyRequests(w http.ResponseWriter, msg string, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", fmt.Sprint(seconds))
+	msg = fmt.Sprintf("%s Please try again in %d seconds.\n", msg, seconds)
+	httpError(w, msg, errorRateLimited, http.StatusTooManyRequests)
+}
+
+// A RateLimit allows up to Requests requests at once, and refills them
+// over Period. The zero RateLimit doesn't limit anything.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// ParseRateLimit parses a limit of the form "<requests>/<period>", e.g.
+// "30/1m". "off" is the zero RateLimit.
+func ParseRateLimit(s string) (RateLimit, error) {
+	if s == "off" {
+		return RateLimit{}, nil
+	}
+	requests, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: expected <requests>/<period>", s)
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: invalid number of requests", s)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: invalid period", s)
+	}
+	return RateLimit{Requests: n, Period: d}, nil
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Requests > 0 && l.Period > 0
+}
+
+// newLimiter returns a rateLimiter that enforces `l`, or nil for the zero
+// RateLimit.
+func (l RateLimit) newLimiter() *rateLimiter {
+	if !l.enabled() {
+		return nil
+	}
+	return newRateLimiter(rate.Limit(float64(l.Requests)/l.Period.Seconds()), l.Requests)
+}
+
+// RateLimits configures the limits of the endpoints that make the server
+// connect to the domain in the request.
+type RateLimits struct {
+	// PerClient limits each client network, as truncated by
+	// clientNetwork.
+	PerClient RateLimit
+	// PerDomain limits the requests for each domain, from any client.
+	PerDomain RateLimit
+}
+
+// DefaultRateLimits returns the limits that New uses.
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		PerClient: RateLimit{Requests: 30, Period: time.Minute},
+		PerDomain: RateLimit{Requests: 10, Period: time.Minute},
+	}
+}
+
+// scanLimiter enforces RateLimits. A nil scanLimiter doesn't limit
+// anything.
+type scanLimiter struct {
+	limits    RateLimits
+	perClient *rateLimiter
+	perDomain *rateLimiter
+}
+
+func newScanLimiter(limits RateLimits) *scanLimiter {
+	return &scanLimiter{
+		limits:    limits,
+		perClient: limits.PerClient.newLimiter(),
+		perDomain: limits.PerDomain.newLimiter(),
+	}
+}
+
+// WithRateLimits returns a copy of `api` that enforces `limits` in
+// RateLimit.
+func (api API) WithRateLimits(limits RateLimits) API {
+	api.scanLimiter = newScanLimiter(limits)
+	return api
+}
+
+// policyHeader returns the RateLimit-Policy header that describes the
+// limits, or "" if there are none.
+func (l *scanLimiter) policyHeader() string {
+	var policies []string
+	for _, p := range l.published() {
+		policies = append(policies, fmt.Sprintf("%q;q=%d;w=%d", p.Key, p.Requests, p.PeriodSeconds))
+	}
+	return strings.Join(policies, ", ")
+}
+
+// PublishedRateLimit describes one of the limits of the scanning
+// endpoints.
+type PublishedRateLimit struct {
+	// Key is what the limit applies to: "client" or "domain".
+	Key           string `json:"key"`
+	Requests      int    `json:"requests"`
+	PeriodSeconds int    `json:"periodSeconds"`
+}
+
+func (l *scanLimiter) published() []PublishedRateLimit {
+	limits := []PublishedRateLimit{}
+	if l == nil {
+		return limits
+	}
+	for _, limit := range []struct {
+		key   string
+		limit RateLimit
+	}{
+		{"client", l.limits.PerClient},
+		{"domain", l.limits.PerDomain},
+	} {
+		if !limit.limit.enabled() {
+			continue
+		}
+		limits = append(limits, PublishedRateLimit{
+			Key:           limit.key,
+			Requests:      limit.limit.Requests,
+			PeriodSeconds: int(math.Ceil(limit.limit.Period.Seconds())),
+		})
+	}
+	return limits
+}
+
+// RateLimit wraps a handler that makes the server connect to the domain in
+// the request, so that each client network and each domain can only make a
+// limited number of requests. It responds with 429 and a Retry-After header
+// when a limit is reached. Every response has a RateLimit-Policy header
+// that describes the limits.
+func (api API) RateLimit(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l := api.scanLimiter
+		// CORS preflight requests don't scan anything.
+		if l == nil || r.Method == http.MethodOptions {
+			handler(w, r)
+			return
+		}
+		if policy := l.policyHeader(); policy != "" {
+			w.Header().Set("RateLimit-Policy", policy)
+		}
+
+		now := time.Now()
+		clientReservation := l.perClient.reserve(api.clientNetwork(r), now)
+		if delay := reservationDelay(clientReservation, now); delay > 0 {
+			cancelReservation(clientReservation, now)
+			tooManyRequests(w, "Too many requests from your network.", delay)
+			return
+		}
+
+		// Invalid domains are rejected by the handler.
+		if domain, err := normalizeDomain(r.URL.Query().Get("domain")); err == nil && domain != "" {
+			domainReservation := l.perDomain.reserve(domain, now)
+			if delay := reservationDelay(domainReservation, now); delay > 0 {
+				cancelReservation(domainReservation, now)
+				cancelReservation(clientReservation, now)
+				tooManyRequests(w, fmt.Sprintf("Too many requests for %s.", domain), delay)
+				return
+			}
+		}
+
+		handler(w, r)
+	}
+}
+
+// limitDomains takes a request from the per-domain limit of each of
+// `domains`, for handlers that read the domains from the request body. It
+// writes an error and returns false if any of them is over the limit, in
+// which case none of the requests are taken.
+func (api API) limitDomains(w http.ResponseWriter, domains []string) (cont bool) {
+	l := api.scanLimiter
+	if l == nil {
+		return true
+	}
+
+	now := time.Now()
+	var reservations []*rate.Reservation
+	for _, domain := range domains {
+		reservation := l.perDomain.reserve(domain, now)
+		reservations = append(reservations, reservation)
+		if delay := reservationDelay(reservation, now); delay > 0 {
+			for _, r := range reservations {
+				cancelReservation(r, now)
+			}
+			tooManyRequests(w, fmt.Sprintf("Too many requests for %s.", domain), delay)
+			return false
+		}
+	}
+	return true
+}
+
+// RateLimits returns the limits that RateLimit enforces.
+//
+// Example: GET /rate-limits
+func (api API) RateLimits(w http.ResponseWriter, r *http.Request) {
+	if cont := api.allowCORS(w, r); !cont {
+		return
+	}
+	if r.Method != http.MethodGet {
+		httpError(w, "Wrong method. Requires GET.", errorMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSONOrBust(w, api.scanLimiter.published())
+}
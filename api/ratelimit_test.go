@@ -0,0 +1,187 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(1, 2)
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.allow("a"); !ok {
+			t.Errorf("Request %d within the burst was not allowed", i)
+		}
+	}
+	ok, retryAfter := limiter.allow("a")
+	if ok {
+		t.Errorf("Request beyond the burst was allowed")
+	}
+	if retryAfter <= 0 || retryAfter > time.Second {
+		t.Errorf("Wrong retry delay: %s", retryAfter)
+	}
+	if ok, _ := limiter.allow("b"); !ok {
+		t.Errorf("Keys should be limited independently")
+	}
+
+	// Keys whose buckets have refilled are forgotten.
+	limiter.limiters["a"].lastSeen = time.Now().Add(-time.Minute)
+	limiter.removeIdle(time.Now())
+	if _, ok := limiter.limiters["a"]; ok {
+		t.Errorf("Idle key was not removed")
+	}
+	if _, ok := limiter.limiters["b"]; !ok {
+		t.Errorf("Recently used key was removed")
+	}
+
+	var nilLimiter *rateLimiter
+	if ok, _ := nilLimiter.allow("a"); !ok {
+		t.Errorf("A nil rateLimiter should not limit anything")
+	}
+}
+
+func TestRateLimiterBoundsKeys(t *testing.T) {
+	limiter := newRateLimiter(1, 2)
+	now := time.Now()
+	for i := 0; i < maxLimiterKeys; i++ {
+		limiter.reserve(fmt.Sprint(i), now)
+	}
+
+	// Known keys don't cause a sweep.
+	limiter.reserve("0", now)
+	if len(limiter.limiters) != maxLimiterKeys || !limiter.lastSweep.IsZero() {
+		t.Errorf("A known key caused a sweep")
+	}
+
+	// A new key sweeps, and starts over if no key is idle.
+	limiter.reserve("new", now)
+	if len(limiter.limiters) != 1 || !limiter.lastSweep.Equal(now) {
+		t.Errorf("Wrong keys after sweeping a full limiter: %d", len(limiter.limiters))
+	}
+
+	// Between sweeps, a full limiter starts over.
+	fill := func(lastSeen time.Time) {
+		for i := 0; i < maxLimiterKeys; i++ {
+			limiter.limiters[fmt.Sprint(i)] = &limiterEntry{limiter: rate.NewLimiter(1, 2), lastSeen: lastSeen}
+		}
+	}
+	fill(now.Add(-time.Hour))
+	limiter.reserve("newer", now.Add(time.Second))
+	if len(limiter.limiters) != 1 || !limiter.lastSweep.Equal(now) {
+		t.Errorf("A full limiter was swept again too soon")
+	}
+
+	fill(now.Add(-time.Hour))
+	limiter.limiters["busy"] = &limiterEntry{limiter: rate.NewLimiter(1, 2), lastSeen: now.Add(limiterSweepInterval)}
+	limiter.reserve("newest", now.Add(limiterSweepInterval))
+	if _, ok := limiter.limiters["busy"]; !ok || len(limiter.limiters) != 2 {
+		t.Errorf("Wrong keys after sweeping idle keys: %d", len(limiter.limiters))
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    RateLimit
+		wantErr bool
+	}{
+		{"30/1m", RateLimit{30, time.Minute}, false},
+		{"5/10s", RateLimit{5, 10 * time.Second}, false},
+		{"off", RateLimit{}, false},
+		{"30", RateLimit{}, true},
+		{"0/1m", RateLimit{}, true},
+		{"30/forever", RateLimit{}, true},
+		{"30/-1m", RateLimit{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRateLimit(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseRateLimit(%q) = %v, %v", tt.s, got, err)
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	api, _, _, _ := mockAPI(0 * time.Second)
+	api = api.WithRateLimits(RateLimits{
+		PerClient: RateLimit{Requests: 3, Period: time.Minute},
+		PerDomain: RateLimit{Requests: 2, Period: time.Minute},
+	})
+	scan := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "scanned")
+	}
+	handler := api.RateLimit(scan)
+	request := func(method string, remoteAddr string, domain string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/?domain="+domain, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	tests := []struct {
+		description string
+		method      string
+		remoteAddr  string
+		domain      string
+		wantCode    int
+	}{
+		{"first request", "GET", "198.51.100.1:1", "a.test", 200},
+		{"second request for the domain", "GET", "198.51.100.2:1", "A.test", 200},
+		{"domain limit", "GET", "203.0.113.1:1", "a.test", 429},
+		{"another domain", "GET", "198.51.100.3:1", "b.test", 200},
+		{"client limit", "GET", "198.51.100.4:1", "c.test", 429},
+		{"preflight request", "OPTIONS", "198.51.100.4:1", "c.test", 200},
+		// The request that hit the domain limit didn't use up a request
+		// from its client.
+		{"another client", "GET", "203.0.113.1:1", "c.test", 200},
+		{"no domain", "GET", "203.0.113.1:1", "", 200},
+		{"another request without a domain", "GET", "203.0.113.1:1", "", 200},
+		{"client limit without a domain", "GET", "203.0.113.1:1", "", 429},
+	}
+	for _, tt := range tests {
+		w := request(tt.method, tt.remoteAddr, tt.domain)
+		if w.Code != tt.wantCode {
+			t.Errorf("[%s] Wrong status code: %d", tt.description, w.Code)
+		}
+		if tt.wantCode == 429 && w.Header().Get("Retry-After") == "" {
+			t.Errorf("[%s] Missing Retry-After", tt.description)
+		}
+		if policy := w.Header().Get("RateLimit-Policy"); tt.method == "GET" && policy != `"client";q=3;w=60, "domain";q=2;w=60` {
+			t.Errorf("[%s] Wrong RateLimit-Policy: %q", tt.description, policy)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/rate-limits", nil)
+	w := httptest.NewRecorder()
+	api.RateLimits(w, r)
+	var limits []PublishedRateLimit
+	if err := json.Unmarshal(w.Body.Bytes(), &limits); err != nil {
+		t.Fatalf("%s", err)
+	}
+	want := []PublishedRateLimit{{"client", 3, 60}, {"domain", 2, 60}}
+	if !reflect.DeepEqual(limits, want) {
+		t.Errorf("Wrong published limits: %#v", limits)
+	}
+
+	// Without limits, nothing is limited or published.
+	api.scanLimiter = nil
+	handler = api.RateLimit(scan)
+	for i := 0; i < 5; i++ {
+		if w := request("GET", "198.51.100.1:1", "a.test"); w.Code != 200 {
+			t.Errorf("Request %d was limited without limits: %d", i, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	api.RateLimits(w, r)
+	if body := strings.TrimSpace(w.Body.String()); body != "[]" {
+		t.Errorf("Wrong published limits without limits: %s", body)
+	}
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/chromium/hstspreload"
+	"github.com/chromium/hstspreload/chromium/preloadlist"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// scanCacheDuration is how long scan results are reused. It covers the
+	// requests that the site makes together (e.g. Preloadable and Status,
+	// then Submit), but is short enough that a site owner who fixes an
+	// issue can check again soon after.
+	scanCacheDuration = 30 * time.Second
+	// maxCachedScans is the number of results scanCache keeps before it
+	// forgets the expired ones, or starts over if none have expired.
+	maxCachedScans = 10000
+)
+
+// scanKey identifies a scan: the check, the domain, and the policy that
+// eligibility is checked for.
+type scanKey struct {
+	check  string
+	domain string
+	policy preloadlist.PolicyType
+}
+
+func (k scanKey) String() string {
+	return fmt.Sprintf("%s\x00%s\x00%s", k.check, k.domain, k.policy)
+}
+
+type scanResult struct {
+	header   *string
+	issues   hstspreload.Issues
+	scanTime time.Time
+}
+
+// scanCache is an hstspreloadWrapper that makes concurrent identical scans
+// only once, and reuses their results for `duration`. PreloadableDomain is
+// the eligibility check for bulk-1-year, so it shares results with
+// EligibleDomain.
+type scanCache struct {
+	hstspreload hstspreloadWrapper
+	duration    time.Duration
+	group       singleflight.Group
+
+	lock    sync.Mutex
+	results map[scanKey]scanResult
+}
+
+func newScanCache(h hstspreloadWrapper, duration time.Duration) *scanCache {
+	return &scanCache{
+		hstspreload: h,
+		duration:    duration,
+		results:     make(map[scanKey]scanResult),
+	}
+}
+
+// uncached returns `h` without its scan cache, if it has one. The
+// RemoveIneligibleDomains cron scans every preloaded domain, so going
+// through the cache would evict the results of the site's requests, and
+// would reuse results that the cron should check again.
+func uncached(h hstspreloadWrapper) hstspreloadWrapper {
+	if c, ok := h.(*scanCache); ok {
+		return c.hstspreload
+	}
+	return h
+}
+
+func (c *scanCache) PreloadableDomain(domain string) (*string, hstspreload.Issues) {
+	return c.scan(scanKey{"eligible", domain, preloadlist.Bulk1Year}, func() (*string, hstspreload.Issues) {
+		return c.hstspreload.PreloadableDomain(domain)
+	})
+}
+
+func (c *scanCache) EligibleDomain(domain string, policy preloadlist.PolicyType) (*string, hstspreload.Issues) {
+	return c.scan(scanKey{"eligible", domain, policy}, func() (*string, hstspreload.Issues) {
+		return c.hstspreload.EligibleDomain(domain, policy)
+	})
+}
+
+func (c *scanCache) RemovableDomain(domain string) (*string, hstspreload.Issues) {
+	return c.scan(scanKey{"removable", domain, ""}, func() (*string, hstspreload.Issues) {
+		return c.hstspreload.RemovableDomain(domain)
+	})
+}
+
+// scan returns a fresh result for `key` if there is one. Otherwise, it
+// calls `scanDomain`, unless an identical scan is already running, in which
+// case it waits for that scan's result.
+func (c *scanCache) scan(key scanKey, scanDomain func() (*string, hstspreload.Issues)) (*string, hstspreload.Issues) {
+	if result, ok := c.fresh(key); ok {
+		return result.copy()
+	}
+
+	v, _, _ := c.group.Do(key.String(), func() (interface{}, error) {
+		// A scan that finished since the check above may have stored a
+		// result.
+		if result, ok := c.fresh(key); ok {
+			return result, nil
+		}
+		header, issues := scanDomain()
+		result := scanResult{header: header, issues: issues, scanTime: time.Now()}
+		c.store(key, result)
+		return result, nil
+	})
+	return v.(scanResult).copy()
+}
+
+func (c *scanCache) fresh(key scanKey) (scanResult, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	result, ok := c.results[key]
+	if !ok || time.Since(result.scanTime) >= c.duration {
+		return scanResult{}, false
+	}
+	return result, true
+}
+
+func (c *scanCache) store(key scanKey, result scanResult) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.results) >= maxCachedScans {
+		for k, r := range c.results {
+			if time.Since(r.scanTime) >= c.duration {
+				delete(c.results, k)
+			}
+		}
+		if len(c.results) >= maxCachedScans {
+			c.results = make(map[scanKey]scanResult)
+		}
+	}
+	c.results[key] = result
+}
+
+// copy returns the header and issues of `r`, copied so that callers can
+// modify them without changing the cached result.
+func (r scanResult) copy() (*string, hstspreload.Issues) {
+	var header *string
+	if r.header != nil {
+		h := *r.header
+		header = &h
+	}
+	return header, hstspreload.Issues{
+		Errors:   slices.Clone(r.issues.Errors),
+		Warnings: slices.Clone(r.issues.Warnings),
+	}
+}
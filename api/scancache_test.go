@@ -0,0 +1,187 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chromium/hstspreload"
+	"github.com/chromium/hstspreload/chromium/preloadlist"
+)
+
+// countingHstspreload counts the scans of each domain. While `block` is
+// set, scans wait for it to be closed.
+type countingHstspreload struct {
+	mockHstspreload
+	block chan struct{}
+
+	lock  sync.Mutex
+	scans map[string]int
+}
+
+func (h *countingHstspreload) count(domain string) {
+	h.lock.Lock()
+	if h.scans == nil {
+		h.scans = make(map[string]int)
+	}
+	h.scans[domain]++
+	h.lock.Unlock()
+
+	if h.block != nil {
+		<-h.block
+	}
+}
+
+func (h *countingHstspreload) PreloadableDomain(domain string) (*string, hstspreload.Issues) {
+	h.count(domain)
+	return h.mockHstspreload.PreloadableDomain(domain)
+}
+
+func (h *countingHstspreload) EligibleDomain(domain string, policy preloadlist.PolicyType) (*string, hstspreload.Issues) {
+	h.count(domain)
+	return h.mockHstspreload.EligibleDomain(domain, policy)
+}
+
+func (h *countingHstspreload) RemovableDomain(domain string) (*string, hstspreload.Issues) {
+	h.count(domain)
+	return h.mockHstspreload.RemovableDomain(domain)
+}
+
+func (h *countingHstspreload) scansOf(domain string) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.scans[domain]
+}
+
+func TestScanCache(t *testing.T) {
+	header := "max-age=63072000; includeSubDomains; preload"
+	warning := hstspreload.Issues{Warnings: []hstspreload.Issue{{Code: "code", Summary: "summary", Message: "message"}}}
+	h := &countingHstspreload{mockHstspreload: mockHstspreload{
+		preloadableResponses: map[string]hstspreload.Issues{"a.test": warning},
+		preloadableHeaders:   map[string]string{"a.test": header},
+	}}
+	c := newScanCache(h, time.Minute)
+
+	gotHeader, issues := c.PreloadableDomain("a.test")
+	if gotHeader == nil || *gotHeader != header || !issues.Match(warning) {
+		t.Errorf("Wrong result: %v %#v", gotHeader, issues)
+	}
+
+	// Callers may change their results.
+	*gotHeader = "changed"
+	issues.Warnings[0].Code = "changed"
+
+	gotHeader, issues = c.EligibleDomain("a.test", preloadlist.Bulk1Year)
+	if gotHeader == nil || *gotHeader != header || !issues.Match(warning) {
+		t.Errorf("Wrong cached result: %v %#v", gotHeader, issues)
+	}
+	if scans := h.scansOf("a.test"); scans != 1 {
+		t.Errorf("The preloadable check should share the bulk-1-year scan, got %d scans", scans)
+	}
+
+	c.EligibleDomain("a.test", preloadlist.Bulk18Weeks)
+	c.RemovableDomain("a.test")
+	c.RemovableDomain("a.test")
+	if scans := h.scansOf("a.test"); scans != 3 {
+		t.Errorf("Each check and policy should be scanned once, got %d scans", scans)
+	}
+
+	// Expired results are scanned again.
+	key := scanKey{"eligible", "a.test", preloadlist.Bulk1Year}
+	result := c.results[key]
+	result.scanTime = time.Now().Add(-time.Minute)
+	c.results[key] = result
+	c.PreloadableDomain("a.test")
+	if scans := h.scansOf("a.test"); scans != 4 {
+		t.Errorf("An expired result was reused, got %d scans", scans)
+	}
+
+	c = newScanCache(h, 0)
+	c.PreloadableDomain("b.test")
+	c.PreloadableDomain("b.test")
+	if scans := h.scansOf("b.test"); scans != 2 {
+		t.Errorf("Results should not be reused without a duration, got %d scans", scans)
+	}
+}
+
+func TestScanCacheCoalescesScans(t *testing.T) {
+	h := &countingHstspreload{block: make(chan struct{})}
+	c := newScanCache(h, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.PreloadableDomain("a.test")
+		}()
+	}
+	for h.scansOf("a.test") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Give the other goroutines time to wait for the running scan.
+	time.Sleep(10 * time.Millisecond)
+	close(h.block)
+	wg.Wait()
+
+	if scans := h.scansOf("a.test"); scans != 1 {
+		t.Errorf("Concurrent scans were not coalesced: %d scans", scans)
+	}
+}
+
+func TestScanCacheSharedBetweenRequests(t *testing.T) {
+	api, _, _, _ := mockAPI(0 * time.Second)
+	h := &countingHstspreload{}
+	api.hstspreload = newScanCache(h, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		r, err := http.NewRequest("GET", "?domain=a.test", nil)
+		if err != nil {
+			t.Fatalf("NewRequest failed: %s", err)
+		}
+		w := httptest.NewRecorder()
+		api.Preloadable(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("Wrong status code: %d", w.Code)
+		}
+	}
+	if scans := h.scansOf("a.test"); scans != 1 {
+		t.Errorf("Repeated requests should share a scan, got %d scans", scans)
+	}
+}
+
+func TestScanCacheBypassedByCron(t *testing.T) {
+	api, _, _, c := mockAPI(0 * time.Second)
+	h := &countingHstspreload{}
+	h.eligibleResponses = map[string]hstspreload.Issues{"a.test": {}}
+	cache := newScanCache(h, time.Minute)
+	api.hstspreload = cache
+	c.list = preloadlist.PreloadList{Entries: []preloadlist.Entry{
+		{Name: "a.test", Mode: preloadlist.ForceHTTPS, IncludeSubDomains: true, Policy: preloadlist.Bulk1Year},
+	}}
+	r, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %s", err)
+	}
+	api.Update(httptest.NewRecorder(), r)
+
+	for i := 0; i < 2; i++ {
+		r, err := http.NewRequest("GET", "", nil)
+		if err != nil {
+			t.Fatalf("NewRequest failed: %s", err)
+		}
+		w := httptest.NewRecorder()
+		api.RemoveIneligibleDomains(w, toAppEngineHttpRequest(r))
+		if w.Code != http.StatusOK {
+			t.Errorf("Wrong status code: %d (%q)", w.Code, w.Body.String())
+		}
+	}
+	if scans := h.scansOf("a.test"); scans != 2 {
+		t.Errorf("Each cron run should scan the domain again, got %d scans", scans)
+	}
+	if len(cache.results) != 0 {
+		t.Errorf("The cron should not fill the scan cache: %d results", len(cache.results))
+	}
+}
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Stats returns the number of domains with each status and policy, and
+// the number of submissions per day. The counts are kept up to date by
+// the database, so this is cheap enough to poll.
+//
+// Example: GET /stats
+func (api API) Stats(w http.ResponseWriter, r *http.Request) {
+	if cont := api.allowCORS(w, r); !cont {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		httpError(w, "Wrong method. Requires GET.", errorMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := api.database.Stats(r.Context())
+	if err != nil {
+		msg := fmt.Sprintf("Internal error: could not retrieve stats. (%s)\n", err)
+		httpError(w, msg, errorDatabase, http.StatusInternalServerError)
+		return
+	}
+	writeJSONOrBust(w, stats)
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chromium/hstspreload.org/database"
+	"github.com/chromium/hstspreload/chromium/preloadlist"
+)
+
+func TestStats(t *testing.T) {
+	api, mc, _, _ := mockAPI(0 * time.Second)
+
+	if err := api.database.PutStates(setupCtx, []database.DomainState{
+		{Name: "a.test", Status: database.StatusPending, SubmissionDate: time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)},
+		{Name: "b.test", Status: database.StatusPreloaded, Policy: preloadlist.Bulk1Year},
+		{Name: "c.test", Status: database.StatusPendingAutomatedRemoval, Policy: preloadlist.Bulk1Year},
+	}, func(format string, args ...interface{}) {}); err != nil {
+		t.Fatalf("cannot put states: %s", err)
+	}
+
+	r, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %s", err)
+	}
+	w := httptest.NewRecorder()
+	api.Stats(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Wrong status code: %d", w.Code)
+	}
+
+	var got map[string]map[string]int
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("%s", err)
+	}
+	want := map[string]map[string]int{
+		"statuses":          {"pending": 1, "preloaded": 1, "pending-automated-removal": 1},
+		"policies":          {"bulk-1-year": 2},
+		"submissionsPerDay": {"2024-03-01": 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong stats: %#v", got)
+	}
+
+	if n := mc.CallCount("AllDomainStates") + mc.CallCount("IterateDomainStates") + mc.CallCount("StatesWithStatus"); n != 0 {
+		t.Errorf("Stats should not read domain states, but made %d calls", n)
+	}
+
+	mc.SetFailCalls(true)
+	w = httptest.NewRecorder()
+	api.Stats(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Wrong status code for a database failure: %d", w.Code)
+	}
+
+	r, err = http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %s", err)
+	}
+	w = httptest.NewRecorder()
+	api.Stats(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Wrong status code for POST: %d", w.Code)
+	}
+}
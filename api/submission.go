@@ -0,0 +1,173 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/chromium/hstspreload"
+	"github.com/chromium/hstspreload.org/database"
+)
+
+// fingerprintLength is the number of hex digits kept from a client
+// fingerprint. It is enough to tell clients apart, and short enough that
+// it doesn't act as a unique identifier across deployments.
+const fingerprintLength = 16
+
+// newRandomKey returns a random HMAC key, for deployments that don't
+// configure one. Fingerprints and tokens made with it can only be
+// compared with others from the same process.
+func newRandomKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// WithFingerprintKey returns a copy of `api` that uses `key` to compute
+// client fingerprints. Fingerprints can only be compared if they were
+// computed with the same key.
+func (api API) WithFingerprintKey(key []byte) API {
+	api.fingerprintKey = key
+	return api
+}
+
+// submissionChannel returns how `r` was submitted: by a maintainer with
+// the admin token, through the form on the site, or by another client.
+func (api API) submissionChannel(r *http.Request) database.SubmissionChannel {
+	if api.isAdmin(r) {
+		return database.ChannelAdmin
+	}
+	// Browsers always send an Origin with POST requests made by the site's
+	// own scripts.
+	if o, err := url.Parse(r.Header.Get("Origin")); err == nil && o.Host != "" && o.Host == r.Host {
+		return database.ChannelWeb
+	}
+	return database.ChannelAPI
+}
+
+// DefaultTrustedProxies returns the proxies that New trusts: local
+// networks, and the Google Cloud load balancers that App Engine requests
+// come through.
+func DefaultTrustedProxies() []netip.Prefix {
+	proxies, _ := ParseTrustedProxies("127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7,35.191.0.0/16,130.211.0.0/22")
+	return proxies
+}
+
+// ParseTrustedProxies parses a comma-separated list of networks and
+// addresses, e.g. "10.0.0.0/8,192.0.2.1".
+func ParseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(field); err == nil {
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %s", field, err)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+// WithTrustedProxies returns a copy of `api` that reads the client address
+// from the X-Forwarded-For addresses added by `proxies`.
+func (api API) WithTrustedProxies(proxies []netip.Prefix) API {
+	api.trustedProxies = proxies
+	return api
+}
+
+// trustedClientAddr returns the address of the client that made `r`. The
+// X-Forwarded-For addresses are read from the right, and each one is only
+// believed if it was added by a trusted proxy.
+func trustedClientAddr(r *http.Request, trustedProxies []netip.Prefix) (netip.Addr, bool) {
+	var addr netip.Addr
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		addr = addrPort.Addr()
+	} else if addr, err = netip.ParseAddr(r.RemoteAddr); err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0 && isTrustedProxy(addr, trustedProxies); i-- {
+		next, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = next.Unmap()
+	}
+	return addr, true
+}
+
+func isTrustedProxy(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientNetwork returns the network that `r` was made from, truncated so
+// that it doesn't identify a single host: a /24 for IPv4, and a /48 for
+// IPv6. It returns "" if the address is unknown.
+func (api API) clientNetwork(r *http.Request) string {
+	addr, ok := trustedClientAddr(r, api.trustedProxies)
+	if !ok {
+		return ""
+	}
+	return truncatedNetwork(addr)
+}
+
+// truncatedNetwork returns the network of `ip` that clientNetwork reports.
+func truncatedNetwork(ip netip.Addr) string {
+	ip = ip.Unmap()
+	bits := 48
+	if ip.Is4() {
+		bits = 24
+	}
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return prefix.String()
+}
+
+// clientFingerprint returns a keyed hash of the network and user agent of
+// the client that made `r`. The address itself is not kept.
+func (api API) clientFingerprint(r *http.Request) string {
+	mac := hmac.New(sha256.New, api.fingerprintKey)
+	mac.Write([]byte(api.clientNetwork(r)))
+	mac.Write([]byte{0})
+	mac.Write([]byte(r.UserAgent()))
+	return hex.EncodeToString(mac.Sum(nil))[:fingerprintLength]
+}
+
+// newSubmission records the metadata of a submission of a domain with
+// the given `header` and `issues`.
+func (api API) newSubmission(r *http.Request, header *string, issues hstspreload.Issues) database.Submission {
+	submission := database.Submission{
+		Channel:           api.submissionChannel(r),
+		Issues:            issues,
+		ClientFingerprint: api.clientFingerprint(r),
+	}
+	if header != nil {
+		submission.Header = *header
+	}
+	return submission
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -22,69 +23,75 @@ func (api API) Update(w http.ResponseWriter, r *http.Request) {
 			"Internal error: could not retrieve latest preload list. (%s)\n",
 			listErr,
 		)
-		http.Error(w, msg, http.StatusInternalServerError)
+		httpError(w, msg, errorPreloadList, http.StatusInternalServerError)
 		return
 	}
 
-	domainStates := make(map[string]database.DomainState)
-	addDomainStatesWithStatus := func(status database.PreloadStatus) bool {
-		domains, err := api.database.StatesWithStatus(status)
-		if err != nil {
-			msg := fmt.Sprintf("Internal error: could not retrieve domain names previously marked as %s. (%s)\n", status, err)
-			http.Error(w, msg, http.StatusInternalServerError)
-			return false
-		}
-		for _, domain := range domains {
-			domainStates[domain.Name] = domain
+	// Index the entries that should be preloaded by name. Entries that
+	// are still in this map after going through the database need to be
+	// added to it.
+	entries := make(map[string]preloadlist.Entry)
+	for _, entry := range preloadList.Entries {
+		if entry.Mode == preloadlist.ForceHTTPS {
+			entries[entry.Name] = entry
 		}
-		return true
-	}
-	// Get domains currently recorded as preloaded, pending removal, or
-	// pending automated removal.
-	if !addDomainStatesWithStatus(database.StatusPreloaded) ||
-		!addDomainStatesWithStatus(database.StatusPendingRemoval) ||
-		!addDomainStatesWithStatus(database.StatusPendingAutomatedRemoval) {
-		return
 	}
 
 	var updates []database.DomainState
 	added := 0
 	updated := 0
 	removed := 0
-	for _, entry := range preloadList.Entries {
-		if entry.Mode != preloadlist.ForceHTTPS {
-			continue
-		}
-		domainState, found := domainStates[entry.Name]
-		if !found {
-			// entry is on the preload list but not marked as
-			// preloaded, pending removal, or pending automated
-			// removal in the database. Mark it as preloaded in the
-			// database.
-			updates = append(updates, database.EntryToDomainState(entry, database.StatusPreloaded))
-			added++
-			continue
+
+	// Go through the domains currently recorded as preloaded, pending
+	// removal, or pending automated removal, without loading all of them
+	// into memory at once.
+	for _, status := range []database.PreloadStatus{
+		database.StatusPreloaded,
+		database.StatusPendingRemoval,
+		database.StatusPendingAutomatedRemoval,
+	} {
+		for domainState, err := range api.database.IterateStatesWithStatus(r.Context(), status) {
+			if err != nil {
+				msg := fmt.Sprintf("Internal error: could not retrieve domain names previously marked as %s. (%s)\n", status, err)
+				httpError(w, msg, errorDatabase, http.StatusInternalServerError)
+				return
+			}
+
+			entry, found := entries[domainState.Name]
+			if !found {
+				// The domain isn't on the preload list. Update its
+				// state in the database to mark it as removed.
+				domainState.Status = database.StatusRemoved
+				domainState.Policy = preloadlist.UnspecifiedPolicyType
+				updates = append(updates, domainState)
+				removed++
+				continue
+			}
+			delete(entries, domainState.Name)
+			// entry is in both the preload list and in one of the states of
+			// preloaded, pending removal, or pending automated removal. If
+			// the preload list entry differs from what's in the database,
+			// update the database to match.
+			if domainState.ToEntry().Equal(entry) {
+				continue
+			}
+			domainState.Policy = entry.Policy
+			domainState.IncludeSubDomains = entry.IncludeSubDomains
+			updates = append(updates, domainState)
+			updated++
 		}
-		delete(domainStates, entry.Name)
-		// entry is in both the preload list and in one of the states of
-		// preloaded, pending removal, or pending automated removal. If
-		// the preload list entry differs from what's in the database,
-		// update the database to match.
-		if domainState.ToEntry().Equal(entry) {
+	}
+
+	// The remaining entries are on the preload list but not marked as
+	// preloaded, pending removal, or pending automated removal in the
+	// database. Mark them as preloaded in the database, in list order.
+	for _, entry := range preloadList.Entries {
+		if _, ok := entries[entry.Name]; !ok {
 			continue
 		}
-		domainState.Policy = entry.Policy
-		domainState.IncludeSubDomains = entry.IncludeSubDomains
-		updates = append(updates, domainState)
-		updated++
-	}
-	// domainStates now only contains domains that aren't on the preload
-	// list. Update their state in the database to mark them as removed.
-	for _, domainState := range domainStates {
-		domainState.Status = database.StatusRemoved
-		domainState.Policy = preloadlist.UnspecifiedPolicyType
-		updates = append(updates, domainState)
-		removed++
+		delete(entries, entry.Name)
+		updates = append(updates, database.EntryToDomainState(entry, database.StatusPreloaded))
+		added++
 	}
 
 	fmt.Fprintf(w, `The preload list has %d entries.
@@ -104,18 +111,29 @@ func (api API) Update(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Update the database.
-	putErr := api.database.PutStates(updates, logf)
+	ctx := database.WithActor(r.Context(), database.ActorUpdate, "Synced with the Chromium preload list.")
+	putErr := api.database.PutStates(ctx, updates, logf)
 	if putErr != nil {
 		msg := fmt.Sprintf(
 			"Internal error: datastore update failed. (%s)\n",
 			putErr,
 		)
+		// The states are computed from the database on every run, so
+		// running the update again only writes the uncommitted ones.
+		var partial *database.PartialCommitError
+		if errors.As(putErr, &partial) {
+			api.logger.Printf("Update committed %d domain states; uncommitted: %v\n", len(partial.Committed), partial.Uncommitted)
+			msg = fmt.Sprintf(
+				"Internal error: datastore update failed after committing %d of %d domain states. Run the update again to write the remaining %d. (%s)\n",
+				len(partial.Committed), len(updates), len(partial.Uncommitted), partial.Err,
+			)
+		}
 		if written {
 			// The header and part of the body have already been sent, so we
 			// can't change the status code anymore.
 			fmt.Fprint(w, msg)
 		} else {
-			http.Error(w, msg, http.StatusInternalServerError)
+			httpError(w, msg, errorDatabase, http.StatusInternalServerError)
 		}
 		return
 	}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -237,7 +238,7 @@ func TestUpdate(t *testing.T) {
 			// Set up test state
 			api, _, _, mockPreloadlist := mockAPI(0 * time.Second)
 			for _, domainState := range test.initialDatabaseEntries {
-				api.database.PutState(domainState)
+				api.database.PutState(setupCtx, domainState)
 			}
 			mockPreloadlist.list = preloadlist.PreloadList{Entries: test.preloadListEntries}
 
@@ -255,7 +256,7 @@ func TestUpdate(t *testing.T) {
 
 			// Verify that the updated domain states in the database
 			// match the expected state.
-			gotStates, err := api.database.AllDomainStates()
+			gotStates, err := api.database.AllDomainStates(context.Background())
 			if err != nil {
 				t.Fatalf("Failed to get database domain states: %v", err)
 			}
@@ -282,3 +283,46 @@ func TestUpdate(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdatePartialFailure(t *testing.T) {
+	api, mc, _, mockPreloadlist := mockAPI(0 * time.Second)
+	mockPreloadlist.list = preloadlist.PreloadList{Entries: []preloadlist.Entry{
+		{Name: "a.test", Mode: preloadlist.ForceHTTPS},
+		{Name: "b.test", Mode: preloadlist.ForceHTTPS},
+		{Name: "c.test", Mode: preloadlist.ForceHTTPS},
+	}}
+	mc.FailOn(database.FailureRule{Method: "PutStates", AfterWrites: 2})
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	api.Update(w, r)
+	if !bytes.Contains(w.Body.Bytes(), []byte("Internal error: datastore update failed after committing 2 of 3 domain states. Run the update again to write the remaining 1. (forced failure)\n")) {
+		t.Errorf("Expected the failure to be reported: %q", w.Body.String())
+	}
+
+	// The states written before the failure are kept, so that the next
+	// update only needs to write the rest.
+	gotStates, err := api.database.AllDomainStates(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get database domain states: %v", err)
+	}
+	if len(gotStates) != 2 {
+		t.Errorf("Expected 2 entries in the database after a partial failure; found %d", len(gotStates))
+	}
+
+	mc.Reset()
+	w = httptest.NewRecorder()
+	api.Update(w, r)
+	if w.Code != 200 {
+		t.Errorf("Expected HTTP status code 200, got %d", w.Code)
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte("to be added in this update: 1\n")) {
+		t.Errorf("Expected the retry to add the remaining domain: %q", w.Body.String())
+	}
+	if n := mc.CallCount("PutStates"); n != 1 {
+		t.Errorf("Expected 1 call to PutStates, got %d", n)
+	}
+}
@@ -0,0 +1,457 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+
+	"github.com/chromium/hstspreload.org/database"
+)
+
+const (
+	// Headers of webhook requests.
+	webhookEventHeader     = "X-Hstspreload-Event"
+	webhookSignatureHeader = "X-Hstspreload-Signature"
+
+	webhookTimeout = 10 * time.Second
+	// webhookWorkers is the number of events that are posted at once.
+	webhookWorkers = 10
+	// maxDeliveriesPerDispatch is the most events DispatchWebhooks posts
+	// in one call. The rest are posted by the next call.
+	maxDeliveriesPerDispatch = 500
+
+	// A failed delivery is retried after minDeliveryBackoff, and the
+	// delay doubles with every attempt up to maxDeliveryBackoff. The event
+	// is dropped after maxDeliveryAttempts, about two days later.
+	minDeliveryBackoff  = time.Minute
+	maxDeliveryBackoff  = 6 * time.Hour
+	maxDeliveryAttempts = 15
+)
+
+// subscribableStatuses are the statuses that a subscription can be limited
+// to.
+var subscribableStatuses = map[database.PreloadStatus]bool{
+	database.StatusPending:                 true,
+	database.StatusPreloaded:               true,
+	database.StatusRemoved:                 true,
+	database.StatusPendingRemoval:          true,
+	database.StatusPendingAutomatedRemoval: true,
+}
+
+// nonPublicNetworks are the networks that webhooks can't be posted to,
+// besides the ones that netip.Addr reports as private, loopback, link-local
+// (e.g. the metadata server at 169.254.169.254) or otherwise not global
+// unicast.
+var nonPublicNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// isPublicAddr reports whether `addr` is an address on the public
+// internet.
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPublicAddress is a net.Dialer Control function that refuses to
+// connect to addresses that are not public. It runs after the host name
+// has been resolved, so a subscriber can't point their host name at the
+// server's own network. It is used for every connection to an address
+// that a client controls: webhooks and ownership verification.
+func checkPublicAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddr(addr) {
+		return fmt.Errorf("refusing to connect to non-public address %s", addr)
+	}
+	return nil
+}
+
+// newPublicClient returns a client for URLs that a client of the API
+// controls, such as webhooks. It only connects to public addresses, and
+// doesn't follow redirects, so that a URL can't lead it to the server's own
+// network or on to another server.
+func newPublicClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would make the connection on our behalf, without the check.
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{
+		Timeout: timeout,
+		Control: checkPublicAddress,
+	}).DialContext
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// SubscriptionRequest is the body of a Subscribe request.
+type SubscriptionRequest struct {
+	Domain            string                   `json:"domain"`
+	IncludeSubdomains bool                     `json:"includeSubdomains"`
+	Statuses          []database.PreloadStatus `json:"statuses"`
+	URL               string                   `json:"url"`
+}
+
+// NewSubscription is the response to a Subscribe request. It is the only
+// response that includes the secret.
+type NewSubscription struct {
+	database.Subscription
+	// Secret signs the events, and authorizes Unsubscribe.
+	Secret string `json:"secret"`
+}
+
+// Subscribe registers a webhook that is called whenever the status of a
+// domain changes. With `includeSubdomains`, it is also called for every
+// subdomain, e.g. for all the domains under a registrable domain.
+//
+// Like a removal request, the requester must first publish the token from
+// RemovalChallenge to show that they control the domain.
+//
+// Example: POST /webhooks/subscribe
+//
+//	{"domain": "example.com", "includeSubdomains": true, "url": "https://hooks.example.com/hsts"}
+func (api API) Subscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Wrong method. Requires POST.", errorMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req SubscriptionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		msg := fmt.Sprintf("Invalid request body. Requires a JSON subscription. (%s)\n", err)
+		httpError(w, msg, errorBodyInvalid, http.StatusBadRequest)
+		return
+	}
+
+	if req.Domain == "" {
+		httpError(w, "Domain not specified.", errorDomainMissing, http.StatusBadRequest)
+		return
+	}
+	domain, err := normalizeDomain(req.Domain)
+	if err != nil {
+		msg := fmt.Sprintf("Invalid domain %q. (%s)\n", req.Domain, err)
+		httpError(w, msg, errorDomainInvalid, http.StatusBadRequest)
+		return
+	}
+	if req.IncludeSubdomains {
+		if _, err := publicsuffix.EffectiveTLDPlusOne(domain); err != nil {
+			msg := fmt.Sprintf("Cannot subscribe to all subdomains of %s. (%s)\n", domain, err)
+			httpError(w, msg, errorDomainInvalid, http.StatusBadRequest)
+			return
+		}
+	}
+	for _, status := range req.Statuses {
+		if !subscribableStatuses[status] {
+			msg := fmt.Sprintf("Invalid status %q.\n", status)
+			httpError(w, msg, errorBodyInvalid, http.StatusBadRequest)
+			return
+		}
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil {
+		msg := fmt.Sprintf("Invalid webhook URL %q. Requires an https:// URL.\n", req.URL)
+		httpError(w, msg, errorBodyInvalid, http.StatusBadRequest)
+		return
+	}
+	// Host names are checked when events are posted, once they have been
+	// resolved.
+	if addr, err := netip.ParseAddr(u.Hostname()); (err == nil && !isPublicAddr(addr)) || strings.EqualFold(u.Hostname(), "localhost") {
+		msg := fmt.Sprintf("Invalid webhook URL %q. Requires a public host.\n", req.URL)
+		httpError(w, msg, errorBodyInvalid, http.StatusBadRequest)
+		return
+	}
+
+	// Verifying ownership connects to the domain.
+	if cont := api.limitDomains(w, []string{domain}); !cont {
+		return
+	}
+	if api.ownership != nil {
+		if err := api.ownership.verify(r.Context(), domain, time.Now()); err != nil {
+			token, _ := api.ownership.token(domain, time.Now())
+			httpError(w, ownershipUnverifiedIssue(domain, token, err).Message, errorOwnershipUnverified, http.StatusForbidden)
+			return
+		}
+	}
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	subscription := database.Subscription{
+		ID:                database.NewID(),
+		Domain:            domain,
+		IncludeSubdomains: req.IncludeSubdomains,
+		Statuses:          req.Statuses,
+		URL:               req.URL,
+		Secret:            hex.EncodeToString(secret),
+		Created:           time.Now(),
+	}
+	if err := api.database.PutSubscription(r.Context(), subscription); err != nil {
+		msg := fmt.Sprintf("Internal error: could not save subscription. (%s)\n", err)
+		httpError(w, msg, errorDatabase, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	writeJSONOrBust(w, NewSubscription{subscription, subscription.Secret})
+}
+
+// Unsubscribe deletes a webhook subscription. It requires the secret of
+// the subscription (or the admin token) as a bearer token.
+//
+// Example: POST /webhooks/unsubscribe?id=0123456789abcdef0123456789abcdef
+func (api API) Unsubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Wrong method. Requires POST.", errorMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		httpError(w, "Subscription ID not specified.", errorIDMissing, http.StatusBadRequest)
+		return
+	}
+
+	subscriptions, err := api.database.Subscriptions(r.Context())
+	if err != nil {
+		msg := fmt.Sprintf("Internal error: could not retrieve subscriptions. (%s)\n", err)
+		httpError(w, msg, errorDatabase, http.StatusInternalServerError)
+		return
+	}
+	var subscription *database.Subscription
+	for i := range subscriptions {
+		if subscriptions[i].ID == id {
+			subscription = &subscriptions[i]
+		}
+	}
+	if subscription == nil {
+		msg := fmt.Sprintf("Unknown subscription %q.\n", id)
+		httpError(w, msg, errorSubscriptionUnknown, http.StatusNotFound)
+		return
+	}
+
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(subscription.Secret)) != 1 && !api.isAdmin(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		httpError(w, "The subscription secret is required.", errorSecretRequired, http.StatusUnauthorized)
+		return
+	}
+
+	if err := api.database.DeleteSubscription(r.Context(), id); err != nil {
+		msg := fmt.Sprintf("Internal error: could not delete subscription. (%s)\n", err)
+		httpError(w, msg, errorDatabase, http.StatusInternalServerError)
+		return
+	}
+	writeJSONOrBust(w, subscription)
+}
+
+// WebhookDispatch summarizes a call to DispatchWebhooks.
+type WebhookDispatch struct {
+	// Delivered is the number of events that were posted.
+	Delivered int `json:"delivered"`
+	// Retrying is the number of events that failed, and will be retried.
+	Retrying int `json:"retrying"`
+	// Dropped is the number of events that were given up on, either
+	// because they failed too often or because their subscription was
+	// deleted.
+	Dropped int `json:"dropped"`
+}
+
+// DispatchWebhooks posts the webhook events that are due. Events are
+// posted at least once: an event can be posted again if the server stops
+// before recording that it was delivered.
+//
+// Example: GET /webhooks/dispatch
+func (api API) DispatchWebhooks(w http.ResponseWriter, r *http.Request) {
+	// ensures endpoint requests can only come from App Engine
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		httpError(w, "Only App Engine cron requests are allowed.", errorCronOnly, http.StatusForbidden)
+		return
+	}
+
+	dispatch, err := api.dispatchWebhooks(r.Context(), time.Now())
+	if err != nil {
+		msg := fmt.Sprintf("Internal error: could not retrieve webhook deliveries. (%s)\n", err)
+		httpError(w, msg, errorDatabase, http.StatusInternalServerError)
+		return
+	}
+	writeJSONOrBust(w, dispatch)
+}
+
+func (api API) dispatchWebhooks(ctx context.Context, now time.Time) (WebhookDispatch, error) {
+	var dispatch WebhookDispatch
+
+	subscriptions, err := api.database.Subscriptions(ctx)
+	if err != nil {
+		return dispatch, err
+	}
+	byID := map[string]database.Subscription{}
+	for _, s := range subscriptions {
+		byID[s.ID] = s
+	}
+
+	deliveries, err := api.database.DueDeliveries(ctx, now, maxDeliveriesPerDispatch)
+	if err != nil {
+		return dispatch, err
+	}
+
+	var lock sync.Mutex
+	work := make(chan database.Delivery)
+	var wg sync.WaitGroup
+	for i := 0; i < webhookWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range work {
+				result := api.deliver(ctx, byID, d, now)
+				lock.Lock()
+				switch result {
+				case delivered:
+					dispatch.Delivered++
+				case retrying:
+					dispatch.Retrying++
+				case dropped:
+					dispatch.Dropped++
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, d := range deliveries {
+		work <- d
+	}
+	close(work)
+	wg.Wait()
+
+	return dispatch, nil
+}
+
+type deliveryResult int
+
+const (
+	delivered deliveryResult = iota
+	retrying
+	dropped
+)
+
+// deliver posts a single event, and records the result.
+func (api API) deliver(ctx context.Context, subscriptions map[string]database.Subscription, d database.Delivery, now time.Time) deliveryResult {
+	subscription, ok := subscriptions[d.SubscriptionID]
+	if !ok {
+		api.deleteDelivery(ctx, d)
+		return dropped
+	}
+
+	err := api.postEvent(ctx, subscription, d)
+	if err == nil {
+		api.deleteDelivery(ctx, d)
+		return delivered
+	}
+
+	d.Attempts++
+	d.LastError = err.Error()
+	if d.Attempts >= maxDeliveryAttempts {
+		api.logger.Printf("Dropping webhook event %s for %s after %d attempts: %s", d.ID, subscription.URL, d.Attempts, err)
+		api.deleteDelivery(ctx, d)
+		return dropped
+	}
+	d.NextAttempt = now.Add(deliveryBackoff(d.Attempts))
+	if err := api.database.PutDelivery(ctx, d); err != nil {
+		api.logger.Printf("Could not record failed webhook event %s: %s", d.ID, err)
+	}
+	return retrying
+}
+
+func (api API) deleteDelivery(ctx context.Context, d database.Delivery) {
+	if err := api.database.DeleteDelivery(ctx, d.ID); err != nil {
+		api.logger.Printf("Could not delete webhook event %s: %s", d.ID, err)
+	}
+}
+
+// deliveryBackoff returns how long to wait before the next attempt, after
+// `attempts` failed attempts.
+func deliveryBackoff(attempts int) time.Duration {
+	backoff := minDeliveryBackoff
+	for i := 1; i < attempts && backoff < maxDeliveryBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxDeliveryBackoff)
+}
+
+// signEvent returns the signature header of an event `body` sent at
+// `timestamp`. The signature is an HMAC-SHA256 of the timestamp and the
+// body, so that subscribers can reject old events that are replayed.
+func signEvent(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// postEvent posts the event of `d` to the subscriber. Any response other
+// than a 2xx status is a failure.
+func (api API) postEvent(ctx context.Context, subscription database.Subscription, d database.Delivery) error {
+	event := d.Event
+	event.ID = d.ID
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set(webhookEventHeader, d.ID)
+	req.Header.Set(webhookSignatureHeader, signEvent(subscription.Secret, time.Now().Unix(), body))
+
+	resp, err := api.webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
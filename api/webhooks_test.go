@@ -0,0 +1,353 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chromium/hstspreload.org/database"
+)
+
+func TestSubscribe(t *testing.T) {
+	api, _, _, _ := mockAPI(0 * time.Second)
+
+	subscribe := func(body string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("POST", "", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest failed: %s", err)
+		}
+		w := httptest.NewRecorder()
+		JSONErrors(http.HandlerFunc(api.Subscribe)).ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		description string
+		body        string
+		wantCode    int
+		wantError   string
+	}{
+		{"invalid body", `{"domain":`, 400, errorBodyInvalid},
+		{"missing domain", `{"url": "https://hooks.test/"}`, 400, errorDomainMissing},
+		{"public suffix", `{"domain": "co.uk", "includeSubdomains": true, "url": "https://hooks.test/"}`, 400, errorDomainInvalid},
+		{"invalid status", `{"domain": "example.com", "statuses": ["unknown"], "url": "https://hooks.test/"}`, 400, errorBodyInvalid},
+		{"http URL", `{"domain": "example.com", "url": "http://hooks.test/"}`, 400, errorBodyInvalid},
+		{"private URL", `{"domain": "example.com", "url": "https://10.0.0.1/"}`, 400, errorBodyInvalid},
+		{"metadata server URL", `{"domain": "example.com", "url": "https://169.254.169.254/"}`, 400, errorBodyInvalid},
+		{"loopback URL", `{"domain": "example.com", "url": "https://[::1]:8443/"}`, 400, errorBodyInvalid},
+		{"localhost URL", `{"domain": "example.com", "url": "https://LOCALHOST/"}`, 400, errorBodyInvalid},
+		{"valid", `{"domain": "Example.COM", "includeSubdomains": true, "statuses": ["removed"], "url": "https://hooks.test/"}`, 201, ""},
+	}
+	for _, tt := range tests {
+		w := subscribe(tt.body)
+		if w.Code != tt.wantCode {
+			t.Errorf("[%s] Wrong status code: %d (%q)", tt.description, w.Code, w.Body.String())
+		}
+		if code := errorCode(w); code != tt.wantError {
+			t.Errorf("[%s] Wrong error code: %q", tt.description, code)
+		}
+	}
+
+	var created NewSubscription
+	if err := json.Unmarshal(subscribe(tests[len(tests)-1].body).Body.Bytes(), &created); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if created.ID == "" || created.Secret == "" || created.Domain != "example.com" || !created.IncludeSubdomains {
+		t.Errorf("Wrong subscription: %#v", created)
+	}
+	subscriptions, err := api.database.Subscriptions(context.Background())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(subscriptions) != 2 {
+		t.Errorf("Wrong number of subscriptions: %#v", subscriptions)
+	}
+
+	// With ownership verification, the token must be published first.
+	api.ownership = newFakeOwnershipChecker(t, fakeResolver{}, nil)
+	w := subscribe(`{"domain": "example.com", "url": "https://hooks.test/"}`)
+	if w.Code != http.StatusForbidden || errorCode(w) != errorOwnershipUnverified {
+		t.Errorf("Wrong response without verification: %d %q", w.Code, w.Body.String())
+	}
+	token, _ := api.ownership.token("example.com", time.Now())
+	api.ownership.resolver = fakeResolver{"_hstspreload-verification.example.com": {token}}
+	if w := subscribe(`{"domain": "example.com", "url": "https://hooks.test/"}`); w.Code != http.StatusCreated {
+		t.Errorf("Wrong status code after verification: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	api, _, _, _ := mockAPI(0 * time.Second)
+	api = api.WithAdminToken(testAdminToken)
+	for _, id := range []string{"first", "second"} {
+		if err := api.database.PutSubscription(context.Background(), database.Subscription{ID: id, Domain: "example.com", URL: "https://hooks.test/", Secret: id + "-secret"}); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	tests := []struct {
+		description string
+		id          string
+		token       string
+		wantCode    int
+	}{
+		{"missing ID", "", "", 400},
+		{"unknown ID", "third", "third-secret", 404},
+		{"no secret", "first", "", 401},
+		{"another subscription's secret", "first", "second-secret", 401},
+		{"secret", "first", "first-secret", 200},
+		{"admin token", "second", testAdminToken, 200},
+	}
+	for _, tt := range tests {
+		r, err := http.NewRequest("POST", "?id="+tt.id, nil)
+		if err != nil {
+			t.Fatalf("NewRequest failed: %s", err)
+		}
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		api.Unsubscribe(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("[%s] Wrong status code: %d", tt.description, w.Code)
+		}
+	}
+
+	subscriptions, err := api.database.Subscriptions(context.Background())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(subscriptions) != 0 {
+		t.Errorf("Subscriptions were not deleted: %#v", subscriptions)
+	}
+}
+
+// webhookReceiver records the events posted to it. It fails requests
+// while `fail` is set.
+type webhookReceiver struct {
+	lock       sync.Mutex
+	events     []database.Event
+	signatures []string
+	bodies     [][]byte
+	fail       bool
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wr.lock.Lock()
+	defer wr.lock.Unlock()
+
+	if wr.fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var event database.Event
+	if err := json.Unmarshal(body, &event); err != nil || r.Header.Get(webhookEventHeader) != event.ID {
+		http.Error(w, "bad event", http.StatusBadRequest)
+		return
+	}
+	wr.events = append(wr.events, event)
+	wr.signatures = append(wr.signatures, r.Header.Get(webhookSignatureHeader))
+	wr.bodies = append(wr.bodies, body)
+}
+
+func TestDispatchWebhooks(t *testing.T) {
+	api, _, _, _ := mockAPI(0 * time.Second)
+	receiver := &webhookReceiver{}
+	server := httptest.NewTLSServer(receiver)
+	defer server.Close()
+	api.webhookClient = server.Client()
+
+	ctx := context.Background()
+	for _, s := range []database.Subscription{
+		{ID: "org", Domain: "example.com", IncludeSubdomains: true, URL: server.URL + "/hook", Secret: "secret"},
+		{ID: "removed-only", Domain: "example.com", Statuses: []database.PreloadStatus{database.StatusRemoved}, URL: server.URL + "/removed", Secret: "secret"},
+	} {
+		if err := api.database.PutSubscription(ctx, s); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	userCtx := database.WithActor(ctx, database.ActorUser, "Submitted for preloading.")
+	if err := api.database.PutStates(userCtx, []database.DomainState{
+		{Name: "www.example.com", Status: database.StatusPending},
+		{Name: "other.test", Status: database.StatusPending},
+	}, func(format string, args ...interface{}) {}); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	r, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %s", err)
+	}
+	w := httptest.NewRecorder()
+	api.DispatchWebhooks(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Wrong status code without the cron header: %d", w.Code)
+	}
+
+	dispatch := func(now time.Time) WebhookDispatch {
+		t.Helper()
+		d, err := api.dispatchWebhooks(ctx, now)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		return d
+	}
+
+	r.Header.Set("X-Appengine-Cron", "true")
+	w = httptest.NewRecorder()
+	api.DispatchWebhooks(w, r)
+	var got WebhookDispatch
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if got != (WebhookDispatch{Delivered: 1}) {
+		t.Errorf("Wrong dispatch: %#v", got)
+	}
+	if len(receiver.events) != 1 {
+		t.Fatalf("Wrong events: %#v", receiver.events)
+	}
+	event := receiver.events[0]
+	if event.Domain != "www.example.com" || event.OldStatus != database.StatusUnknown || event.NewStatus != database.StatusPending ||
+		event.Actor != database.ActorUser || event.Message != "Submitted for preloading." {
+		t.Errorf("Wrong event: %#v", event)
+	}
+	var timestamp int64
+	if _, err := fmt.Sscanf(receiver.signatures[0], "t=%d,", &timestamp); err != nil {
+		t.Fatalf("Wrong signature %q: %s", receiver.signatures[0], err)
+	}
+	if receiver.signatures[0] != signEvent("secret", timestamp, receiver.bodies[0]) {
+		t.Errorf("Wrong signature: %q", receiver.signatures[0])
+	}
+	if got := dispatch(time.Now()); got != (WebhookDispatch{}) {
+		t.Errorf("Delivered events were dispatched again: %#v", got)
+	}
+
+	// Failed events are retried with backoff.
+	if err := api.database.PutState(ctx, database.DomainState{Name: "example.com", Status: database.StatusPreloaded}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if got := dispatch(time.Now()); got != (WebhookDispatch{Delivered: 1}) {
+		t.Errorf("Wrong dispatch: %#v", got)
+	}
+	receiver.fail = true
+	if err := api.database.PutState(ctx, database.DomainState{Name: "example.com", Status: database.StatusRemoved}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	now := time.Now()
+	if got := dispatch(now); got != (WebhookDispatch{Retrying: 2}) {
+		t.Errorf("Wrong dispatch of failing events: %#v", got)
+	}
+	if got := dispatch(now.Add(minDeliveryBackoff / 2)); got != (WebhookDispatch{}) {
+		t.Errorf("Failed events were retried too soon: %#v", got)
+	}
+	deliveries, err := api.database.DueDeliveries(ctx, now.Add(minDeliveryBackoff), 10)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(deliveries) != 2 || deliveries[0].Attempts != 1 || !strings.Contains(deliveries[0].LastError, "503") {
+		t.Errorf("Wrong deliveries after a failure: %#v", deliveries)
+	}
+
+	// Events of deleted subscriptions are dropped, and the others are
+	// delivered once the subscriber recovers.
+	if err := api.database.DeleteSubscription(ctx, "removed-only"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	receiver.fail = false
+	if got := dispatch(now.Add(minDeliveryBackoff)); got != (WebhookDispatch{Delivered: 1, Dropped: 1}) {
+		t.Errorf("Wrong dispatch after recovering: %#v", got)
+	}
+	if len(receiver.events) != 3 || receiver.events[2].NewStatus != database.StatusRemoved {
+		t.Errorf("Wrong events: %#v", receiver.events)
+	}
+
+	// Events are dropped after too many attempts.
+	if err := api.database.PutDelivery(ctx, database.Delivery{ID: "last", SubscriptionID: "org", Attempts: maxDeliveryAttempts - 1, NextAttempt: now}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	receiver.fail = true
+	if got := dispatch(now); got != (WebhookDispatch{Dropped: 1}) {
+		t.Errorf("Wrong dispatch of an event that failed too often: %#v", got)
+	}
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:8.8.8.8", true},
+	}
+	for _, tt := range tests {
+		if got := isPublicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isPublicAddr(%s) = %t, want %t", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestPublicClientRefusesNonPublicAddresses(t *testing.T) {
+	server := httptest.NewTLSServer(&webhookReceiver{})
+	defer server.Close()
+
+	// The host name resolves to the test server on the loopback address.
+	url := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	resp, err := newPublicClient(webhookTimeout).Post(url, "application/json", strings.NewReader("{}"))
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("Posted to %s", url)
+	}
+	if !strings.Contains(err.Error(), "non-public address") {
+		t.Errorf("Wrong error: %s", err)
+	}
+}
+
+func TestDeliveryBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{5, 16 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, maxDeliveryBackoff},
+		{100, maxDeliveryBackoff},
+	}
+	for _, tt := range tests {
+		if got := deliveryBackoff(tt.attempts); got != tt.want {
+			t.Errorf("deliveryBackoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+
+	// The total delay before an event is dropped is about two days.
+	total := time.Duration(0)
+	for attempts := 1; attempts < maxDeliveryAttempts; attempts++ {
+		total += deliveryBackoff(attempts)
+	}
+	if total < 36*time.Hour || total > 60*time.Hour {
+		t.Errorf("Events are retried for %s", total)
+	}
+}
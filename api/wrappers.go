@@ -43,6 +43,8 @@ type mockHstspreload struct {
 	preloadableResponses map[string]hstspreload.Issues
 	eligibleResponses    map[string]hstspreload.Issues
 	removableResponses   map[string]hstspreload.Issues
+	// The header returned by PreloadableDomain and EligibleDomain, if any.
+	preloadableHeaders map[string]string
 }
 type mockPreloadlist struct {
 	list      preloadlist.PreloadList
@@ -50,10 +52,18 @@ type mockPreloadlist struct {
 }
 
 func (h mockHstspreload) PreloadableDomain(domain string) (*string, hstspreload.Issues) {
+	if header, ok := h.preloadableHeaders[domain]; ok {
+		return &header, h.preloadableResponses[domain]
+	}
 	return nil, h.preloadableResponses[domain]
 }
 func (h mockHstspreload) EligibleDomain(domain string, policy preloadlist.PolicyType) (*string, hstspreload.Issues) {
-	return nil, h.eligibleResponses[domain]
+	if issues, ok := h.eligibleResponses[domain]; ok {
+		return nil, issues
+	}
+	// Like the actual PreloadableDomain, which checks eligibility for
+	// bulk-1-year, fall back to the preloadable verdict.
+	return h.PreloadableDomain(domain)
 }
 func (h mockHstspreload) RemovableDomain(domain string) (*string, hstspreload.Issues) {
 	return nil, h.removableResponses[domain]
@@ -0,0 +1,885 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"iter"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// domainStateByStatusBucket indexes DomainState keys by status. Its
+	// keys are status + "\x00" + name, and its values are empty.
+	domainStateByStatusBucket = "DomainStateByStatus"
+
+	boltOpenTimeout = 5 * time.Second
+)
+
+// boltBuckets are the top-level buckets of a BoltBacked database. The
+// transitions bucket holds one nested bucket per domain, whose keys are
+// sequence numbers in write order.
+var boltBuckets = []string{domainStateKind, ineligibleDomainStateKind, domainStateByStatusBucket, transitionKind, migrationKind, counterKind, subscriptionKind, deliveryKind, jobKind}
+
+// BoltBacked is a database stored in a single local file using an
+// embedded key-value store. It is intended for self-hosted deployments
+// that don't have access to Google Cloud Datastore.
+//
+// Each entity kind is kept in its own bucket, keyed by domain name, so
+// iteration follows the same key order as Datastore.
+type BoltBacked struct {
+	db *bolt.DB
+}
+
+// BoltDatabase opens (or creates) the database file at `path`.
+// When there is no error, make sure to call shutdown() in order to
+// release the file.
+func BoltDatabase(path string) (db BoltBacked, shutdown func() error, err error) {
+	shutdown = func() error { return nil }
+
+	boltDB, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return db, shutdown, err
+	}
+
+	err = boltDB.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		boltDB.Close()
+		return db, shutdown, err
+	}
+
+	return BoltBacked{boltDB}, boltDB.Close, nil
+}
+
+// reset empties the database. It is used by tests.
+func (db BoltBacked) reset() error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range boltBuckets {
+			if err := tx.DeleteBucket([]byte(bucket)); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func encodeValue(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeValue(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+func statusIndexKey(status PreloadStatus, name string) []byte {
+	return []byte(string(status) + "\x00" + name)
+}
+
+// putDomainState writes a single state and keeps the status index in sync.
+func putDomainState(tx *bolt.Tx, state DomainState) error {
+	states := tx.Bucket([]byte(domainStateKind))
+	index := tx.Bucket([]byte(domainStateByStatusBucket))
+
+	if old := states.Get([]byte(state.Name)); old != nil {
+		var oldState DomainState
+		if err := decodeValue(old, &oldState); err != nil {
+			return err
+		}
+		if err := index.Delete(statusIndexKey(oldState.Status, state.Name)); err != nil {
+			return err
+		}
+	}
+
+	state.SubmissionDate = truncateTime(state.SubmissionDate)
+	value, err := encodeValue(state)
+	if err != nil {
+		return err
+	}
+	if err := states.Put([]byte(state.Name), value); err != nil {
+		return err
+	}
+	return index.Put(statusIndexKey(state.Status, state.Name), []byte{})
+}
+
+// putTransition appends a transition to its domain's history.
+func putTransition(tx *bolt.Tx, t Transition) error {
+	history, err := tx.Bucket([]byte(transitionKind)).CreateBucketIfNotExists([]byte(t.Name))
+	if err != nil {
+		return err
+	}
+	seq, err := history.NextSequence()
+	if err != nil {
+		return err
+	}
+	value, err := encodeValue(t)
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return history.Put(key, value)
+}
+
+// getDomainState looks up a single state. It returns
+// datastore.ErrNoSuchEntity if there is no state for `domain`.
+func getDomainState(tx *bolt.Tx, domain string) (state DomainState, err error) {
+	value := tx.Bucket([]byte(domainStateKind)).Get([]byte(domain))
+	if value == nil {
+		return state, datastore.ErrNoSuchEntity
+	}
+	if err := decodeValue(value, &state); err != nil {
+		return state, err
+	}
+	state.Name = domain
+	return state, nil
+}
+
+// PutStates updates the given domain updates in batches.
+// Writes updates to logf in real-time.
+func (db BoltBacked) PutStates(ctx context.Context, updates []DomainState, logf func(format string, args ...interface{})) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(updates) == 0 {
+		logf("No updates.\n")
+		return nil
+	}
+	if err := checkDuplicateNames(updates); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(updates); i += batchSize {
+		if err := ctx.Err(); err != nil {
+			return partialCommitError(updates, i, err)
+		}
+		batch := updates[i:min(i+batchSize, len(updates))]
+		logf("Updating %d entries...", len(batch))
+
+		err := db.db.Update(func(tx *bolt.Tx) error {
+			return putBatch(ctx, tx, batch)
+		})
+		if err != nil {
+			logf(" failed: %v\n", err)
+			return partialCommitError(updates, i, err)
+		}
+		logf(" done.\n")
+	}
+	return nil
+}
+
+// putBatch writes the given states, and records their transitions and
+// counts.
+func putBatch(ctx context.Context, tx *bolt.Tx, batch []DomainState) error {
+	stored := map[string]DomainState{}
+	for _, state := range batch {
+		old, err := getDomainState(tx, state.Name)
+		if err == nil {
+			stored[state.Name] = old
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+	if err := checkTransitions(ctx, stored, batch); err != nil {
+		return err
+	}
+
+	transitions := newTransitions(ctx, stored, batch)
+	for _, t := range transitions {
+		if err := putTransition(tx, t); err != nil {
+			return err
+		}
+	}
+	subscriptions, err := boltSubscriptions(tx)
+	if err != nil {
+		return err
+	}
+	for _, d := range newDeliveries(subscriptions, transitions) {
+		if err := putBoltDelivery(tx, d); err != nil {
+			return err
+		}
+	}
+	if err := addBoltCounters(tx, counterDeltas(stored, batch)); err != nil {
+		return err
+	}
+
+	for _, state := range batch {
+		if err := putDomainState(tx, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreStates writes `states` as they are, in batches, without checking
+// or recording their transitions, queueing webhook deliveries or updating
+// the stats counters. It is meant for restoring a backup.
+func (db BoltBacked) RestoreStates(ctx context.Context, states []DomainState, logf func(format string, args ...interface{})) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(states) == 0 {
+		logf("No updates.\n")
+		return nil
+	}
+	if err := checkDuplicateNames(states); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(states); i += batchSize {
+		if err := ctx.Err(); err != nil {
+			return partialCommitError(states, i, err)
+		}
+		batch := states[i:min(i+batchSize, len(states))]
+		logf("Restoring %d entries...", len(batch))
+
+		err := db.db.Update(func(tx *bolt.Tx) error {
+			for _, state := range batch {
+				if err := putDomainState(tx, state); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			logf(" failed: %v\n", err)
+			return partialCommitError(states, i, err)
+		}
+		logf(" done.\n")
+	}
+	return nil
+}
+
+// PutState is a convenience version of PutStates for a single domain.
+func (db BoltBacked) PutState(ctx context.Context, update DomainState) error {
+	return db.PutStates(ctx, []DomainState{update}, blackholeLogf)
+}
+
+// PutStateIfUnchanged writes `update` in a single transaction, but only if
+// the stored state of the domain still matches `old`. Otherwise, it
+// returns ErrStateChanged.
+func (db BoltBacked) PutStateIfUnchanged(ctx context.Context, old DomainState, update DomainState) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return db.db.Update(func(tx *bolt.Tx) error {
+		stored, err := getDomainState(tx, update.Name)
+		if err == datastore.ErrNoSuchEntity {
+			stored = DomainState{Status: StatusUnknown}
+		} else if err != nil {
+			return err
+		}
+		if !unchanged(stored, old) {
+			return ErrStateChanged
+		}
+		return putBatch(ctx, tx, []DomainState{update})
+	})
+}
+
+// StateForDomain get the state for the given domain.
+// Note that the Name field of `state` will not be set.
+func (db BoltBacked) StateForDomain(ctx context.Context, domain string) (state DomainState, err error) {
+	if err := ctx.Err(); err != nil {
+		return DomainState{}, err
+	}
+
+	err = db.db.View(func(tx *bolt.Tx) error {
+		state, err = getDomainState(tx, domain)
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return DomainState{Status: StatusUnknown}, nil
+	}
+	state.Name = ""
+	return state, err
+}
+
+// StatesForDomains returns the domains states for the given domains.
+// Like DatastoreBacked, it fails with a datastore.MultiError if any of the
+// domains is not in the database.
+func (db BoltBacked) StatesForDomains(ctx context.Context, domains []string) (states []DomainState, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	err = db.db.View(func(tx *bolt.Tx) error {
+		for i := 0; i < len(domains); i += batchSize {
+			batch := domains[i:min(i+batchSize, len(domains))]
+			multiErr := make(datastore.MultiError, len(batch))
+			missing := false
+			for j, domain := range batch {
+				state, err := getDomainState(tx, domain)
+				if err == datastore.ErrNoSuchEntity {
+					multiErr[j] = err
+					missing = true
+				} else if err != nil {
+					return err
+				}
+				state.Name = domain
+				states = append(states, state)
+			}
+			if missing {
+				return multiErr
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// boltPages iterates over the entries of `bucket`, starting at key `start`.
+// It reads pageSize entries per read transaction, so that callers can
+// write to the database while iterating (a write inside a read transaction
+// would deadlock). `decode` converts an entry to a value, and returns
+// more == false at the first key past the end of the iteration.
+func boltPages[T any](ctx context.Context, db *bolt.DB, bucket string, start []byte, decode func(tx *bolt.Tx, k, v []byte) (value T, more bool, err error)) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+		var last []byte
+		for {
+			if err := ctx.Err(); err != nil {
+				yield(zero, err)
+				return
+			}
+
+			var page []T
+			done := true
+			err := db.View(func(tx *bolt.Tx) error {
+				c := tx.Bucket([]byte(bucket)).Cursor()
+				k, v := c.Seek(start)
+				if last != nil && bytes.Equal(k, last) {
+					k, v = c.Next()
+				}
+				for ; k != nil; k, v = c.Next() {
+					if len(page) == pageSize {
+						done = false
+						return nil
+					}
+					value, more, err := decode(tx, k, v)
+					if err != nil {
+						return err
+					}
+					if !more {
+						return nil
+					}
+					page = append(page, value)
+					last = append([]byte(nil), k...)
+				}
+				return nil
+			})
+			if err != nil {
+				yield(zero, err)
+				return
+			}
+
+			for _, value := range page {
+				if !yield(value, nil) {
+					return
+				}
+			}
+			if done {
+				return
+			}
+			start = last
+		}
+	}
+}
+
+// AllDomainStates gets the states of all domains in the database.
+func (db BoltBacked) AllDomainStates(ctx context.Context) (states []DomainState, err error) {
+	return collect(db.IterateDomainStates(ctx, "", ""))
+}
+
+// DomainStatesInRange returns the states of domains whose names are in the
+// half-open interval [start, end). An empty start or end leaves that side
+// of the interval unbounded.
+func (db BoltBacked) DomainStatesInRange(ctx context.Context, start, end string) ([]DomainState, error) {
+	return collect(db.IterateDomainStates(ctx, start, end))
+}
+
+// StatesWithStatus returns the states of domains with the given status in the database.
+func (db BoltBacked) StatesWithStatus(ctx context.Context, status PreloadStatus) (domains []DomainState, err error) {
+	return collect(db.IterateStatesWithStatus(ctx, status))
+}
+
+// IterateDomainStates iterates over the states of domains whose names are
+// in the half-open interval [start, end), in key order. An empty start or
+// end leaves that side of the interval unbounded.
+func (db BoltBacked) IterateDomainStates(ctx context.Context, start, end string) iter.Seq2[DomainState, error] {
+	return boltPages(ctx, db.db, domainStateKind, []byte(start), func(tx *bolt.Tx, k, v []byte) (state DomainState, more bool, err error) {
+		if end != "" && string(k) >= end {
+			return state, false, nil
+		}
+		if err := decodeValue(v, &state); err != nil {
+			return state, false, err
+		}
+		state.Name = string(k)
+		return state, true, nil
+	})
+}
+
+// IterateStatesWithStatus iterates over the states of domains with the
+// given status, in key order.
+func (db BoltBacked) IterateStatesWithStatus(ctx context.Context, status PreloadStatus) iter.Seq2[DomainState, error] {
+	prefix := statusIndexKey(status, "")
+	return boltPages(ctx, db.db, domainStateByStatusBucket, prefix, func(tx *bolt.Tx, k, v []byte) (state DomainState, more bool, err error) {
+		if !bytes.HasPrefix(k, prefix) {
+			return state, false, nil
+		}
+		state, err = getDomainState(tx, string(k[len(prefix):]))
+		return state, err == nil, err
+	})
+}
+
+// GetIneligibleDomainStates returns the state for the given domain.
+func (db BoltBacked) GetIneligibleDomainStates(ctx context.Context, domains []string) (states []IneligibleDomainState, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	err = db.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(ineligibleDomainStateKind))
+		for i := 0; i < len(domains); i += batchSize {
+			batch := domains[i:min(i+batchSize, len(domains))]
+			multiErr := make(datastore.MultiError, len(batch))
+			missing := false
+			for j, domain := range batch {
+				var state IneligibleDomainState
+				if value := bucket.Get([]byte(domain)); value == nil {
+					multiErr[j] = datastore.ErrNoSuchEntity
+					missing = true
+				} else if err := decodeValue(value, &state); err != nil {
+					return err
+				}
+				state.Name = domain
+				states = append(states, state)
+			}
+			if missing {
+				return multiErr
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// SetIneligibleDomainStates updates the given domains updates in batches.
+// Writes updates to logf in real-time.
+func (db BoltBacked) SetIneligibleDomainStates(ctx context.Context, updates []IneligibleDomainState, logf func(format string, args ...interface{})) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for i := 0; i == 0 || i < len(updates); i += batchSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch := updates[i:min(i+batchSize, len(updates))]
+		logf("Updating %d entries...", len(batch))
+
+		var names []string
+		for _, state := range batch {
+			names = append(names, state.Name)
+		}
+		if hasDuplicateNames(names) {
+			logf(" failed: %v\n", errDuplicateMutation)
+			return errDuplicateMutation
+		}
+
+		err := db.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(ineligibleDomainStateKind))
+			for _, state := range batch {
+				value, err := encodeValue(copyIneligibleDomainState(state))
+				if err != nil {
+					return err
+				}
+				if err := bucket.Put([]byte(state.Name), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			logf(" failed: %v\n", err)
+			return err
+		}
+		logf(" done.\n")
+	}
+	return nil
+}
+
+// DeleteIneligibleDomainStates deletes the state for the given domain from the database
+func (db BoltBacked) DeleteIneligibleDomainStates(ctx context.Context, domains []string) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return db.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(ineligibleDomainStateKind))
+		for _, domain := range domains {
+			if err := bucket.Delete([]byte(domain)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetAllIneligibleDomainStates returns all the ineligible domains in the database
+func (db BoltBacked) GetAllIneligibleDomainStates(ctx context.Context) (states []IneligibleDomainState, err error) {
+	return collect(db.IterateIneligibleDomainStates(ctx))
+}
+
+// IterateIneligibleDomainStates iterates over all the ineligible domains in
+// the database, in key order.
+func (db BoltBacked) IterateIneligibleDomainStates(ctx context.Context) iter.Seq2[IneligibleDomainState, error] {
+	return boltPages(ctx, db.db, ineligibleDomainStateKind, nil, func(tx *bolt.Tx, k, v []byte) (state IneligibleDomainState, more bool, err error) {
+		if err := decodeValue(v, &state); err != nil {
+			return state, false, err
+		}
+		state.Name = string(k)
+		return state, true, nil
+	})
+}
+
+// TransitionsForDomain returns the status history of the given domain, in
+// chronological order.
+func (db BoltBacked) TransitionsForDomain(ctx context.Context, domain string) (transitions []Transition, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	err = db.db.View(func(tx *bolt.Tx) error {
+		history := tx.Bucket([]byte(transitionKind)).Bucket([]byte(domain))
+		if history == nil {
+			return nil
+		}
+		return history.ForEach(func(k, v []byte) error {
+			var t Transition
+			if err := decodeValue(v, &t); err != nil {
+				return err
+			}
+			t.Name = domain
+			transitions = append(transitions, t)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortTransitions(transitions)
+	return transitions, nil
+}
+
+func migrationRecordKey(version int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(version))
+	return key
+}
+
+// MigrationRecords returns the records of all migrations that have started.
+func (db BoltBacked) MigrationRecords(ctx context.Context) (records []MigrationRecord, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	err = db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(migrationKind)).ForEach(func(k, v []byte) error {
+			var record MigrationRecord
+			if err := decodeValue(v, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// PutMigrationRecord stores the progress of a migration.
+func (db BoltBacked) PutMigrationRecord(ctx context.Context, record MigrationRecord) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return db.db.Update(func(tx *bolt.Tx) error {
+		record.Updated = truncateTime(record.Updated)
+		value, err := encodeValue(record)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(migrationKind)).Put(migrationRecordKey(record.Version), value)
+	})
+}
+
+// addBoltCounters adds `deltas` to the counters in the counter bucket.
+// Counters that drop to zero are deleted.
+func addBoltCounters(tx *bolt.Tx, deltas map[string]int) error {
+	bucket := tx.Bucket([]byte(counterKind))
+	for name, delta := range deltas {
+		count := 0
+		if v := bucket.Get([]byte(name)); v != nil {
+			if err := decodeValue(v, &count); err != nil {
+				return err
+			}
+		}
+		count += delta
+		if count == 0 {
+			if err := bucket.Delete([]byte(name)); err != nil {
+				return err
+			}
+			continue
+		}
+		value, err := encodeValue(count)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(name), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns the counts of domain states kept by the database.
+func (db BoltBacked) Stats(ctx context.Context) (Stats, error) {
+	if err := ctx.Err(); err != nil {
+		return Stats{}, err
+	}
+
+	counters := map[string]int{}
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(counterKind)).ForEach(func(k, v []byte) error {
+			count := 0
+			if err := decodeValue(v, &count); err != nil {
+				return err
+			}
+			counters[string(k)] = count
+			return nil
+		})
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+	return statsFromCounters(counters), nil
+}
+
+// SetStats replaces all of the stored counters with `stats`.
+func (db BoltBacked) SetStats(ctx context.Context, stats Stats) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return db.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(counterKind)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket([]byte(counterKind)); err != nil {
+			return err
+		}
+		return addBoltCounters(tx, countersFromStats(stats))
+	})
+}
+
+// boltSubscriptions returns all webhook subscriptions, in key order.
+func boltSubscriptions(tx *bolt.Tx) (subscriptions []Subscription, err error) {
+	err = tx.Bucket([]byte(subscriptionKind)).ForEach(func(k, v []byte) error {
+		var subscription Subscription
+		if err := decodeValue(v, &subscription); err != nil {
+			return err
+		}
+		subscription.ID = string(k)
+		subscriptions = append(subscriptions, subscription)
+		return nil
+	})
+	return subscriptions, err
+}
+
+// putBoltDelivery writes a webhook delivery under its ID.
+func putBoltDelivery(tx *bolt.Tx, delivery Delivery) error {
+	value, err := encodeValue(truncateDelivery(delivery))
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(deliveryKind)).Put([]byte(delivery.ID), value)
+}
+
+// Subscriptions returns all webhook subscriptions.
+func (db BoltBacked) Subscriptions(ctx context.Context) (subscriptions []Subscription, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	err = db.db.View(func(tx *bolt.Tx) error {
+		subscriptions, err = boltSubscriptions(tx)
+		return err
+	})
+	return subscriptions, err
+}
+
+// PutSubscription stores a webhook subscription under its ID.
+func (db BoltBacked) PutSubscription(ctx context.Context, subscription Subscription) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return db.db.Update(func(tx *bolt.Tx) error {
+		value, err := encodeValue(copySubscription(subscription))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(subscriptionKind)).Put([]byte(subscription.ID), value)
+	})
+}
+
+// DeleteSubscription deletes a webhook subscription. Its remaining
+// deliveries are dropped when they are next due.
+func (db BoltBacked) DeleteSubscription(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(subscriptionKind)).Delete([]byte(id))
+	})
+}
+
+// DueDeliveries returns at most `limit` of the webhook deliveries that are
+// due at `now`, in order of their next attempt.
+func (db BoltBacked) DueDeliveries(ctx context.Context, now time.Time, limit int) ([]Delivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var deliveries []Delivery
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(deliveryKind)).ForEach(func(k, v []byte) error {
+			var delivery Delivery
+			if err := decodeValue(v, &delivery); err != nil {
+				return err
+			}
+			delivery.ID = string(k)
+			deliveries = append(deliveries, delivery)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dueDeliveries(deliveries, now, limit), nil
+}
+
+// PutDelivery stores a webhook delivery under its ID.
+func (db BoltBacked) PutDelivery(ctx context.Context, delivery Delivery) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return putBoltDelivery(tx, delivery)
+	})
+}
+
+// DeleteDelivery deletes a webhook delivery. Deleting a missing delivery
+// is not an error.
+func (db BoltBacked) DeleteDelivery(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(deliveryKind)).Delete([]byte(id))
+	})
+}
+
+// Job returns the preloadable job with the given ID, or ErrNoSuchJob.
+func (db BoltBacked) Job(ctx context.Context, id string) (job Job, err error) {
+	if err := ctx.Err(); err != nil {
+		return Job{}, err
+	}
+
+	err = db.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte(jobKind)).Get([]byte(id))
+		if value == nil {
+			return ErrNoSuchJob
+		}
+		return decodeValue(value, &job)
+	})
+	if err != nil {
+		return Job{}, err
+	}
+	job.ID = id
+	return job, nil
+}
+
+// PutJob stores a preloadable job under its ID.
+func (db BoltBacked) PutJob(ctx context.Context, job Job) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return db.db.Update(func(tx *bolt.Tx) error {
+		value, err := encodeValue(copyJob(job))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(jobKind)).Put([]byte(job.ID), value)
+	})
+}
+
+// DeleteExpiredJobs deletes the preloadable jobs that have expired at
+// `now`.
+func (db BoltBacked) DeleteExpiredJobs(ctx context.Context, now time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return db.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(jobKind))
+		var jobs []Job
+		err := bucket.ForEach(func(k, v []byte) error {
+			var job Job
+			if err := decodeValue(v, &job); err != nil {
+				return err
+			}
+			job.ID = string(k)
+			jobs = append(jobs, job)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range expiredJobIDs(jobs, now) {
+			if err := bucket.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
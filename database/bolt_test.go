@@ -0,0 +1,56 @@
+package database
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltDatabaseReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hstspreload.db")
+
+	db, shutdown, err := BoltDatabase(path)
+	if err != nil {
+		t.Fatalf("could not open bolt database: %s", err)
+	}
+	if err := db.PutState(context.Background(), DomainState{Name: "a.test", Status: StatusPending}); err != nil {
+		t.Fatalf("cannot put state: %s", err)
+	}
+	// Changing the status must move the domain in the status index.
+	if err := db.PutState(context.Background(), DomainState{Name: "a.test", Status: StatusPreloaded}); err != nil {
+		t.Fatalf("cannot put state: %s", err)
+	}
+	if err := shutdown(); err != nil {
+		t.Fatalf("could not close bolt database: %s", err)
+	}
+
+	db, shutdown, err = BoltDatabase(path)
+	if err != nil {
+		t.Fatalf("could not reopen bolt database: %s", err)
+	}
+	defer shutdown()
+
+	state, err := db.StateForDomain(context.Background(), "a.test")
+	if err != nil {
+		t.Fatalf("error retrieving state: %s", err)
+	}
+	if state.Status != StatusPreloaded {
+		t.Errorf("Wrong status: %s", state.Status)
+	}
+
+	pending, err := db.StatesWithStatus(context.Background(), StatusPending)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("Stale status index entry: %#v", pending)
+	}
+
+	preloaded, err := db.StatesWithStatus(context.Background(), StatusPreloaded)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !MatchWanted(preloaded, []DomainState{{Name: "a.test", Status: StatusPreloaded}}) {
+		t.Errorf("Domains do not match wanted: %#v", preloaded)
+	}
+}
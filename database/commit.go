@@ -0,0 +1,120 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A PartialCommitError is returned by PutStates when one of its batches
+// could not be written. Batches are written in order, so the updates
+// before the failing batch have been committed and the others have not.
+// Passing the Uncommitted updates to PutStates again resumes the write.
+type PartialCommitError struct {
+	// Committed and Uncommitted are the names of the domains whose updates
+	// were and were not written, in the order they were passed in.
+	Committed   []string
+	Uncommitted []string
+	// Err is the error the failing batch failed with.
+	Err error
+}
+
+func (e *PartialCommitError) Error() string {
+	return fmt.Sprintf("committed %d of %d domain states: %v", len(e.Committed), len(e.Committed)+len(e.Uncommitted), e.Err)
+}
+
+func (e *PartialCommitError) Unwrap() error {
+	return e.Err
+}
+
+// partialCommitError returns a *PartialCommitError for a PutStates call
+// that wrote the first `committed` of `updates` before failing with `err`.
+func partialCommitError(updates []DomainState, committed int, err error) *PartialCommitError {
+	names := domainStateNames(updates)
+	return &PartialCommitError{
+		Committed:   names[:committed:committed],
+		Uncommitted: names[committed:],
+		Err:         err,
+	}
+}
+
+// ErrDuplicateName is returned (in a *PartialCommitError) by PutStates if
+// the same domain occurs more than once in its updates. Nothing is written
+// in that case.
+var ErrDuplicateName = errors.New("the same domain is updated more than once")
+
+// checkDuplicateNames returns an error for updates that PutStates must
+// reject because of ErrDuplicateName.
+func checkDuplicateNames(updates []DomainState) error {
+	if hasDuplicateNames(domainStateNames(updates)) {
+		return partialCommitError(updates, 0, ErrDuplicateName)
+	}
+	return nil
+}
+
+func domainStateNames(states []DomainState) []string {
+	names := make([]string, len(states))
+	for i, s := range states {
+		names[i] = s.Name
+	}
+	return names
+}
+
+// These are variables so that tests can make retries fast.
+var (
+	// putAttempts is the number of times DatastoreBacked.PutStates tries
+	// to write a batch before giving up.
+	putAttempts = 5
+	// putBackoff is the delay before the first retry of a batch. It
+	// doubles after every attempt.
+	putBackoff = time.Second
+)
+
+// retry calls `attempt` until it succeeds, it fails with an error that is
+// not worth retrying, or it has been called putAttempts times. Every call
+// gets its own timeout, and retries are spaced out with exponential
+// backoff.
+func retry(ctx context.Context, attempt func(c context.Context) error, logf func(format string, args ...interface{})) error {
+	delay := putBackoff
+	for i := 1; ; i++ {
+		c, cancel := context.WithTimeout(ctx, timeout)
+		err := attempt(c)
+		cancel()
+		if err == nil || i == putAttempts || !retryable(ctx, err) {
+			return err
+		}
+
+		logf(" failed: %v; retrying in %s...", err, delay)
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// retryable reports whether a write that failed with `err` may succeed if
+// it is tried again.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var invalid *InvalidTransitionError
+	if errors.As(err, &invalid) || errors.Is(err, errTooManyMutations) {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.PermissionDenied,
+		codes.Unauthenticated, codes.NotFound, codes.AlreadyExists, codes.OutOfRange,
+		codes.Unimplemented:
+		return false
+	}
+	return true
+}
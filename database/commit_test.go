@@ -0,0 +1,70 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetry(t *testing.T) {
+	defer func(backoff time.Duration) { putBackoff = backoff }(putBackoff)
+	putBackoff = time.Millisecond
+
+	errTransient := status.Error(codes.Unavailable, "try again")
+
+	tests := []struct {
+		description  string
+		errs         []error
+		wantErr      error
+		wantAttempts int
+	}{
+		{"success", nil, nil, 1},
+		{"transient failures", []error{errTransient, errTransient}, nil, 3},
+		{"too many failures", []error{errTransient, errTransient, errTransient, errTransient, errTransient, errTransient}, errTransient, putAttempts},
+		{"invalid argument", []error{errDuplicateMutation}, errDuplicateMutation, 1},
+		{"invalid transition", []error{&InvalidTransitionError{Name: "a.test"}}, &InvalidTransitionError{Name: "a.test"}, 1},
+		{"too many mutations", []error{errTooManyMutations}, errTooManyMutations, 1},
+		{"transitions changed", []error{errTransitionsChanged}, nil, 2},
+	}
+
+	for _, tt := range tests {
+		attempts := 0
+		err := retry(context.Background(), func(c context.Context) error {
+			if _, ok := c.Deadline(); !ok {
+				t.Errorf("[%s] Attempt %d has no deadline", tt.description, attempts)
+			}
+			attempts++
+			if attempts <= len(tt.errs) {
+				return tt.errs[attempts-1]
+			}
+			return nil
+		}, blackholeLogf)
+		if (err == nil) != (tt.wantErr == nil) || (err != nil && err.Error() != tt.wantErr.Error()) {
+			t.Errorf("[%s] Wrong error: got %v, want %v", tt.description, err, tt.wantErr)
+		}
+		if attempts != tt.wantAttempts {
+			t.Errorf("[%s] Wrong number of attempts: got %d, want %d", tt.description, attempts, tt.wantAttempts)
+		}
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	defer func(backoff time.Duration) { putBackoff = backoff }(putBackoff)
+	putBackoff = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errTransient := errors.New("transient")
+	attempts := 0
+	err := retry(ctx, func(c context.Context) error {
+		attempts++
+		cancel()
+		return errTransient
+	}, blackholeLogf)
+	if err != errTransient || attempts != 1 {
+		t.Errorf("Expected a single attempt after cancelling: got %d attempts and %v", attempts, err)
+	}
+}
@@ -0,0 +1,23 @@
+package database_test
+
+import (
+	"testing"
+
+	"github.com/chromium/hstspreload.org/database"
+	"github.com/chromium/hstspreload.org/database/databasetest"
+)
+
+// TestConformance runs the conformance suite against the backend selected
+// with -db.
+func TestConformance(t *testing.T) {
+	databasetest.Run(t, func(t *testing.T) database.Database {
+		return database.SharedTestDB()
+	})
+}
+
+func TestMockConformance(t *testing.T) {
+	databasetest.Run(t, func(t *testing.T) database.Database {
+		db, _ := database.NewMock()
+		return db
+	})
+}
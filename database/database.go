@@ -2,10 +2,18 @@ package database
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/datastore"
 	"github.com/chromium/hstspreload.org/database/gcd"
+	"google.golang.org/api/iterator"
 )
 
 const (
@@ -14,6 +22,13 @@ const (
 	batchSize = 450
 	timeout   = 90 * time.Second
 
+	// putStatesBatchSize is the number of states PutStates writes in each
+	// transaction. With their transitions, events and counters, they have
+	// to fit in maxMutations.
+	putStatesBatchSize = 200
+	// maxMutations is the most entities a single commit can write.
+	maxMutations = 500
+
 	domainStateKind           = "DomainState"
 	ineligibleDomainStateKind = "IneligibleDomainState"
 )
@@ -21,61 +36,135 @@ const (
 // A Database is an abstraction over Datastore with hstspreload-specific
 // database functions.
 type Database interface {
-	PutStates([]DomainState, func(string, ...interface{})) error
-	PutState(DomainState) error
-	StateForDomain(string) (DomainState, error)
-	StatesForDomains([]string) ([]DomainState, error)
-	AllDomainStates() ([]DomainState, error)
-	DomainStatesInRange(start, end string) ([]DomainState, error)
-	StatesWithStatus(PreloadStatus) ([]DomainState, error)
-	GetIneligibleDomainStates(domains []string) (states []IneligibleDomainState, err error)
-	SetIneligibleDomainStates(updates []IneligibleDomainState, logf func(format string, args ...interface{})) error
-	DeleteIneligibleDomainStates(domains []string) (err error)
-	GetAllIneligibleDomainStates() (states []IneligibleDomainState, err error)
+	PutStates(context.Context, []DomainState, func(string, ...interface{})) error
+	PutState(context.Context, DomainState) error
+	PutStateIfUnchanged(ctx context.Context, old DomainState, update DomainState) error
+	RestoreStates(context.Context, []DomainState, func(string, ...interface{})) error
+	StateForDomain(context.Context, string) (DomainState, error)
+	StatesForDomains(context.Context, []string) ([]DomainState, error)
+	AllDomainStates(context.Context) ([]DomainState, error)
+	DomainStatesInRange(ctx context.Context, start, end string) ([]DomainState, error)
+	StatesWithStatus(context.Context, PreloadStatus) ([]DomainState, error)
+	IterateDomainStates(ctx context.Context, start, end string) iter.Seq2[DomainState, error]
+	IterateStatesWithStatus(context.Context, PreloadStatus) iter.Seq2[DomainState, error]
+	GetIneligibleDomainStates(ctx context.Context, domains []string) (states []IneligibleDomainState, err error)
+	SetIneligibleDomainStates(ctx context.Context, updates []IneligibleDomainState, logf func(format string, args ...interface{})) error
+	DeleteIneligibleDomainStates(ctx context.Context, domains []string) (err error)
+	GetAllIneligibleDomainStates(ctx context.Context) (states []IneligibleDomainState, err error)
+	IterateIneligibleDomainStates(ctx context.Context) iter.Seq2[IneligibleDomainState, error]
+	TransitionsForDomain(ctx context.Context, domain string) ([]Transition, error)
+	MigrationRecords(ctx context.Context) ([]MigrationRecord, error)
+	PutMigrationRecord(ctx context.Context, record MigrationRecord) error
+	Stats(ctx context.Context) (Stats, error)
+	SetStats(ctx context.Context, stats Stats) error
+	Subscriptions(ctx context.Context) ([]Subscription, error)
+	PutSubscription(ctx context.Context, subscription Subscription) error
+	DeleteSubscription(ctx context.Context, id string) error
+	DueDeliveries(ctx context.Context, now time.Time, limit int) ([]Delivery, error)
+	PutDelivery(ctx context.Context, delivery Delivery) error
+	DeleteDelivery(ctx context.Context, id string) error
+	Job(ctx context.Context, id string) (Job, error)
+	PutJob(ctx context.Context, job Job) error
+	DeleteExpiredJobs(ctx context.Context, now time.Time) error
 }
 
 // DatastoreBacked is a database backed by a gcd.Backend.
+//
+// It holds a single datastore client for its whole lifetime, which is
+// shared by all calls. Call Close() when the database is no longer needed.
 type DatastoreBacked struct {
 	backend   gcd.Backend
 	projectID string
+	client    *datastore.Client
 }
 
 // TempLocalDatabase spin up an local in-memory database based
 // on a Google Cloud Datastore emulator.
 func TempLocalDatabase() (db DatastoreBacked, shutdown func() error, err error) {
-	backend, shutdown, err := gcd.NewLocalBackend()
-	return DatastoreBacked{backend, localProjectID}, shutdown, err
+	backend, backendShutdown, err := gcd.NewLocalBackend()
+	if err != nil {
+		return db, backendShutdown, err
+	}
+
+	client, err := backend.NewClient(context.Background(), localProjectID)
+	if err != nil {
+		return db, backendShutdown, err
+	}
+
+	db = DatastoreBacked{backend, localProjectID, client}
+	shutdown = func() error {
+		closeErr := db.Close()
+		if err := backendShutdown(); err != nil {
+			return err
+		}
+		return closeErr
+	}
+	return db, shutdown, nil
 }
 
 // ProdDatabase gives a Database that will call out to
 // the real production instance of Google Cloud Datastore
-func ProdDatabase(projectID string) DatastoreBacked {
-	return DatastoreBacked{gcd.NewProdBackend(), projectID}
+func ProdDatabase(ctx context.Context, projectID string) (db DatastoreBacked, err error) {
+	backend := gcd.NewProdBackend()
+	client, err := backend.NewClient(ctx, projectID)
+	if err != nil {
+		return db, err
+	}
+	return DatastoreBacked{backend, projectID, client}, nil
+}
+
+// Close releases the datastore client. The database must not be used
+// after calling Close.
+func (db DatastoreBacked) Close() error {
+	return db.client.Close()
+}
+
+// ErrStateChanged is returned by PutStateIfUnchanged if the stored state of
+// a domain no longer matches the state the caller read.
+var ErrStateChanged = errors.New("the domain state has changed since it was read")
+
+// unchanged reports whether `stored` still matches `old`, the state as
+// returned by StateForDomain.
+func unchanged(stored DomainState, old DomainState) bool {
+	stored.Name = ""
+	old.Name = ""
+	return stored.Equal(old)
 }
 
 var blackholeLogf = func(format string, args ...interface{}) {}
 
 // PutStates updates the given domain updates in batches.
 // Writes updates to logf in real-time.
-func (db DatastoreBacked) PutStates(updates []DomainState, logf func(format string, args ...interface{})) error {
+//
+// Each batch is written in a transaction, together with its transitions,
+// webhook deliveries and stats counters, so that an event or a count is only
+// stored along with its status change. Each batch gets its own timeout, and is retried with
+// exponential backoff if it fails with an error that may be transient. If
+// a batch still fails, PutStates returns a *PartialCommitError.
+func (db DatastoreBacked) PutStates(ctx context.Context, updates []DomainState, logf func(format string, args ...interface{})) error {
 	if len(updates) == 0 {
 		logf("No updates.\n")
 		return nil
 	}
-
-	// Set up the datastore context.
-	c, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	client, datastoreErr := db.backend.NewClient(c, db.projectID)
-	if datastoreErr != nil {
-		return datastoreErr
+	// Datastore only rejects duplicate keys in non-transactional commits.
+	if err := checkDuplicateNames(updates); err != nil {
+		return err
 	}
 
-	putMulti := func(keys []*datastore.Key, values []DomainState) error {
-		logf("Updating %d entries...", len(keys))
+	putMulti := func(values []DomainState) error {
+		logf("Updating %d entries...", len(values))
+
+		keys := make([]*datastore.Key, len(values))
+		for i, state := range values {
+			keys[i] = datastore.NameKey(domainStateKind, state.Name, nil)
+		}
 
-		if _, err := client.PutMulti(c, keys, values); err != nil {
+		// The transaction either writes everything or nothing, so it can
+		// simply be retried.
+		err := retry(ctx, func(c context.Context) error {
+			return db.putStatesInTransaction(ctx, c, keys, values)
+		}, logf)
+		if err != nil {
 			logf(" failed: %v\n", err)
 			return err
 		}
@@ -84,69 +173,317 @@ func (db DatastoreBacked) PutStates(updates []DomainState, logf func(format stri
 		return nil
 	}
 
-	var keys []*datastore.Key
-	var values []DomainState
-	for _, state := range updates {
-		key := datastore.NameKey(domainStateKind, string(state.Name), nil)
-		keys = append(keys, key)
-		values = append(values, state)
+	committed := 0
+	for committed < len(updates) {
+		n := min(putStatesBatchSize, len(updates)-committed)
+		err := putMulti(updates[committed : committed+n])
+		// A batch that writes too many entities is split until it fits
+		// in a transaction.
+		for errors.Is(err, errTooManyMutations) && n > 1 {
+			n /= 2
+			err = putMulti(updates[committed : committed+n])
+		}
+		if err != nil {
+			return partialCommitError(updates, committed, err)
+		}
+		committed += n
+	}
+	return nil
+}
 
-		if len(keys) >= batchSize {
-			if err := putMulti(keys, values); err != nil {
-				return err
+// errTooManyMutations is returned by putStatesInTransaction if a batch
+// would write more than maxMutations entities.
+var errTooManyMutations = errors.New("too many entities for a single transaction")
+
+// errTransitionsChanged is returned by putStatesInTransaction if a domain
+// changed status between the read that the subscriptions were looked up
+// for and the transaction. The batch is simply retried.
+var errTransitionsChanged = errors.New("the domain states changed while the batch was written")
+
+// putStatesInTransaction writes `values` under `keys`, along with their
+// transitions, the deliveries of their events and the changes to the stats
+// counters, in a single transaction.
+func (db DatastoreBacked) putStatesInTransaction(ctx, c context.Context, keys []*datastore.Key, values []DomainState) error {
+	// Queries can't run inside a transaction, so the subscriptions are
+	// looked up before it, and only for the domains whose status changes.
+	stored, err := storedStates(keys, func(states []DomainState) error {
+		return db.client.GetMulti(c, keys, states)
+	})
+	if err != nil {
+		return err
+	}
+	subscribed := subscribedDomains(newTransitions(ctx, stored, values))
+	subscriptions, err := db.subscriptionsForDomains(c, subscribed)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.client.RunInTransaction(c, func(tx *datastore.Transaction) error {
+		stored, err := storedStates(keys, func(states []DomainState) error {
+			return tx.GetMulti(keys, states)
+		})
+		if err != nil {
+			return err
+		}
+		if err := checkTransitions(ctx, stored, values); err != nil {
+			return err
+		}
+		transitions := newTransitions(ctx, stored, values)
+		for _, t := range transitions {
+			if _, found := slices.BinarySearch(subscribed, t.Name); !found {
+				return errTransitionsChanged
 			}
-			keys = keys[:0]
-			values = values[:0]
 		}
+		deliveries := newDeliveries(subscriptions, transitions)
+		deltas := counterDeltas(stored, values)
+		if len(values)+len(transitions)+len(deliveries)+len(deltas) > maxMutations {
+			return errTooManyMutations
+		}
+
+		if _, err := tx.PutMulti(keys, values); err != nil {
+			return err
+		}
+		if err := putTransitionsInTransaction(tx, transitions); err != nil {
+			return err
+		}
+		if err := putDeliveriesInTransaction(tx, deliveries); err != nil {
+			return err
+		}
+		return addCountersInTransaction(tx, deltas)
+	})
+	return err
+}
+
+// storedStates returns the states currently stored under `keys`, by name,
+// reading them with `getMulti`. Missing domains are left out of the result.
+func storedStates(keys []*datastore.Key, getMulti func(states []DomainState) error) (map[string]DomainState, error) {
+	stored := map[string]DomainState{}
+	if len(keys) == 0 {
+		return stored, nil
+	}
+
+	states := make([]DomainState, len(keys))
+	err := getMulti(states)
+	multiErr, isMultiErr := err.(datastore.MultiError)
+	if err != nil && !isMultiErr {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		if isMultiErr && multiErr[i] != nil {
+			if multiErr[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return nil, multiErr[i]
+		}
+		states[i].Name = key.Name
+		stored[key.Name] = states[i]
 	}
+	return stored, nil
+}
 
-	return putMulti(keys, values)
+// putTransitionsInTransaction stores each transition as a child of its
+// domain's key.
+func putTransitionsInTransaction(tx *datastore.Transaction, transitions []Transition) error {
+	if len(transitions) == 0 {
+		return nil
+	}
+
+	keys := make([]*datastore.Key, len(transitions))
+	for i, t := range transitions {
+		keys[i] = datastore.IncompleteKey(transitionKind, datastore.NameKey(domainStateKind, t.Name, nil))
+	}
+	_, err := tx.PutMulti(keys, transitions)
+	return err
+}
+
+// putDeliveriesInTransaction stores deliveries under their IDs.
+func putDeliveriesInTransaction(tx *datastore.Transaction, deliveries []Delivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	keys := make([]*datastore.Key, len(deliveries))
+	for i, d := range deliveries {
+		keys[i] = datastore.NameKey(deliveryKind, d.ID, nil)
+	}
+	_, err := tx.PutMulti(keys, deliveries)
+	return err
 }
 
 // PutState is a convenience version of PutStates for a single domain.
-func (db DatastoreBacked) PutState(update DomainState) error {
-	return db.PutStates([]DomainState{update}, blackholeLogf)
+func (db DatastoreBacked) PutState(ctx context.Context, update DomainState) error {
+	return db.PutStates(ctx, []DomainState{update}, blackholeLogf)
 }
 
-// statesForQuery returns the states for the given datastore query.
-func (db DatastoreBacked) statesForQuery(query *datastore.Query) (states []DomainState, err error) {
+// PutStateIfUnchanged writes `update` inside a transaction, but only if the
+// stored state of the domain still matches `old`. Otherwise, it returns
+// ErrStateChanged without writing anything.
+//
+// `old` should be the state as returned by StateForDomain, so a domain
+// that is not in the database matches a state with StatusUnknown.
+func (db DatastoreBacked) PutStateIfUnchanged(ctx context.Context, old DomainState, update DomainState) error {
 	// Set up the datastore context.
-	c, cancel := context.WithTimeout(context.Background(), timeout)
+	c, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	client, datastoreErr := db.backend.NewClient(c, db.projectID)
-	if datastoreErr != nil {
-		return states, datastoreErr
+	// Queries can't run inside a transaction, so the subscriptions are
+	// looked up first. The transaction only writes if the stored status is
+	// still old.Status, so it is known whether the status changes.
+	var subscriptions []Subscription
+	if old.Status != update.Status {
+		var err error
+		subscriptions, err = db.subscriptionsForDomains(c, subscribedDomains([]Transition{{Name: update.Name}}))
+		if err != nil {
+			return err
+		}
 	}
 
-	keys, err := client.GetAll(c, query, &states)
-	if err != nil {
-		return states, err
+	key := datastore.NameKey(domainStateKind, update.Name, nil)
+	_, err := db.client.RunInTransaction(c, func(tx *datastore.Transaction) error {
+		stored := map[string]DomainState{}
+		var state DomainState
+		switch err := tx.Get(key, &state); err {
+		case nil:
+			stored[update.Name] = state
+		case datastore.ErrNoSuchEntity:
+			state = DomainState{Status: StatusUnknown}
+		default:
+			return err
+		}
+		if !unchanged(state, old) {
+			return ErrStateChanged
+		}
+		if err := checkTransitions(ctx, stored, []DomainState{update}); err != nil {
+			return err
+		}
+
+		if _, err := tx.Put(key, &update); err != nil {
+			return err
+		}
+		if err := addCountersInTransaction(tx, counterDeltas(stored, []DomainState{update})); err != nil {
+			return err
+		}
+		transitions := newTransitions(ctx, stored, []DomainState{update})
+		if err := putTransitionsInTransaction(tx, transitions); err != nil {
+			return err
+		}
+		return putDeliveriesInTransaction(tx, newDeliveries(subscriptions, transitions))
+	})
+	return err
+}
+
+// RestoreStates writes `states` as they are, in batches, without checking
+// or recording their transitions, queueing webhook deliveries or updating
+// the stats counters. It is meant for restoring a backup. If a batch
+// fails, RestoreStates returns a *PartialCommitError.
+func (db DatastoreBacked) RestoreStates(ctx context.Context, states []DomainState, logf func(format string, args ...interface{})) error {
+	if len(states) == 0 {
+		logf("No updates.\n")
+		return nil
+	}
+	// Datastore only rejects duplicate keys in non-transactional commits.
+	if err := checkDuplicateNames(states); err != nil {
+		return err
 	}
 
-	for i, key := range keys {
-		state := states[i]
-		state.Name = key.Name
-		states[i] = state
+	for i := 0; i < len(states); i += maxMutations {
+		batch := states[i:min(i+maxMutations, len(states))]
+		logf("Restoring %d entries...", len(batch))
+
+		keys := make([]*datastore.Key, len(batch))
+		for j, state := range batch {
+			keys[j] = datastore.NameKey(domainStateKind, state.Name, nil)
+		}
+		err := retry(ctx, func(c context.Context) error {
+			_, err := db.client.PutMulti(c, keys, batch)
+			return err
+		}, logf)
+		if err != nil {
+			logf(" failed: %v\n", err)
+			return partialCommitError(states, i, err)
+		}
+		logf(" done.\n")
+	}
+	return nil
+}
+
+// queryPage runs a single page of `query`, starting at `cursor` (if not
+// nil). It returns the next cursor, or nil if this was the last page.
+func queryPage[T any](ctx context.Context, client *datastore.Client, query *datastore.Query, cursor *datastore.Cursor, setName func(*T, string)) (values []T, next *datastore.Cursor, err error) {
+	// Set up the datastore context.
+	c, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query = query.Limit(pageSize)
+	if cursor != nil {
+		query = query.Start(*cursor)
+	}
+
+	it := client.Run(c, query)
+	for {
+		var v T
+		key, err := it.Next(&v)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		setName(&v, key.Name)
+		values = append(values, v)
 	}
 
-	return states, nil
+	if len(values) < pageSize {
+		return values, nil, nil
+	}
+	nextCursor, err := it.Cursor()
+	if err != nil {
+		return nil, nil, err
+	}
+	return values, &nextCursor, nil
 }
 
+// queryPages iterates over the results of `query` one page at a time,
+// resuming each page from the cursor where the last one ended. Every page
+// gets its own timeout, so that large queries are not bound by a single
+// deadline.
+func queryPages[T any](ctx context.Context, client *datastore.Client, query *datastore.Query, setName func(*T, string)) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var cursor *datastore.Cursor
+		for {
+			values, next, err := queryPage(ctx, client, query, cursor, setName)
+			if err != nil {
+				var zero T
+				yield(zero, err)
+				return
+			}
+			for _, v := range values {
+				if !yield(v, nil) {
+					return
+				}
+			}
+			if next == nil {
+				return
+			}
+			cursor = next
+		}
+	}
+}
+
+func setDomainStateName(s *DomainState, name string) { s.Name = name }
+
+func setIneligibleDomainStateName(s *IneligibleDomainState, name string) { s.Name = name }
+
 // StateForDomain get the state for the given domain.
 // Note that the Name field of `state` will not be set.
-func (db DatastoreBacked) StateForDomain(domain string) (state DomainState, err error) {
+func (db DatastoreBacked) StateForDomain(ctx context.Context, domain string) (state DomainState, err error) {
 	// Set up the datastore context.
-	c, cancel := context.WithTimeout(context.Background(), timeout)
+	c, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	client, datastoreErr := db.backend.NewClient(c, db.projectID)
-	if datastoreErr != nil {
-		return state, datastoreErr
-	}
-
 	key := datastore.NameKey(domainStateKind, domain, nil)
-	getErr := client.Get(c, key, &state)
+	getErr := db.client.Get(c, key, &state)
 	if getErr != nil {
 		if getErr == datastore.ErrNoSuchEntity {
 			return DomainState{Status: StatusUnknown}, nil
@@ -158,19 +495,14 @@ func (db DatastoreBacked) StateForDomain(domain string) (state DomainState, err
 }
 
 // StatesForDomains returns the domains states for the given domains
-func (db DatastoreBacked) StatesForDomains(domains []string) (states []DomainState, err error) {
+func (db DatastoreBacked) StatesForDomains(ctx context.Context, domains []string) (states []DomainState, err error) {
 	// Set up datastore context
-	c, cancel := context.WithTimeout(context.Background(), timeout)
+	c, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	client, datastoreErr := db.backend.NewClient(c, db.projectID)
-	if datastoreErr != nil {
-		return nil, datastoreErr
-	}
-
 	getDomainStates := func(keys []*datastore.Key) ([]DomainState, error) {
 		domainStates := make([]DomainState, len(keys))
-		if err := client.GetMulti(c, keys, domainStates); err != nil {
+		if err := db.client.GetMulti(c, keys, domainStates); err != nil {
 			return nil, err
 		}
 		for i := range domainStates {
@@ -204,11 +536,23 @@ func (db DatastoreBacked) StatesForDomains(domains []string) (states []DomainSta
 }
 
 // AllDomainStates gets the states of all domains in the database.
-func (db DatastoreBacked) AllDomainStates() (states []DomainState, err error) {
-	return db.statesForQuery(datastore.NewQuery("DomainState"))
+func (db DatastoreBacked) AllDomainStates(ctx context.Context) (states []DomainState, err error) {
+	return collect(db.IterateDomainStates(ctx, "", ""))
 }
 
-func (db DatastoreBacked) DomainStatesInRange(start, end string) ([]DomainState, error) {
+func (db DatastoreBacked) DomainStatesInRange(ctx context.Context, start, end string) ([]DomainState, error) {
+	return collect(db.IterateDomainStates(ctx, start, end))
+}
+
+// StatesWithStatus returns the states of domains with the given status in the database.
+func (db DatastoreBacked) StatesWithStatus(ctx context.Context, status PreloadStatus) (domains []DomainState, err error) {
+	return collect(db.IterateStatesWithStatus(ctx, status))
+}
+
+// IterateDomainStates iterates over the states of domains whose names are
+// in the half-open interval [start, end), in key order. An empty start or
+// end leaves that side of the interval unbounded.
+func (db DatastoreBacked) IterateDomainStates(ctx context.Context, start, end string) iter.Seq2[DomainState, error] {
 	query := datastore.NewQuery(domainStateKind)
 	if start != "" {
 		query = query.FilterField("__key__", ">=", datastore.NameKey(domainStateKind, start, nil))
@@ -216,29 +560,25 @@ func (db DatastoreBacked) DomainStatesInRange(start, end string) ([]DomainState,
 	if end != "" {
 		query = query.FilterField("__key__", "<", datastore.NameKey(domainStateKind, end, nil))
 	}
-	return db.statesForQuery(query)
+	return queryPages(ctx, db.client, query, setDomainStateName)
 }
 
-// StatesWithStatus returns the states of domains with the given status in the database.
-func (db DatastoreBacked) StatesWithStatus(status PreloadStatus) (domains []DomainState, err error) {
-	return db.statesForQuery(
-		datastore.NewQuery("DomainState").FilterField("Status", "=", string(status)))
+// IterateStatesWithStatus iterates over the states of domains with the
+// given status.
+func (db DatastoreBacked) IterateStatesWithStatus(ctx context.Context, status PreloadStatus) iter.Seq2[DomainState, error] {
+	query := datastore.NewQuery(domainStateKind).FilterField("Status", "=", string(status))
+	return queryPages(ctx, db.client, query, setDomainStateName)
 }
 
 // GetIneligibleDomainStates returns the state for the given domain.
-func (db DatastoreBacked) GetIneligibleDomainStates(domains []string) (states []IneligibleDomainState, err error) {
+func (db DatastoreBacked) GetIneligibleDomainStates(ctx context.Context, domains []string) (states []IneligibleDomainState, err error) {
 	// Set up the datastore context.
-	c, cancel := context.WithTimeout(context.Background(), timeout)
+	c, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	client, datastoreErr := db.backend.NewClient(c, db.projectID)
-	if datastoreErr != nil {
-		return nil, datastoreErr
-	}
-
 	get := func(keys []*datastore.Key) ([]IneligibleDomainState, error) {
 		state := make([]IneligibleDomainState, len(keys))
-		if err := client.GetMulti(c, keys, state); err != nil {
+		if err := db.client.GetMulti(c, keys, state); err != nil {
 			return nil, err
 		}
 		for i := range state {
@@ -252,33 +592,34 @@ func (db DatastoreBacked) GetIneligibleDomainStates(domains []string) (states []
 		key := datastore.NameKey(ineligibleDomainStateKind, domain, nil)
 		keys = append(keys, key)
 		if len(keys) >= batchSize {
-			if _, err := get(keys); err != nil {
+			batchStates, err := get(keys)
+			if err != nil {
 				return nil, err
 			}
+			states = append(states, batchStates...)
 			keys = keys[:0]
 		}
 	}
-	return get(keys)
+	batchStates, err := get(keys)
+	if err != nil {
+		return nil, err
+	}
+	return append(states, batchStates...), nil
 }
 
 // SetIneligibleDomainStates updates the given domains updates in batches.
 // Writes updates to logf in real-time.
-func (db DatastoreBacked) SetIneligibleDomainStates(updates []IneligibleDomainState, logf func(format string, args ...interface{})) error {
+func (db DatastoreBacked) SetIneligibleDomainStates(ctx context.Context, updates []IneligibleDomainState, logf func(format string, args ...interface{})) error {
 
 	// Set up the datastore context.
-	c, cancel := context.WithTimeout(context.Background(), timeout)
+	c, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	client, datastoreErr := db.backend.NewClient(c, db.projectID)
-	if datastoreErr != nil {
-		return datastoreErr
-	}
-
 	set := func(keys []*datastore.Key, values []IneligibleDomainState) error {
 
 		logf("Updating %d entries...", len(keys))
 
-		if _, err := client.PutMulti(c, keys, values); err != nil {
+		if _, err := db.client.PutMulti(c, keys, values); err != nil {
 			logf(" failed: %v\n", err)
 			return err
 		}
@@ -305,17 +646,13 @@ func (db DatastoreBacked) SetIneligibleDomainStates(updates []IneligibleDomainSt
 }
 
 // DeleteIneligibleDomainStates deletes the state for the given domain from the database
-func (db DatastoreBacked) DeleteIneligibleDomainStates(domains []string) (err error) {
+func (db DatastoreBacked) DeleteIneligibleDomainStates(ctx context.Context, domains []string) (err error) {
 	// Set up the datastore context.
-	c, cancel := context.WithTimeout(context.Background(), timeout)
+	c, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	client, datastoreErr := db.backend.NewClient(c, db.projectID)
-	if datastoreErr != nil {
-		return datastoreErr
-	}
 	delete := func(keys []*datastore.Key) error {
-		if err := client.DeleteMulti(c, keys); err != nil {
+		if err := db.client.DeleteMulti(c, keys); err != nil {
 			return err
 		}
 		return nil
@@ -336,36 +673,345 @@ func (db DatastoreBacked) DeleteIneligibleDomainStates(domains []string) (err er
 }
 
 // GetAllIneligibleDomainStates returns all the ineligible domains in the database
-func (db DatastoreBacked) GetAllIneligibleDomainStates() (states []IneligibleDomainState, err error) {
+func (db DatastoreBacked) GetAllIneligibleDomainStates(ctx context.Context) (states []IneligibleDomainState, err error) {
+	return collect(db.IterateIneligibleDomainStates(ctx))
+}
+
+// IterateIneligibleDomainStates iterates over all the ineligible domains in
+// the database, in key order.
+func (db DatastoreBacked) IterateIneligibleDomainStates(ctx context.Context) iter.Seq2[IneligibleDomainState, error] {
+	return queryPages(ctx, db.client, datastore.NewQuery(ineligibleDomainStateKind), setIneligibleDomainStateName)
+}
+
+// TransitionsForDomain returns the status history of the given domain, in
+// chronological order.
+func (db DatastoreBacked) TransitionsForDomain(ctx context.Context, domain string) (transitions []Transition, err error) {
 	// Set up the datastore context.
-	c, cancel := context.WithTimeout(context.Background(), timeout)
+	c, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	client, datastoreErr := db.backend.NewClient(c, db.projectID)
-	if datastoreErr != nil {
-		return states, datastoreErr
+	// Ancestor queries are strongly consistent, so a transition is visible
+	// here as soon as the write that caused it has returned.
+	query := datastore.NewQuery(transitionKind).Ancestor(datastore.NameKey(domainStateKind, domain, nil))
+	if _, err := db.client.GetAll(c, query, &transitions); err != nil {
+		return nil, err
+	}
+
+	for i := range transitions {
+		transitions[i].Name = domain
 	}
+	sortTransitions(transitions)
+	return transitions, nil
+}
 
-	keys, err := client.GetAll(c, datastore.NewQuery("IneligibleDomainState"), &states)
+// MigrationRecords returns the records of all migrations that have started.
+func (db DatastoreBacked) MigrationRecords(ctx context.Context) (records []MigrationRecord, err error) {
+	// Set up the datastore context.
+	c, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	keys, err := db.client.GetAll(c, datastore.NewQuery(migrationKind), &records)
 	if err != nil {
-		return states, err
+		return nil, err
 	}
+	for i, key := range keys {
+		records[i].Version = int(key.ID)
+	}
+	return records, nil
+}
+
+// PutMigrationRecord stores the progress of a migration.
+func (db DatastoreBacked) PutMigrationRecord(ctx context.Context, record MigrationRecord) error {
+	// Set up the datastore context.
+	c, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	key := datastore.IDKey(migrationKind, int64(record.Version), nil)
+	_, err := db.client.Put(c, key, &record)
+	return err
+}
+
+// Subscriptions returns all webhook subscriptions.
+func (db DatastoreBacked) Subscriptions(ctx context.Context) (subscriptions []Subscription, err error) {
+	// Set up the datastore context.
+	c, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
+	keys, err := db.client.GetAll(c, datastore.NewQuery(subscriptionKind), &subscriptions)
+	if err != nil {
+		return nil, err
+	}
 	for i, key := range keys {
-		state := states[i]
-		state.Name = key.Name
-		states[i] = state
+		subscriptions[i].ID = key.Name
 	}
+	return subscriptions, nil
+}
+
+// maxInFilterValues is the largest number of values Datastore accepts in
+// an "in" filter.
+const maxInFilterValues = 30
 
-	return states, nil
+// subscriptionsForDomains returns the webhook subscriptions for any of
+// `domains`.
+func (db DatastoreBacked) subscriptionsForDomains(c context.Context, domains []string) ([]Subscription, error) {
+	var subscriptions []Subscription
+	for chunk := range slices.Chunk(domains, maxInFilterValues) {
+		values := make([]interface{}, len(chunk))
+		for i, domain := range chunk {
+			values[i] = domain
+		}
+
+		var found []Subscription
+		query := datastore.NewQuery(subscriptionKind).FilterField("Domain", "in", values)
+		keys, err := db.client.GetAll(c, query, &found)
+		if err != nil {
+			return nil, err
+		}
+		for i, key := range keys {
+			found[i].ID = key.Name
+		}
+		subscriptions = append(subscriptions, found...)
+	}
+	return subscriptions, nil
 }
 
-// SetPendingAutomatedRemoval sets the status of a list of domains to StatusPendingAutoamtedRemoval
-func SetPendingAutomatedRemoval(db Database, domains []string, logf func(fomat string, args ...interface{})) error {
+// PutSubscription stores a webhook subscription under its ID.
+func (db DatastoreBacked) PutSubscription(ctx context.Context, subscription Subscription) error {
+	// Set up the datastore context.
+	c, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	key := datastore.NameKey(subscriptionKind, subscription.ID, nil)
+	_, err := db.client.Put(c, key, &subscription)
+	return err
+}
+
+// DeleteSubscription deletes a webhook subscription. Its remaining
+// deliveries are dropped when they are next due.
+func (db DatastoreBacked) DeleteSubscription(ctx context.Context, id string) error {
+	// Set up the datastore context.
+	c, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return db.client.Delete(c, datastore.NameKey(subscriptionKind, id, nil))
+}
+
+// DueDeliveries returns at most `limit` of the webhook deliveries that are
+// due at `now`, in order of their next attempt.
+func (db DatastoreBacked) DueDeliveries(ctx context.Context, now time.Time, limit int) (deliveries []Delivery, err error) {
+	// Set up the datastore context.
+	c, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query := datastore.NewQuery(deliveryKind).
+		FilterField("NextAttempt", "<=", now).
+		Order("NextAttempt").
+		Limit(limit)
+	keys, err := db.client.GetAll(c, query, &deliveries)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		deliveries[i].ID = key.Name
+	}
+	return deliveries, nil
+}
+
+// PutDelivery stores a webhook delivery under its ID.
+func (db DatastoreBacked) PutDelivery(ctx context.Context, delivery Delivery) error {
+	// Set up the datastore context.
+	c, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	key := datastore.NameKey(deliveryKind, delivery.ID, nil)
+	_, err := db.client.Put(c, key, &delivery)
+	return err
+}
+
+// DeleteDelivery deletes a webhook delivery. Deleting a missing delivery
+// is not an error.
+func (db DatastoreBacked) DeleteDelivery(ctx context.Context, id string) error {
+	// Set up the datastore context.
+	c, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return db.client.Delete(c, datastore.NameKey(deliveryKind, id, nil))
+}
+
+// counter is a single counter of the Stats, stored under its name.
+type counter struct {
+	Count int `datastore:",noindex"`
+}
+
+// counterShards is the number of entities each counter is split into in
+// Datastore. Every write adds to a random shard, so that concurrent
+// writes rarely contend on the same entity. The count of a counter is the
+// sum of its shards.
+const counterShards = 20
+
+// counterShardKey returns the key of a shard of the counter `name`.
+func counterShardKey(name string, shard int) *datastore.Key {
+	return datastore.NameKey(counterKind, fmt.Sprintf("%s#%d", name, shard), nil)
+}
+
+// counterKeys returns the keys of every shard of the counter `name`,
+// including the unsharded key it was stored under before counters were
+// sharded.
+func counterKeys(name string) []*datastore.Key {
+	keys := []*datastore.Key{datastore.NameKey(counterKind, name, nil)}
+	for shard := range counterShards {
+		keys = append(keys, counterShardKey(name, shard))
+	}
+	return keys
+}
+
+// counterName returns the name of the counter that the shard `key`
+// belongs to.
+func counterName(key *datastore.Key) string {
+	name, _, _ := strings.Cut(key.Name, "#")
+	return name
+}
+
+// getCountersInTransaction reads the counters under `keys` within `tx`.
+// Missing counters are zero. exists[i] reports whether keys[i] is stored.
+func getCountersInTransaction(tx *datastore.Transaction, keys []*datastore.Key) (counters []counter, exists []bool, err error) {
+	counters = make([]counter, len(keys))
+	exists = make([]bool, len(keys))
+	for i := range exists {
+		exists[i] = true
+	}
+	if err := tx.GetMulti(keys, counters); err != nil {
+		multiErr, ok := err.(datastore.MultiError)
+		if !ok {
+			return nil, nil, err
+		}
+		for i, err := range multiErr {
+			if err == datastore.ErrNoSuchEntity {
+				exists[i] = false
+			} else if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return counters, exists, nil
+}
+
+// addCountersInTransaction adds `deltas` to the stored counters within
+// `tx`. All of the deltas go to the same, random shard.
+func addCountersInTransaction(tx *datastore.Transaction, deltas map[string]int) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+
+	shard := rand.IntN(counterShards)
+	var keys []*datastore.Key
+	for name := range deltas {
+		keys = append(keys, counterShardKey(name, shard))
+	}
+	counters, _, err := getCountersInTransaction(tx, keys)
+	if err != nil {
+		return err
+	}
+
+	for i, key := range keys {
+		counters[i].Count += deltas[counterName(key)]
+	}
+	_, err = tx.PutMulti(keys, counters)
+	return err
+}
+
+// Stats returns the counts of domain states kept by the database.
+func (db DatastoreBacked) Stats(ctx context.Context) (Stats, error) {
+	// Set up the datastore context.
+	c, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var values []counter
+	keys, err := db.client.GetAll(c, datastore.NewQuery(counterKind), &values)
+	if err != nil {
+		return Stats{}, err
+	}
+	counters := map[string]int{}
+	for i, key := range keys {
+		counters[counterName(key)] += values[i].Count
+	}
+	return statsFromCounters(counters), nil
+}
+
+// setCountersBatchSize is the number of counters SetStats replaces in each
+// transaction. Replacing a counter can write every one of its shards.
+const setCountersBatchSize = maxMutations / (counterShards + 1)
+
+// SetStats replaces all of the stored counters with `stats`. A counter is
+// replaced by storing its count in its first shard and deleting the
+// others. Each batch of counters is replaced in a transaction, so a
+// concurrent write is either replaced or added to the new count, but a
+// failure can leave the earlier batches replaced.
+func (db DatastoreBacked) SetStats(ctx context.Context, stats Stats) error {
+	// Set up the datastore context.
+	c, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Queries can't run inside a transaction, so the names of the stored
+	// counters are read first.
+	oldKeys, err := db.client.GetAll(c, datastore.NewQuery(counterKind).KeysOnly(), nil)
+	if err != nil {
+		return err
+	}
+	counts := countersFromStats(stats)
+	names := slices.Collect(maps.Keys(counts))
+	for _, key := range oldKeys {
+		names = append(names, counterName(key))
+	}
+	slices.Sort(names)
+	names = slices.Compact(names)
+
+	for batch := range slices.Chunk(names, setCountersBatchSize) {
+		_, err := db.client.RunInTransaction(c, func(tx *datastore.Transaction) error {
+			var keys []*datastore.Key
+			for _, name := range batch {
+				keys = append(keys, counterKeys(name)...)
+			}
+			_, exists, err := getCountersInTransaction(tx, keys)
+			if err != nil {
+				return err
+			}
+
+			var deletes []*datastore.Key
+			var puts []*datastore.Key
+			var values []counter
+			for i, key := range keys {
+				name := counterName(key)
+				if key.Name == counterShardKey(name, 0).Name && counts[name] != 0 {
+					puts = append(puts, key)
+					values = append(values, counter{counts[name]})
+				} else if exists[i] {
+					deletes = append(deletes, key)
+				}
+			}
+			if err := tx.DeleteMulti(deletes); err != nil {
+				return err
+			}
+			_, err = tx.PutMulti(puts, values)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetPendingAutomatedRemoval sets the status of a list of domains to StatusPendingAutoamtedRemoval.
+// Domains whose current status can't move to StatusPendingAutomatedRemoval
+// (see ValidTransition) are skipped.
+func SetPendingAutomatedRemoval(ctx context.Context, db Database, domains []string, logf func(fomat string, args ...interface{})) error {
+	ctx = WithActor(ctx, ActorAutomatedRemoval, "The domain no longer meets the preload requirements.")
+
 	setDomainStates := func(domainStates []DomainState) error {
 		logf("Updating %d entries...", len(domainStates))
 
-		if err := db.PutStates(domainStates, logf); err != nil {
+		if err := db.PutStates(ctx, domainStates, logf); err != nil {
 			logf(" failed: %v\n", err)
 			return err
 		}
@@ -373,13 +1019,66 @@ func SetPendingAutomatedRemoval(db Database, domains []string, logf func(fomat s
 		return nil
 	}
 
-	updates, err := db.StatesForDomains(domains)
+	updates, err := db.StatesForDomains(ctx, domains)
 	if err != nil {
 		return err
 	}
-	for i := range updates {
-		updates[i].Status = StatusPendingAutomatedRemoval
+	var valid []DomainState
+	for _, update := range updates {
+		if !ValidTransition(update.Status, StatusPendingAutomatedRemoval) {
+			logf("Skipping %s: cannot move from %s to %s.\n", update.Name, update.Status, StatusPendingAutomatedRemoval)
+			continue
+		}
+		update.Status = StatusPendingAutomatedRemoval
+		valid = append(valid, update)
 	}
 
-	return setDomainStates(updates)
+	return setDomainStates(valid)
+}
+
+// Job returns the preloadable job with the given ID, or ErrNoSuchJob.
+func (db DatastoreBacked) Job(ctx context.Context, id string) (job Job, err error) {
+	// Set up the datastore context.
+	c, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err = db.client.Get(c, datastore.NameKey(jobKind, id, nil), &job)
+	if err == datastore.ErrNoSuchEntity {
+		return Job{}, ErrNoSuchJob
+	}
+	if err != nil {
+		return Job{}, err
+	}
+	job.ID = id
+	return job, nil
+}
+
+// PutJob stores a preloadable job under its ID.
+func (db DatastoreBacked) PutJob(ctx context.Context, job Job) error {
+	// Set up the datastore context.
+	c, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	_, err := db.client.Put(c, datastore.NameKey(jobKind, job.ID, nil), &job)
+	return err
+}
+
+// DeleteExpiredJobs deletes the preloadable jobs that have expired at
+// `now`.
+func (db DatastoreBacked) DeleteExpiredJobs(ctx context.Context, now time.Time) error {
+	// Set up the datastore context.
+	c, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query := datastore.NewQuery(jobKind).FilterField("Expires", "<=", now).KeysOnly()
+	keys, err := db.client.GetAll(c, query, nil)
+	if err != nil {
+		return err
+	}
+	for chunk := range slices.Chunk(keys, maxMutations) {
+		if err := db.client.DeleteMulti(c, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -1,9 +1,13 @@
 package database
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"testing"
@@ -15,9 +19,18 @@ import (
 	"github.com/chromium/hstspreload/chromium/preloadlist"
 )
 
+var testBackend = flag.String("db", "emulator", "backend to run the database tests against: \"emulator\", \"memory\" or \"bolt\"")
+
 // We can share a database across tests because tests are not run
 // in parallel (by default).
-var testDB DatastoreBacked
+var testDB Database
+
+// resetDB clears testDB. It is set up by TestMain.
+var resetDB func()
+
+// setupCtx is used to seed the database with domains in any status. Like
+// an admin tool, it bypasses the transition checks.
+var setupCtx = WithActor(context.Background(), ActorAdmin, "test setup")
 
 func ExampleTempLocalDatabase() {
 	_, shutdown, err := TempLocalDatabase()
@@ -28,26 +41,59 @@ func ExampleTempLocalDatabase() {
 }
 
 func TestMain(m *testing.M) {
-	localDatabase, shutdown, err := TempLocalDatabase()
-	if err != nil {
-		log.Fatalf("could not initialize local backend: %s", err)
+	flag.Parse()
+
+	var shutdown func() error
+	switch *testBackend {
+	case "memory":
+		memoryDatabase, memoryShutdown, err := MemoryDatabase("")
+		if err != nil {
+			log.Fatalf("could not initialize memory backend: %s", err)
+		}
+		testDB, shutdown = memoryDatabase, memoryShutdown
+		resetDB = memoryDatabase.reset
+	case "bolt":
+		dir, err := os.MkdirTemp("", "hstspreload-bolt")
+		if err != nil {
+			log.Fatalf("could not create bolt directory: %s", err)
+		}
+		boltDatabase, boltShutdown, err := BoltDatabase(filepath.Join(dir, "test.db"))
+		if err != nil {
+			log.Fatalf("could not initialize bolt backend: %s", err)
+		}
+		testDB = boltDatabase
+		shutdown = func() error {
+			defer os.RemoveAll(dir)
+			return boltShutdown()
+		}
+		resetDB = func() {
+			if err := boltDatabase.reset(); err != nil {
+				log.Fatalf("could not reset bolt backend: %s", err)
+			}
+		}
+	case "emulator":
+		localDatabase, localShutdown, err := TempLocalDatabase()
+		if err != nil {
+			log.Fatalf("could not initialize local backend: %s", err)
+		}
+		testDB, shutdown = localDatabase, localShutdown
+		resetDB = func() {
+			localDatabase.backend.(gcd.LocalBackend).Reset()
+		}
+	default:
+		log.Fatalf("unknown test backend %q", *testBackend)
 	}
 
-	testDB = localDatabase
 	exitCode := m.Run()
 
 	shutdown()
 	os.Exit(exitCode)
 }
 
-func resetDB() {
-	testDB.backend.(gcd.LocalBackend).Reset()
-}
-
 func TestAllDomainStatesEmptyDB(t *testing.T) {
 	resetDB()
 
-	domains, err := testDB.AllDomainStates()
+	domains, err := testDB.AllDomainStates(context.Background())
 	if err != nil {
 		t.Fatalf("%s", err)
 	}
@@ -123,6 +169,7 @@ func TestPutAndAll(t *testing.T) {
 		}
 
 		err := testDB.PutStates(
+			setupCtx,
 			tt.domainStates,
 			statusReport,
 		)
@@ -135,7 +182,7 @@ func TestPutAndAll(t *testing.T) {
 			t.Errorf("[%s] Incorrect status reports: %#v", tt.description, statuses)
 		}
 
-		domainStates, err := testDB.AllDomainStates()
+		domainStates, err := testDB.AllDomainStates(context.Background())
 		if err != nil {
 			t.Fatalf("%s", err)
 		}
@@ -151,6 +198,7 @@ func TestStateForDomain(t *testing.T) {
 	resetDB()
 
 	err := testDB.PutState(
+		context.Background(),
 		DomainState{Name: "gmail.com", Status: StatusPending},
 	)
 	if err != nil {
@@ -158,7 +206,7 @@ func TestStateForDomain(t *testing.T) {
 		return
 	}
 
-	state, err := testDB.StateForDomain("gmail.com")
+	state, err := testDB.StateForDomain(context.Background(), "gmail.com")
 	if err != nil {
 		t.Errorf("error retrieving state: %s", err)
 		return
@@ -167,7 +215,7 @@ func TestStateForDomain(t *testing.T) {
 		t.Errorf("Wrong status: %s", state.Status)
 	}
 
-	state, err = testDB.StateForDomain("garron.net")
+	state, err = testDB.StateForDomain(context.Background(), "garron.net")
 	if err != nil {
 		t.Errorf("error retrieving state: %s", err)
 		return
@@ -180,16 +228,16 @@ func TestStateForDomain(t *testing.T) {
 func TestStatesForDomains(t *testing.T) {
 	resetDB()
 
-	if err := testDB.PutState(DomainState{Name: "a.test", Status: StatusPreloaded}); err != nil {
+	if err := testDB.PutState(context.Background(), DomainState{Name: "a.test", Status: StatusPreloaded}); err != nil {
 		t.Fatalf("Cannot put state a.test for test StatatesForDomains: %s", err)
 		return
 	}
-	if err := testDB.PutState(DomainState{Name: "b.test", Status: StatusPending}); err != nil {
+	if err := testDB.PutState(context.Background(), DomainState{Name: "b.test", Status: StatusPending}); err != nil {
 		t.Fatalf("Cannot put state b.test for test StatesForDomains: %s", err)
 		return
 	}
 
-	domainStates, err := testDB.StatesForDomains([]string{"a.test", "b.test"})
+	domainStates, err := testDB.StatesForDomains(context.Background(), []string{"a.test", "b.test"})
 	if err != nil {
 		t.Errorf("Cannot get states for test StatesForDomains: %s", err)
 		return
@@ -207,7 +255,7 @@ func TestStatesForDomains(t *testing.T) {
 	}
 
 	// tests domain not in database
-	domainStates, gotErr := testDB.StatesForDomains([]string{"a.test", "b.test", "c.test"})
+	domainStates, gotErr := testDB.StatesForDomains(context.Background(), []string{"a.test", "b.test", "c.test"})
 	wantError := "datastore: no such entity"
 	if gotErr.Error() != wantError {
 		t.Errorf("Non-preloaded domain treated incorrectly for test StatesForDomains: got %s, wanted %s", err, wantError)
@@ -228,7 +276,7 @@ func TestStatesWithStatus(t *testing.T) {
 	domainK := DomainState{Name: "k.com", Status: StatusPending, IncludeSubDomains: true, Policy: preloadlist.Bulk1Year}
 	resetDB()
 
-	domainStates, err := testDB.StatesWithStatus(StatusPreloaded)
+	domainStates, err := testDB.StatesWithStatus(context.Background(), StatusPreloaded)
 	if err != nil {
 		t.Errorf("%s", err)
 	}
@@ -237,6 +285,7 @@ func TestStatesWithStatus(t *testing.T) {
 	}
 
 	err = testDB.PutStates(
+		setupCtx,
 		[]DomainState{
 			domainA, domainB, domainC, domainD, domainE, domainG, domainH, domainI, domainJ, domainK,
 		},
@@ -260,7 +309,7 @@ func TestStatesWithStatus(t *testing.T) {
 
 	for _, tt := range table {
 
-		domainStates, err = testDB.StatesWithStatus(tt.status)
+		domainStates, err = testDB.StatesWithStatus(context.Background(), tt.status)
 		if err != nil {
 			t.Errorf("%s", err)
 		}
@@ -291,7 +340,7 @@ func TestDomainStatesInRange(t *testing.T) {
 	}
 	for _, name := range testNames {
 		state := DomainState{Name: name}
-		if err := testDB.PutState(state); err != nil {
+		if err := testDB.PutState(setupCtx, state); err != nil {
 			t.Fatalf("failed to set test state for TestDomainStatesInRange: %v", err)
 		}
 	}
@@ -348,7 +397,7 @@ func TestDomainStatesInRange(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			states, err := testDB.DomainStatesInRange(test.start, test.end)
+			states, err := testDB.DomainStatesInRange(context.Background(), test.start, test.end)
 			if err != nil {
 				t.Fatalf("DomainStatesInRange unexpectedly failed: %v", err)
 			}
@@ -370,6 +419,95 @@ func TestDomainStatesInRange(t *testing.T) {
 	}
 }
 
+func TestIterate(t *testing.T) {
+	resetDB()
+
+	// Use enough domains to need several pages.
+	var states []DomainState
+	var ineligibleStates []IneligibleDomainState
+	for i := 0; i < 2*pageSize+1; i++ {
+		status := PreloadStatus(StatusPreloaded)
+		if i%2 == 1 {
+			status = StatusPending
+		}
+		name := fmt.Sprintf("domain%04d.test", i)
+		states = append(states, DomainState{Name: name, Status: status})
+		ineligibleStates = append(ineligibleStates, IneligibleDomainState{Name: name})
+	}
+	if err := testDB.PutStates(context.Background(), states, blackholeLogf); err != nil {
+		t.Fatalf("cannot put states: %s", err)
+	}
+	if err := testDB.SetIneligibleDomainStates(context.Background(), ineligibleStates, blackholeLogf); err != nil {
+		t.Fatalf("cannot set ineligible states: %s", err)
+	}
+
+	var names []string
+	for state, err := range testDB.IterateDomainStates(context.Background(), "", "") {
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		names = append(names, state.Name)
+	}
+	if len(names) != len(states) || !sort.StringsAreSorted(names) {
+		t.Errorf("Wrong domain states: got %d, wanted %d in key order", len(names), len(states))
+	}
+
+	numInRange := 0
+	for state, err := range testDB.IterateDomainStates(context.Background(), "domain0500.test", "domain1500.test") {
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if state.Name < "domain0500.test" || state.Name >= "domain1500.test" {
+			t.Errorf("Domain out of range: %s", state.Name)
+		}
+		numInRange++
+	}
+	if numInRange != 1000 {
+		t.Errorf("Wrong number of domains in range: %d", numInRange)
+	}
+
+	numPending := 0
+	for state, err := range testDB.IterateStatesWithStatus(context.Background(), StatusPending) {
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if state.Status != StatusPending || state.Name == "" {
+			t.Errorf("Unexpected state: %#v", state)
+		}
+		numPending++
+	}
+	if numPending != pageSize {
+		t.Errorf("Wrong number of pending domains: %d", numPending)
+	}
+
+	numIneligible := 0
+	for state, err := range testDB.IterateIneligibleDomainStates(context.Background()) {
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		numIneligible++
+		// Stopping early must not leak or block anything.
+		if state.Name == "domain0010.test" {
+			break
+		}
+	}
+	if numIneligible != 11 {
+		t.Errorf("Wrong number of ineligible domains before break: %d", numIneligible)
+	}
+
+	// Writing while iterating must not deadlock.
+	for state, err := range testDB.IterateStatesWithStatus(context.Background(), StatusPreloaded) {
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		state.Status = StatusPendingRemoval
+		if err := testDB.PutState(context.Background(), state); err != nil {
+			t.Fatalf("cannot put state while iterating: %s", err)
+		}
+		break
+	}
+}
+
 func TestSetPendingAutomatedRemoval(t *testing.T) {
 	resetDB()
 
@@ -383,7 +521,7 @@ func TestSetPendingAutomatedRemoval(t *testing.T) {
 		{Name: "pendingautomatedremoval.test", Status: StatusPendingAutomatedRemoval}}
 
 	for _, state := range testStates {
-		if err := testDB.PutState(state); err != nil {
+		if err := testDB.PutState(setupCtx, state); err != nil {
 			t.Fatalf("cannot put state for test SetPendingAutomatedRemoval: %s", err)
 			return
 		}
@@ -396,23 +534,187 @@ func TestSetPendingAutomatedRemoval(t *testing.T) {
 		statuses = append(statuses, formatted)
 	}
 
-	err := SetPendingAutomatedRemoval(testDB, testDomains, statusReport)
+	err := SetPendingAutomatedRemoval(context.Background(), testDB, testDomains, statusReport)
 	if err != nil {
 		t.Errorf("Unexpected error for test SetAutomatedPendingRemoval: %s", err)
 	}
 
-	domainStates, allDomainStatesErr := testDB.AllDomainStates()
+	domainStates, allDomainStatesErr := testDB.AllDomainStates(context.Background())
 	if allDomainStatesErr != nil {
 		t.Errorf("Can't fetch all domain states: %s", allDomainStatesErr)
 	}
 
+	// Domains that can't move to StatusPendingAutomatedRemoval keep their status.
+	wantStatuses := map[string]PreloadStatus{
+		"preloaded.test":               StatusPendingAutomatedRemoval,
+		"pending.test":                 StatusPending,
+		"pendingremoval.test":          StatusPendingAutomatedRemoval,
+		"rejected.test":                StatusRejected,
+		"removed.test":                 StatusRemoved,
+		"unknown.test":                 StatusUnknown,
+		"pendingautomatedremoval.test": StatusPendingAutomatedRemoval,
+	}
 	for i := range domainStates {
-		if domainStates[i].Status != StatusPendingAutomatedRemoval {
-			t.Errorf("Unexpected status for %s domain state: wanted StatusPendingAutomatedRemoval, got %s", domainStates[i].Name, domainStates[i].Status)
+		if want := wantStatuses[domainStates[i].Name]; domainStates[i].Status != want {
+			t.Errorf("Unexpected status for %s domain state: wanted %s, got %s", domainStates[i].Name, want, domainStates[i].Status)
 		}
 	}
 }
 
+func TestPutStateIfUnchanged(t *testing.T) {
+	resetDB()
+
+	ctx := context.Background()
+	missing, err := testDB.StateForDomain(ctx, "cas.test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	pending := DomainState{Name: "cas.test", Status: StatusPending, SubmissionDate: time.Unix(1234, 5000)}
+	if err := testDB.PutStateIfUnchanged(ctx, missing, pending); err != nil {
+		t.Fatalf("cannot put state for a new domain: %s", err)
+	}
+
+	// `missing` is now stale.
+	preloaded := DomainState{Name: "cas.test", Status: StatusPreloaded}
+	if err := testDB.PutStateIfUnchanged(ctx, missing, preloaded); err != ErrStateChanged {
+		t.Errorf("Expected ErrStateChanged for a stale state, got: %v", err)
+	}
+	state, err := testDB.StateForDomain(ctx, "cas.test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if state.Status != StatusPending {
+		t.Errorf("A failed compare-and-swap changed the state: %#v", state)
+	}
+
+	if err := testDB.PutStateIfUnchanged(ctx, state, preloaded); err != nil {
+		t.Errorf("cannot put state with a fresh read: %s", err)
+	}
+	state, err = testDB.StateForDomain(ctx, "cas.test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if state.Status != StatusPreloaded {
+		t.Errorf("Wrong status: %s", state.Status)
+	}
+
+	transitions, err := testDB.TransitionsForDomain(ctx, "cas.test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(transitions) != 2 {
+		t.Errorf("Wrong number of transitions: %#v", transitions)
+	}
+}
+
+func TestInvalidTransition(t *testing.T) {
+	resetDB()
+
+	ctx := context.Background()
+	if err := testDB.PutState(setupCtx, DomainState{Name: "removed.test", Status: StatusRemoved}); err != nil {
+		t.Fatalf("cannot put state: %s", err)
+	}
+
+	err := testDB.PutStates(ctx, []DomainState{
+		{Name: "new.test", Status: StatusPending},
+		{Name: "removed.test", Status: StatusPendingRemoval},
+	}, blackholeLogf)
+	var invalid *InvalidTransitionError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("Expected an *InvalidTransitionError, got: %v", err)
+	}
+	if invalid.Name != "removed.test" || invalid.From != StatusRemoved || invalid.To != StatusPendingRemoval {
+		t.Errorf("Wrong error details: %#v", invalid)
+	}
+
+	// Nothing in the batch is written.
+	states, err := testDB.AllDomainStates(ctx)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !MatchWanted(states, []DomainState{{Name: "removed.test", Status: StatusRemoved}}) {
+		t.Errorf("Domains do not match wanted: %#v", states)
+	}
+
+	state, err := testDB.StateForDomain(ctx, "removed.test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := testDB.PutStateIfUnchanged(ctx, state, DomainState{Name: "removed.test", Status: StatusPendingRemoval}); err == nil {
+		t.Errorf("Expected an error for an invalid compare-and-swap")
+	}
+
+	// Admin tools can make any change.
+	adminCtx := WithActor(ctx, ActorAdmin, "fixing by hand")
+	if err := testDB.PutState(adminCtx, DomainState{Name: "removed.test", Status: StatusPendingRemoval}); err != nil {
+		t.Errorf("Admin writes should not be checked: %s", err)
+	}
+}
+
+func TestTransitionsForDomain(t *testing.T) {
+	resetDB()
+
+	transitions, err := testDB.TransitionsForDomain(context.Background(), "history.test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(transitions) != 0 {
+		t.Errorf("Unexpected transitions for a new domain: %#v", transitions)
+	}
+
+	writes := []struct {
+		actor  Actor
+		status PreloadStatus
+	}{
+		{ActorUser, StatusPending},
+		{ActorUpdate, StatusPreloaded},
+		// Writes that don't change the status are not transitions.
+		{ActorUpdate, StatusPreloaded},
+		{ActorUser, StatusPendingRemoval},
+	}
+	for _, write := range writes {
+		ctx := WithActor(context.Background(), write.actor, "message for "+string(write.status))
+		if err := testDB.PutState(ctx, DomainState{Name: "history.test", Status: write.status}); err != nil {
+			t.Fatalf("cannot put state: %s", err)
+		}
+	}
+	if err := testDB.PutState(context.Background(), DomainState{Name: "other.test", Status: StatusPending}); err != nil {
+		t.Fatalf("cannot put state: %s", err)
+	}
+
+	transitions, err = testDB.TransitionsForDomain(context.Background(), "history.test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	wanted := []Transition{
+		{Name: "history.test", OldStatus: StatusUnknown, NewStatus: StatusPending, Actor: ActorUser, Message: "message for pending"},
+		{Name: "history.test", OldStatus: StatusPending, NewStatus: StatusPreloaded, Actor: ActorUpdate, Message: "message for preloaded"},
+		{Name: "history.test", OldStatus: StatusPreloaded, NewStatus: StatusPendingRemoval, Actor: ActorUser, Message: "message for pending-removal"},
+	}
+	if len(transitions) != len(wanted) {
+		t.Fatalf("Wrong number of transitions: %#v", transitions)
+	}
+	for i, tr := range transitions {
+		if tr.Time.IsZero() {
+			t.Errorf("Transition %d has no time", i)
+		}
+		tr.Time = time.Time{}
+		if tr != wanted[i] {
+			t.Errorf("Transition %d does not match wanted: %#v", i, tr)
+		}
+	}
+
+	other, err := testDB.TransitionsForDomain(context.Background(), "other.test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(other) != 1 || other[0].Actor != ActorUnspecified {
+		t.Errorf("Unexpected transitions for other.test: %#v", other)
+	}
+}
+
 // setAndGetAllIneligibleDomainTests is a struct that is used in testing SetIneligibleDomainStates
 // and GetAllIneligibleDomainStates
 var setAndGetAllIneligibleDomainTests = []struct {
@@ -563,6 +865,7 @@ func TestSetAndGetAllIneligibleDomainStates(t *testing.T) {
 		}
 
 		err := testDB.SetIneligibleDomainStates(
+			context.Background(),
 			tt.domainStates,
 			statusReport,
 		)
@@ -576,7 +879,7 @@ func TestSetAndGetAllIneligibleDomainStates(t *testing.T) {
 		}
 
 		// get all domain states
-		domainStates, err := testDB.GetAllIneligibleDomainStates()
+		domainStates, err := testDB.GetAllIneligibleDomainStates(context.Background())
 		if err != nil {
 			t.Fatalf("%s", err)
 		}
@@ -676,6 +979,7 @@ func TestGetIneligibleDomainStates(t *testing.T) {
 
 		// add domains to the database
 		err := testDB.SetIneligibleDomainStates(
+			context.Background(),
 			tt.wantStates,
 			statusReport,
 		)
@@ -685,7 +989,7 @@ func TestGetIneligibleDomainStates(t *testing.T) {
 		}
 
 		// get domains from the database
-		domainStates, err := testDB.GetIneligibleDomainStates(tt.domainNames)
+		domainStates, err := testDB.GetIneligibleDomainStates(context.Background(), tt.domainNames)
 		if err != nil {
 			t.Errorf("%s", err)
 		}
@@ -716,6 +1020,7 @@ func TestDeleteIneligibleDomainStates(t *testing.T) {
 	for _, tt := range getAndDeleteTests {
 		// add domains to the database
 		err := testDB.SetIneligibleDomainStates(
+			context.Background(),
 			tt.wantStates,
 			statusReport,
 		)
@@ -725,14 +1030,14 @@ func TestDeleteIneligibleDomainStates(t *testing.T) {
 		}
 
 		// delete domains from the database
-		err = testDB.DeleteIneligibleDomainStates(tt.domainNames)
+		err = testDB.DeleteIneligibleDomainStates(context.Background(), tt.domainNames)
 		if err != nil {
 			t.Errorf("%s", err)
 		}
 
 		// get domains from the database
 		// should not exist as they are deleted
-		domainStates, err = testDB.GetIneligibleDomainStates(tt.domainNames)
+		domainStates, err = testDB.GetIneligibleDomainStates(context.Background(), tt.domainNames)
 
 		if merr, ok := err.(datastore.MultiError); ok {
 			for _, err := range merr {
@@ -765,6 +1070,7 @@ func TestSetDuplicateIneligibleDomainStates(t *testing.T) {
 		statuses = append(statuses, formatted)
 	}
 	err := testDB.SetIneligibleDomainStates(
+		context.Background(),
 		[]IneligibleDomainState{{Name: "gmail.test", Policy: "bulk-18-week", Scans: []Scan{
 			{
 				ScanTime: time.Unix(1234, 54324),
@@ -814,6 +1120,7 @@ func TestGetDuplicateIneligibleDomainStates(t *testing.T) {
 
 	// add domains to the database
 	err := testDB.SetIneligibleDomainStates(
+		context.Background(),
 		[]IneligibleDomainState{{Name: "gmail.test", Policy: "bulk-18-week", Scans: []Scan{
 			{
 				ScanTime: time.Unix(1234, 54324),
@@ -838,7 +1145,7 @@ func TestGetDuplicateIneligibleDomainStates(t *testing.T) {
 	// get duplicate domains from the database
 	var domainNames = []string{"gmail.test", "gmail.test"}
 
-	domainStates, err := testDB.GetIneligibleDomainStates(domainNames)
+	domainStates, err := testDB.GetIneligibleDomainStates(context.Background(), domainNames)
 	if err != nil {
 		t.Errorf("%s", err)
 	}
@@ -866,6 +1173,7 @@ func TestDeleteDuplicateIneligibleDomainStates(t *testing.T) {
 	}
 	// add domains to the database
 	err := testDB.SetIneligibleDomainStates(
+		context.Background(),
 		[]IneligibleDomainState{{Name: "gmail.test", Policy: "bulk-18-week", Scans: []Scan{
 			{
 				ScanTime: time.Unix(1234, 54324),
@@ -889,14 +1197,14 @@ func TestDeleteDuplicateIneligibleDomainStates(t *testing.T) {
 
 	// delete domains from the database
 	var domainNames = []string{"gmail.test", "gmail.test"}
-	err = testDB.DeleteIneligibleDomainStates(domainNames)
+	err = testDB.DeleteIneligibleDomainStates(context.Background(), domainNames)
 	if err != nil {
 		t.Errorf("%s", err)
 	}
 
 	// get domains from the database
 	// should not exist as they are deleted
-	domainStates, err := testDB.GetIneligibleDomainStates([]string{"gmail.test"})
+	domainStates, err := testDB.GetIneligibleDomainStates(context.Background(), []string{"gmail.test"})
 
 	if merr, ok := err.(datastore.MultiError); ok {
 		for _, err := range merr {
@@ -914,3 +1222,15 @@ func TestDeleteDuplicateIneligibleDomainStates(t *testing.T) {
 		t.Errorf("Empty database should contain no ineligible domains")
 	}
 }
+
+func TestCounterKeys(t *testing.T) {
+	keys := counterKeys("status:pending")
+	if len(keys) != counterShards+1 || keys[0].Name != "status:pending" || keys[1].Name != "status:pending#0" {
+		t.Errorf("Wrong counter keys: %v", keys)
+	}
+	for _, key := range keys {
+		if name := counterName(key); name != "status:pending" {
+			t.Errorf("counterName(%s) = %q", key.Name, name)
+		}
+	}
+}
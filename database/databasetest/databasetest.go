@@ -0,0 +1,863 @@
+// Package databasetest provides a conformance test suite for
+// implementations of database.Database.
+//
+// The suite pins down the behaviour that callers rely on and that
+// DatastoreBacked has, so that the other implementations (including the
+// Mock used by the API tests) can be checked against it:
+//
+//   - Reading missing domains
+//   - Range boundaries and the order of results
+//   - Duplicate names in a single call
+//   - Calls with more than one batch of entities, and reporting which
+//     batches were committed when one fails
+//   - Filtering by status
+//   - Keeping the stats counters up to date
+//   - Restoring states without recording their changes
+//   - Recording webhook deliveries for status changes
+//   - Storing preloadable jobs until they expire
+package databasetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/chromium/hstspreload"
+	"github.com/chromium/hstspreload.org/database"
+	"github.com/chromium/hstspreload/chromium/preloadlist"
+)
+
+// batchSize matches the batch size used by the database package. Calls
+// with more entities than this are split into several batches.
+const batchSize = 450
+
+// setupCtx is used to seed databases with domains in any status.
+var setupCtx = database.WithActor(context.Background(), database.ActorAdmin, "conformance test setup")
+
+func blackholeLogf(format string, args ...interface{}) {}
+
+// Run runs the conformance suite as subtests of `t`. `newDB` is called at
+// the start of every subtest, and must return an empty database.
+func Run(t *testing.T, newDB func(t *testing.T) database.Database) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, db database.Database)
+	}{
+		{"MissingDomains", testMissingDomains},
+		{"PutAndGet", testPutAndGet},
+		{"RangeBoundaries", testRangeBoundaries},
+		{"DuplicateNames", testDuplicateNames},
+		{"LargeBatches", testLargeBatches},
+		{"PartialCommit", testPartialCommit},
+		{"StatusFiltering", testStatusFiltering},
+		{"Transitions", testTransitions},
+		{"RestoreStates", testRestoreStates},
+		{"Stats", testStats},
+		{"IneligibleDomainStates", testIneligibleDomainStates},
+		{"MigrationRecords", testMigrationRecords},
+		{"Webhooks", testWebhooks},
+		{"Jobs", testJobs},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newDB(t))
+		})
+	}
+}
+
+func putStates(t *testing.T, db database.Database, states []database.DomainState) {
+	t.Helper()
+	if err := db.PutStates(setupCtx, states, blackholeLogf); err != nil {
+		t.Fatalf("cannot put states: %s", err)
+	}
+}
+
+func names(states []database.DomainState) []string {
+	var names []string
+	for _, s := range states {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+func collect[T any](t *testing.T, seq iter.Seq2[T, error]) []T {
+	t.Helper()
+	var values []T
+	for v, err := range seq {
+		if err != nil {
+			t.Fatalf("iteration failed: %s", err)
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func equalNames(got []string, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// isNoSuchEntity reports whether `err` is a datastore.MultiError with
+// datastore.ErrNoSuchEntity at exactly the indices in `missing`.
+func isNoSuchEntity(err error, missing ...int) bool {
+	var multiErr datastore.MultiError
+	if !errors.As(err, &multiErr) {
+		return false
+	}
+	for i, err := range multiErr {
+		wantMissing := false
+		for _, m := range missing {
+			wantMissing = wantMissing || i == m
+		}
+		if wantMissing != (err == datastore.ErrNoSuchEntity) || (!wantMissing && err != nil) {
+			return false
+		}
+	}
+	return true
+}
+
+func testMissingDomains(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	putStates(t, db, []database.DomainState{{Name: "a.test", Status: database.StatusPending}})
+
+	state, err := db.StateForDomain(ctx, "missing.test")
+	if err != nil {
+		t.Errorf("StateForDomain: %s", err)
+	}
+	if !state.Equal(database.DomainState{Status: database.StatusUnknown}) {
+		t.Errorf("StateForDomain of a missing domain: got %#v, want StatusUnknown", state)
+	}
+
+	states, err := db.StatesForDomains(ctx, []string{"a.test", "missing.test"})
+	if !isNoSuchEntity(err, 1) {
+		t.Errorf("StatesForDomains with a missing domain: got error %v, want datastore.ErrNoSuchEntity at index 1", err)
+	}
+	if len(states) != 0 {
+		t.Errorf("StatesForDomains with a missing domain returned states: %#v", states)
+	}
+
+	ineligible, err := db.GetIneligibleDomainStates(ctx, []string{"missing.test"})
+	if !isNoSuchEntity(err, 0) {
+		t.Errorf("GetIneligibleDomainStates with a missing domain: got error %v, want datastore.ErrNoSuchEntity at index 0", err)
+	}
+	if len(ineligible) != 0 {
+		t.Errorf("GetIneligibleDomainStates with a missing domain returned states: %#v", ineligible)
+	}
+
+	if err := db.DeleteIneligibleDomainStates(ctx, []string{"missing.test"}); err != nil {
+		t.Errorf("DeleteIneligibleDomainStates of a missing domain: %s", err)
+	}
+
+	transitions, err := db.TransitionsForDomain(ctx, "missing.test")
+	if err != nil {
+		t.Errorf("TransitionsForDomain: %s", err)
+	}
+	if len(transitions) != 0 {
+		t.Errorf("TransitionsForDomain of a missing domain: %#v", transitions)
+	}
+}
+
+func testPutAndGet(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	want := database.DomainState{
+		Name:              "a.test",
+		Status:            database.StatusPreloaded,
+		Message:           "a message",
+		SubmissionDate:    time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC),
+		IncludeSubDomains: true,
+		Policy:            preloadlist.Bulk1Year,
+		Submission: database.Submission{
+			Channel: database.ChannelWeb,
+			Issues: hstspreload.Issues{
+				Errors:   []hstspreload.Issue{},
+				Warnings: []hstspreload.Issue{{Code: "code", Summary: "summary", Message: "message"}},
+			},
+			Header:            "max-age=63072000; includeSubDomains; preload",
+			ClientFingerprint: "fingerprint",
+		},
+	}
+	if err := db.PutState(setupCtx, want); err != nil {
+		t.Fatalf("cannot put state: %s", err)
+	}
+
+	// Like Datastore, StateForDomain doesn't fill in the name.
+	state, err := db.StateForDomain(ctx, "a.test")
+	if err != nil {
+		t.Fatalf("StateForDomain: %s", err)
+	}
+	state.Name = want.Name
+	if !state.Equal(want) {
+		t.Errorf("StateForDomain: got %#v, want %#v", state, want)
+	}
+
+	states, err := db.StatesForDomains(ctx, []string{"a.test"})
+	if err != nil {
+		t.Fatalf("StatesForDomains: %s", err)
+	}
+	if len(states) != 1 || !states[0].Equal(want) {
+		t.Errorf("StatesForDomains: got %#v, want %#v", states, want)
+	}
+
+	// Updates only succeed if the stored state is the expected one.
+	update := want
+	update.Status = database.StatusPendingRemoval
+	if err := db.PutStateIfUnchanged(ctx, database.DomainState{Status: database.StatusPending}, update); err != database.ErrStateChanged {
+		t.Errorf("PutStateIfUnchanged with a stale state: got %v, want %v", err, database.ErrStateChanged)
+	}
+	if err := db.PutStateIfUnchanged(ctx, state, update); err != nil {
+		t.Errorf("PutStateIfUnchanged: %s", err)
+	}
+
+	// Invalid transitions are rejected.
+	update.Status = database.StatusPending
+	var invalid *database.InvalidTransitionError
+	if err := db.PutState(ctx, update); !errors.As(err, &invalid) {
+		t.Errorf("PutState with an invalid transition: got %v, want an InvalidTransitionError", err)
+	}
+	state, err = db.StateForDomain(ctx, "a.test")
+	if err != nil {
+		t.Fatalf("StateForDomain: %s", err)
+	}
+	if state.Status != database.StatusPendingRemoval {
+		t.Errorf("Wrong status after an invalid transition: %s", state.Status)
+	}
+}
+
+func testRangeBoundaries(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	putStates(t, db, []database.DomainState{
+		{Name: "d.test", Status: database.StatusPending},
+		{Name: "b.test", Status: database.StatusPending},
+		{Name: "a.test", Status: database.StatusPending},
+		{Name: "c.test", Status: database.StatusPending},
+	})
+
+	tests := []struct {
+		start, end string
+		want       []string
+	}{
+		{"", "", []string{"a.test", "b.test", "c.test", "d.test"}},
+		{"b.test", "d.test", []string{"b.test", "c.test"}},
+		{"", "b.test", []string{"a.test"}},
+		{"c.test", "", []string{"c.test", "d.test"}},
+		{"b", "c", []string{"b.test"}},
+		{"b.test", "b.test", nil},
+		{"d.test", "a.test", nil},
+		{"e", "", nil},
+	}
+
+	for _, tt := range tests {
+		states, err := db.DomainStatesInRange(ctx, tt.start, tt.end)
+		if err != nil {
+			t.Fatalf("DomainStatesInRange(%q, %q): %s", tt.start, tt.end, err)
+		}
+		if got := names(states); !equalNames(got, tt.want) {
+			t.Errorf("DomainStatesInRange(%q, %q): got %q, want %q", tt.start, tt.end, got, tt.want)
+		}
+
+		iterated := collect(t, db.IterateDomainStates(ctx, tt.start, tt.end))
+		if got := names(iterated); !equalNames(got, tt.want) {
+			t.Errorf("IterateDomainStates(%q, %q): got %q, want %q", tt.start, tt.end, got, tt.want)
+		}
+	}
+}
+
+func testDuplicateNames(t *testing.T, db database.Database) {
+	ctx := context.Background()
+
+	err := db.PutStates(setupCtx, []database.DomainState{
+		{Name: "a.test", Status: database.StatusPending},
+		{Name: "a.test", Status: database.StatusPreloaded},
+	}, blackholeLogf)
+	if !errors.Is(err, database.ErrDuplicateName) {
+		t.Errorf("PutStates with a duplicate name: got %v, want %v", err, database.ErrDuplicateName)
+	}
+	if state, err := db.StateForDomain(ctx, "a.test"); err != nil || state.Status != database.StatusUnknown {
+		t.Errorf("PutStates with a duplicate name should not write anything: got %#v, %v", state, err)
+	}
+
+	err = db.SetIneligibleDomainStates(ctx, []database.IneligibleDomainState{
+		{Name: "a.test", Policy: preloadlist.Bulk1Year},
+		{Name: "a.test", Policy: preloadlist.Bulk18Weeks},
+	}, blackholeLogf)
+	if err == nil {
+		t.Errorf("SetIneligibleDomainStates with a duplicate name should fail")
+	}
+
+	putStates(t, db, []database.DomainState{{Name: "b.test", Status: database.StatusPending}})
+	states, err := db.StatesForDomains(ctx, []string{"b.test", "b.test"})
+	if err != nil {
+		t.Fatalf("StatesForDomains with a duplicate name: %s", err)
+	}
+	if got := names(states); !equalNames(got, []string{"b.test", "b.test"}) {
+		t.Errorf("StatesForDomains with a duplicate name: got %q", got)
+	}
+
+	if err := db.SetIneligibleDomainStates(ctx, []database.IneligibleDomainState{{Name: "b.test"}}, blackholeLogf); err != nil {
+		t.Fatalf("cannot set ineligible state: %s", err)
+	}
+	ineligible, err := db.GetIneligibleDomainStates(ctx, []string{"b.test", "b.test"})
+	if err != nil {
+		t.Fatalf("GetIneligibleDomainStates with a duplicate name: %s", err)
+	}
+	if len(ineligible) != 2 || ineligible[0].Name != "b.test" || ineligible[1].Name != "b.test" {
+		t.Errorf("GetIneligibleDomainStates with a duplicate name: got %#v", ineligible)
+	}
+	if err := db.DeleteIneligibleDomainStates(ctx, []string{"b.test", "b.test"}); err != nil {
+		t.Errorf("DeleteIneligibleDomainStates with a duplicate name: %s", err)
+	}
+	if all, err := db.GetAllIneligibleDomainStates(ctx); err != nil || len(all) != 0 {
+		t.Errorf("DeleteIneligibleDomainStates with a duplicate name should delete the state: got %#v, %v", all, err)
+	}
+}
+
+func testLargeBatches(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	n := 2*batchSize + 1
+
+	var states []database.DomainState
+	var ineligible []database.IneligibleDomainState
+	var domains []string
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("domain%04d.test", i)
+		domains = append(domains, name)
+		states = append(states, database.DomainState{Name: name, Status: database.StatusPending})
+		ineligible = append(ineligible, database.IneligibleDomainState{Name: name, Policy: preloadlist.Bulk1Year})
+	}
+	putStates(t, db, states)
+	if err := db.SetIneligibleDomainStates(ctx, ineligible, blackholeLogf); err != nil {
+		t.Fatalf("cannot set ineligible states: %s", err)
+	}
+
+	all, err := db.AllDomainStates(ctx)
+	if err != nil {
+		t.Fatalf("AllDomainStates: %s", err)
+	}
+	if len(all) != n {
+		t.Errorf("AllDomainStates: got %d states, want %d", len(all), n)
+	}
+	if iterated := collect(t, db.IterateDomainStates(ctx, "", "")); !equalNames(names(iterated), domains) {
+		t.Errorf("IterateDomainStates: got %d states, want %d in order", len(iterated), n)
+	}
+
+	got, err := db.StatesForDomains(ctx, domains)
+	if err != nil {
+		t.Fatalf("StatesForDomains: %s", err)
+	}
+	if !equalNames(names(got), domains) {
+		t.Errorf("StatesForDomains: got %d states, want %d in order", len(got), n)
+	}
+
+	gotIneligible, err := db.GetIneligibleDomainStates(ctx, domains)
+	if err != nil {
+		t.Fatalf("GetIneligibleDomainStates: %s", err)
+	}
+	if len(gotIneligible) != n {
+		t.Errorf("GetIneligibleDomainStates: got %d states, want %d", len(gotIneligible), n)
+	}
+	if allIneligible, err := db.GetAllIneligibleDomainStates(ctx); err != nil || len(allIneligible) != n {
+		t.Errorf("GetAllIneligibleDomainStates: got %d states, want %d (%v)", len(allIneligible), n, err)
+	}
+	if iterated := collect(t, db.IterateIneligibleDomainStates(ctx)); len(iterated) != n {
+		t.Errorf("IterateIneligibleDomainStates: got %d states, want %d", len(iterated), n)
+	}
+
+	// A missing domain in a later batch is reported at its index in that
+	// batch.
+	_, err = db.StatesForDomains(ctx, append(domains, "missing.test"))
+	if !isNoSuchEntity(err, 1) {
+		t.Errorf("StatesForDomains with a missing domain in the last batch: got error %v", err)
+	}
+
+	if err := db.DeleteIneligibleDomainStates(ctx, domains); err != nil {
+		t.Fatalf("DeleteIneligibleDomainStates: %s", err)
+	}
+	if allIneligible, err := db.GetAllIneligibleDomainStates(ctx); err != nil || len(allIneligible) != 0 {
+		t.Errorf("GetAllIneligibleDomainStates after deleting: got %d states (%v)", len(allIneligible), err)
+	}
+}
+
+func testPartialCommit(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	putStates(t, db, []database.DomainState{{Name: "removed.test", Status: database.StatusRemoved}})
+
+	// The first batch is valid, and the second one isn't.
+	var updates []database.DomainState
+	for i := 0; i < batchSize; i++ {
+		updates = append(updates, database.DomainState{Name: fmt.Sprintf("domain%03d.test", i), Status: database.StatusPending})
+	}
+	updates = append(updates, database.DomainState{Name: "removed.test", Status: database.StatusPendingRemoval})
+
+	err := db.PutStates(ctx, updates, blackholeLogf)
+	var partial *database.PartialCommitError
+	if !errors.As(err, &partial) {
+		t.Fatalf("PutStates with an invalid second batch: got %v, want a PartialCommitError", err)
+	}
+	if len(partial.Committed) != batchSize || partial.Committed[0] != "domain000.test" {
+		t.Errorf("Wrong committed domains: got %d", len(partial.Committed))
+	}
+	if !equalNames(partial.Uncommitted, []string{"removed.test"}) {
+		t.Errorf("Wrong uncommitted domains: got %q", partial.Uncommitted)
+	}
+	var invalid *database.InvalidTransitionError
+	if !errors.As(err, &invalid) {
+		t.Errorf("PartialCommitError should wrap the InvalidTransitionError, got %v", partial.Err)
+	}
+
+	pending, err := db.StatesWithStatus(ctx, database.StatusPending)
+	if err != nil {
+		t.Fatalf("StatesWithStatus: %s", err)
+	}
+	if len(pending) != batchSize {
+		t.Errorf("The first batch should be committed: got %d pending states", len(pending))
+	}
+}
+
+func testStatusFiltering(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	putStates(t, db, []database.DomainState{
+		{Name: "a.test", Status: database.StatusPending},
+		{Name: "b.test", Status: database.StatusPreloaded},
+		{Name: "c.test", Status: database.StatusPending},
+		{Name: "d.test", Status: database.StatusRemoved},
+	})
+
+	check := func(status database.PreloadStatus, want []string) {
+		t.Helper()
+		states, err := db.StatesWithStatus(ctx, status)
+		if err != nil {
+			t.Fatalf("StatesWithStatus(%s): %s", status, err)
+		}
+		if got := names(states); !equalNames(got, want) {
+			t.Errorf("StatesWithStatus(%s): got %q, want %q", status, got, want)
+		}
+		if got := names(collect(t, db.IterateStatesWithStatus(ctx, status))); !equalNames(got, want) {
+			t.Errorf("IterateStatesWithStatus(%s): got %q, want %q", status, got, want)
+		}
+	}
+
+	check(database.StatusPending, []string{"a.test", "c.test"})
+	check(database.StatusPreloaded, []string{"b.test"})
+	check(database.StatusRemoved, []string{"d.test"})
+	check(database.StatusPendingRemoval, nil)
+
+	// Changing the status of a domain moves it between the results.
+	if err := db.PutState(ctx, database.DomainState{Name: "a.test", Status: database.StatusPreloaded}); err != nil {
+		t.Fatalf("cannot put state: %s", err)
+	}
+	check(database.StatusPending, []string{"c.test"})
+	check(database.StatusPreloaded, []string{"a.test", "b.test"})
+}
+
+func testTransitions(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	if err := db.PutState(database.WithActor(ctx, database.ActorUser, "submitted"), database.DomainState{Name: "a.test", Status: database.StatusPending}); err != nil {
+		t.Fatalf("cannot put state: %s", err)
+	}
+	// Writes that keep the status the same are not recorded.
+	if err := db.PutState(ctx, database.DomainState{Name: "a.test", Status: database.StatusPending, Message: "still pending"}); err != nil {
+		t.Fatalf("cannot put state: %s", err)
+	}
+	if err := db.PutStates(database.WithActor(ctx, database.ActorUpdate, "synced"), []database.DomainState{{Name: "a.test", Status: database.StatusPreloaded}}, blackholeLogf); err != nil {
+		t.Fatalf("cannot put states: %s", err)
+	}
+
+	transitions, err := db.TransitionsForDomain(ctx, "a.test")
+	if err != nil {
+		t.Fatalf("TransitionsForDomain: %s", err)
+	}
+	want := []database.Transition{
+		{Name: "a.test", OldStatus: database.StatusUnknown, NewStatus: database.StatusPending, Actor: database.ActorUser, Message: "submitted"},
+		{Name: "a.test", OldStatus: database.StatusPending, NewStatus: database.StatusPreloaded, Actor: database.ActorUpdate, Message: "synced"},
+	}
+	if len(transitions) != len(want) {
+		t.Fatalf("TransitionsForDomain: got %#v", transitions)
+	}
+	for i, tr := range transitions {
+		tr.Time = time.Time{}
+		if tr != want[i] {
+			t.Errorf("Transition %d: got %#v, want %#v", i, tr, want[i])
+		}
+	}
+}
+
+func testRestoreStates(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	if err := db.PutSubscription(ctx, database.Subscription{ID: "sub", Domain: "test", IncludeSubdomains: true, URL: "https://hooks.test/"}); err != nil {
+		t.Fatalf("PutSubscription: %s", err)
+	}
+	putStates(t, db, []database.DomainState{{Name: "a.test", Status: database.StatusPending}})
+	before, err := db.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Stats: %s", err)
+	}
+	deliveries, err := db.DueDeliveries(ctx, time.Now().Add(time.Minute), 100)
+	if err != nil {
+		t.Fatalf("DueDeliveries: %s", err)
+	}
+
+	// Restored states are written as they are, even if the transition
+	// isn't allowed.
+	restored := []database.DomainState{
+		{Name: "a.test", Status: database.StatusRemoved, Message: "restored"},
+		{Name: "b.test", Status: database.StatusPreloaded},
+	}
+	if err := db.RestoreStates(ctx, restored, blackholeLogf); err != nil {
+		t.Fatalf("RestoreStates: %s", err)
+	}
+	states, err := db.StatesForDomains(ctx, []string{"a.test", "b.test"})
+	if err != nil {
+		t.Fatalf("StatesForDomains: %s", err)
+	}
+	if !database.MatchWanted(states, restored) {
+		t.Errorf("StatesForDomains: got %#v", states)
+	}
+
+	transitions, err := db.TransitionsForDomain(ctx, "a.test")
+	if err != nil {
+		t.Fatalf("TransitionsForDomain: %s", err)
+	}
+	if len(transitions) != 1 || transitions[0].NewStatus != database.StatusPending {
+		t.Errorf("TransitionsForDomain: got %#v", transitions)
+	}
+	after, err := db.DueDeliveries(ctx, time.Now().Add(time.Minute), 100)
+	if err != nil {
+		t.Fatalf("DueDeliveries: %s", err)
+	}
+	if len(after) != len(deliveries) {
+		t.Errorf("DueDeliveries: got %d deliveries, want %d", len(after), len(deliveries))
+	}
+	stats, err := db.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Stats: %s", err)
+	}
+	if !reflect.DeepEqual(stats, before) {
+		t.Errorf("Stats: got %#v, want %#v", stats, before)
+	}
+}
+
+func testStats(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	day1 := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	day2 := time.Date(2024, time.March, 2, 23, 0, 0, 0, time.UTC)
+
+	check := func(want database.Stats) {
+		t.Helper()
+		got, err := db.Stats(ctx)
+		if err != nil {
+			t.Fatalf("Stats: %s", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Stats: got %#v, want %#v", got, want)
+		}
+	}
+
+	check(database.Stats{
+		Statuses:    map[database.PreloadStatus]int{},
+		Policies:    map[preloadlist.PolicyType]int{},
+		Submissions: map[string]int{},
+	})
+
+	putStates(t, db, []database.DomainState{
+		{Name: "a.test", Status: database.StatusPending, SubmissionDate: day1},
+		{Name: "b.test", Status: database.StatusPending, SubmissionDate: day1},
+		{Name: "c.test", Status: database.StatusPreloaded, Policy: preloadlist.Bulk1Year},
+		{Name: "d.test", Status: database.StatusPreloaded, Policy: preloadlist.Custom},
+	})
+	want := database.Stats{
+		Statuses:    map[database.PreloadStatus]int{database.StatusPending: 2, database.StatusPreloaded: 2},
+		Policies:    map[preloadlist.PolicyType]int{preloadlist.Bulk1Year: 1, preloadlist.Custom: 1},
+		Submissions: map[string]int{"2024-03-01": 2},
+	}
+	check(want)
+
+	// Rewriting a state without changes doesn't count it twice.
+	putStates(t, db, []database.DomainState{{Name: "a.test", Status: database.StatusPending, SubmissionDate: day1}})
+	check(want)
+
+	// Status and policy changes move the counts, and resubmissions are
+	// counted on the new day.
+	putStates(t, db, []database.DomainState{
+		{Name: "a.test", Status: database.StatusPreloaded, SubmissionDate: day1, Policy: preloadlist.Bulk1Year},
+		{Name: "d.test", Status: database.StatusRemoved},
+	})
+	state, err := db.StateForDomain(ctx, "d.test")
+	if err != nil {
+		t.Fatalf("StateForDomain: %s", err)
+	}
+	if err := db.PutStateIfUnchanged(ctx, state, database.DomainState{Name: "d.test", Status: database.StatusPending, SubmissionDate: day2}); err != nil {
+		t.Fatalf("PutStateIfUnchanged: %s", err)
+	}
+	want = database.Stats{
+		Statuses:    map[database.PreloadStatus]int{database.StatusPending: 2, database.StatusPreloaded: 2},
+		Policies:    map[preloadlist.PolicyType]int{preloadlist.Bulk1Year: 2},
+		Submissions: map[string]int{"2024-03-01": 2, "2024-03-02": 1},
+	}
+	check(want)
+
+	// Removal requests set the SubmissionDate too, but are not counted as
+	// submissions.
+	state, err = db.StateForDomain(ctx, "c.test")
+	if err != nil {
+		t.Fatalf("StateForDomain: %s", err)
+	}
+	if err := db.PutStateIfUnchanged(ctx, state, database.DomainState{Name: "c.test", Status: database.StatusPendingRemoval, SubmissionDate: day2, Policy: preloadlist.Bulk1Year}); err != nil {
+		t.Fatalf("PutStateIfUnchanged: %s", err)
+	}
+	want.Statuses = map[database.PreloadStatus]int{database.StatusPending: 2, database.StatusPreloaded: 1, database.StatusPendingRemoval: 1}
+	check(want)
+
+	// Recounting from scratch only knows about the latest submission of
+	// each pending domain.
+	if err := db.SetStats(ctx, database.Stats{Statuses: map[database.PreloadStatus]int{database.StatusRemoved: 5}}); err != nil {
+		t.Fatalf("SetStats: %s", err)
+	}
+	check(database.Stats{
+		Statuses:    map[database.PreloadStatus]int{database.StatusRemoved: 5},
+		Policies:    map[preloadlist.PolicyType]int{},
+		Submissions: map[string]int{},
+	})
+	if err := database.RecountStats(ctx, db); err != nil {
+		t.Fatalf("RecountStats: %s", err)
+	}
+	want.Submissions = map[string]int{"2024-03-01": 1, "2024-03-02": 1}
+	check(want)
+}
+
+func testIneligibleDomainStates(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	want := database.IneligibleDomainState{
+		Name:   "a.test",
+		Policy: preloadlist.Bulk1Year,
+		Scans: []database.Scan{{
+			ScanTime: time.Date(2024, time.March, 2, 12, 0, 0, 0, time.UTC),
+			Issues:   hstspreload.Issues{Errors: []hstspreload.Issue{{Code: "code", Summary: "summary", Message: "message"}}},
+		}},
+	}
+	if err := db.SetIneligibleDomainStates(ctx, []database.IneligibleDomainState{want, {Name: "b.test"}}, blackholeLogf); err != nil {
+		t.Fatalf("cannot set ineligible states: %s", err)
+	}
+
+	got, err := db.GetIneligibleDomainStates(ctx, []string{"a.test"})
+	if err != nil {
+		t.Fatalf("GetIneligibleDomainStates: %s", err)
+	}
+	if len(got) != 1 || got[0].Name != want.Name || got[0].Policy != want.Policy || len(got[0].Scans) != 1 ||
+		!got[0].Scans[0].ScanTime.Equal(want.Scans[0].ScanTime) || len(got[0].Scans[0].Issues.Errors) != 1 ||
+		got[0].Scans[0].Issues.Errors[0] != want.Scans[0].Issues.Errors[0] {
+		t.Errorf("GetIneligibleDomainStates: got %#v, want %#v", got, want)
+	}
+
+	all, err := db.GetAllIneligibleDomainStates(ctx)
+	if err != nil {
+		t.Fatalf("GetAllIneligibleDomainStates: %s", err)
+	}
+	if len(all) != 2 || all[0].Name != "a.test" || all[1].Name != "b.test" {
+		t.Errorf("GetAllIneligibleDomainStates: got %#v", all)
+	}
+
+	if err := db.DeleteIneligibleDomainStates(ctx, []string{"a.test"}); err != nil {
+		t.Fatalf("DeleteIneligibleDomainStates: %s", err)
+	}
+	iterated := collect(t, db.IterateIneligibleDomainStates(ctx))
+	if len(iterated) != 1 || iterated[0].Name != "b.test" {
+		t.Errorf("IterateIneligibleDomainStates after deleting: got %#v", iterated)
+	}
+}
+
+func testMigrationRecords(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	records, err := db.MigrationRecords(ctx)
+	if err != nil {
+		t.Fatalf("MigrationRecords: %s", err)
+	}
+	if len(records) != 0 {
+		t.Errorf("MigrationRecords of an empty database: %#v", records)
+	}
+
+	updated := time.Date(2024, time.March, 3, 12, 0, 0, 0, time.UTC)
+	for _, record := range []database.MigrationRecord{
+		{Version: 2, Name: "second", Cursor: "b.test\x00", Migrated: 1, Updated: updated},
+		{Version: 1, Name: "first", Migrated: 3, Done: true, Updated: updated},
+		{Version: 2, Name: "second", Migrated: 2, Done: true, Updated: updated},
+	} {
+		if err := db.PutMigrationRecord(ctx, record); err != nil {
+			t.Fatalf("PutMigrationRecord: %s", err)
+		}
+	}
+
+	records, err = db.MigrationRecords(ctx)
+	if err != nil {
+		t.Fatalf("MigrationRecords: %s", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("MigrationRecords: got %#v", records)
+	}
+	for _, r := range records {
+		if !r.Done || r.Cursor != "" || !r.Updated.Equal(updated) {
+			t.Errorf("MigrationRecords: got %#v", r)
+		}
+	}
+}
+
+func testWebhooks(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	created := time.Date(2024, time.March, 3, 12, 0, 0, 0, time.UTC)
+	subscriptions := []database.Subscription{
+		{ID: "exact", Domain: "a.test", URL: "https://hooks.test/exact", Secret: "s1", Created: created},
+		{ID: "suffix", Domain: "b.test", IncludeSubdomains: true, URL: "https://hooks.test/suffix", Secret: "s2", Created: created},
+		{ID: "preloaded", Domain: "a.test", Statuses: []database.PreloadStatus{database.StatusPreloaded}, URL: "https://hooks.test/preloaded", Secret: "s3", Created: created},
+		{ID: "deleted", Domain: "a.test", URL: "https://hooks.test/deleted", Secret: "s4", Created: created},
+	}
+	for _, s := range subscriptions {
+		if err := db.PutSubscription(ctx, s); err != nil {
+			t.Fatalf("PutSubscription: %s", err)
+		}
+	}
+	if err := db.DeleteSubscription(ctx, "deleted"); err != nil {
+		t.Fatalf("DeleteSubscription: %s", err)
+	}
+
+	got, err := db.Subscriptions(ctx)
+	if err != nil {
+		t.Fatalf("Subscriptions: %s", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("Subscriptions: got %#v", got)
+	}
+	byID := map[string]database.Subscription{}
+	for _, s := range got {
+		byID[s.ID] = s
+	}
+	if s := byID["preloaded"]; s.Domain != "a.test" || s.Secret != "s3" || !s.Created.Equal(created) ||
+		!reflect.DeepEqual(s.Statuses, []database.PreloadStatus{database.StatusPreloaded}) {
+		t.Errorf("Subscriptions: got %#v", s)
+	}
+
+	// a.test matches "exact", sub.b.test matches "suffix", and the other
+	// domains match nothing.
+	putStates(t, db, []database.DomainState{
+		{Name: "a.test", Status: database.StatusPending},
+		{Name: "sub.b.test", Status: database.StatusPending},
+		{Name: "notb.test", Status: database.StatusPending},
+		{Name: "c.test", Status: database.StatusPending},
+	})
+	// The second write of a.test matches "exact" and "preloaded".
+	old, err := db.StateForDomain(ctx, "a.test")
+	if err != nil {
+		t.Fatalf("StateForDomain: %s", err)
+	}
+	if err := db.PutStateIfUnchanged(setupCtx, old, database.DomainState{Name: "a.test", Status: database.StatusPreloaded}); err != nil {
+		t.Fatalf("PutStateIfUnchanged: %s", err)
+	}
+	// Writes that don't change the status are not posted.
+	putStates(t, db, []database.DomainState{{Name: "c.test", Status: database.StatusPending, Message: "unchanged"}})
+
+	deliveries, err := db.DueDeliveries(ctx, time.Now().Add(time.Minute), 100)
+	if err != nil {
+		t.Fatalf("DueDeliveries: %s", err)
+	}
+	var gotDeliveries []string
+	for _, d := range deliveries {
+		if d.ID == "" || d.Event.Actor != database.ActorAdmin {
+			t.Errorf("DueDeliveries: got %#v", d)
+		}
+		gotDeliveries = append(gotDeliveries, fmt.Sprintf("%s %s %s", d.SubscriptionID, d.Event.Domain, d.Event.NewStatus))
+	}
+	wantDeliveries := map[string]bool{
+		"exact a.test pending":       true,
+		"suffix sub.b.test pending":  true,
+		"exact a.test preloaded":     true,
+		"preloaded a.test preloaded": true,
+	}
+	if len(gotDeliveries) != len(wantDeliveries) {
+		t.Fatalf("DueDeliveries: got %q", gotDeliveries)
+	}
+	for _, d := range gotDeliveries {
+		if !wantDeliveries[d] {
+			t.Errorf("DueDeliveries: unexpected delivery %q", d)
+		}
+	}
+
+	// Retried deliveries are only due after their next attempt.
+	next := time.Now().Add(time.Hour).Truncate(time.Second)
+	retried := deliveries[0]
+	retried.Attempts = 1
+	retried.NextAttempt = next
+	retried.LastError = "status 500"
+	if err := db.PutDelivery(ctx, retried); err != nil {
+		t.Fatalf("PutDelivery: %s", err)
+	}
+	if err := db.DeleteDelivery(ctx, deliveries[1].ID); err != nil {
+		t.Fatalf("DeleteDelivery: %s", err)
+	}
+	due, err := db.DueDeliveries(ctx, time.Now().Add(time.Minute), 1)
+	if err != nil {
+		t.Fatalf("DueDeliveries: %s", err)
+	}
+	if len(due) != 1 || due[0].ID == retried.ID || due[0].ID == deliveries[1].ID {
+		t.Errorf("DueDeliveries with a limit: got %#v", due)
+	}
+	due, err = db.DueDeliveries(ctx, next, 100)
+	if err != nil {
+		t.Fatalf("DueDeliveries: %s", err)
+	}
+	if len(due) != 3 || due[2].ID != retried.ID || due[2].Attempts != 1 || due[2].LastError != "status 500" || !due[2].NextAttempt.Equal(next) {
+		t.Errorf("DueDeliveries after a retry: got %#v", due)
+	}
+}
+
+func testJobs(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	created := time.Date(2024, time.March, 3, 12, 0, 0, 0, time.UTC)
+	issues := hstspreload.Issues{Errors: []hstspreload.Issue{{Code: "header.preloadable.no_header", Summary: "No HSTS header"}}}
+
+	if _, err := db.Job(ctx, "missing"); !errors.Is(err, database.ErrNoSuchJob) {
+		t.Errorf("Job for a missing job: got %v", err)
+	}
+
+	jobs := []database.Job{
+		{ID: "running", Domains: []string{"a.test", "b.test"}, Created: created, Expires: created.Add(time.Hour),
+			Results: []database.JobResult{{Domain: "a.test", Issues: issues}}},
+		{ID: "expired", Domains: []string{"c.test"}, Created: created, Finished: created, Expires: created.Add(time.Minute),
+			Results: []database.JobResult{{Domain: "c.test"}}},
+	}
+	for _, job := range jobs {
+		if err := db.PutJob(ctx, job); err != nil {
+			t.Fatalf("PutJob: %s", err)
+		}
+	}
+
+	job, err := db.Job(ctx, "running")
+	if err != nil {
+		t.Fatalf("Job: %s", err)
+	}
+	if job.ID != "running" || !reflect.DeepEqual(job.Domains, jobs[0].Domains) ||
+		!job.Created.Equal(created) || !job.Finished.IsZero() || !job.Expires.Equal(created.Add(time.Hour)) ||
+		len(job.Results) != 1 || job.Results[0].Domain != "a.test" || !job.Results[0].Issues.Match(issues) {
+		t.Errorf("Job: got %#v", job)
+	}
+
+	if err := db.DeleteExpiredJobs(ctx, created.Add(time.Minute)); err != nil {
+		t.Fatalf("DeleteExpiredJobs: %s", err)
+	}
+	if _, err := db.Job(ctx, "expired"); !errors.Is(err, database.ErrNoSuchJob) {
+		t.Errorf("Job for an expired job: got %v", err)
+	}
+	if _, err := db.Job(ctx, "running"); err != nil {
+		t.Errorf("Job for a job that has not expired: %s", err)
+	}
+}
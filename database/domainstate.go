@@ -14,7 +14,7 @@ type PreloadStatus string
 // Values for PreloadStatus
 const (
 	// NOTE: If changing (or adding) these values, also update
-	// frontend/static/js/form.js.
+	// frontend/static/js/form.js and validTransitions in statemachine.go.
 	StatusUnknown                 = "unknown"
 	StatusPending                 = "pending"
 	StatusPreloaded               = "preloaded"
@@ -43,6 +43,9 @@ type DomainState struct {
 	IncludeSubDomains bool `json:"-"`
 	// PolicyType represents the policy under which the domain is a part of the preload list
 	Policy preloadlist.PolicyType `json:"-"`
+	// Submission is the metadata recorded when the domain was last
+	// submitted. It is only exposed through the admin API.
+	Submission Submission `datastore:",noindex" json:"-"`
 }
 
 // MatchesWanted checks if the fields of `s` match `wanted`.
@@ -69,14 +72,16 @@ func (s DomainState) MatchesWanted(wanted DomainState) bool {
 
 // Equal checks if the fields of `s` are equal to the fields of `s2`,
 // using == for all fields except for SubmissionDate, where Time.Equal is
-// used instead. This is a more strict check than MatchesWanted and is
-// intended for testing purposes.
+// used instead, and Submission, where Submission.Equal is used instead.
+// This is a more strict check than MatchesWanted and is intended for
+// testing purposes.
 func (s DomainState) Equal(s2 DomainState) bool {
 	return s.Name == s2.Name && s.Status == s2.Status &&
 		s.Message == s2.Message &&
 		s.SubmissionDate.Equal(s2.SubmissionDate) &&
 		s.IncludeSubDomains == s2.IncludeSubDomains &&
-		s.Policy == s2.Policy
+		s.Policy == s2.Policy &&
+		s.Submission.Equal(s2.Submission)
 }
 
 // ToEntry converts a DomainState to a preloadlist.Entry.
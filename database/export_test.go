@@ -0,0 +1,10 @@
+package database
+
+// Exported for the tests in package database_test.
+
+// SharedTestDB returns the database shared by the tests in this package, after
+// clearing it.
+func SharedTestDB() Database {
+	resetDB()
+	return testDB
+}
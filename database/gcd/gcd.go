@@ -147,21 +147,22 @@ func NewLocalBackend() (db LocalBackend, shutdown func() error, err error) {
 
 // NewClient constructs a datastore client for the emulated LocalBackend.
 // The constructed client will work offline and never connect to the wide internet.
+//
+// The client owns its connection to the emulator, so callers should
+// reuse it and call Close() when they are done with it.
 func (db LocalBackend) NewClient(ctx context.Context, projectID string) (*datastore.Client, error) {
-	// The code below is based closely on the implementation of
-	// datastore.NewClient().
+	// The options below match the ones datastore.NewClient() uses when
+	// DATASTORE_EMULATOR_HOST is set.
 
 	if db.addr == "" {
 		return nil, errors.New("empty addr, uninitialized local backend?")
 	}
 
-	//lint:ignore SA1019 ignoring that Dial is deprecated for now
-	conn, err := grpc.Dial(db.addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return nil, fmt.Errorf("grpc.Dial: %v", err)
+	o := []option.ClientOption{
+		option.WithEndpoint(db.addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
 	}
-
-	var o = []option.ClientOption{option.WithGRPCConn(conn)}
 	client, err := datastore.NewClient(ctx, projectID, o...)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+const transitionKind = "DomainStateTransition"
+
+// Actor identifies who (or what) caused a change in a domain's status.
+type Actor string
+
+// Values for Actor
+const (
+	// ActorUnspecified is used for writes made without WithActor.
+	ActorUnspecified Actor = "unspecified"
+	// ActorUser is a submission or removal request from a site operator.
+	ActorUser Actor = "user"
+	// ActorUpdate is the cron job that syncs with the Chromium preload list.
+	ActorUpdate Actor = "update"
+	// ActorAutomatedRemoval is the cron job that removes ineligible domains.
+	ActorAutomatedRemoval Actor = "automated-removal"
+	// ActorAdmin is a preload list maintainer using debug or admin tools.
+	ActorAdmin Actor = "admin"
+	// ActorMigration is a schema migration (see RunMigrations).
+	ActorMigration Actor = "migration"
+)
+
+// A Transition records a single change in the status of a domain.
+type Transition struct {
+	// Name is taken from the parent key in the datastore, so we don't
+	// include it as a field in the stored value.
+	Name      string        `datastore:"-" json:"name"`
+	OldStatus PreloadStatus `json:"oldStatus"`
+	NewStatus PreloadStatus `json:"newStatus"`
+	Actor     Actor         `json:"actor"`
+	Time      time.Time     `json:"time"`
+	Message   string        `datastore:",noindex" json:"message,omitempty"`
+}
+
+type actorKey struct{}
+
+type actorValue struct {
+	actor   Actor
+	message string
+}
+
+// WithActor returns a copy of ctx that attributes any state changes written
+// with it to `actor`. The message is recorded with each transition, and
+// should explain why the status changed.
+func WithActor(ctx context.Context, actor Actor, message string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actorValue{actor, message})
+}
+
+func actorFromContext(ctx context.Context) actorValue {
+	if v, ok := ctx.Value(actorKey{}).(actorValue); ok {
+		return v
+	}
+	return actorValue{actor: ActorUnspecified}
+}
+
+// newTransitions returns a Transition for every update that changes the
+// status of its domain. `stored` holds the states currently in the
+// database; domains missing from it are treated as StatusUnknown.
+func newTransitions(ctx context.Context, stored map[string]DomainState, updates []DomainState) []Transition {
+	a := actorFromContext(ctx)
+	now := truncateTime(time.Now())
+
+	var transitions []Transition
+	for _, update := range updates {
+		oldStatus := PreloadStatus(StatusUnknown)
+		if old, ok := stored[update.Name]; ok {
+			oldStatus = old.Status
+		}
+		if oldStatus == update.Status {
+			continue
+		}
+		transitions = append(transitions, Transition{
+			Name:      update.Name,
+			OldStatus: oldStatus,
+			NewStatus: update.Status,
+			Actor:     a.actor,
+			Time:      now,
+			Message:   a.message,
+		})
+	}
+	return transitions
+}
+
+// sortTransitions sorts transitions into chronological order, keeping the
+// write order for transitions with the same time.
+func sortTransitions(transitions []Transition) {
+	sort.SliceStable(transitions, func(i, j int) bool {
+		return transitions[i].Time.Before(transitions[j].Time)
+	})
+}
@@ -0,0 +1,48 @@
+package database
+
+import (
+	"context"
+	"iter"
+)
+
+// pageSize is the number of entities fetched at a time by the Iterate*
+// methods of the Database implementations that page through results.
+const pageSize = 1000
+
+// The Iterate* methods of a Database return a sequence of (value, nil)
+// pairs. If the underlying query fails, the sequence ends with a single
+// (zero value, err) pair.
+
+// collect gathers the values of `seq` into a slice. It stops at the first
+// error.
+func collect[T any](seq iter.Seq2[T, error]) (values []T, err error) {
+	for v, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// sliceSeq returns a sequence over `values`, or a sequence with only `err`
+// if it is not nil. It is used by implementations that hold all of their
+// values in memory anyway.
+func sliceSeq[T any](ctx context.Context, values []T, err error) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+		for _, v := range values {
+			if err := ctx.Err(); err != nil {
+				yield(zero, err)
+				return
+			}
+			if !yield(v, nil) {
+				return
+			}
+		}
+	}
+}
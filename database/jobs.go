@@ -0,0 +1,64 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/chromium/hstspreload"
+)
+
+const jobKind = "PreloadableJob"
+
+// ErrNoSuchJob is returned by Job if no job with the given ID is stored.
+var ErrNoSuchJob = errors.New("no such job")
+
+// A Job is a bulk preloadability check. It is stored while it runs and
+// for a while after it finishes, so that any instance can serve its
+// progress and results.
+type Job struct {
+	// ID is the key in the datastore, so we don't include it as a field
+	// in the stored value.
+	ID      string   `datastore:"-"`
+	Domains []string `datastore:",noindex"`
+	// Results holds the results for the domains that have been checked so
+	// far, in the order of Domains.
+	Results []JobResult `datastore:",noindex"`
+	Created time.Time   `datastore:",noindex"`
+	// Finished is zero until every domain has been checked.
+	Finished time.Time `datastore:",noindex"`
+	// Expires is when the job may be deleted.
+	Expires time.Time
+}
+
+// JobResult is the result of checking a single domain of a Job.
+type JobResult struct {
+	Domain string
+	Issues hstspreload.Issues
+}
+
+// copyJob makes a deep copy of `job`, with its times truncated like
+// Datastore does.
+func copyJob(job Job) Job {
+	job.Domains = slices.Clone(job.Domains)
+	job.Results = slices.Clone(job.Results)
+	for i, r := range job.Results {
+		job.Results[i].Issues = copyIssues(r.Issues)
+	}
+	job.Created = truncateTime(job.Created)
+	job.Finished = truncateTime(job.Finished)
+	job.Expires = truncateTime(job.Expires)
+	return job
+}
+
+// expiredJobIDs returns the IDs of the jobs in `jobs` that have expired
+// at `now`.
+func expiredJobIDs(jobs []Job, now time.Time) []string {
+	var ids []string
+	for _, job := range jobs {
+		if !now.Before(job.Expires) {
+			ids = append(ids, job.ID)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,186 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/chromium/hstspreload"
+	"github.com/chromium/hstspreload/chromium/preloadlist"
+)
+
+// jsonlRecord is a single line of a JSON Lines export. Exactly one of its
+// fields is set.
+//
+// The JSON encodings of DomainState and IneligibleDomainState are used by
+// the API and leave out some fields, so exports use their own types that
+// include every stored field.
+type jsonlRecord struct {
+	DomainState           *jsonlDomainState           `json:"domainState,omitempty"`
+	IneligibleDomainState *jsonlIneligibleDomainState `json:"ineligibleDomainState,omitempty"`
+}
+
+type jsonlDomainState struct {
+	Name              string                 `json:"name"`
+	Status            PreloadStatus          `json:"status"`
+	Message           string                 `json:"message,omitempty"`
+	SubmissionDate    time.Time              `json:"submissionDate"`
+	IncludeSubDomains bool                   `json:"includeSubDomains"`
+	Policy            preloadlist.PolicyType `json:"policy,omitempty"`
+	Submission        Submission             `json:"submission,omitzero"`
+}
+
+type jsonlIneligibleDomainState struct {
+	Name   string                 `json:"name"`
+	Policy preloadlist.PolicyType `json:"policy,omitempty"`
+	Scans  []jsonlScan            `json:"scans"`
+}
+
+type jsonlScan struct {
+	ScanTime time.Time          `json:"scanTime"`
+	Issues   hstspreload.Issues `json:"issues"`
+}
+
+// Export writes every DomainState and IneligibleDomainState in `db` to `w`
+// as JSON Lines, one entity per line. Entities are written as they are
+// read, so the export doesn't need to fit in memory. The output can be
+// restored with Import.
+//
+// An export only covers the states. The transition history, webhook
+// subscriptions and deliveries, migration records, preloadable jobs and
+// stats counters are not included.
+func Export(ctx context.Context, db Database, w io.Writer) error {
+	enc := json.NewEncoder(w)
+
+	for s, err := range db.IterateDomainStates(ctx, "", "") {
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(jsonlRecord{DomainState: &jsonlDomainState{
+			Name:              s.Name,
+			Status:            s.Status,
+			Message:           s.Message,
+			SubmissionDate:    s.SubmissionDate,
+			IncludeSubDomains: s.IncludeSubDomains,
+			Policy:            s.Policy,
+			Submission:        s.Submission,
+		}}); err != nil {
+			return err
+		}
+	}
+
+	for s, err := range db.IterateIneligibleDomainStates(ctx) {
+		if err != nil {
+			return err
+		}
+		scans := []jsonlScan{}
+		for _, scan := range s.Scans {
+			scans = append(scans, jsonlScan{ScanTime: scan.ScanTime, Issues: scan.Issues})
+		}
+		if err := enc.Encode(jsonlRecord{IneligibleDomainState: &jsonlIneligibleDomainState{
+			Name:   s.Name,
+			Policy: s.Policy,
+			Scans:  scans,
+		}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import reads a JSON Lines export written by Export and stores its
+// entities in `db`, in batches of up to batchSize entities. Existing
+// entities with the same names are overwritten.
+//
+// Domain states are restored with RestoreStates, so importing them doesn't
+// record transitions or queue webhook deliveries. Once everything is
+// written, the stats are recounted from the stored states. If Import
+// fails, the batches before the failure have already been written.
+func Import(ctx context.Context, db Database, r io.Reader, logf func(format string, args ...interface{})) error {
+	var states []DomainState
+	var ineligibleStates []IneligibleDomainState
+	flushStates := func() error {
+		if len(states) == 0 {
+			return nil
+		}
+		err := db.RestoreStates(ctx, states, logf)
+		states = states[:0]
+		return err
+	}
+	flushIneligibleStates := func() error {
+		if len(ineligibleStates) == 0 {
+			return nil
+		}
+		err := db.SetIneligibleDomainStates(ctx, ineligibleStates, logf)
+		ineligibleStates = ineligibleStates[:0]
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	for lineNum := 1; ; lineNum++ {
+		line, readErr := br.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var record jsonlRecord
+			if err := json.Unmarshal(line, &record); err != nil {
+				return fmt.Errorf("line %d: %v", lineNum, err)
+			}
+
+			switch {
+			case record.DomainState != nil && record.IneligibleDomainState == nil:
+				s := record.DomainState
+				states = append(states, DomainState{
+					Name:              s.Name,
+					Status:            s.Status,
+					Message:           s.Message,
+					SubmissionDate:    s.SubmissionDate,
+					IncludeSubDomains: s.IncludeSubDomains,
+					Policy:            s.Policy,
+					Submission:        s.Submission,
+				})
+				if len(states) >= batchSize {
+					if err := flushStates(); err != nil {
+						return err
+					}
+				}
+			case record.IneligibleDomainState != nil && record.DomainState == nil:
+				s := record.IneligibleDomainState
+				var scans []Scan
+				for _, scan := range s.Scans {
+					scans = append(scans, Scan{ScanTime: scan.ScanTime, Issues: scan.Issues})
+				}
+				ineligibleStates = append(ineligibleStates, IneligibleDomainState{
+					Name:   s.Name,
+					Policy: s.Policy,
+					Scans:  scans,
+				})
+				if len(ineligibleStates) >= batchSize {
+					if err := flushIneligibleStates(); err != nil {
+						return err
+					}
+				}
+			default:
+				return fmt.Errorf("line %d: expected exactly one of domainState or ineligibleDomainState", lineNum)
+			}
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	if err := flushStates(); err != nil {
+		return err
+	}
+	if err := flushIneligibleStates(); err != nil {
+		return err
+	}
+	return RecountStats(ctx, db)
+}
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chromium/hstspreload"
+	"github.com/chromium/hstspreload/chromium/preloadlist"
+)
+
+func TestExportImport(t *testing.T) {
+	src, _, err := MemoryDatabase("")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Use more than batchSize states, so that the import needs two batches.
+	var wantStates []DomainState
+	for i := 0; i < batchSize+10; i++ {
+		wantStates = append(wantStates, DomainState{
+			Name:              fmt.Sprintf("domain%03d.test", i),
+			Status:            StatusPreloaded,
+			Message:           "a message",
+			SubmissionDate:    time.Date(2024, time.March, 1, 12, 0, i, 0, time.UTC),
+			IncludeSubDomains: i%2 == 0,
+			Policy:            preloadlist.Bulk1Year,
+		})
+	}
+	wantStates[0].Status = StatusPending
+	wantStates[0].Submission = Submission{
+		Channel:           ChannelAPI,
+		Issues:            hstspreload.Issues{Warnings: []hstspreload.Issue{{Code: "code", Summary: "summary", Message: "message"}}},
+		Header:            "max-age=63072000; includeSubDomains; preload",
+		ClientFingerprint: "fingerprint",
+	}
+	wantIneligible := IneligibleDomainState{
+		Name:   "domain000.test",
+		Policy: preloadlist.Bulk1Year,
+		Scans: []Scan{{
+			ScanTime: time.Date(2024, time.March, 2, 12, 0, 0, 0, time.UTC),
+			Issues:   hstspreload.Issues{Errors: []hstspreload.Issue{{Code: "code", Summary: "summary", Message: "message"}}},
+		}},
+	}
+
+	if err := src.PutStates(setupCtx, wantStates, blackholeLogf); err != nil {
+		t.Fatalf("cannot put states: %s", err)
+	}
+	if err := src.SetIneligibleDomainStates(context.Background(), []IneligibleDomainState{wantIneligible}, blackholeLogf); err != nil {
+		t.Fatalf("cannot set ineligible state: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := Export(context.Background(), src, &buf); err != nil {
+		t.Fatalf("cannot export: %s", err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != len(wantStates)+1 {
+		t.Errorf("Wrong number of exported lines: %d", lines)
+	}
+
+	dst, _, err := MemoryDatabase("")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := dst.PutSubscription(context.Background(), Subscription{ID: "sub", Domain: "test", IncludeSubdomains: true}); err != nil {
+		t.Fatalf("cannot put subscription: %s", err)
+	}
+	var statuses []string
+	statusReport := func(format string, args ...interface{}) {
+		statuses = append(statuses, fmt.Sprintf(format, args...))
+	}
+	if err := Import(context.Background(), dst, &buf, statusReport); err != nil {
+		t.Fatalf("cannot import: %s", err)
+	}
+
+	wantStatusReports := []string{
+		"Restoring 450 entries...", " done.\n",
+		"Restoring 10 entries...", " done.\n",
+		"Updating 1 entries...", " done.\n",
+	}
+	if !reflect.DeepEqual(statuses, wantStatusReports) {
+		t.Errorf("Incorrect status reports: %#v", statuses)
+	}
+
+	states, err := dst.AllDomainStates(context.Background())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(states) != len(wantStates) {
+		t.Fatalf("Wrong number of imported states: %d", len(states))
+	}
+	for i := range states {
+		if !states[i].Equal(wantStates[i]) {
+			t.Errorf("Imported state does not match wanted: %#v", states[i])
+		}
+	}
+
+	// Restoring the states doesn't record any status changes, but the
+	// stats are recounted.
+	transitions, err := dst.TransitionsForDomain(context.Background(), "domain000.test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(transitions) != 0 {
+		t.Errorf("Import recorded transitions: %#v", transitions)
+	}
+	deliveries, err := dst.DueDeliveries(context.Background(), time.Now().Add(time.Hour), 10)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(deliveries) != 0 {
+		t.Errorf("Import queued webhook deliveries: %#v", deliveries)
+	}
+	stats, err := dst.Stats(context.Background())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if stats.Statuses[StatusPreloaded] != len(wantStates)-1 || stats.Statuses[StatusPending] != 1 {
+		t.Errorf("Wrong stats after import: %#v", stats)
+	}
+
+	ineligible, err := dst.GetAllIneligibleDomainStates(context.Background())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(ineligible) != 1 || ineligible[0].Name != wantIneligible.Name || ineligible[0].Policy != wantIneligible.Policy ||
+		len(ineligible[0].Scans) != 1 || !ineligible[0].Scans[0].ScanTime.Equal(wantIneligible.Scans[0].ScanTime) ||
+		!ineligible[0].Scans[0].Issues.Match(wantIneligible.Scans[0].Issues) {
+		t.Errorf("Imported ineligible domain states do not match wanted: %#v", ineligible)
+	}
+}
+
+func TestImportInvalidLine(t *testing.T) {
+	db, _, err := MemoryDatabase("")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	input := `{"domainState":{"name":"a.test","status":"pending"}}
+
+{"name":"b.test"}
+`
+	err = Import(context.Background(), db, strings.NewReader(input), blackholeLogf)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3:") {
+		t.Errorf("Expected an error for line 3, got: %v", err)
+	}
+}
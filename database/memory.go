@@ -0,0 +1,800 @@
+package database
+
+import (
+	"context"
+	"encoding/gob"
+	"iter"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/chromium/hstspreload"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MemoryBacked is a database that keeps all of its entities in process
+// memory. It mirrors the behaviour of DatastoreBacked (key ordering,
+// missing entity errors, batch logging) so that it can stand in for the
+// Cloud Datastore emulator during development and testing.
+//
+// MemoryBacked is safe for concurrent use.
+type MemoryBacked struct {
+	store *memoryStore
+}
+
+type memoryStore struct {
+	lock                   sync.RWMutex
+	domainStates           map[string]DomainState
+	ineligibleDomainStates map[string]IneligibleDomainState
+	transitions            map[string][]Transition
+	migrationRecords       map[int]MigrationRecord
+	counters               map[string]int
+	subscriptions          map[string]Subscription
+	deliveries             map[string]Delivery
+	jobs                   map[string]Job
+	snapshotPath           string
+}
+
+// memorySnapshot is the on-disk format of a MemoryBacked snapshot.
+type memorySnapshot struct {
+	DomainStates           []DomainState
+	IneligibleDomainStates []IneligibleDomainState
+	Transitions            []Transition
+	MigrationRecords       []MigrationRecord
+	Counters               map[string]int
+	Subscriptions          []Subscription
+	Deliveries             []Delivery
+	Jobs                   []Job
+}
+
+// MemoryDatabase constructs a new in-memory database. If snapshotPath is
+// not empty, the database is populated from the snapshot at that path (if
+// it exists), and shutdown() writes the final contents back to it.
+func MemoryDatabase(snapshotPath string) (db MemoryBacked, shutdown func() error, err error) {
+	db = MemoryBacked{&memoryStore{
+		domainStates:           map[string]DomainState{},
+		ineligibleDomainStates: map[string]IneligibleDomainState{},
+		transitions:            map[string][]Transition{},
+		migrationRecords:       map[int]MigrationRecord{},
+		counters:               map[string]int{},
+		subscriptions:          map[string]Subscription{},
+		deliveries:             map[string]Delivery{},
+		jobs:                   map[string]Job{},
+		snapshotPath:           snapshotPath,
+	}}
+	shutdown = func() error { return nil }
+
+	if snapshotPath == "" {
+		return db, shutdown, nil
+	}
+	if err := db.load(); err != nil {
+		return db, shutdown, err
+	}
+	return db, db.Snapshot, nil
+}
+
+// load reads the snapshot file into the store. A missing file is treated
+// as an empty database.
+func (db MemoryBacked) load() error {
+	f, err := os.Open(db.store.snapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var snapshot memorySnapshot
+	if err := gob.NewDecoder(f).Decode(&snapshot); err != nil {
+		return err
+	}
+
+	db.store.lock.Lock()
+	defer db.store.lock.Unlock()
+	for _, state := range snapshot.DomainStates {
+		db.store.domainStates[state.Name] = state
+	}
+	for _, state := range snapshot.IneligibleDomainStates {
+		db.store.ineligibleDomainStates[state.Name] = state
+	}
+	for _, t := range snapshot.Transitions {
+		db.store.transitions[t.Name] = append(db.store.transitions[t.Name], t)
+	}
+	for _, record := range snapshot.MigrationRecords {
+		db.store.migrationRecords[record.Version] = record
+	}
+	addCounters(db.store.counters, snapshot.Counters)
+	for _, subscription := range snapshot.Subscriptions {
+		db.store.subscriptions[subscription.ID] = subscription
+	}
+	for _, delivery := range snapshot.Deliveries {
+		db.store.deliveries[delivery.ID] = delivery
+	}
+	for _, job := range snapshot.Jobs {
+		db.store.jobs[job.ID] = job
+	}
+	return nil
+}
+
+// Snapshot writes the current contents of the database to its snapshot
+// path. The file is replaced atomically, so a crash during Snapshot leaves
+// the previous snapshot intact. It is a no-op for databases constructed
+// without a snapshot path.
+func (db MemoryBacked) Snapshot() error {
+	if db.store.snapshotPath == "" {
+		return nil
+	}
+
+	db.store.lock.RLock()
+	snapshot := memorySnapshot{
+		DomainStates:           db.sortedDomainStates(func(DomainState) bool { return true }),
+		IneligibleDomainStates: db.sortedIneligibleDomainStates(),
+		Transitions:            db.allTransitions(),
+		MigrationRecords:       db.sortedMigrationRecords(),
+		Counters:               maps.Clone(db.store.counters),
+		Subscriptions:          db.sortedSubscriptions(),
+		Deliveries:             db.sortedDeliveries(),
+		Jobs:                   db.sortedJobs(),
+	}
+	db.store.lock.RUnlock()
+
+	dir, file := filepath.Split(db.store.snapshotPath)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, file+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(snapshot); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), db.store.snapshotPath)
+}
+
+// reset empties the database. It is used by tests.
+func (db MemoryBacked) reset() {
+	db.store.lock.Lock()
+	defer db.store.lock.Unlock()
+
+	db.store.domainStates = map[string]DomainState{}
+	db.store.ineligibleDomainStates = map[string]IneligibleDomainState{}
+	db.store.transitions = map[string][]Transition{}
+	db.store.migrationRecords = map[int]MigrationRecord{}
+	db.store.counters = map[string]int{}
+	db.store.subscriptions = map[string]Subscription{}
+	db.store.deliveries = map[string]Delivery{}
+	db.store.jobs = map[string]Job{}
+}
+
+// errDuplicateMutation is the error Datastore returns when a single
+// non-transactional commit writes the same key more than once.
+var errDuplicateMutation = status.Error(codes.InvalidArgument, "A non-transactional commit may not contain multiple mutations affecting the same entity.")
+
+// hasDuplicateNames reports whether any name occurs more than once in a
+// single batch.
+func hasDuplicateNames(names []string) bool {
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if seen[name] {
+			return true
+		}
+		seen[name] = true
+	}
+	return false
+}
+
+// Datastore stores times with microsecond precision.
+func truncateTime(t time.Time) time.Time {
+	return t.Truncate(time.Microsecond)
+}
+
+func copyIssues(issues hstspreload.Issues) hstspreload.Issues {
+	return hstspreload.Issues{
+		Errors:   append([]hstspreload.Issue(nil), issues.Errors...),
+		Warnings: append([]hstspreload.Issue(nil), issues.Warnings...),
+	}
+}
+
+// copyIneligibleDomainState makes a deep copy of `s`, so that callers can't
+// modify the stored value through shared slices.
+func copyIneligibleDomainState(s IneligibleDomainState) IneligibleDomainState {
+	var scans []Scan
+	for _, scan := range s.Scans {
+		scans = append(scans, Scan{
+			ScanTime: truncateTime(scan.ScanTime),
+			Issues:   copyIssues(scan.Issues),
+		})
+	}
+	s.Scans = scans
+	return s
+}
+
+// sortedDomainStates returns the stored states that satisfy `keep`, in key
+// order. The caller must hold the lock.
+func (db MemoryBacked) sortedDomainStates(keep func(DomainState) bool) []DomainState {
+	var states []DomainState
+	for _, state := range db.store.domainStates {
+		if keep(state) {
+			states = append(states, state)
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
+
+// sortedIneligibleDomainStates returns all stored ineligible domain states in
+// key order. The caller must hold the lock.
+func (db MemoryBacked) sortedIneligibleDomainStates() []IneligibleDomainState {
+	var states []IneligibleDomainState
+	for _, state := range db.store.ineligibleDomainStates {
+		states = append(states, copyIneligibleDomainState(state))
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
+
+// allTransitions returns the transitions of all domains, grouped by domain
+// in key order. The caller must hold the lock.
+func (db MemoryBacked) allTransitions() []Transition {
+	var names []string
+	for name := range db.store.transitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var transitions []Transition
+	for _, name := range names {
+		transitions = append(transitions, db.store.transitions[name]...)
+	}
+	return transitions
+}
+
+// sortedMigrationRecords returns all migration records in order of
+// version. The caller must hold the lock.
+func (db MemoryBacked) sortedMigrationRecords() []MigrationRecord {
+	var records []MigrationRecord
+	for _, record := range db.store.migrationRecords {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Version < records[j].Version })
+	return records
+}
+
+// sortedSubscriptions returns copies of all subscriptions in key order.
+// The caller must hold the lock.
+func (db MemoryBacked) sortedSubscriptions() []Subscription {
+	var subscriptions []Subscription
+	for _, subscription := range db.store.subscriptions {
+		subscriptions = append(subscriptions, copySubscription(subscription))
+	}
+	sort.Slice(subscriptions, func(i, j int) bool { return subscriptions[i].ID < subscriptions[j].ID })
+	return subscriptions
+}
+
+// sortedDeliveries returns all deliveries in key order. The caller must
+// hold the lock.
+func (db MemoryBacked) sortedDeliveries() []Delivery {
+	deliveries := slices.Collect(maps.Values(db.store.deliveries))
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID < deliveries[j].ID })
+	return deliveries
+}
+
+// sortedJobs returns copies of all jobs in key order. The caller must hold
+// the lock.
+func (db MemoryBacked) sortedJobs() []Job {
+	var jobs []Job
+	for _, job := range db.store.jobs {
+		jobs = append(jobs, copyJob(job))
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs
+}
+
+// PutStates updates the given domain updates in batches.
+// Writes updates to logf in real-time.
+func (db MemoryBacked) PutStates(ctx context.Context, updates []DomainState, logf func(format string, args ...interface{})) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(updates) == 0 {
+		logf("No updates.\n")
+		return nil
+	}
+	if err := checkDuplicateNames(updates); err != nil {
+		return err
+	}
+
+	db.store.lock.Lock()
+	defer db.store.lock.Unlock()
+
+	for i := 0; i < len(updates); i += batchSize {
+		batch := updates[i:min(i+batchSize, len(updates))]
+		logf("Updating %d entries...", len(batch))
+		if err := db.putBatch(ctx, batch); err != nil {
+			logf(" failed: %v\n", err)
+			return partialCommitError(updates, i, err)
+		}
+		logf(" done.\n")
+	}
+	return nil
+}
+
+// putBatch writes the given states and records their transitions. The
+// caller must hold the write lock.
+func (db MemoryBacked) putBatch(ctx context.Context, batch []DomainState) error {
+	if err := checkTransitions(ctx, db.store.domainStates, batch); err != nil {
+		return err
+	}
+
+	transitions := newTransitions(ctx, db.store.domainStates, batch)
+	for _, t := range transitions {
+		db.store.transitions[t.Name] = append(db.store.transitions[t.Name], t)
+	}
+	for _, d := range newDeliveries(db.sortedSubscriptions(), transitions) {
+		db.store.deliveries[d.ID] = truncateDelivery(d)
+	}
+	addCounters(db.store.counters, counterDeltas(db.store.domainStates, batch))
+	db.putDomainStates(batch)
+	return nil
+}
+
+// putDomainStates writes the given states, and nothing else. The caller
+// must hold the write lock.
+func (db MemoryBacked) putDomainStates(states []DomainState) {
+	for _, state := range states {
+		state.SubmissionDate = truncateTime(state.SubmissionDate)
+		state.Submission.Issues = copyIssues(state.Submission.Issues)
+		db.store.domainStates[state.Name] = state
+	}
+}
+
+// RestoreStates writes `states` as they are, without checking or recording
+// their transitions, queueing webhook deliveries or updating the stats
+// counters. It is meant for restoring a backup.
+func (db MemoryBacked) RestoreStates(ctx context.Context, states []DomainState, logf func(format string, args ...interface{})) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(states) == 0 {
+		logf("No updates.\n")
+		return nil
+	}
+	if err := checkDuplicateNames(states); err != nil {
+		return err
+	}
+
+	db.store.lock.Lock()
+	defer db.store.lock.Unlock()
+
+	logf("Restoring %d entries...", len(states))
+	db.putDomainStates(states)
+	logf(" done.\n")
+	return nil
+}
+
+// PutState is a convenience version of PutStates for a single domain.
+func (db MemoryBacked) PutState(ctx context.Context, update DomainState) error {
+	return db.PutStates(ctx, []DomainState{update}, blackholeLogf)
+}
+
+// PutStateIfUnchanged writes `update`, but only if the stored state of the
+// domain still matches `old`. Otherwise, it returns ErrStateChanged.
+func (db MemoryBacked) PutStateIfUnchanged(ctx context.Context, old DomainState, update DomainState) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.store.lock.Lock()
+	defer db.store.lock.Unlock()
+
+	stored, ok := db.store.domainStates[update.Name]
+	if !ok {
+		stored = DomainState{Status: StatusUnknown}
+	}
+	if !unchanged(stored, old) {
+		return ErrStateChanged
+	}
+	return db.putBatch(ctx, []DomainState{update})
+}
+
+// StateForDomain get the state for the given domain.
+// Note that the Name field of `state` will not be set.
+func (db MemoryBacked) StateForDomain(ctx context.Context, domain string) (state DomainState, err error) {
+	if err := ctx.Err(); err != nil {
+		return DomainState{}, err
+	}
+
+	db.store.lock.RLock()
+	defer db.store.lock.RUnlock()
+
+	state, ok := db.store.domainStates[domain]
+	if !ok {
+		return DomainState{Status: StatusUnknown}, nil
+	}
+	state.Name = ""
+	return state, nil
+}
+
+// StatesForDomains returns the domains states for the given domains.
+// Like DatastoreBacked, it fails with a datastore.MultiError if any of the
+// domains is not in the database.
+func (db MemoryBacked) StatesForDomains(ctx context.Context, domains []string) (states []DomainState, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.store.lock.RLock()
+	defer db.store.lock.RUnlock()
+
+	for i := 0; i < len(domains); i += batchSize {
+		batch := domains[i:min(i+batchSize, len(domains))]
+		multiErr := make(datastore.MultiError, len(batch))
+		missing := false
+		for j, domain := range batch {
+			state, ok := db.store.domainStates[domain]
+			if !ok {
+				multiErr[j] = datastore.ErrNoSuchEntity
+				missing = true
+			}
+			state.Name = domain
+			states = append(states, state)
+		}
+		if missing {
+			return nil, multiErr
+		}
+	}
+	return states, nil
+}
+
+// AllDomainStates gets the states of all domains in the database.
+func (db MemoryBacked) AllDomainStates(ctx context.Context) (states []DomainState, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.store.lock.RLock()
+	defer db.store.lock.RUnlock()
+
+	return db.sortedDomainStates(func(DomainState) bool { return true }), nil
+}
+
+// DomainStatesInRange returns the states of domains whose names are in the
+// half-open interval [start, end). An empty start or end leaves that side
+// of the interval unbounded.
+func (db MemoryBacked) DomainStatesInRange(ctx context.Context, start, end string) ([]DomainState, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.store.lock.RLock()
+	defer db.store.lock.RUnlock()
+
+	return db.sortedDomainStates(func(s DomainState) bool {
+		return (start == "" || s.Name >= start) && (end == "" || s.Name < end)
+	}), nil
+}
+
+// StatesWithStatus returns the states of domains with the given status in the database.
+func (db MemoryBacked) StatesWithStatus(ctx context.Context, status PreloadStatus) (domains []DomainState, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.store.lock.RLock()
+	defer db.store.lock.RUnlock()
+
+	return db.sortedDomainStates(func(s DomainState) bool { return s.Status == status }), nil
+}
+
+// GetIneligibleDomainStates returns the state for the given domain.
+func (db MemoryBacked) GetIneligibleDomainStates(ctx context.Context, domains []string) (states []IneligibleDomainState, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.store.lock.RLock()
+	defer db.store.lock.RUnlock()
+
+	for i := 0; i < len(domains); i += batchSize {
+		batch := domains[i:min(i+batchSize, len(domains))]
+		multiErr := make(datastore.MultiError, len(batch))
+		missing := false
+		for j, domain := range batch {
+			state, ok := db.store.ineligibleDomainStates[domain]
+			if !ok {
+				multiErr[j] = datastore.ErrNoSuchEntity
+				missing = true
+			}
+			state.Name = domain
+			states = append(states, copyIneligibleDomainState(state))
+		}
+		if missing {
+			return nil, multiErr
+		}
+	}
+	return states, nil
+}
+
+// SetIneligibleDomainStates updates the given domains updates in batches.
+// Writes updates to logf in real-time.
+func (db MemoryBacked) SetIneligibleDomainStates(ctx context.Context, updates []IneligibleDomainState, logf func(format string, args ...interface{})) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.store.lock.Lock()
+	defer db.store.lock.Unlock()
+
+	for i := 0; i == 0 || i < len(updates); i += batchSize {
+		batch := updates[i:min(i+batchSize, len(updates))]
+		logf("Updating %d entries...", len(batch))
+		var names []string
+		for _, state := range batch {
+			names = append(names, state.Name)
+		}
+		if hasDuplicateNames(names) {
+			logf(" failed: %v\n", errDuplicateMutation)
+			return errDuplicateMutation
+		}
+		for _, state := range batch {
+			db.store.ineligibleDomainStates[state.Name] = copyIneligibleDomainState(state)
+		}
+		logf(" done.\n")
+	}
+	return nil
+}
+
+// DeleteIneligibleDomainStates deletes the state for the given domain from the database
+func (db MemoryBacked) DeleteIneligibleDomainStates(ctx context.Context, domains []string) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.store.lock.Lock()
+	defer db.store.lock.Unlock()
+
+	for _, domain := range domains {
+		delete(db.store.ineligibleDomainStates, domain)
+	}
+	return nil
+}
+
+// GetAllIneligibleDomainStates returns all the ineligible domains in the database
+func (db MemoryBacked) GetAllIneligibleDomainStates(ctx context.Context) (states []IneligibleDomainState, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.store.lock.RLock()
+	defer db.store.lock.RUnlock()
+
+	return db.sortedIneligibleDomainStates(), nil
+}
+
+// TransitionsForDomain returns the status history of the given domain, in
+// chronological order.
+func (db MemoryBacked) TransitionsForDomain(ctx context.Context, domain string) ([]Transition, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.store.lock.RLock()
+	defer db.store.lock.RUnlock()
+
+	transitions := append([]Transition(nil), db.store.transitions[domain]...)
+	sortTransitions(transitions)
+	return transitions, nil
+}
+
+// IterateDomainStates iterates over the states of domains whose names are
+// in the half-open interval [start, end), in key order. It iterates over a
+// copy of the states, so the database can be modified during iteration.
+func (db MemoryBacked) IterateDomainStates(ctx context.Context, start, end string) iter.Seq2[DomainState, error] {
+	states, err := db.DomainStatesInRange(ctx, start, end)
+	return sliceSeq(ctx, states, err)
+}
+
+// IterateStatesWithStatus iterates over the states of domains with the
+// given status, in key order.
+func (db MemoryBacked) IterateStatesWithStatus(ctx context.Context, status PreloadStatus) iter.Seq2[DomainState, error] {
+	states, err := db.StatesWithStatus(ctx, status)
+	return sliceSeq(ctx, states, err)
+}
+
+// IterateIneligibleDomainStates iterates over all the ineligible domains in
+// the database, in key order.
+func (db MemoryBacked) IterateIneligibleDomainStates(ctx context.Context) iter.Seq2[IneligibleDomainState, error] {
+	states, err := db.GetAllIneligibleDomainStates(ctx)
+	return sliceSeq(ctx, states, err)
+}
+
+// MigrationRecords returns the records of all migrations that have started.
+func (db MemoryBacked) MigrationRecords(ctx context.Context) ([]MigrationRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.store.lock.RLock()
+	defer db.store.lock.RUnlock()
+
+	return db.sortedMigrationRecords(), nil
+}
+
+// PutMigrationRecord stores the progress of a migration.
+func (db MemoryBacked) PutMigrationRecord(ctx context.Context, record MigrationRecord) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.store.lock.Lock()
+	defer db.store.lock.Unlock()
+
+	record.Updated = truncateTime(record.Updated)
+	db.store.migrationRecords[record.Version] = record
+	return nil
+}
+
+// Stats returns the counts of domain states kept by the database.
+func (db MemoryBacked) Stats(ctx context.Context) (Stats, error) {
+	if err := ctx.Err(); err != nil {
+		return Stats{}, err
+	}
+
+	db.store.lock.RLock()
+	defer db.store.lock.RUnlock()
+
+	return statsFromCounters(db.store.counters), nil
+}
+
+// SetStats replaces all of the stored counters with `stats`.
+func (db MemoryBacked) SetStats(ctx context.Context, stats Stats) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.store.lock.Lock()
+	defer db.store.lock.Unlock()
+
+	db.store.counters = countersFromStats(stats)
+	return nil
+}
+
+// Subscriptions returns all webhook subscriptions.
+func (db MemoryBacked) Subscriptions(ctx context.Context) ([]Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.store.lock.RLock()
+	defer db.store.lock.RUnlock()
+
+	return db.sortedSubscriptions(), nil
+}
+
+// PutSubscription stores a webhook subscription under its ID.
+func (db MemoryBacked) PutSubscription(ctx context.Context, subscription Subscription) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.store.lock.Lock()
+	defer db.store.lock.Unlock()
+
+	db.store.subscriptions[subscription.ID] = copySubscription(subscription)
+	return nil
+}
+
+// DeleteSubscription deletes a webhook subscription. Its remaining
+// deliveries are dropped when they are next due.
+func (db MemoryBacked) DeleteSubscription(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.store.lock.Lock()
+	defer db.store.lock.Unlock()
+
+	delete(db.store.subscriptions, id)
+	return nil
+}
+
+// DueDeliveries returns at most `limit` of the webhook deliveries that are
+// due at `now`, in order of their next attempt.
+func (db MemoryBacked) DueDeliveries(ctx context.Context, now time.Time, limit int) ([]Delivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.store.lock.RLock()
+	defer db.store.lock.RUnlock()
+
+	return dueDeliveries(db.sortedDeliveries(), now, limit), nil
+}
+
+// PutDelivery stores a webhook delivery under its ID.
+func (db MemoryBacked) PutDelivery(ctx context.Context, delivery Delivery) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.store.lock.Lock()
+	defer db.store.lock.Unlock()
+
+	db.store.deliveries[delivery.ID] = truncateDelivery(delivery)
+	return nil
+}
+
+// DeleteDelivery deletes a webhook delivery. Deleting a missing delivery
+// is not an error.
+func (db MemoryBacked) DeleteDelivery(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.store.lock.Lock()
+	defer db.store.lock.Unlock()
+
+	delete(db.store.deliveries, id)
+	return nil
+}
+
+// Job returns the preloadable job with the given ID, or ErrNoSuchJob.
+func (db MemoryBacked) Job(ctx context.Context, id string) (Job, error) {
+	if err := ctx.Err(); err != nil {
+		return Job{}, err
+	}
+
+	db.store.lock.RLock()
+	defer db.store.lock.RUnlock()
+
+	job, ok := db.store.jobs[id]
+	if !ok {
+		return Job{}, ErrNoSuchJob
+	}
+	return copyJob(job), nil
+}
+
+// PutJob stores a preloadable job under its ID.
+func (db MemoryBacked) PutJob(ctx context.Context, job Job) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.store.lock.Lock()
+	defer db.store.lock.Unlock()
+
+	db.store.jobs[job.ID] = copyJob(job)
+	return nil
+}
+
+// DeleteExpiredJobs deletes the preloadable jobs that have expired at
+// `now`.
+func (db MemoryBacked) DeleteExpiredJobs(ctx context.Context, now time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.store.lock.Lock()
+	defer db.store.lock.Unlock()
+
+	for _, id := range expiredJobIDs(slices.Collect(maps.Values(db.store.jobs)), now) {
+		delete(db.store.jobs, id)
+	}
+	return nil
+}
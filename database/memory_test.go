@@ -0,0 +1,87 @@
+package database
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chromium/hstspreload"
+	"github.com/chromium/hstspreload/chromium/preloadlist"
+)
+
+func TestMemoryDatabaseSnapshot(t *testing.T) {
+	snapshotPath := filepath.Join(t.TempDir(), "snapshot.gob")
+
+	db, shutdown, err := MemoryDatabase(snapshotPath)
+	if err != nil {
+		t.Fatalf("could not create memory database: %s", err)
+	}
+
+	submissionDate := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	wantState := DomainState{
+		Name:              "a.test",
+		Status:            StatusPending,
+		Message:           "a message",
+		SubmissionDate:    submissionDate,
+		IncludeSubDomains: true,
+		Policy:            preloadlist.Bulk1Year,
+	}
+	wantIneligible := IneligibleDomainState{
+		Name:   "b.test",
+		Policy: preloadlist.Bulk18Weeks,
+		Scans: []Scan{{
+			ScanTime: submissionDate,
+			Issues: hstspreload.Issues{
+				Errors: []hstspreload.Issue{{Code: "code", Summary: "summary", Message: "message"}},
+			},
+		}},
+	}
+
+	if err := db.PutState(context.Background(), wantState); err != nil {
+		t.Fatalf("cannot put state: %s", err)
+	}
+	if err := db.SetIneligibleDomainStates(context.Background(), []IneligibleDomainState{wantIneligible}, blackholeLogf); err != nil {
+		t.Fatalf("cannot set ineligible state: %s", err)
+	}
+	if err := shutdown(); err != nil {
+		t.Fatalf("cannot write snapshot: %s", err)
+	}
+
+	restored, _, err := MemoryDatabase(snapshotPath)
+	if err != nil {
+		t.Fatalf("could not restore memory database: %s", err)
+	}
+
+	states, err := restored.AllDomainStates(context.Background())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(states) != 1 || !states[0].Equal(wantState) {
+		t.Errorf("Restored domain states do not match wanted: %#v", states)
+	}
+
+	ineligible, err := restored.GetAllIneligibleDomainStates(context.Background())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(ineligible) != 1 || ineligible[0].Name != wantIneligible.Name ||
+		len(ineligible[0].Scans) != 1 || !ineligible[0].Scans[0].Issues.Match(wantIneligible.Scans[0].Issues) {
+		t.Errorf("Restored ineligible domain states do not match wanted: %#v", ineligible)
+	}
+}
+
+func TestMemoryDatabaseMissingSnapshot(t *testing.T) {
+	db, _, err := MemoryDatabase(filepath.Join(t.TempDir(), "does-not-exist.gob"))
+	if err != nil {
+		t.Fatalf("a missing snapshot should give an empty database: %s", err)
+	}
+
+	states, err := db.AllDomainStates(context.Background())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(states) != 0 {
+		t.Errorf("Unexpected length: %d", len(states))
+	}
+}
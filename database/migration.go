@@ -0,0 +1,205 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/chromium/hstspreload/chromium/preloadlist"
+)
+
+const migrationKind = "Migration"
+
+// A Migration is a one-off change applied to every DomainState in the
+// database.
+type Migration struct {
+	// Version identifies the migration. Migrations run in increasing order
+	// of Version, and each version must only ever be used once.
+	Version int
+	Name    string
+	// Migrate returns the migrated version of `state`, and whether it is
+	// different from `state`. It must not depend on the order in which
+	// states are migrated.
+	Migrate func(state DomainState) (DomainState, bool)
+}
+
+// A MigrationRecord keeps track of the progress of a migration, so that an
+// interrupted migration resumes where it left off and a completed one is
+// not run again.
+type MigrationRecord struct {
+	// Version is the key in the datastore, so we don't include it as a
+	// field in the stored value.
+	Version int    `datastore:"-" json:"version"`
+	Name    string `json:"name"`
+	// Cursor is the name of the first domain that has not been migrated
+	// yet.
+	Cursor string `datastore:",noindex" json:"cursor"`
+	// Migrated is the number of domain states changed so far.
+	Migrated int       `datastore:",noindex" json:"migrated"`
+	Done     bool      `json:"done"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Migrations returns the migrations that ship with this version of the
+// code. `list` is the current preload list, which some migrations use as a
+// source of truth.
+func Migrations(list preloadlist.PreloadList) []Migration {
+	return []Migration{
+		rejectedToRemovedMigration,
+		backfillPolicyMigration(list),
+	}
+}
+
+// StatusRejected is deprecated in favor of StatusRemoved.
+var rejectedToRemovedMigration = Migration{
+	Version: 1,
+	Name:    "rejected-to-removed",
+	Migrate: func(state DomainState) (DomainState, bool) {
+		if state.Status != StatusRejected {
+			return state, false
+		}
+		state.Status = StatusRemoved
+		return state, true
+	},
+}
+
+// Entities written before policies were introduced have an empty Policy.
+// Fill it in for domains on the preload list. (Removed domains have their
+// policy cleared by the update cron, so they are left alone.)
+func backfillPolicyMigration(list preloadlist.PreloadList) Migration {
+	policies := make(map[string]preloadlist.PolicyType)
+	for _, entry := range list.Entries {
+		if entry.Mode == preloadlist.ForceHTTPS && entry.Policy != preloadlist.UnspecifiedPolicyType {
+			policies[entry.Name] = entry.Policy
+		}
+	}
+
+	return Migration{
+		Version: 2,
+		Name:    "backfill-policy",
+		Migrate: func(state DomainState) (DomainState, bool) {
+			if state.Policy != preloadlist.UnspecifiedPolicyType || state.ToEntry().Mode != preloadlist.ForceHTTPS {
+				return state, false
+			}
+			policy, ok := policies[state.Name]
+			if !ok {
+				return state, false
+			}
+			state.Policy = policy
+			return state, true
+		},
+	}
+}
+
+// RunMigrations runs each of `migrations` that hasn't completed yet, in
+// order of Version. States are migrated in batches of batchSize, and the
+// progress is recorded after each batch.
+//
+// If dryRun is true, nothing is written; instead, RunMigrations logs the
+// number of states each pending migration would change. Counts for later
+// migrations don't take into account the changes earlier ones would make.
+func RunMigrations(ctx context.Context, db Database, migrations []Migration, dryRun bool, logf func(format string, args ...interface{})) error {
+	migrations = append([]Migration(nil), migrations...)
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return fmt.Errorf("duplicate migration version %d", migrations[i].Version)
+		}
+	}
+
+	existing, err := db.MigrationRecords(ctx)
+	if err != nil {
+		return err
+	}
+	records := make(map[int]MigrationRecord)
+	for _, record := range existing {
+		records[record.Version] = record
+	}
+
+	for _, m := range migrations {
+		record, ok := records[m.Version]
+		if ok && record.Done {
+			logf("Migration %d (%s) has already run.\n", m.Version, m.Name)
+			continue
+		}
+		if !ok {
+			record = MigrationRecord{Version: m.Version, Name: m.Name}
+		}
+
+		if dryRun {
+			count, err := countMigration(ctx, db, m, record.Cursor)
+			if err != nil {
+				return err
+			}
+			logf("Migration %d (%s) would change %d domain states.\n", m.Version, m.Name, count)
+			continue
+		}
+
+		logf("Running migration %d (%s)...\n", m.Version, m.Name)
+		if err := runMigration(ctx, db, m, record, logf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countMigration returns the number of states starting at `cursor` that
+// `m` would change.
+func countMigration(ctx context.Context, db Database, m Migration, cursor string) (count int, err error) {
+	for state, err := range db.IterateDomainStates(ctx, cursor, "") {
+		if err != nil {
+			return 0, err
+		}
+		if _, changed := m.Migrate(state); changed {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func runMigration(ctx context.Context, db Database, m Migration, record MigrationRecord, logf func(format string, args ...interface{})) error {
+	ctx = WithActor(ctx, ActorMigration, fmt.Sprintf("Migration %d (%s).", m.Version, m.Name))
+
+	var batch []DomainState
+	var last string
+	scanned := 0
+	flush := func() error {
+		if len(batch) > 0 {
+			if err := db.PutStates(ctx, batch, logf); err != nil {
+				return err
+			}
+			record.Migrated += len(batch)
+			batch = batch[:0]
+		}
+		if last != "" {
+			// The smallest name that sorts after `last`.
+			record.Cursor = last + "\x00"
+		}
+		record.Updated = time.Now()
+		return db.PutMigrationRecord(ctx, record)
+	}
+
+	for state, err := range db.IterateDomainStates(ctx, record.Cursor, "") {
+		if err != nil {
+			return err
+		}
+		if migrated, changed := m.Migrate(state); changed {
+			batch = append(batch, migrated)
+		}
+		last = state.Name
+		scanned++
+		if scanned%batchSize == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	record.Done = true
+	if err := flush(); err != nil {
+		return err
+	}
+	logf("Migration %d (%s) changed %d domain states.\n", m.Version, m.Name, record.Migrated)
+	return nil
+}
@@ -0,0 +1,180 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chromium/hstspreload/chromium/preloadlist"
+)
+
+func TestRunMigrations(t *testing.T) {
+	resetDB()
+
+	// Use more than batchSize states, so that the migration needs several
+	// batches.
+	var states []DomainState
+	for i := 0; i < batchSize+10; i++ {
+		status := PreloadStatus(StatusPending)
+		if i%3 == 0 {
+			status = StatusRejected
+		}
+		states = append(states, DomainState{
+			Name:           fmt.Sprintf("domain%03d.test", i),
+			Status:         status,
+			SubmissionDate: time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC),
+		})
+	}
+	if err := testDB.PutStates(setupCtx, states, blackholeLogf); err != nil {
+		t.Fatalf("cannot put states: %s", err)
+	}
+	wantMigrated := (batchSize + 10 + 2) / 3
+
+	migrations := []Migration{rejectedToRemovedMigration}
+
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	if err := RunMigrations(context.Background(), testDB, migrations, true, logf); err != nil {
+		t.Fatalf("cannot run dry run: %s", err)
+	}
+	wantLogs := []string{fmt.Sprintf("Migration 1 (rejected-to-removed) would change %d domain states.\n", wantMigrated)}
+	if !reflect.DeepEqual(logs, wantLogs) {
+		t.Errorf("Wrong dry run logs: %#v", logs)
+	}
+	rejected, err := testDB.StatesWithStatus(context.Background(), StatusRejected)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(rejected) != wantMigrated {
+		t.Errorf("Dry run changed states: %d rejected states left", len(rejected))
+	}
+
+	if err := RunMigrations(context.Background(), testDB, migrations, false, blackholeLogf); err != nil {
+		t.Fatalf("cannot run migrations: %s", err)
+	}
+	rejected, err = testDB.StatesWithStatus(context.Background(), StatusRejected)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(rejected) != 0 {
+		t.Errorf("Wrong number of rejected states after migration: %d", len(rejected))
+	}
+	removed, err := testDB.StatesWithStatus(context.Background(), StatusRemoved)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(removed) != wantMigrated {
+		t.Errorf("Wrong number of removed states after migration: %d", len(removed))
+	}
+
+	transitions, err := testDB.TransitionsForDomain(context.Background(), "domain000.test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(transitions) == 0 || transitions[len(transitions)-1].Actor != ActorMigration {
+		t.Errorf("Migration was not recorded as the actor: %#v", transitions)
+	}
+
+	records, err := testDB.MigrationRecords(context.Background())
+	if err != nil {
+		t.Fatalf("cannot get migration records: %s", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("Wrong number of migration records: %#v", records)
+	}
+	if r := records[0]; r.Version != 1 || r.Name != "rejected-to-removed" || !r.Done || r.Migrated != wantMigrated {
+		t.Errorf("Wrong migration record: %#v", r)
+	}
+
+	logs = nil
+	if err := RunMigrations(context.Background(), testDB, migrations, false, logf); err != nil {
+		t.Fatalf("cannot run migrations again: %s", err)
+	}
+	wantLogs = []string{"Migration 1 (rejected-to-removed) has already run.\n"}
+	if !reflect.DeepEqual(logs, wantLogs) {
+		t.Errorf("Completed migration ran again: %#v", logs)
+	}
+}
+
+func TestRunMigrationsResume(t *testing.T) {
+	resetDB()
+
+	states := []DomainState{
+		{Name: "a.test", Status: StatusRejected},
+		{Name: "b.test", Status: StatusRejected},
+		{Name: "c.test", Status: StatusRejected},
+	}
+	if err := testDB.PutStates(setupCtx, states, blackholeLogf); err != nil {
+		t.Fatalf("cannot put states: %s", err)
+	}
+
+	// Pretend that an earlier run was interrupted after a.test.
+	if err := testDB.PutMigrationRecord(context.Background(), MigrationRecord{
+		Version:  1,
+		Name:     "rejected-to-removed",
+		Cursor:   "a.test\x00",
+		Migrated: 1,
+	}); err != nil {
+		t.Fatalf("cannot put migration record: %s", err)
+	}
+
+	if err := RunMigrations(context.Background(), testDB, []Migration{rejectedToRemovedMigration}, false, blackholeLogf); err != nil {
+		t.Fatalf("cannot run migrations: %s", err)
+	}
+
+	wantStatuses := map[string]PreloadStatus{
+		"a.test": StatusRejected,
+		"b.test": StatusRemoved,
+		"c.test": StatusRemoved,
+	}
+	for name, want := range wantStatuses {
+		state, err := testDB.StateForDomain(context.Background(), name)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if state.Status != want {
+			t.Errorf("Wrong status for %s: %s, want %s", name, state.Status, want)
+		}
+	}
+
+	records, err := testDB.MigrationRecords(context.Background())
+	if err != nil {
+		t.Fatalf("cannot get migration records: %s", err)
+	}
+	if len(records) != 1 || !records[0].Done || records[0].Migrated != 3 {
+		t.Errorf("Wrong migration records: %#v", records)
+	}
+}
+
+func TestBackfillPolicyMigration(t *testing.T) {
+	list := preloadlist.PreloadList{Entries: []preloadlist.Entry{
+		{Name: "bulk.test", Mode: preloadlist.ForceHTTPS, Policy: preloadlist.Bulk1Year},
+		{Name: "custom.test", Mode: preloadlist.ForceHTTPS, Policy: preloadlist.Custom},
+		{Name: "pinned.test", Mode: "", Policy: preloadlist.Custom},
+	}}
+	m := backfillPolicyMigration(list)
+
+	tests := []struct {
+		state       DomainState
+		wantPolicy  preloadlist.PolicyType
+		wantChanged bool
+	}{
+		{DomainState{Name: "bulk.test", Status: StatusPreloaded}, preloadlist.Bulk1Year, true},
+		{DomainState{Name: "custom.test", Status: StatusPendingRemoval}, preloadlist.Custom, true},
+		{DomainState{Name: "bulk.test", Status: StatusPreloaded, Policy: preloadlist.Bulk18Weeks}, preloadlist.Bulk18Weeks, false},
+		{DomainState{Name: "bulk.test", Status: StatusRemoved}, preloadlist.UnspecifiedPolicyType, false},
+		{DomainState{Name: "pinned.test", Status: StatusPreloaded}, preloadlist.UnspecifiedPolicyType, false},
+		{DomainState{Name: "unlisted.test", Status: StatusPreloaded}, preloadlist.UnspecifiedPolicyType, false},
+	}
+
+	for _, tt := range tests {
+		got, changed := m.Migrate(tt.state)
+		if changed != tt.wantChanged || got.Policy != tt.wantPolicy {
+			t.Errorf("Migrate(%#v) = (%#v, %v), want policy %q and changed %v", tt.state, got, changed, tt.wantPolicy, tt.wantChanged)
+		}
+	}
+}
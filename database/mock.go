@@ -1,162 +1,484 @@
 package database
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"iter"
+	"sync"
+	"time"
+)
 
-// Mock is a very simple Mock for our database.
+// ErrMockFailure is returned by Mock calls that are made to fail through
+// the MockController, unless the FailureRule specifies another error.
+var ErrMockFailure = errors.New("forced failure")
+
+// Mock is a MemoryBacked database whose calls are recorded, and can be
+// delayed or made to fail through its MockController. It is safe for
+// concurrent use.
 type Mock struct {
-	ds map[string]DomainState
-	ids map[string]IneligibleDomainState
+	db MemoryBacked
 	// This is a pointer so that we can pass around a Mock but continue
 	// to control its behaviour.
 	state *MockController
 }
 
-// MockController keeps track of mocking behaviour.
+// MockController keeps track of mocking behaviour. Its methods are safe
+// to call while the Mock is in use.
 type MockController struct {
-	FailCalls bool
+	lock sync.Mutex
+	// failCalls makes every call fail with ErrMockFailure.
+	failCalls bool
+	rules     []*mockRule
+	latency   map[string]time.Duration
+	calls     []MockCall
+}
+
+// A MockCall records a call to one of the methods of a Mock.
+type MockCall struct {
+	// Method is the name of the method, e.g. "PutStates".
+	Method string
+	// Domains are the domains the call reads or writes, if the method
+	// takes any.
+	Domains []string
+}
+
+// A FailureRule describes calls to a Mock that should fail. The zero
+// FailureRule fails every call.
+type FailureRule struct {
+	// Method is the name of the method to fail, e.g. "PutStates". If it is
+	// empty, the rule applies to every method.
+	Method string
+	// Domains limits the rule to calls that involve at least one of these
+	// domains. If it is empty, the rule applies regardless of domains.
+	Domains []string
+	// Call makes only the Call-th matching call fail, counting from 1.
+	// If it is 0, every matching call fails.
+	Call int
+	// AfterWrites makes a failing PutStates or SetIneligibleDomainStates
+	// call store its first AfterWrites updates before returning, like a
+	// batched write that fails partway through.
+	AfterWrites int
+	// Err is the error that failing calls return. If it is nil, they
+	// return ErrMockFailure.
+	Err error
+}
+
+type mockRule struct {
+	FailureRule
+	matched int
 }
 
 // NewMock constructs a new mock, along with a MockController pointer to
 // control the behaviour of the new Mock.
 func NewMock() (m Mock, mc *MockController) {
-	mc = &MockController{}
-	m = Mock{
-		ds:    map[string]DomainState{},
-		ids:   map[string]IneligibleDomainState{},
-		state: mc,
+	mc = &MockController{latency: map[string]time.Duration{}}
+	db, _, _ := MemoryDatabase("")
+	return Mock{db: db, state: mc}, mc
+}
+
+// FailOn adds a rule for failing calls. Rules are checked in the order
+// they were added, and the first one that fails a call wins.
+func (mc *MockController) FailOn(rule FailureRule) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	rule.Domains = append([]string(nil), rule.Domains...)
+	mc.rules = append(mc.rules, &mockRule{FailureRule: rule})
+}
+
+// SetLatency makes calls to `method` take at least `d`, or until their
+// context is done. If `method` is empty, it sets the latency of every
+// method that doesn't have its own.
+func (mc *MockController) SetLatency(method string, d time.Duration) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	mc.latency[method] = d
+}
+
+// Calls returns the calls made to the Mock so far, in order.
+func (mc *MockController) Calls() []MockCall {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	return append([]MockCall(nil), mc.calls...)
+}
+
+// CallCount returns the number of calls made to `method` so far.
+func (mc *MockController) CallCount(method string) int {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	count := 0
+	for _, call := range mc.calls {
+		if call.Method == method {
+			count++
+		}
+	}
+	return count
+}
+
+// Reset clears all failure rules, latencies and recorded calls, and stops
+// failing every call. The data stored in the Mock is kept.
+func (mc *MockController) Reset() {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	mc.failCalls = false
+	mc.rules = nil
+	mc.latency = map[string]time.Duration{}
+	mc.calls = nil
+}
+
+// SetFailCalls makes every call fail with ErrMockFailure, or stops doing
+// so.
+func (mc *MockController) SetFailCalls(fail bool) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	mc.failCalls = fail
+}
+
+// record records a call, and returns how long it should be delayed by and
+// the rule that makes it fail, if any.
+func (mc *MockController) record(method string, domains []string) (time.Duration, *mockRule) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	mc.calls = append(mc.calls, MockCall{Method: method, Domains: append([]string(nil), domains...)})
+
+	latency, ok := mc.latency[method]
+	if !ok {
+		latency = mc.latency[""]
+	}
+
+	for _, rule := range mc.rules {
+		if !rule.matches(method, domains) {
+			continue
+		}
+		rule.matched++
+		if rule.Call == 0 || rule.matched == rule.Call {
+			return latency, rule
+		}
+	}
+	return latency, nil
+}
+
+func (mc *MockController) failing() bool {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	return mc.failCalls
+}
+
+func (r *mockRule) matches(method string, domains []string) bool {
+	if r.Method != "" && r.Method != method {
+		return false
+	}
+	if len(r.Domains) == 0 {
+		return true
+	}
+	for _, d := range domains {
+		for _, rd := range r.Domains {
+			if d == rd {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check records a call and returns the error that it should fail with, if
+// any. Calls fail if their context is done, or if the controller says so.
+// For failing batch writes, `partial` is the number of updates to store
+// before failing.
+func (m Mock) check(ctx context.Context, method string, domains []string) (partial int, err error) {
+	latency, rule := m.state.record(method, domains)
+	if latency > 0 {
+		t := time.NewTimer(latency)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if m.state.failing() {
+		return 0, ErrMockFailure
+	}
+	if rule != nil {
+		if rule.Err != nil {
+			return rule.AfterWrites, rule.Err
+		}
+		return rule.AfterWrites, ErrMockFailure
 	}
-	return m, mc
+	return 0, nil
 }
 
-// PutStates mock method
-func (m Mock) PutStates(updates []DomainState, logf func(format string, args ...interface{})) error {
-	if m.state.FailCalls {
-		return errors.New("forced failure")
+func ineligibleDomainStateNames(states []IneligibleDomainState) []string {
+	names := make([]string, len(states))
+	for i, s := range states {
+		names[i] = s.Name
 	}
+	return names
+}
+
+// PutStates mock method. A failing call can store some of the updates
+// first (see FailureRule.AfterWrites).
+func (m Mock) PutStates(ctx context.Context, updates []DomainState, logf func(format string, args ...interface{})) error {
+	partial, err := m.check(ctx, "PutStates", domainStateNames(updates))
+	if err == nil {
+		return m.db.PutStates(ctx, updates, blackholeLogf)
+	}
+
+	written := updates[:min(partial, len(updates))]
+	if len(written) > 0 {
+		if putErr := m.db.PutStates(ctx, written, blackholeLogf); putErr != nil {
+			return putErr
+		}
+	}
+	return partialCommitError(updates, len(written), err)
+}
 
-	for _, s := range updates {
-		m.PutState(s)
+// RestoreStates mock method
+func (m Mock) RestoreStates(ctx context.Context, states []DomainState, logf func(format string, args ...interface{})) error {
+	if _, err := m.check(ctx, "RestoreStates", domainStateNames(states)); err != nil {
+		return err
 	}
-	return nil
+	return m.db.RestoreStates(ctx, states, blackholeLogf)
 }
 
 // PutState mock method
-func (m Mock) PutState(update DomainState) error {
-	if m.state.FailCalls {
-		return errors.New("forced failure")
+func (m Mock) PutState(ctx context.Context, update DomainState) error {
+	if _, err := m.check(ctx, "PutState", []string{update.Name}); err != nil {
+		return err
 	}
+	return m.db.PutState(ctx, update)
+}
 
-	m.ds[update.Name] = update
-	return nil
+// PutStateIfUnchanged mock method
+func (m Mock) PutStateIfUnchanged(ctx context.Context, old DomainState, update DomainState) error {
+	if _, err := m.check(ctx, "PutStateIfUnchanged", []string{update.Name}); err != nil {
+		return err
+	}
+	return m.db.PutStateIfUnchanged(ctx, old, update)
 }
 
 // StateForDomain mock method
-func (m Mock) StateForDomain(domain string) (state DomainState, err error) {
-	if m.state.FailCalls {
-		return state, errors.New("forced failure")
+func (m Mock) StateForDomain(ctx context.Context, domain string) (DomainState, error) {
+	if _, err := m.check(ctx, "StateForDomain", []string{domain}); err != nil {
+		return DomainState{}, err
 	}
+	return m.db.StateForDomain(ctx, domain)
+}
 
-	s, ok := m.ds[domain]
-	if ok {
-		return s, nil
+// StatesForDomains mock method
+func (m Mock) StatesForDomains(ctx context.Context, domains []string) ([]DomainState, error) {
+	if _, err := m.check(ctx, "StatesForDomains", domains); err != nil {
+		return nil, err
 	}
-	return DomainState{Status: StatusUnknown}, nil
+	return m.db.StatesForDomains(ctx, domains)
 }
 
-// StatesForDomain mock method
-func (m Mock) StatesForDomains(domains []string) (states []DomainState, err error) {
-	if m.state.FailCalls {
-		return states, errors.New("forced failure")
+// AllDomainStates mock method
+func (m Mock) AllDomainStates(ctx context.Context) ([]DomainState, error) {
+	if _, err := m.check(ctx, "AllDomainStates", nil); err != nil {
+		return nil, err
 	}
+	return m.db.AllDomainStates(ctx)
+}
 
-	for _, domain := range domains {
-		states = append(states, m.ds[domain])
+// DomainStatesInRange mock method
+func (m Mock) DomainStatesInRange(ctx context.Context, start, end string) ([]DomainState, error) {
+	if _, err := m.check(ctx, "DomainStatesInRange", nil); err != nil {
+		return nil, err
 	}
-	return states, nil
+	return m.db.DomainStatesInRange(ctx, start, end)
 }
 
-// AllDomainStates mock method
-func (m Mock) AllDomainStates() (states []DomainState, err error) {
-	if m.state.FailCalls {
-		return states, errors.New("forced failure")
+// StatesWithStatus mock method
+func (m Mock) StatesWithStatus(ctx context.Context, status PreloadStatus) ([]DomainState, error) {
+	if _, err := m.check(ctx, "StatesWithStatus", nil); err != nil {
+		return nil, err
 	}
+	return m.db.StatesWithStatus(ctx, status)
+}
 
-	for _, s := range m.ds {
-		states = append(states, s)
+// GetIneligibleDomainStates mock method
+func (m Mock) GetIneligibleDomainStates(ctx context.Context, domains []string) ([]IneligibleDomainState, error) {
+	if _, err := m.check(ctx, "GetIneligibleDomainStates", domains); err != nil {
+		return nil, err
 	}
-	return states, nil
+	return m.db.GetIneligibleDomainStates(ctx, domains)
 }
 
-// DomainStatesInRange mock method
-func (m Mock) DomainStatesInRange(start, end string) ([]DomainState, error) {
-	if m.state.FailCalls{
-		return nil, errors.New("forced failure")
+// SetIneligibleDomainStates mock method. A failing call can store some of
+// the updates first (see FailureRule.AfterWrites).
+func (m Mock) SetIneligibleDomainStates(ctx context.Context, updates []IneligibleDomainState, logf func(format string, args ...interface{})) error {
+	partial, err := m.check(ctx, "SetIneligibleDomainStates", ineligibleDomainStateNames(updates))
+	if err == nil {
+		return m.db.SetIneligibleDomainStates(ctx, updates, blackholeLogf)
 	}
 
-	states := []DomainState{}
-	for name, state := range m.ds {
-		if (start == "" || name >= start) && (end == "" || name < end) {
-			states = append(states, state)
+	if written := updates[:min(partial, len(updates))]; len(written) > 0 {
+		if setErr := m.db.SetIneligibleDomainStates(ctx, written, blackholeLogf); setErr != nil {
+			return setErr
 		}
 	}
-	return states, nil
+	return err
 }
 
-// StatesWithStatus mock method
-func (m Mock) StatesWithStatus(status PreloadStatus) (domains []DomainState, err error) {
-	if m.state.FailCalls {
-		return domains, errors.New("forced failure")
+// DeleteIneligibleDomainStates mock method
+func (m Mock) DeleteIneligibleDomainStates(ctx context.Context, domains []string) error {
+	if _, err := m.check(ctx, "DeleteIneligibleDomainStates", domains); err != nil {
+		return err
 	}
+	return m.db.DeleteIneligibleDomainStates(ctx, domains)
+}
 
-	for _, s := range m.ds {
-		if s.Status == status {
-			domains = append(domains, s)
-		}
+// GetAllIneligibleDomainStates mock method
+func (m Mock) GetAllIneligibleDomainStates(ctx context.Context) ([]IneligibleDomainState, error) {
+	if _, err := m.check(ctx, "GetAllIneligibleDomainStates", nil); err != nil {
+		return nil, err
 	}
-	return domains, nil
+	return m.db.GetAllIneligibleDomainStates(ctx)
 }
 
-func (m Mock) GetIneligibleDomainStates(domains []string) (states []IneligibleDomainState, err error) {
-	if m.state.FailCalls {
-		return states, errors.New("forced failure")
+// TransitionsForDomain mock method
+func (m Mock) TransitionsForDomain(ctx context.Context, domain string) ([]Transition, error) {
+	if _, err := m.check(ctx, "TransitionsForDomain", []string{domain}); err != nil {
+		return nil, err
 	}
-	for _, domain := range domains {
-		s, found := m.ids[domain]
-		if found {
-			states = append(states, s)
-		} 
+	return m.db.TransitionsForDomain(ctx, domain)
+}
+
+// IterateDomainStates mock method
+func (m Mock) IterateDomainStates(ctx context.Context, start, end string) iter.Seq2[DomainState, error] {
+	if _, err := m.check(ctx, "IterateDomainStates", nil); err != nil {
+		return sliceSeq[DomainState](ctx, nil, err)
+	}
+	return m.db.IterateDomainStates(ctx, start, end)
+}
+
+// IterateStatesWithStatus mock method
+func (m Mock) IterateStatesWithStatus(ctx context.Context, status PreloadStatus) iter.Seq2[DomainState, error] {
+	if _, err := m.check(ctx, "IterateStatesWithStatus", nil); err != nil {
+		return sliceSeq[DomainState](ctx, nil, err)
 	}
-	return states, nil
+	return m.db.IterateStatesWithStatus(ctx, status)
 }
 
-func (m Mock) SetIneligibleDomainStates(updates []IneligibleDomainState, logf func(format string, args ...interface{})) error {
-	if m.state.FailCalls {
-		return  errors.New("forced failure")
+// IterateIneligibleDomainStates mock method
+func (m Mock) IterateIneligibleDomainStates(ctx context.Context) iter.Seq2[IneligibleDomainState, error] {
+	if _, err := m.check(ctx, "IterateIneligibleDomainStates", nil); err != nil {
+		return sliceSeq[IneligibleDomainState](ctx, nil, err)
 	}
+	return m.db.IterateIneligibleDomainStates(ctx)
+}
 
-	for _, update := range updates {
-		m.ids[update.Name] = update
+// MigrationRecords mock method
+func (m Mock) MigrationRecords(ctx context.Context) ([]MigrationRecord, error) {
+	if _, err := m.check(ctx, "MigrationRecords", nil); err != nil {
+		return nil, err
 	}
-	return nil
+	return m.db.MigrationRecords(ctx)
 }
 
-func (m Mock) DeleteIneligibleDomainStates(domains []string) (err error) {
-    if m.state.FailCalls {
-		return  errors.New("forced failure")
+// PutMigrationRecord mock method
+func (m Mock) PutMigrationRecord(ctx context.Context, record MigrationRecord) error {
+	if _, err := m.check(ctx, "PutMigrationRecord", nil); err != nil {
+		return err
 	}
+	return m.db.PutMigrationRecord(ctx, record)
+}
 
-	for _, domain := range domains {
-		delete(m.ids, domain)
+// Stats mock method
+func (m Mock) Stats(ctx context.Context) (Stats, error) {
+	if _, err := m.check(ctx, "Stats", nil); err != nil {
+		return Stats{}, err
 	}
-	return nil
+	return m.db.Stats(ctx)
 }
 
-func (m Mock) GetAllIneligibleDomainStates() (states []IneligibleDomainState, err error) {
-	if m.state.FailCalls {
-		return states, errors.New("forced failure")
+// SetStats mock method
+func (m Mock) SetStats(ctx context.Context, stats Stats) error {
+	if _, err := m.check(ctx, "SetStats", nil); err != nil {
+		return err
 	}
-	for _, s := range m.ids {
-		states = append(states, s)
+	return m.db.SetStats(ctx, stats)
+}
+
+// Subscriptions mock method
+func (m Mock) Subscriptions(ctx context.Context) ([]Subscription, error) {
+	if _, err := m.check(ctx, "Subscriptions", nil); err != nil {
+		return nil, err
+	}
+	return m.db.Subscriptions(ctx)
+}
+
+// PutSubscription mock method
+func (m Mock) PutSubscription(ctx context.Context, subscription Subscription) error {
+	if _, err := m.check(ctx, "PutSubscription", []string{subscription.Domain}); err != nil {
+		return err
+	}
+	return m.db.PutSubscription(ctx, subscription)
+}
+
+// DeleteSubscription mock method
+func (m Mock) DeleteSubscription(ctx context.Context, id string) error {
+	if _, err := m.check(ctx, "DeleteSubscription", nil); err != nil {
+		return err
+	}
+	return m.db.DeleteSubscription(ctx, id)
+}
+
+// DueDeliveries mock method
+func (m Mock) DueDeliveries(ctx context.Context, now time.Time, limit int) ([]Delivery, error) {
+	if _, err := m.check(ctx, "DueDeliveries", nil); err != nil {
+		return nil, err
+	}
+	return m.db.DueDeliveries(ctx, now, limit)
+}
+
+// PutDelivery mock method
+func (m Mock) PutDelivery(ctx context.Context, delivery Delivery) error {
+	if _, err := m.check(ctx, "PutDelivery", []string{delivery.Event.Domain}); err != nil {
+		return err
+	}
+	return m.db.PutDelivery(ctx, delivery)
+}
+
+// DeleteDelivery mock method
+func (m Mock) DeleteDelivery(ctx context.Context, id string) error {
+	if _, err := m.check(ctx, "DeleteDelivery", nil); err != nil {
+		return err
+	}
+	return m.db.DeleteDelivery(ctx, id)
+}
+
+// Job mock method
+func (m Mock) Job(ctx context.Context, id string) (Job, error) {
+	if _, err := m.check(ctx, "Job", nil); err != nil {
+		return Job{}, err
+	}
+	return m.db.Job(ctx, id)
+}
+
+// PutJob mock method
+func (m Mock) PutJob(ctx context.Context, job Job) error {
+	if _, err := m.check(ctx, "PutJob", job.Domains); err != nil {
+		return err
+	}
+	return m.db.PutJob(ctx, job)
+}
+
+// DeleteExpiredJobs mock method
+func (m Mock) DeleteExpiredJobs(ctx context.Context, now time.Time) error {
+	if _, err := m.check(ctx, "DeleteExpiredJobs", nil); err != nil {
+		return err
 	}
-	return states, nil
+	return m.db.DeleteExpiredJobs(ctx, now)
 }
@@ -0,0 +1,205 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMockFailureRules(t *testing.T) {
+	m, mc := NewMock()
+	ctx := context.Background()
+	errCustom := errors.New("custom failure")
+
+	mc.FailOn(FailureRule{Method: "StateForDomain", Call: 2})
+	mc.FailOn(FailureRule{Method: "TransitionsForDomain", Domains: []string{"b.test"}, Err: errCustom})
+
+	for i, want := range []error{nil, ErrMockFailure, nil} {
+		if _, err := m.StateForDomain(ctx, "a.test"); err != want {
+			t.Errorf("StateForDomain call %d: got %v, want %v", i+1, err, want)
+		}
+	}
+
+	if _, err := m.TransitionsForDomain(ctx, "a.test"); err != nil {
+		t.Errorf("TransitionsForDomain(a.test) should succeed: %s", err)
+	}
+	if _, err := m.TransitionsForDomain(ctx, "b.test"); err != errCustom {
+		t.Errorf("TransitionsForDomain(b.test): got %v, want %v", err, errCustom)
+	}
+
+	// Other methods are not affected by the rules.
+	if _, err := m.AllDomainStates(ctx); err != nil {
+		t.Errorf("AllDomainStates should succeed: %s", err)
+	}
+
+	mc.Reset()
+	if _, err := m.TransitionsForDomain(ctx, "b.test"); err != nil {
+		t.Errorf("Rules should be cleared by Reset: %s", err)
+	}
+}
+
+func TestMockPartialWrites(t *testing.T) {
+	m, mc := NewMock()
+	ctx := context.Background()
+
+	mc.FailOn(FailureRule{Method: "PutStates", AfterWrites: 2})
+	states := []DomainState{
+		{Name: "a.test", Status: StatusPending},
+		{Name: "b.test", Status: StatusPending},
+		{Name: "c.test", Status: StatusPending},
+	}
+	err := m.PutStates(ctx, states, blackholeLogf)
+	var partial *PartialCommitError
+	if !errors.As(err, &partial) || partial.Err != ErrMockFailure {
+		t.Fatalf("PutStates: got %v, want a PartialCommitError for %v", err, ErrMockFailure)
+	}
+	if !reflect.DeepEqual(partial.Committed, []string{"a.test", "b.test"}) || !reflect.DeepEqual(partial.Uncommitted, []string{"c.test"}) {
+		t.Errorf("Wrong partial commit: %#v", partial)
+	}
+
+	got, err := m.AllDomainStates(ctx)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(got) != 2 {
+		t.Errorf("Wrong number of states after a partial write: %#v", got)
+	}
+	if s, err := m.StateForDomain(ctx, "c.test"); err != nil || s.Status != StatusUnknown {
+		t.Errorf("c.test should not have been written: %#v, %v", s, err)
+	}
+}
+
+func TestMockSetPendingAutomatedRemovalFailure(t *testing.T) {
+	m, mc := NewMock()
+
+	var domains []string
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("domain%d.test", i)
+		domains = append(domains, name)
+		if err := m.PutState(setupCtx, DomainState{Name: name, Status: StatusPreloaded}); err != nil {
+			t.Fatalf("cannot put state: %s", err)
+		}
+	}
+
+	mc.FailOn(FailureRule{Method: "PutStates", AfterWrites: 1})
+	var statuses []string
+	statusReport := func(format string, args ...interface{}) {
+		statuses = append(statuses, fmt.Sprintf(format, args...))
+	}
+	if err := SetPendingAutomatedRemoval(context.Background(), m, domains, statusReport); !errors.Is(err, ErrMockFailure) {
+		t.Errorf("SetPendingAutomatedRemoval: got %v, want %v", err, ErrMockFailure)
+	}
+
+	wantStatusReports := []string{"Updating 3 entries...", " failed: committed 1 of 3 domain states: forced failure\n"}
+	if !reflect.DeepEqual(statuses, wantStatusReports) {
+		t.Errorf("Incorrect status reports: %#v", statuses)
+	}
+
+	pending, err := m.StatesWithStatus(context.Background(), StatusPendingAutomatedRemoval)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(pending) != 1 || pending[0].Name != "domain0.test" {
+		t.Errorf("Wrong states after a partial failure: %#v", pending)
+	}
+}
+
+func TestMockCalls(t *testing.T) {
+	m, mc := NewMock()
+	ctx := context.Background()
+
+	m.PutStates(setupCtx, []DomainState{{Name: "a.test"}, {Name: "b.test"}}, blackholeLogf)
+	m.StateForDomain(ctx, "a.test")
+	for range m.IterateDomainStates(ctx, "", "") {
+	}
+
+	wantCalls := []MockCall{
+		{Method: "PutStates", Domains: []string{"a.test", "b.test"}},
+		{Method: "StateForDomain", Domains: []string{"a.test"}},
+		{Method: "IterateDomainStates"},
+	}
+	if calls := mc.Calls(); !reflect.DeepEqual(calls, wantCalls) {
+		t.Errorf("Wrong calls: %#v", calls)
+	}
+	if n := mc.CallCount("StateForDomain"); n != 1 {
+		t.Errorf("Wrong call count: %d", n)
+	}
+}
+
+func TestMockLatency(t *testing.T) {
+	m, mc := NewMock()
+	mc.SetLatency("StateForDomain", time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := m.StateForDomain(ctx, "a.test"); err != context.DeadlineExceeded {
+		t.Errorf("StateForDomain: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Methods without their own latency are not delayed.
+	start := time.Now()
+	if _, err := m.AllDomainStates(context.Background()); err != nil {
+		t.Errorf("AllDomainStates should succeed: %s", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("AllDomainStates took %s", d)
+	}
+}
+
+func TestMockConcurrentUse(t *testing.T) {
+	m, mc := NewMock()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("domain%d.test", i)
+			m.PutState(ctx, DomainState{Name: name, Status: StatusPending})
+			m.StateForDomain(ctx, name)
+			m.SetIneligibleDomainStates(ctx, []IneligibleDomainState{{Name: name}}, blackholeLogf)
+			m.GetAllIneligibleDomainStates(ctx)
+		}()
+	}
+	wg.Wait()
+
+	states, err := m.AllDomainStates(ctx)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(states) != 50 {
+		t.Errorf("Wrong number of states: %d", len(states))
+	}
+	if n := mc.CallCount("PutState"); n != 50 {
+		t.Errorf("Wrong call count: %d", n)
+	}
+}
+
+func TestMockSetFailCalls(t *testing.T) {
+	m, mc := NewMock()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.StateForDomain(ctx, "a.test")
+		}()
+	}
+	mc.SetFailCalls(true)
+	wg.Wait()
+
+	if _, err := m.StateForDomain(ctx, "a.test"); err != ErrMockFailure {
+		t.Errorf("Wrong error: %v", err)
+	}
+	mc.SetFailCalls(false)
+	if _, err := m.StateForDomain(ctx, "a.test"); err != nil {
+		t.Errorf("%s", err)
+	}
+}
@@ -0,0 +1,38 @@
+package database
+
+import (
+	"context"
+	"fmt"
+)
+
+// Open opens an existing database for a command line tool. `backend` is
+// one of:
+//
+//   - "datastore": Google Cloud Datastore for the project `projectID`
+//   - "bolt": the BoltBacked database in the file `dbFile`
+//   - "memory": a MemoryBacked database loaded from the snapshot `dbFile`
+//
+// When there is no error, make sure to call shutdown() in order to release
+// the database (and, for "memory", to write back the snapshot).
+func Open(ctx context.Context, backend string, dbFile string, projectID string) (db Database, shutdown func() error, err error) {
+	switch backend {
+	case "datastore":
+		prodDB, err := ProdDatabase(ctx, projectID)
+		if err != nil {
+			return nil, nil, err
+		}
+		return prodDB, prodDB.Close, nil
+	case "bolt":
+		if dbFile == "" {
+			return nil, nil, fmt.Errorf("-db=bolt requires -db-file")
+		}
+		return BoltDatabase(dbFile)
+	case "memory":
+		if dbFile == "" {
+			return nil, nil, fmt.Errorf("-db=memory requires -db-file")
+		}
+		return MemoryDatabase(dbFile)
+	default:
+		return nil, nil, fmt.Errorf("unknown database backend: %q", backend)
+	}
+}
@@ -0,0 +1,78 @@
+package database
+
+import (
+	"context"
+	"fmt"
+)
+
+// validTransitions lists the statuses each status may move to. Writes
+// that keep the status of a domain the same are always valid.
+//
+// Domains that are not in the database are treated as StatusUnknown.
+var validTransitions = map[PreloadStatus][]PreloadStatus{
+	// Submit, or the update cron for domains added to the list manually.
+	StatusUnknown: {StatusPending, StatusPreloaded},
+	// The update cron, or Remove while the domain is still pending.
+	StatusPending: {StatusPreloaded, StatusPendingRemoval},
+	// Remove, RemoveIneligibleDomains, or the update cron once the domain
+	// has been removed from the list.
+	StatusPreloaded: {StatusPendingRemoval, StatusPendingAutomatedRemoval, StatusRemoved},
+	// Resubmission, RemoveIneligibleDomains, or the update cron.
+	StatusPendingRemoval: {StatusPreloaded, StatusPendingAutomatedRemoval, StatusRemoved},
+	// Resubmission, or the update cron.
+	StatusPendingAutomatedRemoval: {StatusPreloaded, StatusRemoved},
+	// Submit, or the update cron for domains added back to the list manually.
+	StatusRemoved:  {StatusPending, StatusPreloaded},
+	StatusRejected: {StatusPending, StatusPreloaded},
+}
+
+// ValidTransition reports whether a domain may move from status `from` to
+// status `to` without going through an admin tool.
+func ValidTransition(from PreloadStatus, to PreloadStatus) bool {
+	if from == to {
+		return true
+	}
+	for _, s := range validTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// An InvalidTransitionError is returned for a write that would move a
+// domain between two statuses that are not connected by a valid
+// transition. Nothing in the batch containing the write is stored.
+type InvalidTransitionError struct {
+	Name string
+	From PreloadStatus
+	To   PreloadStatus
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("invalid status transition for %s: %s -> %s", e.Name, e.From, e.To)
+}
+
+// checkTransitions returns an *InvalidTransitionError for the first update
+// whose status change is not valid. `stored` holds the states currently in
+// the database; domains missing from it are treated as StatusUnknown.
+//
+// Writes made with ActorAdmin (see WithActor) are not checked, so that
+// maintainers can still correct any state by hand. Neither are writes made
+// by migrations, which may need to move away from deprecated statuses.
+func checkTransitions(ctx context.Context, stored map[string]DomainState, updates []DomainState) error {
+	if actor := actorFromContext(ctx).actor; actor == ActorAdmin || actor == ActorMigration {
+		return nil
+	}
+
+	for _, update := range updates {
+		from := PreloadStatus(StatusUnknown)
+		if old, ok := stored[update.Name]; ok {
+			from = old.Status
+		}
+		if !ValidTransition(from, update.Status) {
+			return &InvalidTransitionError{Name: update.Name, From: from, To: update.Status}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package database
+
+import (
+	"context"
+	"strings"
+
+	"github.com/chromium/hstspreload/chromium/preloadlist"
+)
+
+const counterKind = "Counter"
+
+// Counters are stored by name, with one of these prefixes.
+const (
+	statusCounterPrefix     = "status:"
+	policyCounterPrefix     = "policy:"
+	submissionCounterPrefix = "submissions:"
+
+	// submissionDayFormat is the format of the (UTC) days that
+	// submissions are counted by.
+	submissionDayFormat = "2006-01-02"
+)
+
+// Stats are aggregate counts over the DomainStates in the database. The
+// database keeps them up to date as states are written, so they are cheap
+// to read.
+type Stats struct {
+	// Statuses is the number of domains with each status.
+	Statuses map[PreloadStatus]int `json:"statuses"`
+	// Policies is the number of domains with each policy. Domains without
+	// a policy are not counted.
+	Policies map[preloadlist.PolicyType]int `json:"policies"`
+	// Submissions is the number of submissions made on each day (UTC),
+	// keyed by YYYY-MM-DD. A write counts as a submission if it makes a
+	// domain pending with a new SubmissionDate. Other writes, such as
+	// removal requests, may also set the SubmissionDate, but aren't
+	// counted.
+	Submissions map[string]int `json:"submissionsPerDay"`
+}
+
+// counterDeltas returns the changes to the counters caused by writing
+// `updates` over `stored`. Domains missing from `stored` are new.
+func counterDeltas(stored map[string]DomainState, updates []DomainState) map[string]int {
+	deltas := map[string]int{}
+	for _, update := range updates {
+		old, exists := stored[update.Name]
+		if exists {
+			deltas[statusCounterPrefix+string(old.Status)]--
+			if old.Policy != preloadlist.UnspecifiedPolicyType {
+				deltas[policyCounterPrefix+string(old.Policy)]--
+			}
+		}
+
+		deltas[statusCounterPrefix+string(update.Status)]++
+		if update.Policy != preloadlist.UnspecifiedPolicyType {
+			deltas[policyCounterPrefix+string(update.Policy)]++
+		}
+		submitted := truncateTime(update.SubmissionDate)
+		if update.Status == StatusPending && !submitted.IsZero() && (!exists || !truncateTime(old.SubmissionDate).Equal(submitted)) {
+			deltas[submissionCounterPrefix+submitted.UTC().Format(submissionDayFormat)]++
+		}
+	}
+
+	for name, delta := range deltas {
+		if delta == 0 {
+			delete(deltas, name)
+		}
+	}
+	return deltas
+}
+
+// addCounters adds `deltas` to `counters`, removing counters that drop to
+// zero.
+func addCounters(counters map[string]int, deltas map[string]int) {
+	for name, delta := range deltas {
+		counters[name] += delta
+		if counters[name] == 0 {
+			delete(counters, name)
+		}
+	}
+}
+
+// statsFromCounters converts counters by name into Stats.
+func statsFromCounters(counters map[string]int) Stats {
+	stats := Stats{
+		Statuses:    map[PreloadStatus]int{},
+		Policies:    map[preloadlist.PolicyType]int{},
+		Submissions: map[string]int{},
+	}
+	for name, count := range counters {
+		if count == 0 {
+			continue
+		}
+		if status, ok := strings.CutPrefix(name, statusCounterPrefix); ok {
+			stats.Statuses[PreloadStatus(status)] = count
+		} else if policy, ok := strings.CutPrefix(name, policyCounterPrefix); ok {
+			stats.Policies[preloadlist.PolicyType(policy)] = count
+		} else if day, ok := strings.CutPrefix(name, submissionCounterPrefix); ok {
+			stats.Submissions[day] = count
+		}
+	}
+	return stats
+}
+
+// countersFromStats is the inverse of statsFromCounters.
+func countersFromStats(stats Stats) map[string]int {
+	counters := map[string]int{}
+	for status, count := range stats.Statuses {
+		counters[statusCounterPrefix+string(status)] = count
+	}
+	for policy, count := range stats.Policies {
+		counters[policyCounterPrefix+string(policy)] = count
+	}
+	for day, count := range stats.Submissions {
+		counters[submissionCounterPrefix+day] = count
+	}
+	for name, count := range counters {
+		if count == 0 {
+			delete(counters, name)
+		}
+	}
+	return counters
+}
+
+// ComputeStats computes Stats by going through every DomainState in `db`.
+// Only the latest submission of each pending domain is known, so earlier
+// submissions are not counted.
+func ComputeStats(ctx context.Context, db Database) (Stats, error) {
+	counters := map[string]int{}
+	for state, err := range db.IterateDomainStates(ctx, "", "") {
+		if err != nil {
+			return Stats{}, err
+		}
+		addCounters(counters, counterDeltas(nil, []DomainState{state}))
+	}
+	return statsFromCounters(counters), nil
+}
+
+// RecountStats replaces the stats stored in `db` with ones computed by
+// ComputeStats. It is meant for databases written before stats were
+// kept, and for repairing counters. States written while it runs may not
+// be counted correctly.
+func RecountStats(ctx context.Context, db Database) error {
+	stats, err := ComputeStats(ctx, db)
+	if err != nil {
+		return err
+	}
+	return db.SetStats(ctx, stats)
+}
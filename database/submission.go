@@ -0,0 +1,51 @@
+package database
+
+import (
+	"slices"
+
+	"github.com/chromium/hstspreload"
+)
+
+// SubmissionChannel is how a domain was submitted.
+type SubmissionChannel string
+
+// Values for SubmissionChannel
+const (
+	// ChannelWeb is a submission through the form on the site.
+	ChannelWeb SubmissionChannel = "web"
+	// ChannelAPI is a submission by a client calling the API directly.
+	ChannelAPI SubmissionChannel = "api"
+	// ChannelAdmin is a submission by a preload list maintainer.
+	ChannelAdmin SubmissionChannel = "admin"
+)
+
+// Submission is the metadata recorded when a domain is submitted for
+// preloading, for maintainers reviewing the pending list.
+type Submission struct {
+	// e.g. ChannelWeb or ChannelAPI
+	Channel SubmissionChannel `json:"channel,omitempty"`
+	// The issues (i.e. warnings) the domain had when it was submitted.
+	Issues hstspreload.Issues `json:"issues"`
+	// The Strict-Transport-Security header observed when the domain was
+	// submitted.
+	Header string `json:"header,omitempty"`
+	// An opaque, keyed hash of the network and user agent of the client
+	// that submitted the domain. It can be used to tell whether two
+	// submissions came from the same client, but not who the client is.
+	ClientFingerprint string `json:"clientFingerprint,omitempty"`
+}
+
+// IsZero reports whether no submission metadata has been recorded.
+func (s Submission) IsZero() bool {
+	return s.Equal(Submission{})
+}
+
+// Equal checks if the fields of `s` are equal to the fields of `s2`. Nil
+// and empty issue lists are considered equal, since not every backend
+// distinguishes between them.
+func (s Submission) Equal(s2 Submission) bool {
+	return s.Channel == s2.Channel && s.Header == s2.Header &&
+		s.ClientFingerprint == s2.ClientFingerprint &&
+		slices.Equal(s.Issues.Errors, s2.Issues.Errors) &&
+		slices.Equal(s.Issues.Warnings, s2.Issues.Warnings)
+}
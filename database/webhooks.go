@@ -0,0 +1,156 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	subscriptionKind = "WebhookSubscription"
+	deliveryKind     = "WebhookDelivery"
+)
+
+// A Subscription asks for the status changes of a domain to be posted to a
+// webhook URL.
+type Subscription struct {
+	// ID is the key in the datastore, so we don't include it as a field
+	// in the stored value.
+	ID string `datastore:"-" json:"id"`
+	// Domain is the domain whose status changes are posted.
+	Domain string `json:"domain"`
+	// IncludeSubdomains extends the subscription to every subdomain of
+	// Domain, e.g. to all the domains of an organization.
+	IncludeSubdomains bool `datastore:",noindex" json:"includeSubdomains"`
+	// Statuses limits the subscription to changes into these statuses. If
+	// it is empty, every change is posted.
+	Statuses []PreloadStatus `datastore:",noindex" json:"statuses,omitempty"`
+	// URL is where events are posted.
+	URL string `datastore:",noindex" json:"url"`
+	// Secret is the HMAC key that events are signed with.
+	Secret  string    `datastore:",noindex" json:"-"`
+	Created time.Time `datastore:",noindex" json:"created"`
+}
+
+// Matches reports whether `t` should be posted to the subscriber.
+func (s Subscription) Matches(t Transition) bool {
+	if t.Name != s.Domain && !(s.IncludeSubdomains && strings.HasSuffix(t.Name, "."+s.Domain)) {
+		return false
+	}
+	return len(s.Statuses) == 0 || slices.Contains(s.Statuses, t.NewStatus)
+}
+
+// An Event is the body of a webhook request. It describes a single change
+// in the status of a domain.
+type Event struct {
+	// ID is the ID of the delivery. A subscriber may receive the same
+	// event more than once, and can use the ID to tell.
+	ID        string        `datastore:"-" json:"id"`
+	Domain    string        `json:"domain"`
+	OldStatus PreloadStatus `json:"oldStatus"`
+	NewStatus PreloadStatus `json:"newStatus"`
+	Actor     Actor         `json:"actor"`
+	Time      time.Time     `json:"time"`
+	Message   string        `datastore:",noindex" json:"message,omitempty"`
+}
+
+// A Delivery is an event waiting to be posted to a subscriber. Deliveries
+// are written along with the transitions that cause them, so that events
+// are not lost if the server stops before posting them.
+type Delivery struct {
+	// ID is the key in the datastore, so we don't include it as a field
+	// in the stored value.
+	ID             string `datastore:"-"`
+	SubscriptionID string `datastore:",noindex"`
+	Event          Event
+	// Attempts is the number of failed attempts to post the event.
+	Attempts int `datastore:",noindex"`
+	// NextAttempt is when the event should be posted next.
+	NextAttempt time.Time
+	// LastError describes why the last attempt failed.
+	LastError string `datastore:",noindex"`
+}
+
+// NewID returns a random ID for a subscription or a delivery.
+func NewID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// subscribedDomains returns the domains a subscription can have so that it
+// matches one of `transitions`: the name of each transition and all of its
+// parent domains, sorted and without duplicates.
+func subscribedDomains(transitions []Transition) []string {
+	var domains []string
+	for _, t := range transitions {
+		for name := t.Name; name != ""; {
+			domains = append(domains, name)
+			_, name, _ = strings.Cut(name, ".")
+		}
+	}
+	slices.Sort(domains)
+	return slices.Compact(domains)
+}
+
+// newDeliveries returns a delivery for every pair of a transition and a
+// subscription that matches it. They are due immediately.
+func newDeliveries(subscriptions []Subscription, transitions []Transition) []Delivery {
+	var deliveries []Delivery
+	for _, t := range transitions {
+		for _, s := range subscriptions {
+			if !s.Matches(t) {
+				continue
+			}
+			deliveries = append(deliveries, Delivery{
+				ID:             NewID(),
+				SubscriptionID: s.ID,
+				Event: Event{
+					Domain:    t.Name,
+					OldStatus: t.OldStatus,
+					NewStatus: t.NewStatus,
+					Actor:     t.Actor,
+					Time:      t.Time,
+					Message:   t.Message,
+				},
+				NextAttempt: t.Time,
+			})
+		}
+	}
+	return deliveries
+}
+
+// dueDeliveries returns at most `limit` of the deliveries that are due at
+// `now`, in order of their next attempt.
+func dueDeliveries(deliveries []Delivery, now time.Time, limit int) []Delivery {
+	var due []Delivery
+	for _, d := range deliveries {
+		if !d.NextAttempt.After(now) {
+			due = append(due, d)
+		}
+	}
+	slices.SortStableFunc(due, func(a, b Delivery) int {
+		return a.NextAttempt.Compare(b.NextAttempt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due
+}
+
+// truncateDelivery truncates the times of `d` like Datastore does.
+func truncateDelivery(d Delivery) Delivery {
+	d.Event.Time = truncateTime(d.Event.Time)
+	d.NextAttempt = truncateTime(d.NextAttempt)
+	return d
+}
+
+// copySubscription makes a deep copy of `s`, with its times truncated like
+// Datastore does.
+func copySubscription(s Subscription) Subscription {
+	s.Statuses = slices.Clone(s.Statuses)
+	s.Created = truncateTime(s.Created)
+	return s
+}
@@ -0,0 +1,22 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSubscribedDomains(t *testing.T) {
+	transitions := []Transition{
+		{Name: "a.example.test"},
+		{Name: "b.example.test"},
+		{Name: "example.test"},
+	}
+	want := []string{"a.example.test", "b.example.test", "example.test", "test"}
+	if got := subscribedDomains(transitions); !reflect.DeepEqual(got, want) {
+		t.Errorf("subscribedDomains() = %v, want %v", got, want)
+	}
+
+	if got := subscribedDomains(nil); len(got) != 0 {
+		t.Errorf("subscribedDomains(nil) = %v, want none", got)
+	}
+}
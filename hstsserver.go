@@ -6,7 +6,20 @@ import (
 	"net/http"
 )
 
-type hstsServer struct{}
+type hstsServer struct {
+	// rateLimit is the middleware of the handlers wrapped with
+	// RateLimited. Nothing is limited if it is nil.
+	rateLimit func(http.HandlerFunc) http.HandlerFunc
+}
+
+// RateLimited wraps `handlerFunc` with the rate limit middleware of the
+// server.
+func (server hstsServer) RateLimited(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	if server.rateLimit == nil {
+		return handlerFunc
+	}
+	return server.rateLimit(handlerFunc)
+}
 
 func (server hstsServer) Handle(pattern string, handler http.Handler) {
 	server.HandleFunc(pattern, handler.ServeHTTP)
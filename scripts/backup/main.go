@@ -0,0 +1,55 @@
+// Command backup exports a hstspreload.org database to JSON Lines, or
+// imports such an export into a database.
+//
+// Examples:
+//
+//	go run ./scripts/backup -db=datastore export > hstspreload.jsonl
+//	go run ./scripts/backup -db=bolt -db-file=hstspreload.db import < hstspreload.jsonl
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/chromium/hstspreload.org/database"
+)
+
+func main() {
+	dbBackend := flag.String("db", "datastore", "database backend: \"datastore\", \"bolt\" or \"memory\"")
+	dbFile := flag.String("db-file", "", "database file: the database file for -db=bolt, or the snapshot file for -db=memory")
+	projectID := flag.String("project", "hstspreload", "Cloud project ID for -db=datastore")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] export|import\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || (flag.Arg(0) != "export" && flag.Arg(0) != "import") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	db, shutdown, err := database.Open(ctx, *dbBackend, *dbFile, *projectID)
+	if err != nil {
+		log.Fatalf("Error opening database: %v", err)
+	}
+
+	switch flag.Arg(0) {
+	case "export":
+		err = database.Export(ctx, db, os.Stdout)
+	case "import":
+		err = database.Import(ctx, db, os.Stdin, func(format string, args ...interface{}) {
+			fmt.Fprintf(os.Stderr, format, args...)
+		})
+	}
+	if shutdownErr := shutdown(); err == nil {
+		err = shutdownErr
+	}
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+// Command migrate runs the schema migrations in the database package that
+// haven't completed yet.
+//
+// Examples:
+//
+//	go run ./scripts/migrate -db=datastore -dry-run
+//	go run ./scripts/migrate -db=bolt -db-file=hstspreload.db
+//	go run ./scripts/migrate -db=datastore -recount-stats
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/chromium/hstspreload.org/database"
+	"github.com/chromium/hstspreload/chromium/preloadlist"
+)
+
+func main() {
+	dbBackend := flag.String("db", "datastore", "database backend: \"datastore\", \"bolt\" or \"memory\"")
+	dbFile := flag.String("db-file", "", "database file: the database file for -db=bolt, or the snapshot file for -db=memory")
+	projectID := flag.String("project", "hstspreload", "Cloud project ID for -db=datastore")
+	dryRun := flag.Bool("dry-run", false, "only count the domain states each migration would change")
+	recountStats := flag.Bool("recount-stats", false, "recompute the stats counters from scratch after running the migrations")
+	flag.Parse()
+
+	log.Println("Fetching the preload list...")
+	list, err := preloadlist.NewFromLatest()
+	if err != nil {
+		log.Fatalf("Error fetching the preload list: %v", err)
+	}
+
+	ctx := context.Background()
+	db, shutdown, err := database.Open(ctx, *dbBackend, *dbFile, *projectID)
+	if err != nil {
+		log.Fatalf("Error opening database: %v", err)
+	}
+
+	err = database.RunMigrations(ctx, db, database.Migrations(list), *dryRun, func(format string, args ...interface{}) {
+		fmt.Fprintf(os.Stderr, format, args...)
+	})
+	if err == nil && *recountStats && !*dryRun {
+		log.Println("Recounting stats...")
+		err = database.RecountStats(ctx, db)
+	}
+	if shutdownErr := shutdown(); err == nil {
+		err = shutdownErr
+	}
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
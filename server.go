@@ -7,6 +7,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"cloud.google.com/go/logging"
 	"github.com/chromium/hstspreload.org/api"
@@ -15,16 +18,21 @@ import (
 
 const (
 	prodProjectID = "hstspreload"
+
+	// shutdownTimeout is how long the server waits for requests to finish
+	// when it is stopped.
+	shutdownTimeout = 10 * time.Second
 )
 
 func main() {
 	local := flag.Bool("local", false, "run the server using a local database")
+	dbBackend := flag.String("db", "", "database backend: \"emulator\", \"memory\", \"bolt\" or \"datastore\" (default: \"emulator\" with -local, \"datastore\" otherwise)")
+	dbFile := flag.String("db-file", "", "database file: the snapshot file for -db=memory (optional), or the database file for -db=bolt")
 	flag.Parse()
 
-	a, shutdown := mustSetupAPI(*local)
-	defer shutdown()
+	a, shutdown := mustSetupAPI(*local, *dbBackend, *dbFile)
 
-	server := hstsServer{}
+	server := hstsServer{rateLimit: a.RateLimit}
 
 	staticHandler := http.FileServer(http.Dir("frontend"))
 	server.Handle("/", staticHandler)
@@ -33,34 +41,111 @@ func main() {
 	server.Handle("/static/", staticHandler)
 
 	server.Handle("/search.xml", searchXML(origin(*local)))
+	server.HandleFunc("/autocomplete", a.Autocomplete)
 	server.HandleFunc("/robots.txt", http.NotFound)
 
-	server.HandleFunc("/api/v2/preloadable", a.Preloadable)
-	server.HandleFunc("/api/v2/removable", a.Removable)
-	server.HandleFunc("/api/v2/status", a.Status)
-	server.HandleFunc("/api/v2/submit", a.Submit)
-	server.HandleFunc("/api/v2/remove", a.Remove)
-
-	server.HandleFunc("/api/v2/pending", a.Pending)
-	server.HandleFunc("/api/v2/pending-removal", a.PendingRemoval)
-	server.HandleFunc("/api/v2/pending-automated-removal", a.PendingAutomatedRemoval)
-
-	server.HandleFunc("/api/v2/update", a.Update)
-
-	server.HandleFunc("/api/v2/remove-ineligible-domains", a.RemoveIneligibleDomains)
-
-	if *local {
-		server.HandleFunc("/api/v2/debug/all-states", a.DebugAllStates)
-		server.HandleFunc("/api/v2/debug/set-preloaded", a.DebugSetPreloaded)
-		server.HandleFunc("/api/v2/debug/set-rejected", a.DebugSetRejected)
+	server.HandleFunc("/api/openapi.json", a.OpenAPI)
+	for _, route := range apiRoutes(a, *local) {
+		handler := route.handler
+		if rateLimitedRoutes[route.path] {
+			handler = server.RateLimited(handler)
+		}
+		server.HandleFunc("/api/v2"+route.path, handler)
+		// v3 has the same handlers, but its error responses are JSON.
+		server.Handle("/api/v3"+route.path, api.JSONErrors(handler))
 	}
 
 	server.HandleFunc("/_ah/health", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "ok")
 	})
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	httpServer := &http.Server{Addr: fmt.Sprintf(":%s", port())}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpServer.ListenAndServe()
+	}()
 	fmt.Printf("Serving from: %s\n", origin(*local))
-	fmt.Println(http.ListenAndServe(fmt.Sprintf(":%s", port()), nil))
+
+	select {
+	case err := <-serveErr:
+		fmt.Println(err)
+	case <-ctx.Done():
+		// Let the requests in flight finish before the database is shut
+		// down (e.g. so that their writes are in the memory snapshot).
+		fmt.Println("Shutting down...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			fmt.Println(err)
+		}
+		cancel()
+	}
+
+	if err := shutdown(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not shut down the database: %s\n", err)
+	}
+}
+
+// apiRoute is an API handler, with its path relative to the API version
+// prefix (e.g. "/api/v2").
+type apiRoute struct {
+	path    string
+	handler http.HandlerFunc
+}
+
+// rateLimitedRoutes are the routes that make the server connect to the
+// domains in the request, so that clients can't use it to scan other sites.
+var rateLimitedRoutes = map[string]bool{
+	"/preloadable":        true,
+	"/preloadable/jobs":   true,
+	"/removable":          true,
+	"/submit":             true,
+	"/remove":             true,
+	"/webhooks/subscribe": true,
+}
+
+// apiRoutes returns the handlers that are served under every API version.
+// The debug handlers are only included when running locally.
+func apiRoutes(a api.API, local bool) []apiRoute {
+	routes := []apiRoute{
+		{"/preloadable", a.Preloadable},
+		{"/preloadable/jobs", a.SubmitPreloadableJob},
+		{"/preloadable/job", a.PreloadableJobStatus},
+		{"/removable", a.Removable},
+		{"/status", a.Status},
+		{"/status/batch", a.StatusBatch},
+		{"/history", a.History},
+		{"/stats", a.Stats},
+		{"/submit", a.Submit},
+		{"/remove", a.Remove},
+		{"/removal-challenge", a.RemovalChallenge},
+		{"/rate-limits", a.RateLimits},
+		{"/webhooks/subscribe", a.Subscribe},
+		{"/webhooks/unsubscribe", a.Unsubscribe},
+		{"/webhooks/dispatch", a.DispatchWebhooks},
+
+		{"/pending", a.Pending},
+		{"/pending-removal", a.PendingRemoval},
+		{"/pending-automated-removal", a.PendingAutomatedRemoval},
+
+		{"/update", a.Update},
+
+		{"/remove-ineligible-domains", a.RemoveIneligibleDomains},
+
+		{"/admin/pending", a.AdminPending},
+		{"/admin/submission", a.AdminSubmission},
+	}
+
+	if local {
+		routes = append(routes,
+			apiRoute{"/debug/all-states", a.DebugAllStates},
+			apiRoute{"/debug/set-preloaded", a.DebugSetPreloaded},
+			apiRoute{"/debug/set-rejected", a.DebugSetRejected},
+		)
+	}
+	return routes
 }
 
 func port() string {
@@ -79,33 +164,107 @@ func origin(local bool) string {
 	return "https://hstspreload.org"
 }
 
-func mustSetupAPI(local bool) (a api.API, shutdown func() error) {
+func mustSetupAPI(local bool, dbBackend string, dbFile string) (a api.API, shutdown func() error) {
 	var db database.Database
 	ctx := context.Background()
 	logger := log.Default()
 
-	if local {
+	if dbBackend == "" {
+		dbBackend = "datastore"
+		if local {
+			dbBackend = "emulator"
+		}
+	}
+
+	production := !local && dbBackend == "datastore"
+
+	// Only the production deployment logs to Cloud Logging.
+	if production {
+		logClient, err := logging.NewClient(ctx, prodProjectID)
+		if err != nil {
+			logger.Fatalf("Failed to create logging client: %v", err)
+		}
+		logger = logClient.Logger("hstspreload-server").StandardLogger(logging.Info)
+	}
+
+	switch dbBackend {
+	case "memory":
+		logger.Print("Setting up in-memory database...")
+		memoryDB, dbShutdown, err := database.MemoryDatabase(dbFile)
+		if err != nil {
+			logger.Fatalf("Error creating database: %v", err)
+		}
+		db, shutdown = memoryDB, dbShutdown
+	case "bolt":
+		if dbFile == "" {
+			logger.Fatal("-db=bolt requires -db-file")
+		}
+		logger.Printf("Setting up bolt database at %s...", dbFile)
+		boltDB, dbShutdown, err := database.BoltDatabase(dbFile)
+		if err != nil {
+			logger.Fatalf("Error creating database: %v", err)
+		}
+		db, shutdown = boltDB, dbShutdown
+	case "emulator":
 		logger.Print("Setting up local database...")
 		localDB, dbShutdown, err := database.TempLocalDatabase()
 		if err != nil {
 			logger.Fatalf("Error creating database: %v", err)
 		}
 		db, shutdown = localDB, dbShutdown
-	} else {
+	case "datastore":
 		logger.Print("Setting up prod database...")
-		db = database.ProdDatabase(prodProjectID)
-		logClient, err := logging.NewClient(ctx, prodProjectID)
+		prodDB, err := database.ProdDatabase(ctx, prodProjectID)
 		if err != nil {
-			logger.Fatalf("Failed to create logging client: %v", err)
+			logger.Fatalf("Error creating database: %v", err)
 		}
-		logger = logClient.Logger("hstspreload-server").StandardLogger(logging.Info)
-		shutdown = func() error { return nil }
+		db, shutdown = prodDB, prodDB.Close
+	default:
+		logger.Fatalf("Unknown database backend: %q", dbBackend)
 	}
 
 	logger.Print(" checking database connection...")
 
 	a = api.New(db, logger)
-	err := a.CheckConnection()
+	if token := os.Getenv("HSTSPRELOAD_ADMIN_TOKEN"); token != "" {
+		a = a.WithAdminToken(token)
+	}
+	if key := os.Getenv("HSTSPRELOAD_FINGERPRINT_KEY"); key != "" {
+		a = a.WithFingerprintKey([]byte(key))
+	} else {
+		logger.Print("HSTSPRELOAD_FINGERPRINT_KEY is not set; client fingerprints will not match across restarts.")
+	}
+	if key := os.Getenv("HSTSPRELOAD_VERIFICATION_KEY"); key != "" {
+		a = a.WithVerificationKey([]byte(key))
+	} else if production {
+		logger.Fatal("HSTSPRELOAD_VERIFICATION_KEY must be set in production, so that every instance accepts the same removal challenge tokens.")
+	} else {
+		logger.Print("HSTSPRELOAD_VERIFICATION_KEY is not set; removal challenge tokens will not be accepted across restarts or instances.")
+	}
+	limits := api.DefaultRateLimits()
+	if s := os.Getenv("HSTSPRELOAD_CLIENT_RATE_LIMIT"); s != "" {
+		limit, err := api.ParseRateLimit(s)
+		if err != nil {
+			logger.Fatalf("HSTSPRELOAD_CLIENT_RATE_LIMIT: %v", err)
+		}
+		limits.PerClient = limit
+	}
+	if s := os.Getenv("HSTSPRELOAD_DOMAIN_RATE_LIMIT"); s != "" {
+		limit, err := api.ParseRateLimit(s)
+		if err != nil {
+			logger.Fatalf("HSTSPRELOAD_DOMAIN_RATE_LIMIT: %v", err)
+		}
+		limits.PerDomain = limit
+	}
+	a = a.WithRateLimits(limits)
+	if s, ok := os.LookupEnv("HSTSPRELOAD_TRUSTED_PROXIES"); ok {
+		proxies, err := api.ParseTrustedProxies(s)
+		if err != nil {
+			logger.Fatalf("HSTSPRELOAD_TRUSTED_PROXIES: %v", err)
+		}
+		a = a.WithTrustedProxies(proxies)
+	}
+	err := a.CheckConnection(ctx)
 	if err != nil {
 		logger.Fatalf("%v", err)
 	}
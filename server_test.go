@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chromium/hstspreload.org/api"
+	"github.com/chromium/hstspreload.org/database"
+)
+
+type openAPIDocument struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components map[string]map[string]json.RawMessage `json:"components"`
+}
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	db, _, err := database.MemoryDatabase("")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	a := api.New(db, log.Default())
+
+	r, err := http.NewRequest("GET", "/api/openapi.json", nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %s", err)
+	}
+	w := httptest.NewRecorder()
+	a.OpenAPI(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Wrong status code: %d", w.Code)
+	}
+
+	var doc openAPIDocument
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("The OpenAPI document is not valid JSON: %s", err)
+	}
+
+	// The debug routes are only registered locally, so they aren't part
+	// of the public API.
+	routes := map[string]bool{}
+	for _, route := range apiRoutes(a, false) {
+		routes[route.path] = true
+		if _, ok := doc.Paths[route.path]; !ok {
+			t.Errorf("Route %s is missing from api/openapi.json", route.path)
+		}
+	}
+	for path := range rateLimitedRoutes {
+		if !routes[path] {
+			t.Errorf("Rate limited route %s is not a route", path)
+		}
+		for method, operation := range doc.Paths[path] {
+			if !strings.Contains(string(operation), `"429"`) {
+				t.Errorf("api/openapi.json is missing the rate limit response of %s %s", method, path)
+			}
+		}
+	}
+	for path, operations := range doc.Paths {
+		if !routes[path] {
+			t.Errorf("api/openapi.json describes %s, which is not a route", path)
+		}
+		if len(operations) == 0 {
+			t.Errorf("api/openapi.json has no operations for %s", path)
+		}
+	}
+
+	// Every reference must point to a component.
+	var refs []string
+	var collectRefs func(v interface{})
+	collectRefs = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for key, value := range v {
+				if s, ok := value.(string); ok && key == "$ref" {
+					refs = append(refs, s)
+				}
+				collectRefs(value)
+			}
+		case []interface{}:
+			for _, value := range v {
+				collectRefs(value)
+			}
+		}
+	}
+	var raw interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &raw); err != nil {
+		t.Fatalf("%s", err)
+	}
+	collectRefs(raw)
+	for _, ref := range refs {
+		parts := strings.Split(strings.TrimPrefix(ref, "#/components/"), "/")
+		if len(parts) != 2 || doc.Components[parts[0]][parts[1]] == nil {
+			t.Errorf("Unresolved reference in api/openapi.json: %s", ref)
+		}
+	}
+}